@@ -15,6 +15,7 @@ import (
 	"appengine/user"
 
 	"github.com/decitrig/innerhearth/auth"
+	"github.com/decitrig/innerhearth/config"
 )
 
 var (
@@ -25,15 +26,23 @@ var (
 
 var (
 	delayedConfirmAccount = delay.Func("confirmAccount", func(c appengine.Context, user Account) error {
+		cfg, err := config.Get(c)
+		if err != nil {
+			c.Errorf("Failed to load site config; using defaults: %s", err)
+		}
 		buf := &bytes.Buffer{}
-		if err := accountConfirmationEmail.Execute(buf, user); err != nil {
+		data := map[string]interface{}{
+			"Account": user,
+			"Config":  cfg,
+		}
+		if err := accountConfirmationEmail.Execute(buf, data); err != nil {
 			c.Criticalf("Couldn't execute account confirm email: %s", err)
 			return nil
 		}
 		msg := &mail.Message{
-			Sender:  fmt.Sprintf("no-reply@%s.appspotmail.com", appengine.AppID(c)),
+			Sender:  cfg.Sender(c),
 			To:      []string{user.Email},
-			Subject: "Confirm your account registration with Inner Hearth Yoga",
+			Subject: fmt.Sprintf("Confirm your account registration with %s", cfg.StudioName),
 			Body:    buf.String(),
 		}
 		if err := mail.Send(c, msg); err != nil {
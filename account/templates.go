@@ -5,10 +5,10 @@ import (
 )
 
 var (
-	accountConfirmationEmail = template.Must(template.New("accountConfirm").Parse(`Thank you for registering an account with InnerHearthYoga.
+	accountConfirmationEmail = template.Must(template.New("accountConfirm").Parse(`Thank you for registering an account with {{.Config.StudioName}}.
 You must confirm your account before registering for classes; you can confirm by visiting
 
-http://innerhearthyoga.appspot.com/login/confirm?code={{.ConfirmationCode}}
+{{.Config.URL "/login/confirm"}}?code={{.Account.ConfirmationCode}}
 
-in your web browser. If you have any questions, please contact us at info@innerhearthyoga.com. Thank you!`))
+in your web browser. If you have any questions, please contact us at {{.Config.ContactEmail}}. Thank you!`))
 )
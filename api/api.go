@@ -0,0 +1,200 @@
+// Package api defines the JSON representations of the studio's
+// schedule which are served by the public API.
+package api
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/students"
+	"github.com/decitrig/innerhearth/yogassage"
+)
+
+// Layouts used for dates and times in API responses. Times of day are
+// given in the studio's local time zone.
+const (
+	DateLayout = "2006-01-02"
+	TimeLayout = "15:04"
+)
+
+// A Teacher is the public view of a classes.Teacher; it omits contact
+// details.
+type Teacher struct {
+	ID        string `json:"id"`
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+}
+
+// NewTeacher returns the public view of a teacher, or nil if t is nil.
+func NewTeacher(t *classes.Teacher) *Teacher {
+	if t == nil {
+		return nil
+	}
+	return &Teacher{
+		ID:        t.ID,
+		FirstName: t.FirstName,
+		LastName:  t.LastName,
+	}
+}
+
+// A Class is a weekly class within a session.
+type Class struct {
+	ID          int64    `json:"id"`
+	SessionID   int64    `json:"sessionId"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Teacher     *Teacher `json:"teacher,omitempty"`
+	Weekday     string   `json:"weekday"`
+	StartTime   string   `json:"startTime"`
+	EndTime     string   `json:"endTime"`
+	Minutes     int64    `json:"minutes"`
+	DropInOnly  bool     `json:"dropInOnly"`
+	Capacity    int32    `json:"capacity"`
+
+	// The number of spaces left as of the time of the response. Never
+	// negative.
+	Remaining int32 `json:"remaining"`
+}
+
+// NewClass returns the public view of a class with the given teacher
+// and number of currently registered students.
+func NewClass(cls *classes.Class, teacher *classes.Teacher, registered int, loc *time.Location) *Class {
+	remaining := cls.Capacity - int32(registered)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return &Class{
+		ID:          cls.ID,
+		SessionID:   cls.Session,
+		Title:       cls.Title,
+		Description: cls.Description(),
+		Teacher:     NewTeacher(teacher),
+		Weekday:     cls.Weekday.String(),
+		StartTime:   cls.StartTime.In(loc).Format(TimeLayout),
+		EndTime:     cls.StartTime.Add(cls.Length).In(loc).Format(TimeLayout),
+		Minutes:     int64(cls.Length / time.Minute),
+		DropInOnly:  cls.DropInOnly,
+		Capacity:    cls.Capacity,
+		Remaining:   remaining,
+	}
+}
+
+// A Session is a block of time containing weekly classes.
+type Session struct {
+	ID      int64    `json:"id"`
+	Name    string   `json:"name"`
+	Start   string   `json:"start"`
+	End     string   `json:"end"`
+	Classes []*Class `json:"classes"`
+}
+
+// NewSession returns the public view of a session and its classes.
+func NewSession(s *classes.Session, classList []*Class, loc *time.Location) *Session {
+	if classList == nil {
+		classList = []*Class{}
+	}
+	return &Session{
+		ID:      s.ID,
+		Name:    s.Name,
+		Start:   s.Start.In(loc).Format(DateLayout),
+		End:     s.End.In(loc).Format(DateLayout),
+		Classes: classList,
+	}
+}
+
+// A YinYogassage is a single scheduled Yin Yogassage class.
+type YinYogassage struct {
+	ID         int64  `json:"id"`
+	Date       string `json:"date"`
+	StartTime  string `json:"startTime,omitempty"`
+	Minutes    int64  `json:"minutes,omitempty"`
+	SignupLink string `json:"signupLink,omitempty"`
+
+	// The class through which students register for the offering, if
+	// it takes registrations on the site.
+	ClassID int64 `json:"classId,omitempty"`
+}
+
+// NewYinYogassage returns the public view of a Yin Yogassage class.
+func NewYinYogassage(y *yogassage.YinYogassage, loc *time.Location) *YinYogassage {
+	yin := &YinYogassage{
+		ID:         y.ID,
+		Date:       y.Date.In(loc).Format(DateLayout),
+		Minutes:    int64(y.Length / time.Minute),
+		SignupLink: y.SignupLink,
+		ClassID:    y.ClassID,
+	}
+	if y.Length > 0 {
+		yin.StartTime = y.Date.In(loc).Format(TimeLayout)
+	}
+	return yin
+}
+
+// A Student is a single registration on a class roster.
+type Student struct {
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+	Email     string `json:"email"`
+	Phone     string `json:"phone,omitempty"`
+	DropIn    bool   `json:"dropIn"`
+
+	// The date of a drop-in registration; empty for session
+	// registrations.
+	Date string `json:"date,omitempty"`
+
+	// Payment status, and the balance in cents if the registration's
+	// price is known.
+	PaymentStatus string `json:"paymentStatus"`
+	Balance       *int64 `json:"balance,omitempty"`
+}
+
+// NewStudent returns the roster view of a student registration.
+func NewStudent(s *students.Student, loc *time.Location) *Student {
+	student := &Student{
+		FirstName: s.FirstName,
+		LastName:  s.LastName,
+		Email:     s.Email,
+		Phone:     s.Phone,
+		DropIn:    s.DropIn,
+
+		PaymentStatus: string(s.PaymentStatus()),
+	}
+	if s.DropIn {
+		student.Date = s.Date.In(loc).Format(DateLayout)
+	}
+	if s.Priced {
+		balance := int64(s.Balance())
+		student.Balance = &balance
+	}
+	return student
+}
+
+// A Registration is a request to register a student for a class.
+type Registration struct {
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+	Email     string `json:"email"`
+	Phone     string `json:"phone"`
+
+	// If true, the student is registered only for Date; otherwise they
+	// are registered for the whole session.
+	DropIn bool   `json:"dropIn"`
+	Date   string `json:"date"`
+}
+
+// Validate checks that the registration has all required fields, and
+// returns the parsed drop-in date, if any.
+func (r *Registration) Validate(loc *time.Location) (time.Time, error) {
+	if r.FirstName == "" || r.LastName == "" || r.Email == "" {
+		return time.Time{}, fmt.Errorf("firstName, lastName and email are required")
+	}
+	if !r.DropIn {
+		return time.Time{}, nil
+	}
+	date, err := time.ParseInLocation(DateLayout, r.Date, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q; use YYYY-MM-DD", r.Date)
+	}
+	return date, nil
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/decitrig/innerhearth/account"
+	"github.com/decitrig/innerhearth/classes"
+)
+
+func TestNewClass(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	teacher := &classes.Teacher{
+		ID:   "0x1",
+		Info: account.Info{FirstName: "a", LastName: "b", Email: "a@example.com", Phone: "555"},
+	}
+	class := &classes.Class{
+		ID:              5,
+		Session:         2,
+		Title:           "Flow",
+		LongDescription: []byte("A flowing class"),
+		Weekday:         time.Tuesday,
+		StartTime:       time.Date(0, 1, 1, 18, 30, 0, 0, loc),
+		Length:          75 * time.Minute,
+		Capacity:        10,
+	}
+	got := NewClass(class, teacher, 4, loc)
+	want := Class{
+		ID:          5,
+		SessionID:   2,
+		Title:       "Flow",
+		Description: "A flowing class",
+		Weekday:     "Tuesday",
+		StartTime:   "18:30",
+		EndTime:     "19:45",
+		Minutes:     75,
+		Capacity:    10,
+		Remaining:   6,
+	}
+	if got.Teacher == nil || got.Teacher.FirstName != "a" || got.Teacher.ID != "0x1" {
+		t.Errorf("Wrong teacher: %v", got.Teacher)
+	}
+	got.Teacher = nil
+	if *got != want {
+		t.Errorf("Wrong class view; %+v vs %+v", got, want)
+	}
+	if full := NewClass(class, nil, 12, loc); full.Remaining != 0 {
+		t.Errorf("Remaining capacity should not be negative: %d", full.Remaining)
+	} else if full.Teacher != nil {
+		t.Errorf("Class without teacher should have nil teacher")
+	}
+}
+
+func TestNewSession(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := &classes.Session{
+		ID:    3,
+		Name:  "Spring",
+		Start: time.Date(2014, time.April, 14, 0, 0, 0, 0, loc),
+		End:   time.Date(2014, time.July, 6, 0, 0, 0, 0, loc),
+	}
+	got := NewSession(session, nil, loc)
+	if got.Start != "2014-04-14" || got.End != "2014-07-06" {
+		t.Errorf("Wrong session dates: %s - %s", got.Start, got.End)
+	}
+	if got.Classes == nil {
+		t.Errorf("Classes should be an empty list, not nil")
+	}
+}
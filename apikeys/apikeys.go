@@ -0,0 +1,197 @@
+// Package apikeys manages the credentials with which client
+// applications, such as the front-desk tablet, call the write API.
+package apikeys
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/decitrig/innerhearth/auth"
+)
+
+var (
+	ErrKeyNotFound = fmt.Errorf("apikeys: key not found")
+	ErrInvalidKey  = fmt.Errorf("apikeys: invalid key")
+	ErrKeyRevoked  = fmt.Errorf("apikeys: key has been revoked")
+)
+
+// A Scope is a set of API operations which a key may perform.
+type Scope string
+
+const (
+	ReadSchedule       Scope = "schedule:read"
+	WriteRegistrations Scope = "registrations:write"
+	ReadRosters        Scope = "rosters:read"
+)
+
+// Scopes lists all scopes which may be granted to a key.
+var Scopes = []Scope{ReadSchedule, WriteRegistrations, ReadRosters}
+
+// A Key identifies a client application acting on behalf of a Staff
+// or Teacher account. Only a hash of the key's secret is stored; the
+// secret itself is shown once, when the key is created.
+type Key struct {
+	ID string `datastore:"-"`
+
+	// A description of the client, e.g. "Front desk tablet".
+	Name string `datastore:",noindex"`
+
+	// The account on whose behalf the client acts.
+	AccountID string
+
+	Scopes []Scope `datastore:",noindex"`
+
+	SecretHash string `datastore:",noindex"`
+	Created    time.Time
+	CreatedBy  string `datastore:",noindex"`
+
+	// The time at which the key was revoked, or zero if it has not
+	// been revoked.
+	Revoked time.Time `datastore:",noindex"`
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// New creates a new key for an account with the given scopes. It
+// returns the key along with the credential which the client must
+// present; the credential cannot be recovered later.
+func New(name, accountID, createdBy string, scopes []Scope, now time.Time) (*Key, string, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, "", fmt.Errorf("apikeys: failed to create key ID: %s", err)
+	}
+	secret, err := randomHex(24)
+	if err != nil {
+		return nil, "", fmt.Errorf("apikeys: failed to create secret: %s", err)
+	}
+	key := &Key{
+		ID:         id,
+		Name:       name,
+		AccountID:  accountID,
+		Scopes:     scopes,
+		SecretHash: auth.SaltAndHashString(secret),
+		Created:    now,
+		CreatedBy:  createdBy,
+	}
+	return key, fmt.Sprintf("%s.%s", id, secret), nil
+}
+
+func keyFromID(c appengine.Context, id string) *datastore.Key {
+	return datastore.NewKey(c, "APIKey", id, 0, nil)
+}
+
+// WithID returns the Key with the given ID, if one exists.
+func WithID(c appengine.Context, id string) (*Key, error) {
+	k := &Key{}
+	switch err := datastore.Get(c, keyFromID(c, id), k); err {
+	case nil:
+		k.ID = id
+		return k, nil
+	case datastore.ErrNoSuchEntity:
+		return nil, ErrKeyNotFound
+	default:
+		return nil, err
+	}
+}
+
+// All returns a list of all keys, including revoked keys.
+func All(c appengine.Context) ([]*Key, error) {
+	q := datastore.NewQuery("APIKey").
+		Order("-Created").
+		Limit(100)
+	keys := []*Key{}
+	dsKeys, err := q.GetAll(c, &keys)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range dsKeys {
+		keys[i].ID = key.StringID()
+	}
+	return keys, nil
+}
+
+// Put persists the key to the datastore.
+func (k *Key) Put(c appengine.Context) error {
+	if _, err := datastore.Put(c, keyFromID(c, k.ID), k); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Revoke marks the key as revoked; it can no longer be used to
+// authenticate.
+func (k *Key) Revoke(c appengine.Context, now time.Time) error {
+	k.Revoked = now
+	return k.Put(c)
+}
+
+// IsRevoked returns true if the key has been revoked.
+func (k *Key) IsRevoked() bool {
+	return !k.Revoked.IsZero()
+}
+
+// Allows returns true if the key has been granted the scope.
+func (k *Key) Allows(scope Scope) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns true if secret is the key's secret.
+func (k *Key) matches(secret string) bool {
+	hash := auth.SaltAndHashString(secret)
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(k.SecretHash)) == 1
+}
+
+// Credential returns the API credential presented with a request, if
+// any. Clients may send it either as a bearer token in the
+// Authorization header or in an X-API-Key header.
+func Credential(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// Authenticate returns the key for a credential created by New.
+// Returns ErrInvalidKey if the credential doesn't match any key, and
+// ErrKeyRevoked if the key has been revoked.
+func Authenticate(c appengine.Context, credential string) (*Key, error) {
+	parts := strings.SplitN(credential, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, ErrInvalidKey
+	}
+	key, err := WithID(c, parts[0])
+	switch err {
+	case nil:
+		break
+	case ErrKeyNotFound:
+		return nil, ErrInvalidKey
+	default:
+		return nil, err
+	}
+	if !key.matches(parts[1]) {
+		return nil, ErrInvalidKey
+	}
+	if key.IsRevoked() {
+		return nil, ErrKeyRevoked
+	}
+	return key, nil
+}
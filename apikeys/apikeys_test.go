@@ -0,0 +1,69 @@
+package apikeys
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"appengine/aetest"
+)
+
+func TestAuthenticate(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	key, credential, err := New("tablet", "0x1", "admin@example.com", []Scope{WriteRegistrations}, time.Unix(1000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := key.Put(c); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Authenticate(c, credential)
+	if err != nil {
+		t.Fatalf("Couldn't authenticate %q: %s", credential, err)
+	}
+	if got.ID != key.ID || got.AccountID != "0x1" {
+		t.Errorf("Wrong key; wanted %v, got %v", key, got)
+	}
+	if !got.Allows(WriteRegistrations) {
+		t.Errorf("Key should allow %s", WriteRegistrations)
+	}
+	if got.Allows(ReadRosters) {
+		t.Errorf("Key should not allow %s", ReadRosters)
+	}
+	for _, bad := range []string{"", key.ID, key.ID + ".wrong", "nosuchkey.secret"} {
+		if _, err := Authenticate(c, bad); err != ErrInvalidKey {
+			t.Errorf("Expected ErrInvalidKey for %q; got %v", bad, err)
+		}
+	}
+	if err := key.Revoke(c, time.Unix(2000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Authenticate(c, credential); err != ErrKeyRevoked {
+		t.Errorf("Expected ErrKeyRevoked; got %v", err)
+	}
+}
+
+func TestCredential(t *testing.T) {
+	for _, test := range []struct {
+		header, value string
+		want          string
+	}{
+		{"Authorization", "Bearer abc.def", "abc.def"},
+		{"Authorization", "Basic abc.def", ""},
+		{"X-API-Key", "abc.def", "abc.def"},
+		{"", "", ""},
+	} {
+		r, _ := http.NewRequest("GET", "/api/v1/sessions", nil)
+		if test.header != "" {
+			r.Header.Set(test.header, test.value)
+		}
+		if got := Credential(r); got != test.want {
+			t.Errorf("Wrong credential for %s: %q; wanted %q", test.header, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"sync"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// A signingKey is the secret with which signatures are keyed. It is
+// generated the first time it is needed and kept in the datastore, so
+// that it never appears in the source.
+type signingKey struct {
+	Key []byte `datastore:",noindex"`
+}
+
+var (
+	keyMu     sync.Mutex
+	cachedKey []byte
+)
+
+func signingKeyKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "SigningKey", "site", 0, nil)
+}
+
+// secret returns the signing key, creating it if there is none yet.
+func secret(c appengine.Context) ([]byte, error) {
+	keyMu.Lock()
+	defer keyMu.Unlock()
+	if cachedKey != nil {
+		return cachedKey, nil
+	}
+	k := &signingKey{}
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		switch err := datastore.Get(c, signingKeyKey(c), k); err {
+		case nil:
+			return nil
+		case datastore.ErrNoSuchEntity:
+			break
+		default:
+			return err
+		}
+		k.Key = make([]byte, sha256.Size)
+		if _, err := rand.Read(k.Key); err != nil {
+			return err
+		}
+		_, err := datastore.Put(c, signingKeyKey(c), k)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	cachedKey = k.Key
+	return cachedKey, nil
+}
+
+func sign(key []byte, message string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sign returns a signature for a message, keyed with the site's
+// signing key, which can be embedded in a URL. It lets links sent by
+// email prove which action they were created for without storing a
+// token.
+func Sign(c appengine.Context, message string) (string, error) {
+	key, err := secret(c)
+	if err != nil {
+		return "", err
+	}
+	return sign(key, message), nil
+}
+
+// ValidSignature reports whether signature was created by Sign for
+// the message.
+func ValidSignature(c appengine.Context, message, signature string) bool {
+	key, err := secret(c)
+	if err != nil {
+		c.Errorf("Failed to load signing key: %s", err)
+		return false
+	}
+	return hmac.Equal([]byte(sign(key, message)), []byte(signature))
+}
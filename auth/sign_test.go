@@ -0,0 +1,34 @@
+package auth
+
+import (
+	"testing"
+
+	"appengine/aetest"
+)
+
+func TestSign(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	sig, err := Sign(c, "unsubscribe:jill@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ValidSignature(c, "unsubscribe:jill@example.com", sig) {
+		t.Errorf("Signature %q didn't validate", sig)
+	}
+	for _, msg := range []string{"unsubscribe:lauren@example.com", "unsubscribe:jill@example.com ", ""} {
+		if ValidSignature(c, msg, sig) {
+			t.Errorf("Signature %q shouldn't validate %q", sig, msg)
+		}
+	}
+	if ValidSignature(c, "unsubscribe:jill@example.com", "") {
+		t.Errorf("Empty signature shouldn't validate")
+	}
+	if sign(salt, "unsubscribe:jill@example.com") == sig {
+		t.Errorf("Signature shouldn't be keyed with the salt from the source")
+	}
+}
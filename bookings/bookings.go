@@ -0,0 +1,614 @@
+// Package bookings tracks requests for private lessons, small groups,
+// corporate classes and special events, from a student's request
+// through to a time confirmed with a teacher.
+package bookings
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+	"appengine/mail"
+
+	"github.com/decitrig/innerhearth/account"
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/config"
+	"github.com/decitrig/innerhearth/series"
+)
+
+var (
+	ErrBookingNotFound = fmt.Errorf("bookings: booking not found")
+	ErrBookingClosed   = fmt.Errorf("bookings: booking has already been confirmed or declined")
+	ErrNotProposed     = fmt.Errorf("bookings: no time has been proposed")
+	ErrInvalidBooking  = fmt.Errorf("bookings: invalid booking request")
+	ErrSlotTaken       = fmt.Errorf("bookings: time slot is no longer open")
+	ErrPastStart       = fmt.Errorf("bookings: proposed time has already passed")
+)
+
+var (
+	delayedSendUpdate = delay.Func("sendBookingUpdate", func(c appengine.Context, id int64) error {
+		b, err := WithID(c, id)
+		if err != nil {
+			c.Errorf("Failed to find booking %d for update: %s", id, err)
+			return nil
+		}
+		cfg, err := config.Get(c)
+		if err != nil {
+			c.Errorf("Failed to load site config; using defaults: %s", err)
+		}
+		buf := &bytes.Buffer{}
+		data := map[string]interface{}{
+			"Booking": b,
+			"Teacher": b.TeacherEntity(c),
+			"Config":  cfg,
+			"Link":    cfg.URL("/bookings"),
+		}
+		if err := updateEmail.Execute(buf, data); err != nil {
+			c.Criticalf("Couldn't execute booking update email: %s", err)
+			return nil
+		}
+		msg := &mail.Message{
+			Sender:  cfg.Sender(c),
+			To:      []string{b.Email},
+			Subject: fmt.Sprintf("Your %s request with %s", b.Kind, cfg.StudioName),
+			Body:    buf.String(),
+		}
+		if err := mail.Send(c, msg); err != nil {
+			c.Criticalf("Couldn't send booking update to %q: %s", b.Email, err)
+			return fmt.Errorf("failed to send email")
+		}
+		return nil
+	})
+
+	delayedSendRequest = delay.Func("sendBookingRequest", func(c appengine.Context, id int64) error {
+		b, err := WithID(c, id)
+		if err != nil {
+			c.Errorf("Failed to find booking %d for request: %s", id, err)
+			return nil
+		}
+		cfg, err := config.Get(c)
+		if err != nil {
+			c.Errorf("Failed to load site config; using defaults: %s", err)
+		}
+		to := cfg.ContactEmail
+		teacher := b.TeacherEntity(c)
+		if teacher != nil {
+			to = teacher.Email
+		}
+		buf := &bytes.Buffer{}
+		data := map[string]interface{}{
+			"Booking": b,
+			"Teacher": teacher,
+			"Config":  cfg,
+			"Link":    cfg.URL("/bookings/manage"),
+		}
+		if err := requestEmail.Execute(buf, data); err != nil {
+			c.Criticalf("Couldn't execute booking request email: %s", err)
+			return nil
+		}
+		msg := &mail.Message{
+			Sender:  cfg.Sender(c),
+			To:      []string{to},
+			ReplyTo: b.Email,
+			Subject: fmt.Sprintf("New %s request from %s", b.Kind, b.Name),
+			Body:    buf.String(),
+		}
+		if err := mail.Send(c, msg); err != nil {
+			c.Criticalf("Couldn't send booking request to %q: %s", to, err)
+			return fmt.Errorf("failed to send email")
+		}
+		return nil
+	})
+)
+
+// A Kind is a kind of lesson which can be booked.
+type Kind string
+
+const (
+	Private      Kind = "private lesson"
+	SmallGroup   Kind = "small group lesson"
+	Corporate    Kind = "corporate class"
+	SpecialEvent Kind = "special event"
+)
+
+// Kinds lists all kinds of bookings.
+var Kinds = []Kind{Private, SmallGroup, Corporate, SpecialEvent}
+
+// A Status is the stage a booking has reached.
+type Status string
+
+const (
+	// The student has asked for a booking and is waiting to hear back.
+	Requested Status = "requested"
+
+	// A teacher has offered a time, which the student may accept.
+	Proposed Status = "proposed"
+
+	// The booking will take place at its Start time.
+	Confirmed Status = "confirmed"
+
+	// The studio can't take the booking.
+	Declined Status = "declined"
+)
+
+// A Booking is a request for a private lesson or other event, along
+// with the time eventually arranged for it.
+type Booking struct {
+	ID int64 `datastore:"-"`
+
+	// The account which made the request, and how to reach the student.
+	AccountID string
+	Name      string `datastore:",noindex"`
+	Email     string `datastore:",noindex"`
+	Phone     string `datastore:",noindex"`
+
+	Kind      Kind  `datastore:",noindex"`
+	GroupSize int32 `datastore:",noindex"`
+
+	// The teacher the student asked for, if any; once a time has been
+	// proposed, the teacher who will teach.
+	Teacher *datastore.Key
+
+	// The student's description of when they are available, and
+	// anything else the teacher should know.
+	PreferredTimes []byte `datastore:",noindex"`
+	Notes          []byte `datastore:",noindex"`
+
+	Status Status
+
+	// The proposed or confirmed time of the booking.
+	Start  time.Time
+	Length time.Duration `datastore:",noindex"`
+
+	// A note to the student sent with the most recent update.
+	Message string `datastore:",noindex"`
+
+	Created   time.Time `datastore:",noindex"`
+	Updated   time.Time `datastore:",noindex"`
+	UpdatedBy string    `datastore:",noindex"`
+}
+
+// New returns a new booking request from an account.
+func New(user *account.Account, kind Kind, size int32, teacher *datastore.Key, times, notes string, now time.Time) *Booking {
+	return &Booking{
+		AccountID:      user.ID,
+		Name:           fmt.Sprintf("%s %s", user.FirstName, user.LastName),
+		Email:          user.Email,
+		Phone:          user.Phone,
+		Kind:           kind,
+		GroupSize:      size,
+		Teacher:        teacher,
+		PreferredTimes: []byte(times),
+		Notes:          []byte(notes),
+		Status:         Requested,
+		Created:        now,
+		Updated:        now,
+	}
+}
+
+// Valid returns whether the booking is a complete request. Requests
+// must say when the student is available, unless they were booked
+// directly into an open slot.
+func (b *Booking) Valid() bool {
+	if b.GroupSize <= 0 || (len(b.PreferredTimes) == 0 && b.Start.IsZero()) {
+		return false
+	}
+	for _, k := range Kinds {
+		if b.Kind == k {
+			return true
+		}
+	}
+	return false
+}
+
+// PreferredTimesText returns the student's preferred times.
+func (b *Booking) PreferredTimesText() string {
+	return string(b.PreferredTimes)
+}
+
+// NotesText returns the student's notes.
+func (b *Booking) NotesText() string {
+	return string(b.Notes)
+}
+
+// End returns the time at which the proposed or confirmed booking
+// ends.
+func (b *Booking) End() time.Time {
+	return b.Start.Add(b.Length)
+}
+
+// Minutes returns the length of the booking in minutes.
+func (b *Booking) Minutes() int64 {
+	return int64(b.Length.Minutes())
+}
+
+// Closed returns whether the booking has been confirmed or declined.
+func (b *Booking) Closed() bool {
+	return b.Status == Confirmed || b.Status == Declined
+}
+
+// Book sets the booking to take place with a teacher in one of their
+// open slots. The booking is confirmed straight away.
+func (b *Booking) Book(c appengine.Context, teacher *classes.Teacher, slot classes.Occurrence, now time.Time) {
+	b.Teacher = teacher.Key(c)
+	b.Start = slot.Start
+	b.Length = slot.End.Sub(slot.Start)
+	b.Status = Confirmed
+	b.Updated = now
+	b.UpdatedBy = b.Email
+}
+
+// Propose offers the student a time with a teacher. The time must not
+// have passed.
+func (b *Booking) Propose(teacher *datastore.Key, start time.Time, length time.Duration, message, by string, now time.Time) error {
+	if b.Closed() {
+		return ErrBookingClosed
+	}
+	if start.Before(now) {
+		return ErrPastStart
+	}
+	b.Teacher = teacher
+	b.Start = start
+	b.Length = length
+	b.Status = Proposed
+	b.Message = message
+	b.Updated = now
+	b.UpdatedBy = by
+	return nil
+}
+
+// Confirm confirms the proposed time, whether on behalf of the student
+// or because they accepted it.
+func (b *Booking) Confirm(message, by string, now time.Time) error {
+	switch {
+	case b.Closed():
+		return ErrBookingClosed
+	case b.Status != Proposed:
+		return ErrNotProposed
+	}
+	b.Status = Confirmed
+	b.Message = message
+	b.Updated = now
+	b.UpdatedBy = by
+	return nil
+}
+
+// Decline turns down the request. A confirmed booking may also be
+// declined, if it must be called off.
+func (b *Booking) Decline(message, by string, now time.Time) error {
+	if b.Status == Declined {
+		return ErrBookingClosed
+	}
+	b.Status = Declined
+	b.Message = message
+	b.Updated = now
+	b.UpdatedBy = by
+	return nil
+}
+
+// TeacherEntity returns the booking's teacher, or nil if it has none.
+func (b *Booking) TeacherEntity(c appengine.Context) *classes.Teacher {
+	if b.Teacher == nil {
+		return nil
+	}
+	teacher, err := classes.TeacherWithID(c, b.Teacher.StringID())
+	if err != nil {
+		c.Errorf("Failed to find teacher for booking %d: %s", b.ID, err)
+		return nil
+	}
+	return teacher
+}
+
+func bookingKey(c appengine.Context, id int64) *datastore.Key {
+	return datastore.NewKey(c, "Booking", "", id, nil)
+}
+
+// WithID returns the booking with the given ID, if one exists.
+func WithID(c appengine.Context, id int64) (*Booking, error) {
+	b := &Booking{}
+	switch err := datastore.Get(c, bookingKey(c, id), b); err {
+	case nil:
+		b.ID = id
+		return b, nil
+	case datastore.ErrNoSuchEntity:
+		return nil, ErrBookingNotFound
+	default:
+		return nil, err
+	}
+}
+
+// Insert stores a new booking request, emails it to the requested
+// teacher, or to the studio if no teacher was requested, and lets the
+// student know it was received.
+func (b *Booking) Insert(c appengine.Context) error {
+	if !b.Valid() {
+		return ErrInvalidBooking
+	}
+	return b.insert(c)
+}
+
+func (b *Booking) insert(c appengine.Context) error {
+	key, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Booking", nil), b)
+	if err != nil {
+		return err
+	}
+	b.ID = key.IntID()
+	delayedSendRequest.Call(c, b.ID)
+	delayedSendUpdate.Call(c, b.ID)
+	return nil
+}
+
+// Put stores the booking.
+func (b *Booking) Put(c appengine.Context) error {
+	if _, err := datastore.Put(c, bookingKey(c, b.ID), b); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Update stores the booking and emails the student about its new
+// status.
+func (b *Booking) Update(c appengine.Context) error {
+	if err := b.Put(c); err != nil {
+		return err
+	}
+	delayedSendUpdate.Call(c, b.ID)
+	return nil
+}
+
+type byCreated []*Booking
+
+func (l byCreated) Len() int           { return len(l) }
+func (l byCreated) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byCreated) Less(i, j int) bool { return l[i].Created.After(l[j].Created) }
+
+// ByStart sorts bookings by their start time.
+type ByStart []*Booking
+
+func (l ByStart) Len() int           { return len(l) }
+func (l ByStart) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l ByStart) Less(i, j int) bool { return l[i].Start.Before(l[j].Start) }
+
+func getAll(q *datastore.Query, c appengine.Context) ([]*Booking, error) {
+	bookings := []*Booking{}
+	keys, err := q.GetAll(c, &bookings)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		bookings[i].ID = key.IntID()
+	}
+	return bookings, nil
+}
+
+// ForAccount returns all of an account's bookings, newest first.
+func ForAccount(c appengine.Context, accountID string) ([]*Booking, error) {
+	bookings, err := getAll(datastore.NewQuery("Booking").Filter("AccountID =", accountID), c)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(byCreated(bookings))
+	return bookings, nil
+}
+
+// Open returns all bookings which are waiting on the studio or the
+// student, newest first.
+func Open(c appengine.Context) ([]*Booking, error) {
+	open := []*Booking{}
+	for _, status := range []Status{Requested, Proposed} {
+		bookings, err := getAll(datastore.NewQuery("Booking").Filter("Status =", status), c)
+		if err != nil {
+			return nil, err
+		}
+		open = append(open, bookings...)
+	}
+	sort.Sort(byCreated(open))
+	return open, nil
+}
+
+// Upcoming returns the confirmed bookings which have not yet ended,
+// soonest first.
+func Upcoming(c appengine.Context, now time.Time) ([]*Booking, error) {
+	q := datastore.NewQuery("Booking").
+		Filter("Status =", Confirmed)
+	all, err := getAll(q, c)
+	if err != nil {
+		return nil, err
+	}
+	upcoming := []*Booking{}
+	for _, b := range all {
+		if b.End().After(now) {
+			upcoming = append(upcoming, b)
+		}
+	}
+	sort.Sort(ByStart(upcoming))
+	return upcoming, nil
+}
+
+// ForTeacher returns the bookings which have asked for or been
+// assigned to a teacher, including closed bookings, newest first.
+func ForTeacher(c appengine.Context, teacher *classes.Teacher) ([]*Booking, error) {
+	bookings, err := getAll(datastore.NewQuery("Booking").Filter("Teacher =", teacher.Key(c)), c)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(byCreated(bookings))
+	return bookings, nil
+}
+
+// UpcomingForTeacher returns a teacher's confirmed bookings which have
+// not yet ended, soonest first.
+func UpcomingForTeacher(c appengine.Context, teacher *classes.Teacher, now time.Time) ([]*Booking, error) {
+	all, err := ForTeacher(c, teacher)
+	if err != nil {
+		return nil, err
+	}
+	upcoming := []*Booking{}
+	for _, b := range all {
+		if b.Status == Confirmed && b.End().After(now) {
+			upcoming = append(upcoming, b)
+		}
+	}
+	sort.Sort(ByStart(upcoming))
+	return upcoming, nil
+}
+
+// busy returns the times of a teacher's bookings which are confirmed,
+// or proposed and waiting on the student, and which end after from.
+func busy(c appengine.Context, teacher *classes.Teacher, from time.Time) ([]classes.Occurrence, error) {
+	all, err := ForTeacher(c, teacher)
+	if err != nil {
+		return nil, err
+	}
+	times := []classes.Occurrence{}
+	for _, b := range all {
+		if (b.Status == Confirmed || b.Status == Proposed) && b.End().After(from) {
+			times = append(times, classes.Occurrence{Start: b.Start, End: b.End()})
+		}
+	}
+	return times, nil
+}
+
+// seriesTimes returns the meetings between from and until of the
+// series taught by a teacher.
+func seriesTimes(c appengine.Context, teacher *classes.Teacher, from, until time.Time) ([]classes.Occurrence, error) {
+	sessionless, err := teacher.SessionlessClasses(c)
+	if err != nil {
+		return nil, err
+	}
+	times := []classes.Occurrence{}
+	for _, class := range sessionless {
+		if class.Series == 0 {
+			continue
+		}
+		s, err := series.WithID(c, class.Series)
+		switch err {
+		case nil:
+			break
+		case series.ErrSeriesNotFound:
+			continue
+		default:
+			return nil, err
+		}
+		for _, o := range s.Occurrences() {
+			if o.End.After(from) && o.Start.Before(until) {
+				times = append(times, o)
+			}
+		}
+	}
+	return times, nil
+}
+
+// OpenSlots returns the slots of the given length, starting between
+// from and until, in which a teacher is available and has neither a
+// class nor another booking.
+func OpenSlots(c appengine.Context, teacher *classes.Teacher, from, until time.Time, length time.Duration, loc *time.Location) ([]classes.Occurrence, error) {
+	taken, err := busy(c, teacher, from)
+	if err != nil {
+		return nil, err
+	}
+	meetings, err := seriesTimes(c, teacher, from, until)
+	if err != nil {
+		return nil, err
+	}
+	taken = append(taken, meetings...)
+	taken = append(taken, teacher.ClassTimes(c, from, until, loc)...)
+	return teacher.OpenSlots(taken, from, until, length, loc), nil
+}
+
+// A claim marks one SlotStep of a teacher's time as reserved by a
+// booking. A teacher's claims share the teacher's entity group, so
+// that two reservations of overlapping times can't both succeed.
+type claim struct {
+	BookingID int64 `datastore:",noindex"`
+}
+
+// claimKeys returns the keys of the claims covering a slot.
+func claimKeys(c appengine.Context, teacher *classes.Teacher, slot classes.Occurrence) []*datastore.Key {
+	parent := teacher.Key(c)
+	keys := []*datastore.Key{}
+	for t := slot.Start.Truncate(classes.SlotStep); t.Before(slot.End); t = t.Add(classes.SlotStep) {
+		keys = append(keys, datastore.NewKey(c, "BookingClaim", "", t.Unix(), parent))
+	}
+	return keys
+}
+
+// holds returns whether the booking which made a claim still takes up
+// part of a slot. Claims are left behind when bookings are declined or
+// moved, and are then free to be claimed again.
+func holds(c appengine.Context, cl claim, slot classes.Occurrence) (bool, error) {
+	b, err := WithID(c, cl.BookingID)
+	switch err {
+	case nil:
+		break
+	case ErrBookingNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+	if b.Status != Confirmed && b.Status != Proposed {
+		return false, nil
+	}
+	return slot.Overlaps(classes.Occurrence{Start: b.Start, End: b.End()}), nil
+}
+
+// Reserve books a request directly into one of a teacher's open slots
+// and stores it. Returns ErrSlotTaken if the slot is no longer open.
+// The booking claims the slot in the same transaction as it is stored,
+// so that concurrent reservations of the slot can't both succeed.
+func (b *Booking) Reserve(c appengine.Context, teacher *classes.Teacher, slot classes.Occurrence, loc *time.Location, now time.Time) error {
+	open, err := OpenSlots(c, teacher, slot.Start, slot.End, slot.End.Sub(slot.Start), loc)
+	if err != nil {
+		return err
+	}
+	if len(open) == 0 || !open[0].Start.Equal(slot.Start) {
+		return ErrSlotTaken
+	}
+	b.Book(c, teacher, slot, now)
+	if !b.Valid() {
+		return ErrInvalidBooking
+	}
+	keys := claimKeys(c, teacher, slot)
+	opts := &datastore.TransactionOptions{XG: true}
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		claims := make([]claim, len(keys))
+		var errs datastore.MultiError
+		switch err := datastore.GetMulti(c, keys, claims); err.(type) {
+		case nil:
+			errs = make(datastore.MultiError, len(keys))
+		case datastore.MultiError:
+			errs = err.(datastore.MultiError)
+		default:
+			return err
+		}
+		for i, cl := range claims {
+			switch errs[i] {
+			case nil:
+				break
+			case datastore.ErrNoSuchEntity:
+				continue
+			default:
+				return errs[i]
+			}
+			held, err := holds(c, cl, slot)
+			if err != nil {
+				return err
+			}
+			if held {
+				return ErrSlotTaken
+			}
+		}
+		if err := b.insert(c); err != nil {
+			return err
+		}
+		for i := range claims {
+			claims[i] = claim{b.ID}
+		}
+		_, err := datastore.PutMulti(c, keys, claims)
+		return err
+	}, opts)
+}
@@ -0,0 +1,206 @@
+package bookings
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"appengine/aetest"
+
+	"github.com/decitrig/innerhearth/account"
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/config"
+)
+
+func newBooking(now time.Time) *Booking {
+	user := &account.Account{
+		ID:   "0x1",
+		Info: account.Info{FirstName: "Ann", LastName: "Lee", Email: "ann@example.com"},
+	}
+	return New(user, Private, 1, nil, "Weekday mornings", "", now)
+}
+
+func TestWorkflow(t *testing.T) {
+	now := time.Date(2014, 3, 3, 9, 0, 0, 0, time.UTC)
+	b := newBooking(now)
+	if !b.Valid() {
+		t.Fatalf("Expected %+v to be valid", b)
+	}
+	if err := b.Confirm("", "staff@example.com", now); err != ErrNotProposed {
+		t.Errorf("Expected ErrNotProposed confirming a new request; got %v", err)
+	}
+	start := now.AddDate(0, 0, 2)
+	if err := b.Propose(nil, now.Add(-time.Hour), time.Hour, "", "staff@example.com", now); err != ErrPastStart {
+		t.Errorf("Expected ErrPastStart proposing a past time; got %v", err)
+	}
+	if err := b.Propose(nil, start, time.Hour, "", "staff@example.com", now); err != nil {
+		t.Fatal(err)
+	}
+	if b.Status != Proposed || !b.End().Equal(start.Add(time.Hour)) {
+		t.Errorf("Expected a proposed hour-long booking; got %+v", b)
+	}
+	if err := b.Confirm("", "ann@example.com", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Propose(nil, start, time.Hour, "", "staff@example.com", now); err != ErrBookingClosed {
+		t.Errorf("Expected ErrBookingClosed proposing a confirmed booking; got %v", err)
+	}
+	if err := b.Decline("Teacher is ill", "staff@example.com", now); err != nil {
+		t.Errorf("Expected to be able to call off a confirmed booking; got %v", err)
+	}
+	if err := b.Decline("", "staff@example.com", now); err != ErrBookingClosed {
+		t.Errorf("Expected ErrBookingClosed declining twice; got %v", err)
+	}
+}
+
+func TestValid(t *testing.T) {
+	now := time.Unix(0, 0)
+	for _, test := range []struct {
+		name   string
+		modify func(b *Booking)
+	}{
+		{"unknown kind", func(b *Booking) { b.Kind = "party" }},
+		{"no people", func(b *Booking) { b.GroupSize = 0 }},
+		{"no times", func(b *Booking) { b.PreferredTimes = nil }},
+	} {
+		b := newBooking(now)
+		test.modify(b)
+		if b.Valid() {
+			t.Errorf("%s: expected %+v to be invalid", test.name, b)
+		}
+	}
+}
+
+func TestUpdateEmail(t *testing.T) {
+	now := time.Date(2014, 3, 3, 9, 0, 0, 0, time.UTC)
+	b := newBooking(now)
+	b.Propose(nil, now.AddDate(0, 0, 2), time.Hour, "Bring a mat.", "staff@example.com", now)
+	buf := &bytes.Buffer{}
+	data := map[string]interface{}{
+		"Booking": b,
+		"Config":  config.Defaults(),
+		"Link":    config.Defaults().URL("/bookings"),
+	}
+	if err := updateEmail.Execute(buf, data); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"(60 minutes)",
+		"To accept this time",
+		"Bring a mat.",
+		"/bookings",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("Expected email to contain %q; got\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestInsert(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	now := time.Date(2014, 3, 3, 9, 0, 0, 0, time.UTC)
+	if err := (&Booking{}).Insert(c); err != ErrInvalidBooking {
+		t.Errorf("Expected ErrInvalidBooking; got %v", err)
+	}
+	teacher := &classes.Teacher{ID: "0x2"}
+	b := newBooking(now)
+	b.Teacher = teacher.Key(c)
+	if err := b.Insert(c); err != nil {
+		t.Fatalf("Failed to insert booking: %s", err)
+	}
+	mine, err := ForAccount(c, "0x1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mine) != 1 || mine[0].ID != b.ID {
+		t.Errorf("Expected booking %d for account; got %+v", b.ID, mine)
+	}
+	open, err := Open(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(open) != 1 {
+		t.Errorf("Expected the request to be open; got %+v", open)
+	}
+	b.Propose(teacher.Key(c), now.AddDate(0, 0, 2), time.Hour, "", "staff@example.com", now)
+	b.Confirm("", "ann@example.com", now)
+	if err := b.Put(c); err != nil {
+		t.Fatal(err)
+	}
+	upcoming, err := UpcomingForTeacher(c, teacher, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(upcoming) != 1 || upcoming[0].Status != Confirmed {
+		t.Errorf("Expected a confirmed booking for the teacher; got %+v", upcoming)
+	}
+	if upcoming, err := UpcomingForTeacher(c, teacher, now.AddDate(0, 0, 3)); err != nil || len(upcoming) != 0 {
+		t.Errorf("Expected no bookings after the booking has ended; got %+v, %v", upcoming, err)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	nine := time.Date(0, 1, 1, 9, 0, 0, 0, time.UTC)
+	monday := time.Date(2014, 3, 3, 0, 0, 0, 0, time.UTC)
+	teacher := &classes.Teacher{
+		ID:           "0x2",
+		Availability: []classes.Window{{Weekday: time.Monday, StartTime: nine, Length: 2 * time.Hour}},
+	}
+	slots, err := OpenSlots(c, teacher, monday, monday.AddDate(0, 0, 1), time.Hour, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slots) != 3 {
+		t.Fatalf("Expected slots at 9, 9:30 and 10; got %v", slots)
+	}
+	b := New(&account.Account{ID: "0x1"}, Private, 1, nil, "", "", monday)
+	if err := b.Reserve(c, teacher, slots[1], time.UTC, monday); err != nil {
+		t.Fatalf("Failed to reserve slot: %s", err)
+	}
+	if b.Status != Confirmed || !b.Start.Equal(slots[1].Start) {
+		t.Errorf("Expected a confirmed booking at %s; got %+v", slots[1].Start, b)
+	}
+	other := New(&account.Account{ID: "0x3"}, Private, 1, nil, "", "", monday)
+	if err := other.Reserve(c, teacher, slots[0], time.UTC, monday); err != ErrSlotTaken {
+		t.Errorf("Expected ErrSlotTaken for an overlapping slot; got %v", err)
+	}
+
+	// A declined booking leaves its claim behind, but no longer holds
+	// the slot.
+	if err := b.Decline("", "staff@example.com", monday); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Reserve(c, teacher, slots[1], time.UTC, monday); err != nil {
+		t.Errorf("Failed to reserve a slot freed by a declined booking: %s", err)
+	}
+
+	// Classes outside any session, such as workshops, take up the
+	// teacher's time too.
+	next := monday.AddDate(0, 0, 7)
+	class := &classes.Class{Teacher: teacher.Key(c), StartTime: next.Add(10 * time.Hour), Length: time.Hour, DropInOnly: true}
+	if err := class.Insert(c); err != nil {
+		t.Fatal(err)
+	}
+	slots, err = OpenSlots(c, teacher, next, next.AddDate(0, 0, 1), time.Hour, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slots) != 1 || !slots[0].Start.Equal(next.Add(9*time.Hour)) {
+		t.Errorf("Expected only the 9am slot around the workshop; got %v", slots)
+	}
+}
@@ -0,0 +1,57 @@
+package bookings
+
+import (
+	"text/template"
+)
+
+var (
+	updateEmail = template.Must(template.New("update").Parse(`Dear {{.Booking.Name}},
+{{if eq .Booking.Status "proposed"}}
+Thank you for your {{.Booking.Kind}} request. {{with .Teacher}}{{.DisplayName}}{{else}}We{{end}} can meet you on
+
+  {{.Config.FormatDate .Booking.Start}} at {{.Config.FormatTime .Booking.Start}} ({{.Booking.Minutes}} minutes)
+
+To accept this time, visit
+
+{{.Link}}
+
+or reply to this email if it doesn't suit you.
+{{else if eq .Booking.Status "confirmed"}}
+Your {{.Booking.Kind}}{{with .Teacher}} with {{.DisplayName}}{{end}} is confirmed for
+
+  {{.Config.FormatDate .Booking.Start}} at {{.Config.FormatTime .Booking.Start}} ({{.Booking.Minutes}} minutes)
+
+We look forward to seeing you!
+{{else if eq .Booking.Status "declined"}}
+We're sorry, but we aren't able to schedule your {{.Booking.Kind}}{{if not .Booking.Start.IsZero}} on {{.Config.FormatDate .Booking.Start}}{{end}}.
+{{else}}
+We have received your {{.Booking.Kind}} request and will be in touch soon to arrange a time.
+{{end}}{{with .Booking.Message}}
+{{.}}
+{{end}}
+You can check on your requests at any time at {{.Link}}
+
+{{.Config.StudioName}}
+{{.Config.ContactEmail}}
+{{.Config.ContactPhone}}
+{{.Config.BaseURL}}`))
+
+	requestEmail = template.Must(template.New("request").Parse(`{{.Booking.Name}} has {{if eq .Booking.Status "confirmed"}}booked{{else}}requested{{end}} a {{.Booking.Kind}}{{with .Teacher}} with {{.DisplayName}}{{end}}.
+
+Group size: {{.Booking.GroupSize}}
+Email: {{.Booking.Email}}{{with .Booking.Phone}}
+Phone: {{.}}{{end}}
+{{if eq .Booking.Status "confirmed"}}
+Booked for:
+{{.Config.FormatDate .Booking.Start}} at {{.Config.FormatTime .Booking.Start}} ({{.Booking.Minutes}} minutes)
+{{else}}
+Preferred times:
+{{.Booking.PreferredTimesText}}
+{{end}}{{with .Booking.NotesText}}
+Notes:
+{{.}}
+{{end}}
+{{if eq .Booking.Status "confirmed"}}See your bookings, or cancel this one,{{else}}Propose a time, confirm or decline the request{{end}} at
+
+{{.Link}}`))
+)
@@ -0,0 +1,124 @@
+// Package cache provides a small key/value cache interface with a
+// memcache-backed implementation for production and an in-process
+// implementation for tests.
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sync"
+	"time"
+
+	"appengine"
+	"appengine/memcache"
+)
+
+var (
+	ErrCacheMiss = fmt.Errorf("cache: cache miss")
+)
+
+// A Cache stores arbitrary gob-encodable values by key.
+type Cache interface {
+	// Get decodes the value stored under key into v. Returns
+	// ErrCacheMiss if no unexpired value is stored.
+	Get(c appengine.Context, key string, v interface{}) error
+
+	// Set stores v under key. If expiration is non-zero, the value
+	// will be discarded after that duration.
+	Set(c appengine.Context, key string, v interface{}, expiration time.Duration) error
+
+	// Delete removes any value stored under key. It is not an error to
+	// delete a key which is not stored.
+	Delete(c appengine.Context, key string) error
+}
+
+// Memcache is a Cache backed by the appengine memcache service.
+type Memcache struct{}
+
+func (Memcache) Get(c appengine.Context, key string, v interface{}) error {
+	switch _, err := memcache.Gob.Get(c, key, v); err {
+	case nil:
+		return nil
+	case memcache.ErrCacheMiss:
+		return ErrCacheMiss
+	default:
+		return err
+	}
+}
+
+func (Memcache) Set(c appengine.Context, key string, v interface{}, expiration time.Duration) error {
+	return memcache.Gob.Set(c, &memcache.Item{
+		Key:        key,
+		Object:     v,
+		Expiration: expiration,
+	})
+}
+
+func (Memcache) Delete(c appengine.Context, key string) error {
+	if err := memcache.Delete(c, key); err != nil && err != memcache.ErrCacheMiss {
+		return err
+	}
+	return nil
+}
+
+type item struct {
+	value      []byte
+	expiration time.Time
+}
+
+// Memory is a Cache which stores values in the memory of the current
+// process. Values are gob-encoded, so callers see the same copying
+// behavior as with Memcache.
+type Memory struct {
+	mu    sync.Mutex
+	items map[string]item
+
+	// Now returns the current time; it may be replaced in tests to
+	// control expiration.
+	Now func() time.Time
+}
+
+// NewMemory returns an empty in-process Cache.
+func NewMemory() *Memory {
+	return &Memory{
+		items: make(map[string]item),
+		Now:   time.Now,
+	}
+}
+
+func (m *Memory) Get(c appengine.Context, key string, v interface{}) error {
+	m.mu.Lock()
+	it, ok := m.items[key]
+	if ok && !it.expiration.IsZero() && !m.Now().Before(it.expiration) {
+		delete(m.items, key)
+		ok = false
+	}
+	m.mu.Unlock()
+	if !ok {
+		return ErrCacheMiss
+	}
+	return gob.NewDecoder(bytes.NewReader(it.value)).Decode(v)
+}
+
+func (m *Memory) Set(c appengine.Context, key string, v interface{}, expiration time.Duration) error {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return err
+	}
+	it := item{value: buf.Bytes()}
+	if expiration > 0 {
+		it.expiration = m.Now().Add(expiration)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.items[key] = it
+	return nil
+}
+
+func (m *Memory) Delete(c appengine.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.items, key)
+	return nil
+}
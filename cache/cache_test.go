@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type value struct {
+	Name  string
+	Count int
+	When  time.Time
+}
+
+func TestMemory(t *testing.T) {
+	now := time.Unix(1000, 0)
+	m := NewMemory()
+	m.Now = func() time.Time { return now }
+
+	got := &value{}
+	if err := m.Get(nil, "foo", got); err != ErrCacheMiss {
+		t.Errorf("Expected cache miss, got %v", err)
+	}
+	want := &value{"foo", 3, time.Unix(500, 0).UTC()}
+	if err := m.Set(nil, "foo", want, time.Minute); err != nil {
+		t.Fatalf("Failed to set value: %s", err)
+	}
+	if err := m.Set(nil, "bar", &value{Name: "bar"}, 0); err != nil {
+		t.Fatalf("Failed to set value: %s", err)
+	}
+	if err := m.Get(nil, "foo", got); err != nil {
+		t.Fatalf("Failed to get value: %s", err)
+	} else if !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong value; %v vs %v", got, want)
+	}
+	got.Count = 10
+	if err := m.Get(nil, "foo", got); err != nil || got.Count != want.Count {
+		t.Errorf("Cached value should not be shared with caller: %v", got)
+	}
+
+	now = now.Add(time.Minute)
+	if err := m.Get(nil, "foo", got); err != ErrCacheMiss {
+		t.Errorf("Value should have expired; got %v", err)
+	}
+	if err := m.Get(nil, "bar", got); err != nil {
+		t.Errorf("Value without expiration should not expire: %s", err)
+	}
+	if err := m.Delete(nil, "bar"); err != nil {
+		t.Fatalf("Failed to delete: %s", err)
+	}
+	if err := m.Get(nil, "bar", got); err != ErrCacheMiss {
+		t.Errorf("Deleted value should not be found; got %v", err)
+	}
+	if err := m.Delete(nil, "baz"); err != nil {
+		t.Errorf("Deleting missing key should not be an error: %s", err)
+	}
+}
@@ -0,0 +1,128 @@
+package classes
+
+import (
+	"sort"
+	"time"
+
+	"appengine"
+)
+
+// SlotStep is the interval between the start times of the open slots
+// offered within a teacher's availability.
+const SlotStep = 30 * time.Minute
+
+// A Window is a weekly period during which a teacher is available to
+// teach privately. As with classes, the start time is a time of day in
+// the studio's location.
+type Window struct {
+	Weekday   time.Weekday
+	StartTime time.Time
+	Length    time.Duration
+}
+
+// On returns the window's period on the given date, as a date in loc.
+func (w Window) On(date time.Time, loc *time.Location) Occurrence {
+	date = date.In(loc)
+	hour, min, _ := w.StartTime.In(loc).Clock()
+	start := time.Date(date.Year(), date.Month(), date.Day(), hour, min, 0, 0, loc)
+	return Occurrence{start, start.Add(w.Length)}
+}
+
+// Overlaps returns whether two periods overlap.
+func (o Occurrence) Overlaps(other Occurrence) bool {
+	return o.Start.Before(other.End) && other.Start.Before(o.End)
+}
+
+// BlackedOut returns whether the teacher is unavailable for the whole
+// of the given day.
+func (t *Teacher) BlackedOut(date time.Time, loc *time.Location) bool {
+	y, m, d := date.In(loc).Date()
+	for _, b := range t.Blackouts {
+		by, bm, bd := b.In(loc).Date()
+		if by == y && bm == m && bd == d {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenSlots returns the periods of the given length, starting between
+// from and until, which fall within the teacher's availability on days
+// which aren't blacked out and which don't overlap any of the busy
+// periods. Slots start every SlotStep from the start of each window.
+func (t *Teacher) OpenSlots(busy []Occurrence, from, until time.Time, length time.Duration, loc *time.Location) []Occurrence {
+	slots := []Occurrence{}
+	if length <= 0 {
+		return slots
+	}
+	start := from.In(loc)
+	for day := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc); day.Before(until); day = day.AddDate(0, 0, 1) {
+		if t.BlackedOut(day, loc) {
+			continue
+		}
+		for _, w := range t.Availability {
+			if w.Weekday != day.Weekday() {
+				continue
+			}
+			window := w.On(day, loc)
+			for s := window.Start; !s.Add(length).After(window.End); s = s.Add(SlotStep) {
+				slot := Occurrence{s, s.Add(length)}
+				if s.Before(from) || !s.Before(until) || overlapsAny(slot, busy) {
+					continue
+				}
+				slots = append(slots, slot)
+			}
+		}
+	}
+	sort.Sort(byStart(slots))
+	return slots
+}
+
+func overlapsAny(o Occurrence, busy []Occurrence) bool {
+	for _, b := range busy {
+		if o.Overlaps(b) {
+			return true
+		}
+	}
+	return false
+}
+
+type byStart []Occurrence
+
+func (l byStart) Len() int           { return len(l) }
+func (l byStart) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byStart) Less(i, j int) bool { return l[i].Start.Before(l[j].Start) }
+
+// ClassTimes returns the meetings between from and until of the
+// teacher's regular classes in the current sessions, and of their
+// workshop slots and Yin Yogassage classes. The meetings of a series
+// are kept by the series, and are not included.
+func (t *Teacher) ClassTimes(c appengine.Context, from, until time.Time, loc *time.Location) []Occurrence {
+	key := t.Key(c)
+	times := []Occurrence{}
+	for _, s := range Sessions(c, from) {
+		for _, class := range s.Classes(c) {
+			if class.Teacher == nil || !class.Teacher.Equal(key) {
+				continue
+			}
+			for _, o := range class.Occurrences(s, from, loc) {
+				if o.Start.Before(until) {
+					times = append(times, o)
+				}
+			}
+		}
+	}
+	sessionless, err := t.SessionlessClasses(c)
+	if err != nil {
+		c.Errorf("Failed to find classes outside sessions for %q: %s", t.Email, err)
+	}
+	for _, class := range sessionless {
+		if class.Series != 0 {
+			continue
+		}
+		if o := class.Meeting(); o.End.After(from) && o.Start.Before(until) {
+			times = append(times, o)
+		}
+	}
+	return times
+}
@@ -0,0 +1,55 @@
+package classes_test
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/decitrig/innerhearth/classes"
+)
+
+func TestOpenSlots(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nine, err := time.ParseInLocation("3:04pm", "9:00am", loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Monday, March 3 and Monday, March 10 2014, either side of the
+	// start of daylight saving time.
+	monday := time.Date(2014, time.March, 3, 0, 0, 0, 0, loc)
+	teacher := &Teacher{
+		Availability: []Window{{Weekday: time.Monday, StartTime: nine, Length: 3 * time.Hour}},
+		Blackouts:    []time.Time{monday.AddDate(0, 0, 14)},
+	}
+	busy := []Occurrence{{
+		Start: time.Date(2014, time.March, 3, 10, 0, 0, 0, loc),
+		End:   time.Date(2014, time.March, 3, 11, 0, 0, 0, loc),
+	}}
+	got := teacher.OpenSlots(busy, monday, monday.AddDate(0, 0, 21), time.Hour, loc)
+	want := []time.Time{
+		time.Date(2014, time.March, 3, 9, 0, 0, 0, loc),
+		time.Date(2014, time.March, 3, 11, 0, 0, 0, loc),
+		time.Date(2014, time.March, 10, 9, 0, 0, 0, loc),
+		time.Date(2014, time.March, 10, 9, 30, 0, 0, loc),
+		time.Date(2014, time.March, 10, 10, 0, 0, 0, loc),
+		time.Date(2014, time.March, 10, 10, 30, 0, 0, loc),
+		time.Date(2014, time.March, 10, 11, 0, 0, 0, loc),
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d slots; got %v", len(want), got)
+	}
+	for i, slot := range got {
+		if !slot.Start.Equal(want[i]) || slot.End.Sub(slot.Start) != time.Hour {
+			t.Errorf("Wrong slot at %d: expected an hour at %s; got %v", i, want[i], slot)
+		}
+	}
+	if !teacher.BlackedOut(time.Date(2014, time.March, 17, 10, 0, 0, 0, loc), loc) {
+		t.Errorf("Expected March 17 to be blacked out")
+	}
+	later := teacher.OpenSlots(nil, monday.Add(10*time.Hour), monday.AddDate(0, 0, 1), time.Hour, loc)
+	if len(later) != 3 || !later[0].Start.Equal(monday.Add(10*time.Hour)) {
+		t.Errorf("Expected slots starting no earlier than 10am; got %v", later)
+	}
+}
@@ -108,8 +108,27 @@ const (
 	Regular Type = iota
 	Workshop
 	YinYogassage
+	Series
 )
 
+// Types lists all types of class.
+var Types = []Type{Regular, Workshop, YinYogassage, Series}
+
+func (t Type) String() string {
+	switch t {
+	case Regular:
+		return "Regular"
+	case Workshop:
+		return "Workshop"
+	case YinYogassage:
+		return "Yin Yogassage"
+	case Series:
+		return "Series"
+	default:
+		return fmt.Sprintf("Type(%d)", int(t))
+	}
+}
+
 // A Class is a yoga class for which students can register.
 type Class struct {
 	ID int64 `datastore: "-"`
@@ -125,6 +144,17 @@ type Class struct {
 
 	DropInOnly bool
 	Capacity   int32 `datastore: ",noindex"`
+
+	// The workshop of which the class is a single time slot, or zero
+	// for a class which belongs to a session.
+	Workshop int64 `datastore:",noindex"`
+
+	// The series whose meetings the class holds, or zero for a class
+	// which is not part of a series.
+	Series int64 `datastore:",noindex"`
+
+	// The Yin Yogassage offering which the class holds, or zero.
+	YinYogassage int64 `datastore:",noindex"`
 }
 
 func classKeyFromID(c appengine.Context, id int64) *datastore.Key {
@@ -215,28 +245,129 @@ func (cls *Class) Update(c appengine.Context) error {
 	return nil
 }
 
+// Delete deletes the class. Its students are not deleted; callers
+// should cancel their registrations first.
 func (cls *Class) Delete(c appengine.Context) error {
-	// TODO(rwsims): This should defer a task to delete all students of the class. And maybe notify them?
+	// TODO(rwsims): Notify students that the class was cancelled.
 	if err := datastore.Delete(c, cls.Key(c)); err != nil {
 		return err
 	}
 	return nil
 }
 
-// TeachersByClass returns a map from Class ID to Teacher entity (or nil if the class has no teacher).
+// An Occurrence is a single meeting of a weekly class.
+type Occurrence struct {
+	Start time.Time
+	End   time.Time
+}
+
+// OccurrenceOn returns the meeting of the class on the given date, as
+// a date in loc. The class's start time is interpreted as a time of
+// day in loc, so occurrences keep the same local time across
+// daylight saving time changes.
+func (cls *Class) OccurrenceOn(date time.Time, loc *time.Location) Occurrence {
+	date = date.In(loc)
+	hour, min, _ := cls.StartTime.In(loc).Clock()
+	start := time.Date(date.Year(), date.Month(), date.Day(), hour, min, 0, 0, loc)
+	return Occurrence{start, start.Add(cls.Length)}
+}
+
+// Meeting returns the single meeting of a class which belongs to no
+// session and meets once, such as a workshop slot or a Yin Yogassage
+// class, whose StartTime is the date and time of the meeting.
+func (cls *Class) Meeting() Occurrence {
+	return Occurrence{cls.StartTime, cls.StartTime.Add(cls.Length)}
+}
+
+// Occurrences returns all meetings of the class within a session,
+// in order, which end after the given time. The session's start and
+// end are treated as inclusive dates in loc.
+func (cls *Class) Occurrences(s *Session, after time.Time, loc *time.Location) []Occurrence {
+	start, end := s.Start.In(loc), s.End.In(loc)
+	day := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc)
+	last := time.Date(end.Year(), end.Month(), end.Day(), 0, 0, 0, 0, loc)
+	for day.Weekday() != cls.Weekday {
+		day = day.AddDate(0, 0, 1)
+	}
+	occurrences := []Occurrence{}
+	for ; !day.After(last); day = day.AddDate(0, 0, 7) {
+		o := cls.OccurrenceOn(day, loc)
+		if !o.End.After(after) {
+			continue
+		}
+		occurrences = append(occurrences, o)
+	}
+	return occurrences
+}
+
+// SessionlessClasses returns the classes taught by a teacher which
+// belong to no session: workshop slots, series and Yin Yogassage
+// classes.
+func (t *Teacher) SessionlessClasses(c appengine.Context) ([]*Class, error) {
+	q := datastore.NewQuery("Class").
+		Filter("Teacher =", t.Key(c)).
+		Filter("Session =", int64(0))
+	classes := []*Class{}
+	keys, err := q.GetAll(c, &classes)
+	if err != nil && !isFieldMismatch(err) {
+		return nil, err
+	}
+	for i, key := range keys {
+		classes[i].ID = key.IntID()
+	}
+	return classes, nil
+}
+
+// TeachersByClass returns a map from Class ID to Teacher entity. Classes
+// with no teacher, or whose teacher cannot be found, are left out of
+// the map. The teachers are looked up in a single batch.
 func TeachersByClass(c appengine.Context, classList []*Class) map[int64]*Teacher {
 	teachers := make(map[int64]*Teacher)
+	keys := []*datastore.Key{}
+	indexByID := make(map[string]int)
 	for _, class := range classList {
 		key := class.Teacher
 		if key == nil {
 			continue
 		}
-		teacher, err := teacherByKey(c, key)
-		if err != nil && !isFieldMismatch(err) {
-			c.Errorf("Failed to find teacher for class %d: %s", class.ID, err)
+		if _, ok := indexByID[key.StringID()]; ok {
+			continue
+		}
+		indexByID[key.StringID()] = len(keys)
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return teachers
+	}
+	found := make([]*Teacher, len(keys))
+	for i := range found {
+		found[i] = &Teacher{}
+	}
+	errs := make([]error, len(keys))
+	switch err := datastore.GetMulti(c, keys, found); err.(type) {
+	case nil:
+		break
+	case datastore.MultiError:
+		errs = err.(datastore.MultiError)
+	default:
+		c.Errorf("Failed to look up teachers: %s", err)
+		return teachers
+	}
+	for i, key := range keys {
+		found[i].ID = key.StringID()
+	}
+	for _, class := range classList {
+		if class.Teacher == nil {
+			continue
+		}
+		i := indexByID[class.Teacher.StringID()]
+		if err := errs[i]; err != nil && !isFieldMismatch(err) {
+			if err != datastore.ErrNoSuchEntity {
+				c.Errorf("Failed to find teacher for class %d: %s", class.ID, err)
+			}
 			continue
 		}
-		teachers[class.ID] = teacher
+		teachers[class.ID] = found[i]
 	}
 	return teachers
 }
@@ -143,3 +143,44 @@ func TestClasses(t *testing.T) {
 		t.Errorf("Should not have found class %d", class.ID)
 	}
 }
+
+func TestOccurrences(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime, err := time.ParseInLocation("3:04pm", "6:30pm", loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Daylight saving time began on March 9, 2014.
+	session := NewSession("winter",
+		time.Date(2014, time.March, 1, 0, 0, 0, 0, loc),
+		time.Date(2014, time.March, 17, 0, 0, 0, 0, loc))
+	class := &Class{
+		Weekday:   time.Monday,
+		StartTime: startTime,
+		Length:    time.Hour,
+	}
+	got := class.Occurrences(session, time.Time{}, loc)
+	want := []time.Time{
+		time.Date(2014, time.March, 3, 23, 30, 0, 0, time.UTC),
+		time.Date(2014, time.March, 10, 22, 30, 0, 0, time.UTC),
+		time.Date(2014, time.March, 17, 22, 30, 0, 0, time.UTC),
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Wrong number of occurrences; %d vs %d", len(got), len(want))
+	}
+	for i, o := range got {
+		if !o.Start.Equal(want[i]) {
+			t.Errorf("Wrong start for occurrence %d; %s vs %s", i, o.Start.UTC(), want[i])
+		}
+		if d := o.End.Sub(o.Start); d != time.Hour {
+			t.Errorf("Wrong length for occurrence %d: %s", i, d)
+		}
+	}
+	after := time.Date(2014, time.March, 10, 19, 0, 0, 0, loc)
+	if got := class.Occurrences(session, after, loc); len(got) != 2 {
+		t.Errorf("Expected 2 occurrences ending after %s, got %d", after, len(got))
+	}
+}
@@ -1,7 +1,11 @@
 package classes
 
 import (
+	"bytes"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"appengine"
 	"appengine/datastore"
@@ -18,6 +22,22 @@ type Teacher struct {
 	// Contact information for the teacher. This is identical to the
 	// information in the teachers' InnerHearthUser account.
 	account.Info
+
+	// When the teacher is available to teach privately each week, and
+	// the days on which they are not.
+	Availability []Window    `datastore:",noindex"`
+	Blackouts    []time.Time `datastore:",noindex"`
+
+	// The teacher's public profile. Credentials is a short line shown
+	// with their name, e.g. "co-owner, E-RYT"; Headshot is the URL of
+	// their photo.
+	Credentials string   `datastore:",noindex"`
+	Bio         []byte   `datastore:",noindex"`
+	Headshot    string   `datastore:",noindex"`
+	Specialties []string `datastore:",noindex"`
+
+	// Teachers are listed on the teachers page in increasing order.
+	Order int `datastore:",noindex"`
 }
 
 // Creates a new Teacher associated with the given user.
@@ -28,6 +48,29 @@ func NewTeacher(user *account.Account) *Teacher {
 	}
 }
 
+// Listed returns whether the teacher has a profile to show on the
+// teachers page.
+func (t *Teacher) Listed() bool {
+	return len(bytes.TrimSpace(t.Bio)) > 0
+}
+
+// BioText returns the teacher's bio.
+func (t *Teacher) BioText() string {
+	return string(t.Bio)
+}
+
+// BioParagraphs returns the paragraphs of the teacher's bio, which are
+// separated by blank lines.
+func (t *Teacher) BioParagraphs() []string {
+	paragraphs := []string{}
+	for _, p := range strings.Split(strings.Replace(string(t.Bio), "\r\n", "\n", -1), "\n\n") {
+		if p = strings.TrimSpace(p); p != "" {
+			paragraphs = append(paragraphs, p)
+		}
+	}
+	return paragraphs
+}
+
 // TeachersByName sorts teachers in alphabetical order by first and then last name.
 type TeachersByName []*Teacher
 
@@ -120,6 +163,32 @@ func (t *Teacher) DisplayName() string {
 	return fmt.Sprintf("%s %s", t.FirstName, t.LastName)
 }
 
+// TeachersByOrder sorts teachers by their display order, and then by
+// name.
+type TeachersByOrder []*Teacher
+
+func (l TeachersByOrder) Len() int      { return len(l) }
+func (l TeachersByOrder) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l TeachersByOrder) Less(i, j int) bool {
+	if l[i].Order != l[j].Order {
+		return l[i].Order < l[j].Order
+	}
+	return TeachersByName(l).Less(i, j)
+}
+
+// Profiles returns the teachers who have profiles to show, in display
+// order.
+func Profiles(c appengine.Context) []*Teacher {
+	listed := []*Teacher{}
+	for _, t := range Teachers(c) {
+		if t.Listed() {
+			listed = append(listed, t)
+		}
+	}
+	sort.Sort(TeachersByOrder(listed))
+	return listed
+}
+
 // Teachers returns a list of all the Teachers which currently exist.
 func Teachers(c appengine.Context) []*Teacher {
 	q := datastore.NewQuery("Teacher").
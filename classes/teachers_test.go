@@ -91,3 +91,28 @@ func usersToTeachers(users []*account.Account) []*Teacher {
 	}
 	return teachers
 }
+
+func TestProfiles(t *testing.T) {
+	teacher := &Teacher{Bio: []byte("First paragraph,\r\nstill first.\r\n\r\nSecond.\n\n\n")}
+	if !teacher.Listed() {
+		t.Errorf("Expected teacher with a bio to be listed")
+	}
+	want := []string{"First paragraph,\nstill first.", "Second."}
+	if got := teacher.BioParagraphs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong paragraphs; %q vs %q", got, want)
+	}
+	if (&Teacher{Bio: []byte("  \n")}).Listed() {
+		t.Errorf("Expected teacher with a blank bio not to be listed")
+	}
+	teachers := []*Teacher{
+		{Info: account.Info{FirstName: "c"}, Order: 2},
+		{Info: account.Info{FirstName: "b"}, Order: 1},
+		{Info: account.Info{FirstName: "a"}, Order: 2},
+	}
+	sort.Sort(TeachersByOrder(teachers))
+	for i, name := range []string{"b", "a", "c"} {
+		if got := teachers[i].FirstName; got != name {
+			t.Errorf("Wrong teacher at %d; %q vs %q", i, got, name)
+		}
+	}
+}
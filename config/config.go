@@ -0,0 +1,251 @@
+// Package config provides the site-wide configuration: time zone,
+// public URL, studio contact details and display formats.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+)
+
+const (
+	memcacheKey = "config:site"
+)
+
+// A Config holds the settings which vary between deployments of the
+// site. Empty fields fall back to the file defaults.
+type Config struct {
+	// The IANA name of the studio's time zone, e.g. "America/New_York".
+	TimeZone string `datastore:",noindex" json:",omitempty"`
+
+	// The public URL of the site, without a trailing slash.
+	BaseURL string `datastore:",noindex" json:",omitempty"`
+
+	// The name of the studio, as shown to students.
+	StudioName string `datastore:",noindex" json:",omitempty"`
+
+	// The address students should write to with questions.
+	ContactEmail string `datastore:",noindex" json:",omitempty"`
+
+	// The studio's phone number.
+	ContactPhone string `datastore:",noindex" json:",omitempty"`
+
+	// The studio's street address, one line of the address per line.
+	Address string `datastore:",noindex" json:",omitempty"`
+
+	// The address from which the site sends email. If empty, a
+	// no-reply address for the application is used.
+	SenderEmail string `datastore:",noindex" json:",omitempty"`
+
+	// Layouts (as in time.Format) for displaying dates and times.
+	DateFormat string `datastore:",noindex" json:",omitempty"`
+	TimeFormat string `datastore:",noindex" json:",omitempty"`
+
+	loc *time.Location
+}
+
+var (
+	mu       sync.RWMutex
+	defaults = (&Config{
+		TimeZone:     "America/New_York",
+		BaseURL:      "http://innerhearthyoga.appspot.com",
+		StudioName:   "Inner Hearth Yoga",
+		ContactEmail: "info@innerhearthyoga.com",
+		ContactPhone: "412-204-7227",
+		Address:      "6736 Reynolds Street (second floor)\nPittsburgh, PA 15206",
+		DateFormat:   "1/2/2006",
+		TimeFormat:   "3:04pm",
+	}).withDefaults(&Config{})
+	current = defaults
+)
+
+// LoadDefaults reads default settings from a JSON file. Settings
+// missing from the file keep their built-in values.
+func LoadDefaults(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fromFile := &Config{}
+	if err := json.NewDecoder(f).Decode(fromFile); err != nil {
+		return fmt.Errorf("config: failed to parse %s: %s", path, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	merged := fromFile.withDefaults(defaults)
+	if _, err := merged.location(); err != nil {
+		return err
+	}
+	defaults = merged
+	current = defaults
+	return nil
+}
+
+// Defaults returns a copy of the file defaults.
+func Defaults() *Config {
+	mu.RLock()
+	defer mu.RUnlock()
+	d := *defaults
+	return &d
+}
+
+// Current returns the most recently loaded configuration. It is
+// intended for code which has no request context, such as template
+// functions; handlers should prefer Get.
+func Current() *Config {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+// withDefaults returns a copy of the config with empty fields filled
+// in from d.
+func (cfg *Config) withDefaults(d *Config) *Config {
+	out := *cfg
+	out.loc = nil
+	for _, f := range []struct{ dst, def *string }{
+		{&out.TimeZone, &d.TimeZone},
+		{&out.BaseURL, &d.BaseURL},
+		{&out.StudioName, &d.StudioName},
+		{&out.ContactEmail, &d.ContactEmail},
+		{&out.ContactPhone, &d.ContactPhone},
+		{&out.Address, &d.Address},
+		{&out.SenderEmail, &d.SenderEmail},
+		{&out.DateFormat, &d.DateFormat},
+		{&out.TimeFormat, &d.TimeFormat},
+	} {
+		if *f.dst == "" {
+			*f.dst = *f.def
+		}
+	}
+	out.loc, _ = out.location()
+	return &out
+}
+
+func (cfg *Config) location() (*time.Location, error) {
+	if cfg.loc != nil {
+		return cfg.loc, nil
+	}
+	loc, err := time.LoadLocation(cfg.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("config: invalid time zone %q: %s", cfg.TimeZone, err)
+	}
+	return loc, nil
+}
+
+// Validate returns an error if the config contains settings which
+// cannot be used.
+func (cfg *Config) Validate() error {
+	_, err := cfg.location()
+	return err
+}
+
+// Location returns the studio's time zone. If the configured zone
+// cannot be loaded, UTC is returned.
+func (cfg *Config) Location() *time.Location {
+	loc, err := cfg.location()
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// Sender returns the address from which site email should be sent.
+func (cfg *Config) Sender(c appengine.Context) string {
+	if cfg.SenderEmail != "" {
+		return cfg.SenderEmail
+	}
+	return fmt.Sprintf("no-reply@%s.appspotmail.com", appengine.AppID(c))
+}
+
+// URL returns the absolute URL for a path on the site.
+func (cfg *Config) URL(path string) string {
+	return cfg.BaseURL + path
+}
+
+// AddressLines returns the lines of the studio's address.
+func (cfg *Config) AddressLines() []string {
+	return strings.Split(strings.TrimSpace(cfg.Address), "\n")
+}
+
+// FormatDate formats the date of t in the studio's time zone.
+func (cfg *Config) FormatDate(t time.Time) string {
+	return t.In(cfg.Location()).Format(cfg.DateFormat)
+}
+
+// FormatTime formats the time of day of t in the studio's time zone.
+func (cfg *Config) FormatTime(t time.Time) string {
+	return t.In(cfg.Location()).Format(cfg.TimeFormat)
+}
+
+func key(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "Config", "site", 0, nil)
+}
+
+func setCurrent(cfg *Config) {
+	mu.Lock()
+	defer mu.Unlock()
+	current = cfg
+}
+
+// Get returns the site configuration stored in the datastore, with
+// any unset fields taken from the defaults. If no configuration has
+// been stored, the defaults are returned.
+func Get(c appengine.Context) (*Config, error) {
+	stored := &Config{}
+	if _, err := memcache.Gob.Get(c, memcacheKey, stored); err != nil {
+		if err != memcache.ErrCacheMiss {
+			c.Warningf("Failed to read config from memcache: %s", err)
+		}
+		switch err := datastore.Get(c, key(c), stored); err {
+		case nil:
+			break
+		case datastore.ErrNoSuchEntity:
+			break
+		default:
+			if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+				return Defaults(), err
+			}
+		}
+		if err := memcache.Gob.Set(c, &memcache.Item{Key: memcacheKey, Object: stored}); err != nil {
+			c.Warningf("Failed to cache config: %s", err)
+		}
+	}
+	cfg := stored.withDefaults(Defaults())
+	if err := cfg.Validate(); err != nil {
+		c.Errorf("Ignoring stored config: %s", err)
+		return Defaults(), nil
+	}
+	setCurrent(cfg)
+	return cfg, nil
+}
+
+// Put stores the configuration in the datastore.
+func (cfg *Config) Put(c appengine.Context) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if _, err := datastore.Put(c, key(c), cfg); err != nil {
+		return err
+	}
+	if err := memcache.Delete(c, memcacheKey); err != nil && err != memcache.ErrCacheMiss {
+		c.Warningf("Failed to clear cached config: %s", err)
+	}
+	setCurrent(cfg.withDefaults(Defaults()))
+	return nil
+}
+
+// TemplateFuncs are the template functions through which templates
+// read the site configuration.
+var TemplateFuncs = template.FuncMap{
+	"Site": Current,
+}
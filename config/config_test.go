@@ -0,0 +1,115 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"appengine/aetest"
+)
+
+func TestWithDefaults(t *testing.T) {
+	d := &Config{
+		TimeZone:     "America/New_York",
+		StudioName:   "Studio",
+		ContactEmail: "info@example.com",
+		TimeFormat:   "3:04pm",
+	}
+	cfg := (&Config{StudioName: "Other Studio"}).withDefaults(d)
+	if cfg.StudioName != "Other Studio" {
+		t.Errorf("Stored name was overwritten: %q", cfg.StudioName)
+	}
+	if cfg.ContactEmail != d.ContactEmail {
+		t.Errorf("Wrong default contact email %q; want %q", cfg.ContactEmail, d.ContactEmail)
+	}
+	if got := cfg.Location().String(); got != "America/New_York" {
+		t.Errorf("Wrong location %q", got)
+	}
+	noon := time.Date(2014, time.July, 1, 16, 0, 0, 0, time.UTC)
+	if got, want := cfg.FormatTime(noon), "12:00pm"; got != want {
+		t.Errorf("Wrong local time %q; want %q", got, want)
+	}
+}
+
+func TestAddressLines(t *testing.T) {
+	cfg := &Config{Address: "1 Main Street\nPittsburgh, PA\n"}
+	lines := cfg.AddressLines()
+	if len(lines) != 2 || lines[0] != "1 Main Street" || lines[1] != "Pittsburgh, PA" {
+		t.Errorf("Wrong address lines %q", lines)
+	}
+}
+
+func TestInvalidTimeZone(t *testing.T) {
+	cfg := &Config{TimeZone: "Not/A_Zone"}
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("Expected error for time zone %q", cfg.TimeZone)
+	}
+	if loc := cfg.Location(); loc != time.UTC {
+		t.Errorf("Wrong fallback location %s", loc)
+	}
+}
+
+func TestLoadDefaults(t *testing.T) {
+	f, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(`{"TimeZone": "America/Chicago", "StudioName": "Test Studio"}`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	old := Defaults()
+	defer func() { defaults, current = old, old }()
+	if err := LoadDefaults(f.Name()); err != nil {
+		t.Fatalf("Failed to load defaults: %s", err)
+	}
+	d := Defaults()
+	if d.StudioName != "Test Studio" || d.TimeZone != "America/Chicago" {
+		t.Errorf("Defaults not read from file: %+v", d)
+	}
+	if d.ContactEmail != old.ContactEmail {
+		t.Errorf("Built-in default lost: %q vs %q", d.ContactEmail, old.ContactEmail)
+	}
+}
+
+func TestGetAndPut(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	cfg, err := Get(c)
+	if err != nil {
+		t.Fatalf("Failed to get default config: %s", err)
+	}
+	if d := Defaults(); cfg.BaseURL != d.BaseURL || cfg.TimeZone != d.TimeZone {
+		t.Errorf("Expected defaults, got %+v", cfg)
+	}
+	stored := &Config{BaseURL: "http://example.com", TimeZone: "Europe/London"}
+	if err := stored.Put(c); err != nil {
+		t.Fatalf("Failed to store config: %s", err)
+	}
+	cfg, err = Get(c)
+	if err != nil {
+		t.Fatalf("Failed to get stored config: %s", err)
+	}
+	if cfg.BaseURL != stored.BaseURL {
+		t.Errorf("Wrong base URL %q; want %q", cfg.BaseURL, stored.BaseURL)
+	}
+	if got := cfg.URL("/login"); got != "http://example.com/login" {
+		t.Errorf("Wrong URL %q", got)
+	}
+	if cfg.StudioName != Defaults().StudioName {
+		t.Errorf("Expected default studio name, got %q", cfg.StudioName)
+	}
+	if got := Current().Location().String(); got != "Europe/London" {
+		t.Errorf("Current config not updated; location is %s", got)
+	}
+	bad := &Config{TimeZone: "Nowhere/Special"}
+	if err := bad.Put(c); err == nil {
+		t.Errorf("Should not have stored invalid time zone")
+	}
+}
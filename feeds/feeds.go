@@ -0,0 +1,277 @@
+// Package feeds builds iCalendar feeds of the studio schedule and of
+// individual students' registrations.
+package feeds
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/decitrig/innerhearth/bookings"
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/config"
+	"github.com/decitrig/innerhearth/ical"
+	"github.com/decitrig/innerhearth/schedule"
+	"github.com/decitrig/innerhearth/series"
+	"github.com/decitrig/innerhearth/students"
+)
+
+var (
+	ErrTokenNotFound = fmt.Errorf("feeds: token not found")
+)
+
+// A Token is an unguessable string which grants read access to the
+// calendar feed of a single account.
+type Token struct {
+	Token     string `datastore:"-"`
+	AccountID string
+	Created   time.Time
+}
+
+func newTokenString() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+func tokenKey(c appengine.Context, token string) *datastore.Key {
+	return datastore.NewKey(c, "FeedToken", token, 0, nil)
+}
+
+// TokenForAccount returns the feed token for an account, creating one
+// if the account doesn't yet have a token.
+func TokenForAccount(c appengine.Context, accountID string, now time.Time) (*Token, error) {
+	q := datastore.NewQuery("FeedToken").
+		Filter("AccountID =", accountID).
+		KeysOnly().
+		Limit(1)
+	keys, err := q.GetAll(c, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) > 0 {
+		return WithToken(c, keys[0].StringID())
+	}
+	return newToken(c, accountID, now)
+}
+
+// ResetToken revokes every feed token of an account and returns a new
+// one, so that a feed address which has been shared stops working.
+func ResetToken(c appengine.Context, accountID string, now time.Time) (*Token, error) {
+	q := datastore.NewQuery("FeedToken").
+		Filter("AccountID =", accountID).
+		KeysOnly()
+	keys, err := q.GetAll(c, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := datastore.DeleteMulti(c, keys); err != nil {
+		return nil, err
+	}
+	return newToken(c, accountID, now)
+}
+
+func newToken(c appengine.Context, accountID string, now time.Time) (*Token, error) {
+	s, err := newTokenString()
+	if err != nil {
+		return nil, fmt.Errorf("feeds: failed to create token: %s", err)
+	}
+	token := &Token{
+		Token:     s,
+		AccountID: accountID,
+		Created:   now,
+	}
+	if _, err := datastore.Put(c, tokenKey(c, s), token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// WithToken returns the Token entity for a token string, if one exists.
+func WithToken(c appengine.Context, token string) (*Token, error) {
+	t := &Token{}
+	switch err := datastore.Get(c, tokenKey(c, token), t); err {
+	case nil:
+		t.Token = token
+		return t, nil
+	case datastore.ErrNoSuchEntity:
+		return nil, ErrTokenNotFound
+	default:
+		return nil, err
+	}
+}
+
+// Delete revokes the token; the feed will no longer be readable with it.
+func (t *Token) Delete(c appengine.Context) error {
+	return datastore.Delete(c, tokenKey(c, t.Token))
+}
+
+func host(cfg *config.Config) string {
+	u, err := url.Parse(cfg.BaseURL)
+	if err != nil || u.Host == "" {
+		return "innerhearth"
+	}
+	return u.Host
+}
+
+func productID(cfg *config.Config) string {
+	return fmt.Sprintf("-//%s//Schedule//EN", cfg.StudioName)
+}
+
+func event(class *classes.Class, teacher *classes.Teacher, o classes.Occurrence, cfg *config.Config) *ical.Event {
+	return &ical.Event{
+		UID:         fmt.Sprintf("class-%d-%s@%s", class.ID, o.Start.In(cfg.Location()).Format("20060102"), host(cfg)),
+		Start:       o.Start,
+		End:         o.End,
+		Summary:     fmt.Sprintf("%s with %s", class.Title, teacher.DisplayName()),
+		Description: class.Description(),
+		Location:    cfg.StudioName,
+	}
+}
+
+// ClassEvents returns an event for each meeting of a class within its
+// session which ends after the given time.
+func ClassEvents(class *classes.Class, session *classes.Session, teacher *classes.Teacher, after time.Time, cfg *config.Config) []*ical.Event {
+	events := []*ical.Event{}
+	for _, o := range class.Occurrences(session, after, cfg.Location()) {
+		events = append(events, event(class, teacher, o, cfg))
+	}
+	return events
+}
+
+// DropInEvent returns the event for a single drop-in meeting of a
+// class on the given date.
+func DropInEvent(class *classes.Class, teacher *classes.Teacher, date time.Time, cfg *config.Config) *ical.Event {
+	return event(class, teacher, class.OccurrenceOn(date, cfg.Location()), cfg)
+}
+
+// SeriesEvents returns an event for each meeting of a series, starting
+// with the meeting at first, which ends after the given time.
+func SeriesEvents(class *classes.Class, s *series.Series, teacher *classes.Teacher, first, after time.Time, cfg *config.Config) []*ical.Event {
+	events := []*ical.Event{}
+	for _, m := range s.Meetings {
+		if m.Start.Before(first) || !m.End().After(after) {
+			continue
+		}
+		events = append(events, event(class, teacher, classes.Occurrence{Start: m.Start, End: m.End()}, cfg))
+	}
+	return events
+}
+
+// BookingEvent returns the event for a confirmed private or group
+// booking, as seen by its teacher.
+func BookingEvent(b *bookings.Booking, cfg *config.Config) *ical.Event {
+	return &ical.Event{
+		UID:         fmt.Sprintf("booking-%d@%s", b.ID, host(cfg)),
+		Start:       b.Start,
+		End:         b.End(),
+		Summary:     fmt.Sprintf("%s with %s", b.Kind, b.Name),
+		Description: fmt.Sprintf("Group of %d. %s %s", b.GroupSize, b.Email, b.Phone),
+		Location:    cfg.StudioName,
+	}
+}
+
+// Studio returns a calendar of all upcoming class meetings in the
+// schedule.
+func Studio(sched *schedule.Schedule, now time.Time, cfg *config.Config) *ical.Calendar {
+	cal := &ical.Calendar{
+		Name:      cfg.StudioName,
+		ProductID: productID(cfg),
+	}
+	for _, s := range sched.Sessions {
+		for _, class := range s.Classes {
+			cal.Events = append(cal.Events, ClassEvents(class, s.Session, s.TeachersByClass[class.ID], now, cfg)...)
+		}
+	}
+	return cal
+}
+
+// ForAccount returns a calendar of the upcoming class meetings for
+// which an account is registered, either for the session, for a
+// series or as a drop-in. If the account is a teacher's, the calendar
+// also includes their confirmed bookings.
+func ForAccount(c appengine.Context, accountID string, now time.Time, cfg *config.Config) *ical.Calendar {
+	cal := &ical.Calendar{
+		Name:      fmt.Sprintf("My %s classes", cfg.StudioName),
+		ProductID: productID(cfg),
+	}
+	if teacher, err := classes.TeacherWithID(c, accountID); err == nil {
+		upcoming, err := bookings.UpcomingForTeacher(c, teacher, now)
+		if err != nil {
+			c.Errorf("Failed to find bookings for teacher %q: %s", accountID, err)
+		}
+		for _, b := range upcoming {
+			cal.Events = append(cal.Events, BookingEvent(b, cfg))
+		}
+	}
+	// Drop-ins are kept until their meeting ends, which is checked once
+	// their classes are loaded; those from before today are over.
+	registrations := []*students.Student{}
+	for _, student := range students.WithID(c, accountID) {
+		if student.Lapsed(now) || (student.DropIn && !student.Date.AddDate(0, 0, 1).After(now)) {
+			continue
+		}
+		registrations = append(registrations, student)
+	}
+	classIDs := make([]int64, len(registrations))
+	for i, student := range registrations {
+		classIDs[i] = student.ClassID
+	}
+	classList := classes.ClassesWithIDs(c, classIDs)
+	if len(classList) != len(registrations) {
+		// Some class couldn't be loaded, most likely because it was
+		// deleted; look the classes up one at a time and leave out
+		// those which are missing.
+		found, kept := []*classes.Class{}, []*students.Student{}
+		for i, id := range classIDs {
+			class, err := classes.ClassWithID(c, id)
+			if err != nil {
+				c.Errorf("Failed to find class %d for %q: %s", id, accountID, err)
+				continue
+			}
+			found = append(found, class)
+			kept = append(kept, registrations[i])
+		}
+		classList, registrations = found, kept
+	}
+	teachers := classes.TeachersByClass(c, classList)
+	sessions := make(map[int64]*classes.Session)
+	for i, student := range registrations {
+		class := classList[i]
+		teacher := teachers[class.ID]
+		if student.DropIn {
+			if e := DropInEvent(class, teacher, student.Date, cfg); e.End.After(now) {
+				cal.Events = append(cal.Events, e)
+			}
+			continue
+		}
+		if class.Series != 0 {
+			s, err := series.WithID(c, class.Series)
+			if err != nil {
+				c.Errorf("Failed to find series %d for class %d: %s", class.Series, class.ID, err)
+				continue
+			}
+			cal.Events = append(cal.Events, SeriesEvents(class, s, teacher, student.Date, now, cfg)...)
+			continue
+		}
+		session, ok := sessions[class.Session]
+		if !ok {
+			var err error
+			session, err = classes.SessionWithID(c, class.Session)
+			if err != nil {
+				c.Errorf("Failed to find session %d for class %d: %s", class.Session, class.ID, err)
+				continue
+			}
+			sessions[class.Session] = session
+		}
+		cal.Events = append(cal.Events, ClassEvents(class, session, teacher, now, cfg)...)
+	}
+	return cal
+}
@@ -0,0 +1,155 @@
+package feeds
+
+import (
+	"testing"
+	"time"
+
+	"appengine/aetest"
+
+	"github.com/decitrig/innerhearth/account"
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/config"
+	"github.com/decitrig/innerhearth/schedule"
+	"github.com/decitrig/innerhearth/students"
+)
+
+var cfg = &config.Config{
+	TimeZone:   "America/New_York",
+	BaseURL:    "http://example.com",
+	StudioName: "Studio",
+}
+
+func local(t *testing.T) *time.Location {
+	loc, err := time.LoadLocation(cfg.TimeZone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestStudio(t *testing.T) {
+	loc := local(t)
+	startTime, _ := time.ParseInLocation("3:04pm", "9:00am", loc)
+	session := &classes.Session{
+		ID:    1,
+		Name:  "spring",
+		Start: time.Date(2014, time.April, 14, 0, 0, 0, 0, loc),
+		End:   time.Date(2014, time.April, 27, 0, 0, 0, 0, loc),
+	}
+	class := &classes.Class{
+		ID:        2,
+		Title:     "Flow",
+		Weekday:   time.Wednesday,
+		StartTime: startTime,
+		Length:    time.Hour,
+		Session:   session.ID,
+	}
+	sched := &schedule.Schedule{
+		Sessions: []*schedule.Session{{
+			Session:         session,
+			Classes:         []*classes.Class{class},
+			TeachersByClass: map[int64]*classes.Teacher{},
+		}},
+	}
+	cal := Studio(sched, time.Date(2014, time.April, 17, 0, 0, 0, 0, loc), cfg)
+	if len(cal.Events) != 1 {
+		t.Fatalf("Wrong number of events: %d", len(cal.Events))
+	}
+	e := cal.Events[0]
+	if want := "class-2-20140423@example.com"; e.UID != want {
+		t.Errorf("Wrong UID %q; want %q", e.UID, want)
+	}
+	if want := time.Date(2014, time.April, 23, 9, 0, 0, 0, loc); !e.Start.Equal(want) {
+		t.Errorf("Wrong start %s; want %s", e.Start, want)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	now := time.Unix(1000, 0)
+	token, err := TokenForAccount(c, "0x1", now)
+	if err != nil {
+		t.Fatalf("Failed to create token: %s", err)
+	}
+	if len(token.Token) < 20 {
+		t.Errorf("Token %q is too short", token.Token)
+	}
+	if got, err := WithToken(c, token.Token); err != nil {
+		t.Errorf("Failed to find token: %s", err)
+	} else if got.AccountID != "0x1" {
+		t.Errorf("Wrong account for token: %q", got.AccountID)
+	}
+	other, err := TokenForAccount(c, "0x2", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Token == token.Token {
+		t.Errorf("Two accounts got the same token")
+	}
+	if err := token.Delete(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WithToken(c, token.Token); err != ErrTokenNotFound {
+		t.Errorf("Should not have found deleted token")
+	}
+	reset, err := ResetToken(c, "0x2", now)
+	if err != nil {
+		t.Fatalf("Failed to reset token: %s", err)
+	}
+	if reset.Token == other.Token || reset.AccountID != "0x2" {
+		t.Errorf("Wrong reset token: %+v", reset)
+	}
+	if _, err := WithToken(c, other.Token); err != ErrTokenNotFound {
+		t.Errorf("Should not have found replaced token")
+	}
+}
+
+func TestForAccount(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	loc := local(t)
+	now := time.Date(2014, time.April, 1, 0, 0, 0, 0, loc)
+	session := classes.NewSession("spring", now, now.AddDate(0, 0, 13))
+	if err := session.Insert(c); err != nil {
+		t.Fatal(err)
+	}
+	class := &classes.Class{Title: "Flow", Weekday: time.Thursday, Session: session.ID, Capacity: 10}
+	if err := class.Insert(c); err != nil {
+		t.Fatal(err)
+	}
+	startTime, _ := time.ParseInLocation("3:04pm", "9:00am", loc)
+	dropIn := &classes.Class{Title: "Yin", Weekday: time.Friday, StartTime: startTime, Length: time.Hour, Session: session.ID, Capacity: 10}
+	if err := dropIn.Insert(c); err != nil {
+		t.Fatal(err)
+	}
+	acct := &account.Account{ID: "0x1", Info: account.Info{Email: "a@example.com"}}
+	if err := students.New(acct, class).Add(c, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := students.NewDropIn(acct, dropIn, now.AddDate(0, 0, 3)).Add(c, now); err != nil {
+		t.Fatal(err)
+	}
+	cal := ForAccount(c, acct.ID, now, cfg)
+	// Two Thursdays in the session, plus one drop-in.
+	if len(cal.Events) != 3 {
+		t.Errorf("Wrong number of events: %d", len(cal.Events))
+	}
+	// On the morning of the drop-in, it's still to come.
+	cal = ForAccount(c, acct.ID, time.Date(2014, time.April, 4, 8, 0, 0, 0, loc), cfg)
+	if len(cal.Events) != 2 {
+		t.Errorf("Wrong number of events before the drop-in: %d", len(cal.Events))
+	}
+	cal = ForAccount(c, acct.ID, time.Date(2014, time.April, 4, 11, 0, 0, 0, loc), cfg)
+	if len(cal.Events) != 1 {
+		t.Errorf("Wrong number of events after the drop-in: %d", len(cal.Events))
+	}
+}
@@ -0,0 +1,135 @@
+// Package ical writes calendars in the iCalendar format (RFC 5545).
+package ical
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	// ContentType is the MIME type of iCalendar data.
+	ContentType = "text/calendar; charset=utf-8"
+
+	utcLayout = "20060102T150405Z"
+
+	// Content lines longer than this many octets must be folded.
+	maxLineLength = 75
+)
+
+// A Calendar is a named list of events.
+type Calendar struct {
+	// The calendar's display name, shown by most calendar clients.
+	Name string
+
+	// The product which produced the calendar, e.g. "-//Inner Hearth Yoga//Schedule//EN".
+	ProductID string
+
+	Events []*Event
+}
+
+// An Event is a single calendar entry.
+type Event struct {
+	// A globally unique, stable identifier for the event.
+	UID string
+
+	Start time.Time
+	End   time.Time
+
+	Summary     string
+	Description string
+	Location    string
+}
+
+// escape escapes text property values as required by RFC 5545
+// section 3.3.11.
+func escape(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	).Replace(s)
+}
+
+// fold splits a content line into chunks of at most maxLineLength
+// octets, without splitting UTF-8 sequences. Continuation lines begin
+// with a single space.
+func fold(line string) string {
+	if len(line) <= maxLineLength {
+		return line
+	}
+	var out []string
+	limit := maxLineLength
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !isRuneStart(line[cut]) {
+			cut--
+		}
+		out = append(out, line[:cut])
+		line = line[cut:]
+		// Continuation lines lose one octet to the leading space.
+		limit = maxLineLength - 1
+	}
+	out = append(out, line)
+	return strings.Join(out, "\r\n ")
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(utcLayout)
+}
+
+type writer struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (w *writer) line(name, value string) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = fmt.Fprintf(w.w, "%s\r\n", fold(name+":"+value))
+}
+
+// Write writes the calendar to w. All times are written in UTC, so no
+// time zone definitions are needed; now is used as the timestamp of
+// each event.
+func (cal *Calendar) Write(w io.Writer, now time.Time) error {
+	out := &writer{w: bufio.NewWriter(w)}
+	out.line("BEGIN", "VCALENDAR")
+	out.line("VERSION", "2.0")
+	out.line("PRODID", cal.ProductID)
+	out.line("CALSCALE", "GREGORIAN")
+	out.line("METHOD", "PUBLISH")
+	if cal.Name != "" {
+		out.line("X-WR-CALNAME", escape(cal.Name))
+	}
+	stamp := formatTime(now)
+	for _, e := range cal.Events {
+		out.line("BEGIN", "VEVENT")
+		out.line("UID", e.UID)
+		out.line("DTSTAMP", stamp)
+		out.line("DTSTART", formatTime(e.Start))
+		out.line("DTEND", formatTime(e.End))
+		out.line("SUMMARY", escape(e.Summary))
+		if e.Description != "" {
+			out.line("DESCRIPTION", escape(e.Description))
+		}
+		if e.Location != "" {
+			out.line("LOCATION", escape(e.Location))
+		}
+		out.line("END", "VEVENT")
+	}
+	out.line("END", "VCALENDAR")
+	if out.err != nil {
+		return out.err
+	}
+	return out.w.Flush()
+}
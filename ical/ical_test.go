@@ -0,0 +1,85 @@
+package ical
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEscape(t *testing.T) {
+	for _, test := range []struct{ in, want string }{
+		{"plain", "plain"},
+		{"a, b; c", `a\, b\; c`},
+		{"line1\nline2", `line1\nline2`},
+		{`back\slash`, `back\\slash`},
+	} {
+		if got := escape(test.in); got != test.want {
+			t.Errorf("escape(%q) = %q; want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestFold(t *testing.T) {
+	short := strings.Repeat("a", 75)
+	if got := fold(short); got != short {
+		t.Errorf("Short line should not be folded: %q", got)
+	}
+	long := "DESCRIPTION:" + strings.Repeat("é", 100)
+	folded := fold(long)
+	for i, line := range strings.Split(folded, "\r\n") {
+		if len(line) > maxLineLength {
+			t.Errorf("Line %d is %d octets long", i, len(line))
+		}
+		if i > 0 && !strings.HasPrefix(line, " ") {
+			t.Errorf("Continuation line %d doesn't start with a space: %q", i, line)
+		}
+	}
+	if unfolded := strings.Replace(folded, "\r\n ", "", -1); unfolded != long {
+		t.Errorf("Unfolding didn't restore line: %q", unfolded)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2014, time.March, 10, 18, 30, 0, 0, loc)
+	cal := &Calendar{
+		Name:      "Schedule",
+		ProductID: "-//Test//Test//EN",
+		Events: []*Event{{
+			UID:      "1@example.com",
+			Start:    start,
+			End:      start.Add(time.Hour),
+			Summary:  "Yoga, with friends",
+			Location: "Studio",
+		}},
+	}
+	buf := &bytes.Buffer{}
+	if err := cal.Write(buf, time.Date(2014, time.March, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//Test//Test//EN",
+		"CALSCALE:GREGORIAN",
+		"METHOD:PUBLISH",
+		"X-WR-CALNAME:Schedule",
+		"BEGIN:VEVENT",
+		"UID:1@example.com",
+		"DTSTAMP:20140301T000000Z",
+		"DTSTART:20140310T223000Z",
+		"DTEND:20140310T233000Z",
+		`SUMMARY:Yoga\, with friends`,
+		"LOCATION:Studio",
+		"END:VEVENT",
+		"END:VCALENDAR",
+		"",
+	}, "\r\n")
+	if got := buf.String(); got != want {
+		t.Errorf("Wrong calendar output:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,279 @@
+// Package images stores images uploaded by staff and teachers, such
+// as workshop flyers and headshots, so that they can be added without
+// deploying the app. Each upload is kept in a Store along with smaller
+// variants for thumbnails and page layouts.
+package images
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+var (
+	ErrImageNotFound    = fmt.Errorf("images: image not found")
+	ErrTooLarge         = fmt.Errorf("images: file is too large")
+	ErrTooManyPixels    = fmt.Errorf("images: image dimensions are too large")
+	ErrUnsupportedType  = fmt.Errorf("images: unsupported file type")
+	ErrVariantNotFound  = fmt.Errorf("images: no such variant")
+	errFormatMismatched = fmt.Errorf("images: file contents don't match its type")
+)
+
+const (
+	// The largest file which may be uploaded.
+	MaxSize = 8 << 20
+
+	// The most pixels an uploaded image may have, enough for a
+	// 12-megapixel photo; larger images would take too much memory to
+	// decode and resize.
+	MaxPixels = 12 << 20
+)
+
+// ContentTypes maps the content types which may be uploaded to the
+// names of their decoders.
+var ContentTypes = map[string]string{
+	"image/jpeg": "jpeg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+}
+
+// A Variant is a named size in which each image is stored.
+type Variant struct {
+	Name  string
+	Width int
+}
+
+// The variants of each image. The original upload is kept as the
+// Original variant.
+const (
+	Thumb    = "thumb"
+	Medium   = "medium"
+	Large    = "large"
+	Original = "original"
+)
+
+// Variants lists the resized variants generated for each image,
+// smallest first.
+var Variants = []Variant{
+	{Thumb, 200},
+	{Medium, 640},
+	{Large, 1280},
+}
+
+// An Image is an uploaded image.
+type Image struct {
+	ID int64 `datastore:"-"`
+
+	// The name of the uploaded file, and a description of the image for
+	// alt text.
+	Filename    string `datastore:",noindex"`
+	Description string `datastore:",noindex"`
+
+	ContentType string `datastore:",noindex"`
+	Width       int    `datastore:",noindex"`
+	Height      int    `datastore:",noindex"`
+	Size        int    `datastore:",noindex"`
+
+	Created   time.Time
+	CreatedBy string `datastore:",noindex"`
+}
+
+// blobName returns the name under which a variant of the image is
+// kept in a Store.
+func (i *Image) blobName(variant string) string {
+	return fmt.Sprintf("%d/%s", i.ID, variant)
+}
+
+// URL returns the path at which a variant of the image is served.
+func (i *Image) URL(variant string) string {
+	return fmt.Sprintf("/uploads/%d/%s", i.ID, variant)
+}
+
+// VariantNames lists the names of all of the image's variants,
+// including the original.
+func VariantNames() []string {
+	names := []string{}
+	for _, v := range Variants {
+		names = append(names, v.Name)
+	}
+	return append(names, Original)
+}
+
+// Validate checks that data is an image which may be uploaded, and
+// returns its content type and dimensions.
+func Validate(data []byte) (string, image.Config, error) {
+	if len(data) > MaxSize {
+		return "", image.Config{}, ErrTooLarge
+	}
+	contentType := http.DetectContentType(data)
+	format, ok := ContentTypes[contentType]
+	if !ok {
+		return "", image.Config{}, ErrUnsupportedType
+	}
+	cfg, decoded, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || decoded != format {
+		return "", image.Config{}, errFormatMismatched
+	}
+	if cfg.Width*cfg.Height > MaxPixels {
+		return "", image.Config{}, ErrTooManyPixels
+	}
+	return contentType, cfg, nil
+}
+
+// encode encodes a resized variant. Photographs stay JPEGs; other
+// images become PNGs, which keeps sharp edges and transparency.
+func encode(img image.Image, contentType string) ([]byte, string, error) {
+	buf := &bytes.Buffer{}
+	if contentType == "image/jpeg" {
+		err := jpeg.Encode(buf, img, &jpeg.Options{Quality: 85})
+		return buf.Bytes(), contentType, err
+	}
+	err := png.Encode(buf, img)
+	return buf.Bytes(), "image/png", err
+}
+
+func decode(data []byte, contentType string) (image.Image, error) {
+	r := bytes.NewReader(data)
+	switch contentType {
+	case "image/jpeg":
+		return jpeg.Decode(r)
+	case "image/png":
+		return png.Decode(r)
+	case "image/gif":
+		return gif.Decode(r)
+	}
+	return nil, ErrUnsupportedType
+}
+
+// New validates an uploaded file and returns a new image for it. The
+// image must be inserted to store it.
+func New(filename string, data []byte, createdBy string, now time.Time) (*Image, error) {
+	contentType, cfg, err := Validate(data)
+	if err != nil {
+		return nil, err
+	}
+	return &Image{
+		Filename:    filename,
+		ContentType: contentType,
+		Width:       cfg.Width,
+		Height:      cfg.Height,
+		Size:        len(data),
+		Created:     now,
+		CreatedBy:   createdBy,
+	}, nil
+}
+
+func imageKey(c appengine.Context, id int64) *datastore.Key {
+	return datastore.NewKey(c, "Image", "", id, nil)
+}
+
+// Insert stores a new image, along with each of its variants, in the
+// given store. The variants are stored before the image, so that an
+// image is never listed without them; if the image can't be stored,
+// its variants are deleted again.
+func (i *Image) Insert(c appengine.Context, s Store, data []byte) error {
+	src, err := decode(data, i.ContentType)
+	if err != nil {
+		return err
+	}
+	id, _, err := datastore.AllocateIDs(c, "Image", nil, 1)
+	if err != nil {
+		return err
+	}
+	i.ID = id
+	if err := i.putVariants(c, s, src, data); err != nil {
+		i.deleteVariants(c, s)
+		return err
+	}
+	if _, err := datastore.Put(c, imageKey(c, i.ID), i); err != nil {
+		i.deleteVariants(c, s)
+		return err
+	}
+	return nil
+}
+
+// putVariants stores the original upload and each resized variant.
+func (i *Image) putVariants(c appengine.Context, s Store, src image.Image, data []byte) error {
+	if err := s.Put(c, i.blobName(Original), &Blob{i.ContentType, data}); err != nil {
+		return err
+	}
+	for _, v := range Variants {
+		resized, contentType, err := encode(resize(src, v.Width), i.ContentType)
+		if err != nil {
+			return err
+		}
+		if err := s.Put(c, i.blobName(v.Name), &Blob{contentType, resized}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteVariants deletes whichever variants of an image which couldn't
+// be inserted were stored. Errors are logged.
+func (i *Image) deleteVariants(c appengine.Context, s Store) {
+	for _, name := range VariantNames() {
+		if err := s.Delete(c, i.blobName(name)); err != nil {
+			c.Errorf("Failed to delete %s of unstored image %d: %s", name, i.ID, err)
+		}
+	}
+}
+
+// WithID returns the image with the given ID, if one exists.
+func WithID(c appengine.Context, id int64) (*Image, error) {
+	i := &Image{}
+	switch err := datastore.Get(c, imageKey(c, id), i); err {
+	case nil:
+		i.ID = id
+		return i, nil
+	case datastore.ErrNoSuchEntity:
+		return nil, ErrImageNotFound
+	default:
+		return nil, err
+	}
+}
+
+// Get returns the stored content of a variant of the image.
+func (i *Image) Get(c appengine.Context, s Store, variant string) (*Blob, error) {
+	for _, name := range VariantNames() {
+		if name == variant {
+			return s.Get(c, i.blobName(variant))
+		}
+	}
+	return nil, ErrVariantNotFound
+}
+
+// Recent returns the most recently uploaded images, newest first.
+func Recent(c appengine.Context, limit int) ([]*Image, error) {
+	q := datastore.NewQuery("Image").
+		Order("-Created").
+		Limit(limit)
+	images := []*Image{}
+	keys, err := q.GetAll(c, &images)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		images[i].ID = key.IntID()
+	}
+	return images, nil
+}
+
+// Delete deletes the image and all of its variants. Pages which still
+// link to the image will show it as missing.
+func (i *Image) Delete(c appengine.Context, s Store) error {
+	for _, name := range VariantNames() {
+		if err := s.Delete(c, i.blobName(name)); err != nil {
+			return err
+		}
+	}
+	return datastore.Delete(c, imageKey(c, i.ID))
+}
@@ -0,0 +1,137 @@
+package images
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+	"time"
+
+	"appengine/aetest"
+)
+
+func testPNG(t *testing.T, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 0x80, 0xff})
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestValidate(t *testing.T) {
+	if contentType, cfg, err := Validate(testPNG(t, 30, 20)); err != nil {
+		t.Errorf("Rejected valid PNG: %s", err)
+	} else if contentType != "image/png" || cfg.Width != 30 || cfg.Height != 20 {
+		t.Errorf("Wrong image info: %q %dx%d", contentType, cfg.Width, cfg.Height)
+	}
+	for i, test := range []struct {
+		data []byte
+		want error
+	}{
+		{[]byte("hello, world"), ErrUnsupportedType},
+		{[]byte("<html><body></body></html>"), ErrUnsupportedType},
+		{make([]byte, MaxSize+1), ErrTooLarge},
+		{append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 20)...), errFormatMismatched},
+	} {
+		if _, _, err := Validate(test.data); err != test.want {
+			t.Errorf("%d: wrong error; got %v, want %v", i, err, test.want)
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 400, 100))
+	for i, test := range []struct {
+		width        int
+		wantW, wantH int
+	}{
+		{200, 200, 50},
+		{399, 399, 99},
+		{400, 400, 100},
+		{1000, 400, 100},
+	} {
+		b := resize(src, test.width).Bounds()
+		if b.Dx() != test.wantW || b.Dy() != test.wantH {
+			t.Errorf("%d: wrong size; got %dx%d, want %dx%d", i, b.Dx(), b.Dy(), test.wantW, test.wantH)
+		}
+	}
+}
+
+// opaque hides the type of an image, so that it is read through At.
+type opaque struct{ image.Image }
+
+func TestResizePixels(t *testing.T) {
+	r := image.Rect(0, 0, 64, 48)
+	rgba, nrgba := image.NewRGBA(r), image.NewNRGBA(r)
+	ycbcr := image.NewYCbCr(r, image.YCbCrSubsampleRatio420)
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			rgba.Set(x, y, color.RGBA{uint8(x), uint8(y), 0x40, 0xff})
+			nrgba.Set(x, y, color.NRGBA{uint8(4 * x), uint8(y), 0x80, uint8(2 * y)})
+			ycbcr.Y[ycbcr.YOffset(x, y)] = uint8(3 * x)
+			ci := ycbcr.COffset(x, y)
+			ycbcr.Cb[ci], ycbcr.Cr[ci] = uint8(y), uint8(x)
+		}
+	}
+	for _, src := range []image.Image{rgba, nrgba, ycbcr} {
+		got, want := resize(src, 20).(*image.RGBA), resize(opaque{src}, 20).(*image.RGBA)
+		if !bytes.Equal(got.Pix, want.Pix) {
+			t.Errorf("Resizing %T directly differs from resizing through At", src)
+		}
+	}
+}
+
+func TestImages(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s := DatastoreStore{}
+	data := testPNG(t, 800, 400)
+	img, err := New("flyer.png", data, "staff@example.com", time.Unix(1000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Insert(c, s, data); err != nil {
+		t.Fatalf("Failed to insert image: %s", err)
+	}
+	got, err := WithID(c, img.ID)
+	if err != nil {
+		t.Fatalf("Didn't find image %d: %s", img.ID, err)
+	}
+	if got.Filename != "flyer.png" || got.Width != 800 || got.Height != 400 {
+		t.Errorf("Wrong image for %d: %+v", img.ID, got)
+	}
+	wantWidths := map[string]int{Thumb: 200, Medium: 640, Large: 800, Original: 800}
+	for variant, width := range wantWidths {
+		blob, err := got.Get(c, s, variant)
+		if err != nil {
+			t.Errorf("Failed to get variant %q: %s", variant, err)
+			continue
+		}
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(blob.Data))
+		if err != nil || cfg.Width != width || blob.ContentType != "image/png" {
+			t.Errorf("Wrong %q variant: %s %dx%d (%v)", variant, blob.ContentType, cfg.Width, cfg.Height, err)
+		}
+	}
+	if _, err := got.Get(c, s, "huge"); err != ErrVariantNotFound {
+		t.Errorf("Expected missing variant; got %v", err)
+	}
+	if err := got.Delete(c, s); err != nil {
+		t.Fatalf("Failed to delete image: %s", err)
+	}
+	if _, err := WithID(c, img.ID); err != ErrImageNotFound {
+		t.Errorf("Shouldn't have found image %d: %v", img.ID, err)
+	}
+	if _, err := s.Get(c, got.blobName(Original)); err != ErrBlobNotFound {
+		t.Errorf("Expected original to be deleted; got %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package images
+
+import (
+	"image"
+	"image/color"
+)
+
+// pixels returns a function which reads the premultiplied 16-bit color
+// of a pixel of src. The common decoded formats are read straight from
+// their pixel buffers, which is much faster than going through At.
+func pixels(src image.Image) func(x, y int) (r, g, b, a uint32) {
+	switch src := src.(type) {
+	case *image.RGBA:
+		return func(x, y int) (r, g, b, a uint32) {
+			p := src.Pix[src.PixOffset(x, y):]
+			return uint32(p[0]) * 0x101, uint32(p[1]) * 0x101, uint32(p[2]) * 0x101, uint32(p[3]) * 0x101
+		}
+	case *image.NRGBA:
+		return func(x, y int) (r, g, b, a uint32) {
+			p := src.Pix[src.PixOffset(x, y):]
+			a = uint32(p[3]) * 0x101
+			return uint32(p[0]) * a / 0xff, uint32(p[1]) * a / 0xff, uint32(p[2]) * a / 0xff, a
+		}
+	case *image.YCbCr:
+		return func(x, y int) (r, g, b, a uint32) {
+			ci := src.COffset(x, y)
+			return color.YCbCr{Y: src.Y[src.YOffset(x, y)], Cb: src.Cb[ci], Cr: src.Cr[ci]}.RGBA()
+		}
+	}
+	return func(x, y int) (r, g, b, a uint32) {
+		return src.At(x, y).RGBA()
+	}
+}
+
+// resize scales an image down to the given width, keeping its aspect
+// ratio. Each pixel of the result is the average of the pixels it
+// covers in the source, which gives good results when shrinking.
+// Images no wider than width are returned unchanged.
+func resize(src image.Image, width int) image.Image {
+	b := src.Bounds()
+	if b.Dx() <= width {
+		return src
+	}
+	height := b.Dy() * width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+	at := pixels(src)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := b.Min.Y + y*b.Dy()/height
+		y1 := b.Min.Y + (y+1)*b.Dy()/height
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < width; x++ {
+			x0 := b.Min.X + x*b.Dx()/width
+			x1 := b.Min.X + (x+1)*b.Dx()/width
+			if x1 == x0 {
+				x1++
+			}
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := at(sx, sy)
+					r += uint64(pr)
+					g += uint64(pg)
+					bl += uint64(pb)
+					a += uint64(pa)
+					n++
+				}
+			}
+			p := dst.Pix[dst.PixOffset(x, y):]
+			p[0] = uint8((r / n) >> 8)
+			p[1] = uint8((g / n) >> 8)
+			p[2] = uint8((bl / n) >> 8)
+			p[3] = uint8((a / n) >> 8)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,180 @@
+package images
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+var (
+	ErrBlobNotFound = fmt.Errorf("images: blob not found")
+)
+
+// A Blob is the stored content of a file.
+type Blob struct {
+	ContentType string
+	Data        []byte
+}
+
+// A Store keeps uploaded files by name. Names are slash-separated
+// paths, e.g. "12/thumb".
+type Store interface {
+	Put(c appengine.Context, name string, blob *Blob) error
+	Get(c appengine.Context, name string) (*Blob, error)
+	Delete(c appengine.Context, name string) error
+}
+
+// chunkSize is the most data a DatastoreStore keeps in a single
+// entity, leaving room under the datastore's 1MB entity limit.
+const chunkSize = 900 << 10
+
+// A DatastoreStore keeps files in the datastore, split into chunks
+// small enough to fit in single entities.
+type DatastoreStore struct{}
+
+type blobEntity struct {
+	ContentType string `datastore:",noindex"`
+	Chunks      int    `datastore:",noindex"`
+}
+
+type chunkEntity struct {
+	Data []byte `datastore:",noindex"`
+}
+
+func blobKey(c appengine.Context, name string) *datastore.Key {
+	return datastore.NewKey(c, "ImageBlob", name, 0, nil)
+}
+
+func chunkKeys(c appengine.Context, parent *datastore.Key, n int) []*datastore.Key {
+	keys := make([]*datastore.Key, n)
+	for i := range keys {
+		keys[i] = datastore.NewKey(c, "ImageChunk", "", int64(i+1), parent)
+	}
+	return keys
+}
+
+// Put stores a file, replacing any file of the same name.
+func (s DatastoreStore) Put(c appengine.Context, name string, blob *Blob) error {
+	if err := s.Delete(c, name); err != nil {
+		return err
+	}
+	chunks := []*chunkEntity{}
+	for data := blob.Data; len(data) > 0; {
+		n := chunkSize
+		if n > len(data) {
+			n = len(data)
+		}
+		chunks = append(chunks, &chunkEntity{data[:n]})
+		data = data[n:]
+	}
+	key := blobKey(c, name)
+	if len(chunks) > 0 {
+		if _, err := datastore.PutMulti(c, chunkKeys(c, key, len(chunks)), chunks); err != nil {
+			return err
+		}
+	}
+	if _, err := datastore.Put(c, key, &blobEntity{blob.ContentType, len(chunks)}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get returns the file with the given name, if one exists.
+func (DatastoreStore) Get(c appengine.Context, name string) (*Blob, error) {
+	key := blobKey(c, name)
+	e := &blobEntity{}
+	switch err := datastore.Get(c, key, e); err {
+	case nil:
+		break
+	case datastore.ErrNoSuchEntity:
+		return nil, ErrBlobNotFound
+	default:
+		return nil, err
+	}
+	blob := &Blob{ContentType: e.ContentType}
+	if e.Chunks == 0 {
+		return blob, nil
+	}
+	chunks := make([]*chunkEntity, e.Chunks)
+	for i := range chunks {
+		chunks[i] = &chunkEntity{}
+	}
+	if err := datastore.GetMulti(c, chunkKeys(c, key, e.Chunks), chunks); err != nil {
+		return nil, err
+	}
+	for _, chunk := range chunks {
+		blob.Data = append(blob.Data, chunk.Data...)
+	}
+	return blob, nil
+}
+
+// Delete deletes the file with the given name, if one exists.
+func (DatastoreStore) Delete(c appengine.Context, name string) error {
+	key := blobKey(c, name)
+	e := &blobEntity{}
+	switch err := datastore.Get(c, key, e); err {
+	case nil:
+		break
+	case datastore.ErrNoSuchEntity:
+		return nil
+	default:
+		return err
+	}
+	if err := datastore.DeleteMulti(c, chunkKeys(c, key, e.Chunks)); err != nil {
+		return err
+	}
+	return datastore.Delete(c, key)
+}
+
+// A FileStore keeps files in a directory on the local filesystem, for
+// development. Each file's content type is kept alongside it.
+type FileStore struct {
+	Dir string
+}
+
+func (s FileStore) path(name string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(filepath.Clean("/"+name)))
+}
+
+// Put stores a file, replacing any file of the same name.
+func (s FileStore) Put(c appengine.Context, name string, blob *Blob) error {
+	p := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(p+".type", []byte(blob.ContentType), 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, blob.Data, 0644)
+}
+
+// Get returns the file with the given name, if one exists.
+func (s FileStore) Get(c appengine.Context, name string) (*Blob, error) {
+	p := s.path(name)
+	data, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	contentType, err := ioutil.ReadFile(p + ".type")
+	if err != nil {
+		return nil, err
+	}
+	return &Blob{string(contentType), data}, nil
+}
+
+// Delete deletes the file with the given name, if one exists.
+func (s FileStore) Delete(c appengine.Context, name string) error {
+	p := s.path(name)
+	for _, f := range []string{p, p + ".type"} {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
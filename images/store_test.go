@@ -0,0 +1,58 @@
+package images
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"appengine"
+	"appengine/aetest"
+)
+
+func testStore(t *testing.T, c appengine.Context, s Store) {
+	big := bytes.Repeat([]byte("0123456789"), chunkSize/4)
+	for i, blob := range []*Blob{
+		{"image/png", []byte("small")},
+		{"image/jpeg", big},
+		{"image/gif", nil},
+	} {
+		if err := s.Put(c, "1/original", blob); err != nil {
+			t.Fatalf("%d: failed to store blob: %s", i, err)
+		}
+		got, err := s.Get(c, "1/original")
+		if err != nil {
+			t.Fatalf("%d: failed to get blob: %s", i, err)
+		}
+		if got.ContentType != blob.ContentType || !bytes.Equal(got.Data, blob.Data) {
+			t.Errorf("%d: wrong blob: %q with %d bytes", i, got.ContentType, len(got.Data))
+		}
+	}
+	if err := s.Delete(c, "1/original"); err != nil {
+		t.Fatalf("Failed to delete blob: %s", err)
+	}
+	if _, err := s.Get(c, "1/original"); err != ErrBlobNotFound {
+		t.Errorf("Expected deleted blob; got %v", err)
+	}
+	if err := s.Delete(c, "1/original"); err != nil {
+		t.Errorf("Failed to delete missing blob: %s", err)
+	}
+}
+
+func TestDatastoreStore(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testStore(t, c, DatastoreStore{})
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testStore(t, nil, FileStore{Dir: dir})
+}
@@ -2,26 +2,36 @@ package innerhearth
 
 import (
 	"fmt"
-	"html/template"
 	"net/http"
+	"strings"
 	"time"
 
 	"appengine"
 
 	"github.com/decitrig/innerhearth/account"
+	"github.com/decitrig/innerhearth/apikeys"
 	"github.com/decitrig/innerhearth/auth"
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/config"
+	"github.com/decitrig/innerhearth/payments"
 	"github.com/decitrig/innerhearth/staff"
 	"github.com/decitrig/innerhearth/webapp"
 )
 
 var (
-	adminPage    = template.Must(template.ParseFiles("templates/base.html", "templates/admin/index.html"))
-	addStaffPage = template.Must(template.ParseFiles("templates/base.html", "templates/admin/add-staff.html"))
+	adminPage    = newPage("templates/admin/index.html", nil)
+	addStaffPage = newPage("templates/admin/add-staff.html", nil)
+	configPage   = newPage("templates/admin/config.html", nil)
+	apiKeysPage  = newPage("templates/admin/api-keys.html", nil)
+	paymentsPage = newPage("templates/admin/payments.html", nil)
 )
 
 func init() {
 	webapp.HandleFunc("/admin", userContextHandler(webapp.HandlerFunc(admin)))
 	webapp.HandleFunc("/admin/add-staff", userContextHandler(webapp.HandlerFunc(addStaff)))
+	webapp.HandleFunc("/admin/config", userContextHandler(webapp.HandlerFunc(editConfig)))
+	webapp.HandleFunc("/admin/api-keys", userContextHandler(webapp.HandlerFunc(apiKeys)))
+	webapp.HandleFunc("/admin/payments", userContextHandler(webapp.HandlerFunc(editPaymentSettings)))
 }
 
 func admin(w http.ResponseWriter, r *http.Request) *webapp.Error {
@@ -30,8 +40,13 @@ func admin(w http.ResponseWriter, r *http.Request) *webapp.Error {
 	if err != nil {
 		return webapp.InternalError(err)
 	}
+	settings, err := payments.GetSettings(c)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to load payment settings: %s", err))
+	}
 	data := map[string]interface{}{
-		"Staff": staff,
+		"Staff":          staff,
+		"OnlinePayments": settings.Processor() != nil,
 	}
 	if err := adminPage.Execute(w, data); err != nil {
 		return webapp.InternalError(err)
@@ -80,3 +95,210 @@ func addStaff(w http.ResponseWriter, r *http.Request) *webapp.Error {
 	}
 	return nil
 }
+
+func editConfig(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	adminAccount, ok := userContext(r)
+	if !ok {
+		return webapp.InternalError(fmt.Errorf("user not logged in"))
+	}
+	if r.Method == "POST" {
+		token, err := auth.TokenForRequest(c, adminAccount.ID, r.URL.Path)
+		if err != nil {
+			return webapp.UnauthorizedError(fmt.Errorf("didn't find an auth token"))
+		}
+		if !token.IsValid(r.FormValue(auth.TokenFieldName), time.Now()) {
+			return webapp.UnauthorizedError(fmt.Errorf("invalid auth token"))
+		}
+		cfg := &config.Config{
+			TimeZone:     r.FormValue("timezone"),
+			BaseURL:      strings.TrimRight(r.FormValue("baseurl"), "/"),
+			StudioName:   r.FormValue("studioname"),
+			ContactEmail: r.FormValue("contactemail"),
+			ContactPhone: r.FormValue("contactphone"),
+			Address:      strings.Replace(strings.TrimSpace(r.FormValue("address")), "\r\n", "\n", -1),
+			SenderEmail:  r.FormValue("senderemail"),
+			DateFormat:   r.FormValue("dateformat"),
+			TimeFormat:   r.FormValue("timeformat"),
+		}
+		if err := cfg.Validate(); err != nil {
+			return invalidData(w, fmt.Sprintf("Unknown time zone %q", cfg.TimeZone))
+		}
+		if err := cfg.Put(c); err != nil {
+			return webapp.InternalError(fmt.Errorf("failed to store config: %s", err))
+		}
+		token.Delete(c)
+		http.Redirect(w, r, "/admin", http.StatusSeeOther)
+		return nil
+	}
+	cfg, err := config.Get(c)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to load config: %s", err))
+	}
+	token, err := auth.NewToken(adminAccount.ID, r.URL.Path, time.Now())
+	if err != nil {
+		return webapp.InternalError(err)
+	}
+	if err := token.Store(c); err != nil {
+		return webapp.InternalError(err)
+	}
+	data := map[string]interface{}{
+		"Token":    token.Encode(),
+		"Config":   cfg,
+		"Defaults": config.Defaults(),
+	}
+	if err := configPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
+
+// editPaymentSettings sets up the processor which takes payment for
+// registrations. The secret key is never shown once it's stored; a
+// blank key leaves the stored one unchanged.
+func editPaymentSettings(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	adminAccount, ok := userContext(r)
+	if !ok {
+		return webapp.InternalError(fmt.Errorf("user not logged in"))
+	}
+	settings, err := payments.GetSettings(c)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to load payment settings: %s", err))
+	}
+	if r.Method == "POST" {
+		token, err := auth.TokenForRequest(c, adminAccount.ID, r.URL.Path)
+		if err != nil {
+			return webapp.UnauthorizedError(fmt.Errorf("didn't find an auth token"))
+		}
+		if !token.IsValid(r.FormValue(auth.TokenFieldName), time.Now()) {
+			return webapp.UnauthorizedError(fmt.Errorf("invalid auth token"))
+		}
+		switch r.FormValue("action") {
+		case "disable":
+			settings.StripeSecretKey = ""
+		default:
+			if key := strings.TrimSpace(r.FormValue("stripekey")); key != "" {
+				settings.StripeSecretKey = key
+			}
+			settings.Currency = r.FormValue("currency")
+		}
+		if err := settings.Put(c); err != nil {
+			return webapp.InternalError(fmt.Errorf("failed to store payment settings: %s", err))
+		}
+		c.Infof("%s changed the payment settings", adminAccount.Email)
+		token.Delete(c)
+		http.Redirect(w, r, "/admin", http.StatusSeeOther)
+		return nil
+	}
+	token, err := auth.NewToken(adminAccount.ID, r.URL.Path, time.Now())
+	if err != nil {
+		return webapp.InternalError(err)
+	}
+	if err := token.Store(c); err != nil {
+		return webapp.InternalError(err)
+	}
+	data := map[string]interface{}{
+		"Token":           token.Encode(),
+		"Configured":      settings.StripeSecretKey != "",
+		"Currency":        settings.Currency,
+		"DefaultCurrency": payments.DefaultCurrency,
+	}
+	if err := paymentsPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
+
+// createAPIKey creates a key for the staff or teacher account with the
+// email given in the form, returning the key and its credential.
+func createAPIKey(c appengine.Context, w http.ResponseWriter, r *http.Request, adminAccount *account.Account) (*apikeys.Key, string, *webapp.Error) {
+	acct, err := account.WithEmail(c, r.FormValue("email"))
+	if err != nil {
+		return nil, "", invalidData(w, fmt.Sprintf("No account found for %q", r.FormValue("email")))
+	}
+	_, staffErr := staff.WithID(c, acct.ID)
+	_, teacherErr := classes.TeacherWithID(c, acct.ID)
+	if staffErr != nil && teacherErr != nil {
+		return nil, "", invalidData(w, fmt.Sprintf("%s is neither staff nor a teacher", acct.Email))
+	}
+	scopes := []apikeys.Scope{}
+	for _, s := range apikeys.Scopes {
+		if r.FormValue(string(s)) != "" {
+			scopes = append(scopes, s)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, "", invalidData(w, "At least one scope must be granted")
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		return nil, "", missingFields(w)
+	}
+	key, credential, err := apikeys.New(name, acct.ID, adminAccount.Email, scopes, time.Now())
+	if err != nil {
+		return nil, "", webapp.InternalError(err)
+	}
+	if err := key.Put(c); err != nil {
+		return nil, "", webapp.InternalError(fmt.Errorf("failed to store API key: %s", err))
+	}
+	return key, credential, nil
+}
+
+func apiKeys(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	adminAccount, ok := userContext(r)
+	if !ok {
+		return webapp.InternalError(fmt.Errorf("user not logged in"))
+	}
+	data := map[string]interface{}{}
+	if r.Method == "POST" {
+		token, err := auth.TokenForRequest(c, adminAccount.ID, r.URL.Path)
+		if err != nil {
+			return webapp.UnauthorizedError(fmt.Errorf("didn't find an auth token"))
+		}
+		if !token.IsValid(r.FormValue(auth.TokenFieldName), time.Now()) {
+			return webapp.UnauthorizedError(fmt.Errorf("invalid auth token"))
+		}
+		switch r.FormValue("action") {
+		case "create":
+			key, credential, werr := createAPIKey(c, w, r, adminAccount)
+			if werr != nil {
+				return werr
+			}
+			c.Infof("%s created API key %s (%s)", adminAccount.Email, key.ID, key.Name)
+			data["Created"] = key
+			data["Credential"] = credential
+		case "revoke":
+			key, err := apikeys.WithID(c, r.FormValue("id"))
+			if err != nil {
+				return invalidData(w, "No such API key")
+			}
+			if err := key.Revoke(c, time.Now()); err != nil {
+				return webapp.InternalError(fmt.Errorf("failed to revoke API key %s: %s", key.ID, err))
+			}
+			c.Infof("%s revoked API key %s (%s)", adminAccount.Email, key.ID, key.Name)
+		default:
+			return badRequest(w, fmt.Sprintf("Unknown action %q", r.FormValue("action")))
+		}
+		token.Delete(c)
+	}
+	keys, err := apikeys.All(c)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to list API keys: %s", err))
+	}
+	token, err := auth.NewToken(adminAccount.ID, r.URL.Path, time.Now())
+	if err != nil {
+		return webapp.InternalError(err)
+	}
+	if err := token.Store(c); err != nil {
+		return webapp.InternalError(err)
+	}
+	data["Token"] = token.Encode()
+	data["Keys"] = keys
+	data["Scopes"] = apikeys.Scopes
+	if err := apiKeysPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
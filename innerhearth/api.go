@@ -0,0 +1,239 @@
+package innerhearth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"appengine"
+
+	"github.com/gorilla/mux"
+
+	"github.com/decitrig/innerhearth/account"
+	"github.com/decitrig/innerhearth/api"
+	"github.com/decitrig/innerhearth/apikeys"
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/config"
+	"github.com/decitrig/innerhearth/schedule"
+	"github.com/decitrig/innerhearth/staff"
+	"github.com/decitrig/innerhearth/students"
+	"github.com/decitrig/innerhearth/webapp"
+)
+
+func init() {
+	for url, fn := range map[string]webapp.HandlerFunc{
+		"/api/v1/sessions":            apiSessions,
+		"/api/v1/classes/{id:[0-9]+}": apiClass,
+		"/api/v1/teachers":            apiTeachers,
+		"/api/v1/yin-yogassage":       apiYinYogassage,
+	} {
+		webapp.HandleFunc(url, optionalAPIKeyHandler(apikeys.ReadSchedule, getOnly(fn)))
+	}
+	webapp.HandleFunc("/api/v1/classes/{id:[0-9]+}/roster",
+		apiKeyHandler(apikeys.ReadRosters, getOnly(apiRoster)))
+	webapp.HandleFunc("/api/v1/classes/{id:[0-9]+}/registrations",
+		apiKeyHandler(apikeys.WriteRegistrations, postOnly(apiRegister)))
+}
+
+// postOnly rejects requests which are not POST requests.
+func postOnly(fn webapp.HandlerFunc) webapp.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) *webapp.Error {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			webapp.JSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return nil
+		}
+		return fn(w, r)
+	}
+}
+
+// getOnly rejects requests which are not GET or HEAD requests.
+func getOnly(fn webapp.HandlerFunc) webapp.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) *webapp.Error {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.Header().Set("Allow", "GET, HEAD")
+			webapp.JSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return nil
+		}
+		return fn(w, r)
+	}
+}
+
+// apiClassView returns the API view of a class, with its remaining
+// capacity as of now. Remaining capacity changes with every
+// registration, so responses which include it are validated by ETag
+// only, without a Last-Modified time.
+func apiClassView(c appengine.Context, class *classes.Class, teacher *classes.Teacher, now time.Time) *api.Class {
+	registered := len(students.In(c, class, now))
+	return api.NewClass(class, teacher, registered, config.Current().Location())
+}
+
+func apiSessions(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	now := time.Now()
+	sched := schedule.Get(c, scheduleCache, now)
+	loc := config.Current().Location()
+	sessions := []*api.Session{}
+	for _, s := range sched.Sessions {
+		classList := make([]*api.Class, len(s.Classes))
+		for i, class := range s.Classes {
+			classList[i] = apiClassView(c, class, s.TeachersByClass[class.ID], now)
+		}
+		sessions = append(sessions, api.NewSession(s.Session, classList, loc))
+	}
+	return webapp.WriteJSON(w, r, map[string]interface{}{"sessions": sessions}, time.Time{})
+}
+
+// apiClassFromPath returns the class named in the request path. If
+// the class can't be found, an error response is written and the
+// returned class is nil.
+func apiClassFromPath(w http.ResponseWriter, r *http.Request) (*classes.Class, *webapp.Error) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		webapp.JSONError(w, http.StatusBadRequest, "invalid class ID")
+		return nil, nil
+	}
+	c := appengine.NewContext(r)
+	class, err := classes.ClassWithID(c, id)
+	switch err {
+	case nil:
+		return class, nil
+	case classes.ErrClassNotFound:
+		webapp.JSONError(w, http.StatusNotFound, "no such class")
+		return nil, nil
+	default:
+		return nil, webapp.InternalError(fmt.Errorf("failed to find class %d: %s", id, err))
+	}
+}
+
+func apiClass(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	class, err := apiClassFromPath(w, r)
+	if class == nil {
+		return err
+	}
+	c := appengine.NewContext(r)
+	return webapp.WriteJSON(w, r, apiClassView(c, class, class.TeacherEntity(c), time.Now()), time.Time{})
+}
+
+// apiCanViewRoster checks that the account using the request's API
+// key may see the roster of a class, as for the HTML roster page.
+func apiCanViewRoster(c appengine.Context, r *http.Request, class *classes.Class) bool {
+	acct, ok := userContext(r)
+	if !ok {
+		return false
+	}
+	staffer, _ := staff.WithID(c, acct.ID)
+	return canViewRoster(staffer, acct, class.TeacherEntity(c))
+}
+
+func apiRoster(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	class, err := apiClassFromPath(w, r)
+	if class == nil {
+		return err
+	}
+	c := appengine.NewContext(r)
+	if !apiCanViewRoster(c, r, class) {
+		webapp.JSONError(w, http.StatusForbidden, "only staff or the class's teacher may view its roster")
+		return nil
+	}
+	loc := config.Current().Location()
+	roster := []*api.Student{}
+	for _, s := range rosterFor(c, class, time.Now()) {
+		roster = append(roster, api.NewStudent(s, loc))
+	}
+	return webapp.WriteJSON(w, r, map[string]interface{}{
+		"class":    apiClassView(c, class, class.TeacherEntity(c), time.Now()),
+		"students": roster,
+	}, time.Time{})
+}
+
+func apiRegister(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	class, werr := apiClassFromPath(w, r)
+	if class == nil {
+		return werr
+	}
+	c := appengine.NewContext(r)
+	if !apiCanViewRoster(c, r, class) {
+		webapp.JSONError(w, http.StatusForbidden, "only staff or the class's teacher may register students")
+		return nil
+	}
+	reg := &api.Registration{}
+	if err := json.NewDecoder(r.Body).Decode(reg); err != nil {
+		webapp.JSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return nil
+	}
+	loc := config.Current().Location()
+	date, err := reg.Validate(loc)
+	if err != nil {
+		webapp.JSONError(w, http.StatusBadRequest, err.Error())
+		return nil
+	}
+	offering := class.Workshop != 0 || class.Series != 0 || class.YinYogassage != 0
+	if reg.DropIn && !offering && date.Weekday() != class.Weekday {
+		webapp.JSONError(w, http.StatusBadRequest, fmt.Sprintf("%s does not meet on %s", class.Title, reg.Date))
+		return nil
+	}
+	info := account.Info{
+		FirstName: reg.FirstName,
+		LastName:  reg.LastName,
+		Email:     reg.Email,
+		Phone:     reg.Phone,
+	}
+	// Students in workshops, series and Yin Yogassage classes are
+	// registered under the offering's own rules.
+	student, err := paperStudent(c, class, info, reg.DropIn, date, time.Now())
+	if msg, ok := err.(offeringClosed); ok {
+		webapp.JSONError(w, http.StatusConflict, string(msg))
+		return nil
+	} else if err != nil {
+		return webapp.InternalError(err)
+	}
+	setPrice(c, student, class, time.Now())
+	switch err := student.Add(c, time.Now()); err {
+	case nil:
+		break
+	case students.ErrAlreadyRegistered:
+		// Registering is idempotent; a client retrying a request gets
+		// back the registration it already made.
+		existing, err := students.WithIDInClass(c, student.ID, class, time.Now())
+		if err != nil {
+			return webapp.InternalError(fmt.Errorf("failed to find existing student %q in %d: %s", student.ID, class.ID, err))
+		}
+		return webapp.WriteJSONStatus(w, http.StatusOK, api.NewStudent(existing, loc))
+	case students.ErrClassIsFull:
+		webapp.JSONError(w, http.StatusConflict, "class is full")
+		return nil
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to write student: %s", err))
+	}
+	if key, ok := apiKeyContext(r); ok {
+		c.Infof("API key %s (%s) registered %q in class %d", key.ID, key.Name, student.Email, class.ID)
+	}
+	return webapp.WriteJSONStatus(w, http.StatusCreated, api.NewStudent(student, loc))
+}
+
+func apiTeachers(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	sched := schedule.Get(c, scheduleCache, time.Now())
+	teacherList := classes.Teachers(c)
+	sort.Sort(classes.TeachersByName(teacherList))
+	teachers := make([]*api.Teacher, len(teacherList))
+	for i, t := range teacherList {
+		teachers[i] = api.NewTeacher(t)
+	}
+	return webapp.WriteJSON(w, r, map[string]interface{}{"teachers": teachers}, sched.Generated)
+}
+
+func apiYinYogassage(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	sched := schedule.Get(c, scheduleCache, time.Now())
+	loc := config.Current().Location()
+	yins := make([]*api.YinYogassage, len(sched.YinYogassage))
+	for i, yin := range sched.YinYogassage {
+		yins[i] = api.NewYinYogassage(yin, loc)
+	}
+	return webapp.WriteJSON(w, r, map[string]interface{}{"yinYogassage": yins}, sched.Generated)
+}
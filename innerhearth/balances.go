@@ -0,0 +1,166 @@
+package innerhearth
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/decitrig/innerhearth/auth"
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/pricing"
+	"github.com/decitrig/innerhearth/staff"
+	"github.com/decitrig/innerhearth/students"
+	"github.com/decitrig/innerhearth/webapp"
+)
+
+var (
+	balancesPage = newPage("templates/staff/balances.html", nil)
+)
+
+func init() {
+	webapp.HandleFunc("/roster/payment", userContextHandler(webapp.HandlerFunc(recordPayment)))
+}
+
+func parsePaymentMethod(s string) (students.PaymentMethod, bool) {
+	for _, m := range students.PaymentMethods {
+		if string(m) == s {
+			return m, true
+		}
+	}
+	return "", false
+}
+
+// recordPayment records a payment made at the front desk towards a
+// student's registration.
+func recordPayment(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Method not allowed")
+		return nil
+	}
+	c := appengine.NewContext(r)
+	acct, ok := userContext(r)
+	if !ok {
+		return badRequest(w, "Must be logged in.")
+	}
+	id, err := strconv.ParseInt(r.FormValue("class"), 10, 64)
+	if err != nil {
+		return invalidData(w, "Invalid class ID")
+	}
+	class, err := classes.ClassWithID(c, id)
+	if err != nil {
+		return invalidData(w, "No such class.")
+	}
+	staffer, _ := staff.WithID(c, acct.ID)
+	if !canViewRoster(staffer, acct, class.TeacherEntity(c)) {
+		return webapp.UnauthorizedError(fmt.Errorf("only staff or teachers can record payments"))
+	}
+	token, ok := checkToken(c, acct.ID, r.URL.Path, r.FormValue(auth.TokenFieldName))
+	if !ok {
+		return webapp.UnauthorizedError(fmt.Errorf("Invalid auth token"))
+	}
+	amount, err := pricing.ParseCents(r.FormValue("amount"))
+	if err != nil {
+		return invalidData(w, "Invalid amount; please enter dollars, e.g. 15 or 12.50")
+	}
+	method, ok := parsePaymentMethod(r.FormValue("method"))
+	if !ok {
+		return invalidData(w, "Unknown payment method")
+	}
+	now := time.Now()
+	// The registration is updated in a transaction, as online payments
+	// and cancellations may be updating it at the same time.
+	var student *students.Student
+	var previous pricing.Cents
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var err error
+		student, err = students.WithIDInClass(c, r.FormValue("student"), class, now)
+		if err != nil {
+			return err
+		}
+		previous = student.AmountPaid
+		student.RecordPayment(amount, method, acct.Email, now)
+		return student.Put(c)
+	}, nil)
+	switch err {
+	case nil:
+		break
+	case students.ErrStudentNotFound:
+		return invalidData(w, "No such student")
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to record payment for %q in %d: %s", r.FormValue("student"), class.ID, err))
+	}
+	recordDeskOrder(c, student, class, previous, amount, method, now)
+	c.Infof("%s recorded %s payment of %s for %q in %d", acct.Email, method, amount, student.Email, class.ID)
+	token.Delete(c)
+	http.Redirect(w, r, fmt.Sprintf("/roster?class=%d", class.ID), http.StatusSeeOther)
+	return nil
+}
+
+// classBalances is a class together with those of its students who
+// have not paid in full.
+type classBalances struct {
+	Class    *classes.Class
+	Teacher  *classes.Teacher
+	Students []*students.Student
+	Total    pricing.Cents
+}
+
+// balances shows the outstanding balance of every registration in a
+// session.
+func balances(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	id, err := strconv.ParseInt(r.FormValue("session"), 10, 64)
+	if err != nil {
+		return invalidData(w, "Couldn't parse session ID")
+	}
+	session, err := classes.SessionWithID(c, id)
+	switch err {
+	case nil:
+		break
+	case classes.ErrSessionNotFound:
+		return invalidData(w, "No such session")
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to find session %d: %s", id, err))
+	}
+	classList := session.Classes(c)
+	sort.Sort(classes.ClassesByStartTime(classList))
+	teachers := classes.TeachersByClass(c, classList)
+	now := time.Now()
+	report := []*classBalances{}
+	var total pricing.Cents
+	unpriced := 0
+	for _, class := range classList {
+		cb := &classBalances{Class: class, Teacher: teachers[class.ID]}
+		for _, s := range rosterFor(c, class, now) {
+			if s.PaymentStatus() == students.Paid {
+				continue
+			}
+			if !s.Priced {
+				unpriced++
+			}
+			cb.Students = append(cb.Students, s)
+			cb.Total += s.Balance()
+		}
+		if len(cb.Students) == 0 {
+			continue
+		}
+		total += cb.Total
+		report = append(report, cb)
+	}
+	data := map[string]interface{}{
+		"Session":  session,
+		"Classes":  report,
+		"Total":    total,
+		"Unpriced": unpriced,
+	}
+	if err := balancesPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
@@ -0,0 +1,592 @@
+package innerhearth
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+
+	"github.com/decitrig/innerhearth/account"
+	"github.com/decitrig/innerhearth/auth"
+	"github.com/decitrig/innerhearth/bookings"
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/config"
+	"github.com/decitrig/innerhearth/staff"
+	"github.com/decitrig/innerhearth/webapp"
+)
+
+var (
+	privatesGroupsPage  = newPage("templates/privates-groups.html", nil)
+	accountBookingsPage = newPage("templates/account/bookings.html", nil)
+	manageBookingsPage  = newPage("templates/manage-bookings.html", template.FuncMap{
+		"TeacherHasEmail": teacherHasEmail,
+	})
+	availabilityPage = newPage("templates/availability.html", template.FuncMap{
+		"WeekdayAsInt":  weekdayAsInt,
+		"WeekdayEquals": weekdayEquals,
+		"Minutes":       minutes,
+		"FormatLocal":   formatLocal,
+	})
+	bookingSlotsPage = newPage("templates/booking-slots.html", nil)
+)
+
+// Students may book open slots with teachers from bookingNotice until
+// bookingHorizon from now.
+const (
+	bookingNotice  = 24 * time.Hour
+	bookingHorizon = 14 * 24 * time.Hour
+)
+
+// bookingLengths are the lengths, in minutes, of the slots which
+// students may book directly.
+var bookingLengths = []int{30, 60}
+
+func init() {
+	webapp.HandleFunc("/privates-groups", privatesGroups)
+	webapp.HandleFunc("/bookings", userContextHandler(webapp.HandlerFunc(accountBookings)))
+	webapp.HandleFunc("/bookings/request", userContextHandler(webapp.HandlerFunc(requestBooking)))
+	webapp.HandleFunc("/bookings/manage", userContextHandler(webapp.HandlerFunc(manageBookings)))
+	webapp.HandleFunc("/bookings/availability", userContextHandler(webapp.HandlerFunc(teacherAvailability)))
+	webapp.HandleFunc("/bookings/slots", bookingSlots)
+	webapp.HandleFunc("/bookings/book", userContextHandler(webapp.HandlerFunc(bookSlot)))
+}
+
+// bookingEntry is a booking together with its teacher, for display.
+type bookingEntry struct {
+	*bookings.Booking
+	Teacher *classes.Teacher
+}
+
+func bookingEntries(c appengine.Context, list []*bookings.Booking) []*bookingEntry {
+	entries := make([]*bookingEntry, len(list))
+	for i, b := range list {
+		entries[i] = &bookingEntry{b, b.TeacherEntity(c)}
+	}
+	return entries
+}
+
+// privatesGroups describes private and group lessons, and lets
+// logged-in users request one.
+func privatesGroups(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	teachers := classes.Teachers(c)
+	bookable := []*classes.Teacher{}
+	for _, t := range teachers {
+		if len(t.Availability) > 0 {
+			bookable = append(bookable, t)
+		}
+	}
+	data := map[string]interface{}{
+		"Kinds":    bookings.Kinds,
+		"Teachers": teachers,
+		"Bookable": bookable,
+		"Page":     pageContent(c, "privates-groups"),
+	}
+	if u := user.Current(c); u != nil {
+		if acct, err := maybeOldAccount(c, u); err == nil {
+			data["User"] = acct
+			token, err := storeNewToken(c, acct.ID, "/bookings/request")
+			if err != nil {
+				return webapp.InternalError(fmt.Errorf("failed to store token: %s", err))
+			}
+			data["Token"] = token.Encode()
+		}
+	}
+	if err := privatesGroupsPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
+
+// requestBooking stores a new booking request from the current user.
+func requestBooking(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Method not allowed")
+		return nil
+	}
+	c := appengine.NewContext(r)
+	acct, ok := userContext(r)
+	if !ok {
+		return badRequest(w, "Must be logged in.")
+	}
+	token, ok := checkToken(c, acct.ID, r.URL.Path, r.FormValue(auth.TokenFieldName))
+	if !ok {
+		return webapp.UnauthorizedError(fmt.Errorf("Invalid auth token"))
+	}
+	size, err := strconv.ParseInt(r.FormValue("size"), 10, 32)
+	if err != nil {
+		return invalidData(w, "Please enter how many people will attend.")
+	}
+	var teacher *datastore.Key
+	if email := r.FormValue("teacher"); email != "" {
+		t, err := classes.TeacherWithEmail(c, email)
+		if err != nil {
+			return invalidData(w, "Invalid teacher selected")
+		}
+		teacher = t.Key(c)
+	}
+	times := strings.TrimSpace(r.FormValue("times"))
+	notes := strings.TrimSpace(r.FormValue("notes"))
+	b := bookings.New(acct, bookings.Kind(r.FormValue("kind")), int32(size), teacher, times, notes, time.Now())
+	switch err := b.Insert(c); err {
+	case nil:
+		break
+	case bookings.ErrInvalidBooking:
+		return invalidData(w, "Please choose what you'd like to book, how many people will attend and when you're available.")
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to store booking for %q: %s", acct.Email, err))
+	}
+	c.Infof("%s requested booking %d", acct.Email, b.ID)
+	token.Delete(c)
+	http.Redirect(w, r, "/bookings", http.StatusSeeOther)
+	return nil
+}
+
+// accountBookings lists the current user's booking requests and lets
+// them accept proposed times.
+func accountBookings(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	acct, ok := userContext(r)
+	if !ok {
+		return badRequest(w, "Must be logged in.")
+	}
+	if r.Method == "POST" {
+		token, ok := checkToken(c, acct.ID, r.URL.Path, r.FormValue(auth.TokenFieldName))
+		if !ok {
+			return webapp.UnauthorizedError(fmt.Errorf("Invalid auth token"))
+		}
+		b, werr := bookingForRequest(w, r)
+		if b == nil {
+			return werr
+		}
+		if b.AccountID != acct.ID {
+			return webapp.UnauthorizedError(fmt.Errorf("%s may not accept booking %d", acct.Email, b.ID))
+		}
+		switch err := b.Confirm("", acct.Email, time.Now()); err {
+		case nil:
+			break
+		case bookings.ErrNotProposed, bookings.ErrBookingClosed:
+			return invalidData(w, "This booking has no time waiting to be accepted.")
+		default:
+			return webapp.InternalError(err)
+		}
+		if err := b.Update(c); err != nil {
+			return webapp.InternalError(fmt.Errorf("failed to update booking %d: %s", b.ID, err))
+		}
+		c.Infof("%s accepted booking %d", acct.Email, b.ID)
+		token.Delete(c)
+		http.Redirect(w, r, "/bookings", http.StatusSeeOther)
+		return nil
+	}
+	list, err := bookings.ForAccount(c, acct.ID)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to find bookings for %q: %s", acct.ID, err))
+	}
+	token, err := storeNewToken(c, acct.ID, r.URL.Path)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to store token: %s", err))
+	}
+	data := map[string]interface{}{
+		"Token":    token.Encode(),
+		"Bookings": bookingEntries(c, list),
+	}
+	if err := accountBookingsPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
+
+// bookingForRequest returns the booking named by the request's id
+// field. If the booking can't be found, writes an error and returns a
+// nil booking.
+func bookingForRequest(w http.ResponseWriter, r *http.Request) (*bookings.Booking, *webapp.Error) {
+	c := appengine.NewContext(r)
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		return nil, invalidData(w, "Couldn't parse booking ID")
+	}
+	switch b, err := bookings.WithID(c, id); err {
+	case nil:
+		return b, nil
+	case bookings.ErrBookingNotFound:
+		return nil, invalidData(w, "No such booking")
+	default:
+		return nil, webapp.InternalError(fmt.Errorf("failed to find booking %d: %s", id, err))
+	}
+}
+
+// canManageBooking returns whether an account may propose times for,
+// confirm or decline a booking. Staff may manage any booking; teachers
+// may manage the bookings which have asked for them.
+func canManageBooking(c appengine.Context, s *staff.Staff, teacher *classes.Teacher, b *bookings.Booking) bool {
+	if s != nil {
+		return true
+	}
+	return teacher != nil && b.Teacher != nil && b.Teacher.Equal(teacher.Key(c))
+}
+
+// manageBookings lists open booking requests and upcoming bookings for
+// staff, or for a teacher those which have asked for them, and takes
+// staff and teachers through proposing times, confirming and
+// declining.
+func manageBookings(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	acct, ok := userContext(r)
+	if !ok {
+		return badRequest(w, "Must be logged in.")
+	}
+	staffer, _ := staff.WithID(c, acct.ID)
+	teacher, _ := classes.TeacherForUser(c, acct)
+	if staffer == nil && teacher == nil {
+		return webapp.UnauthorizedError(fmt.Errorf("only staff or teachers can manage bookings"))
+	}
+	if r.Method == "POST" {
+		token, ok := checkToken(c, acct.ID, r.URL.Path, r.FormValue(auth.TokenFieldName))
+		if !ok {
+			return webapp.UnauthorizedError(fmt.Errorf("Invalid auth token"))
+		}
+		b, werr := bookingForRequest(w, r)
+		if b == nil {
+			return werr
+		}
+		if !canManageBooking(c, staffer, teacher, b) {
+			return webapp.UnauthorizedError(fmt.Errorf("%s may not manage booking %d", acct.Email, b.ID))
+		}
+		if werr := updateBooking(w, r, acct, staffer, teacher, b); werr != nil {
+			return werr
+		}
+		if err := b.Update(c); err != nil {
+			return webapp.InternalError(fmt.Errorf("failed to update booking %d: %s", b.ID, err))
+		}
+		c.Infof("%s marked booking %d %s", acct.Email, b.ID, b.Status)
+		token.Delete(c)
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return nil
+	}
+	now := time.Now()
+	var open, upcoming []*bookings.Booking
+	if staffer != nil {
+		var err error
+		if open, err = bookings.Open(c); err != nil {
+			return webapp.InternalError(fmt.Errorf("failed to find open bookings: %s", err))
+		}
+		if upcoming, err = bookings.Upcoming(c, now); err != nil {
+			return webapp.InternalError(fmt.Errorf("failed to find upcoming bookings: %s", err))
+		}
+	} else {
+		all, err := bookings.ForTeacher(c, teacher)
+		if err != nil {
+			return webapp.InternalError(fmt.Errorf("failed to find bookings for %q: %s", teacher.ID, err))
+		}
+		for _, b := range all {
+			if !b.Closed() {
+				open = append(open, b)
+			}
+		}
+		if upcoming, err = bookings.UpcomingForTeacher(c, teacher, now); err != nil {
+			return webapp.InternalError(fmt.Errorf("failed to find upcoming bookings for %q: %s", teacher.ID, err))
+		}
+	}
+	token, err := storeNewToken(c, acct.ID, r.URL.Path)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to store token: %s", err))
+	}
+	data := map[string]interface{}{
+		"Token":    token.Encode(),
+		"Open":     bookingEntries(c, open),
+		"Upcoming": bookingEntries(c, upcoming),
+		"IsStaff":  staffer != nil,
+		"Teachers": classes.Teachers(c),
+	}
+	if err := manageBookingsPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
+
+// updateBooking applies the action in a staff or teacher's form to a
+// booking. The booking must be Updated for the change to be stored.
+func updateBooking(w http.ResponseWriter, r *http.Request, acct *account.Account, staffer *staff.Staff, teacher *classes.Teacher, b *bookings.Booking) *webapp.Error {
+	c := appengine.NewContext(r)
+	message := strings.TrimSpace(r.FormValue("message"))
+	now := time.Now()
+	var err error
+	switch r.FormValue("action") {
+	case "propose":
+		start, length, perr := parseSlot(r.FormValue("date"), r.FormValue("start"), r.FormValue("length"))
+		if perr != nil {
+			return invalidData(w, fmt.Sprintf("Invalid time: %s", perr))
+		}
+		// Teachers propose times for themselves; staff may offer the
+		// booking to any teacher.
+		var key *datastore.Key
+		if staffer == nil {
+			key = teacher.Key(c)
+		} else if email := r.FormValue("teacher"); email != "" {
+			t, terr := classes.TeacherWithEmail(c, email)
+			if terr != nil {
+				return invalidData(w, "Invalid teacher selected")
+			}
+			key = t.Key(c)
+		}
+		err = b.Propose(key, start, length, message, acct.Email, now)
+	case "confirm":
+		err = b.Confirm(message, acct.Email, now)
+	case "decline":
+		err = b.Decline(message, acct.Email, now)
+	default:
+		return invalidData(w, "Unknown action")
+	}
+	switch err {
+	case nil:
+		return nil
+	case bookings.ErrBookingClosed:
+		return invalidData(w, "This booking has already been confirmed or declined.")
+	case bookings.ErrPastStart:
+		return invalidData(w, "The proposed time has already passed.")
+	case bookings.ErrNotProposed:
+		return invalidData(w, "Please propose a time before confirming the booking.")
+	default:
+		return webapp.InternalError(err)
+	}
+}
+
+// parseAvailability sets a teacher's weekly availability and blackout
+// dates from a form.
+func parseAvailability(r *http.Request, teacher *classes.Teacher, now time.Time) error {
+	days, starts, lengths := r.Form["windowday"], r.Form["windowstart"], r.Form["windowlength"]
+	if len(starts) != len(days) || len(lengths) != len(days) {
+		return fmt.Errorf("missing fields")
+	}
+	windows := []classes.Window{}
+	for i, day := range days {
+		if starts[i] == "" {
+			continue
+		}
+		weekday, err := strconv.Atoi(day)
+		if err != nil || weekday < 0 || weekday > 6 {
+			return fmt.Errorf("invalid day")
+		}
+		start, err := parseLocalTime(starts[i])
+		if err != nil {
+			return fmt.Errorf("invalid start time %q; please use e.g. 9:00am", starts[i])
+		}
+		length, err := parseMinutes(lengths[i])
+		if err != nil {
+			return fmt.Errorf("invalid length %q", lengths[i])
+		}
+		windows = append(windows, classes.Window{
+			Weekday:   time.Weekday(weekday),
+			StartTime: start,
+			Length:    length,
+		})
+	}
+	blackouts := []time.Time{}
+	for _, line := range strings.Split(r.FormValue("blackouts"), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		date, err := parseLocalDate(line)
+		if err != nil {
+			return fmt.Errorf("invalid blackout date %q; please use mm/dd/yyyy", line)
+		}
+		// Dates which have passed no longer matter.
+		if date.AddDate(0, 0, 1).After(now) {
+			blackouts = append(blackouts, date)
+		}
+	}
+	teacher.Availability = windows
+	teacher.Blackouts = blackouts
+	return nil
+}
+
+// teacherAvailability shows and sets when a teacher is available for
+// private bookings.
+func teacherAvailability(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	acct, ok := userContext(r)
+	if !ok {
+		return badRequest(w, "Must be logged in.")
+	}
+	teacher, werr := teacherForEditing(w, r, acct)
+	if teacher == nil {
+		return werr
+	}
+	if r.Method == "POST" {
+		token, ok := checkToken(c, acct.ID, r.URL.Path, r.FormValue(auth.TokenFieldName))
+		if !ok {
+			return webapp.UnauthorizedError(fmt.Errorf("Invalid auth token"))
+		}
+		if err := parseAvailability(r, teacher, time.Now()); err != nil {
+			return invalidData(w, fmt.Sprintf("Invalid availability: %s", err))
+		}
+		if err := teacher.Put(c); err != nil {
+			return webapp.InternalError(fmt.Errorf("failed to store availability for %q: %s", teacher.ID, err))
+		}
+		c.Infof("%s updated availability for %q", acct.Email, teacher.ID)
+		token.Delete(c)
+		http.Redirect(w, r, fmt.Sprintf("/bookings/availability?teacher=%s", teacher.ID), http.StatusSeeOther)
+		return nil
+	}
+	token, err := storeNewToken(c, acct.ID, r.URL.Path)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to store token: %s", err))
+	}
+	data := map[string]interface{}{
+		"Token":      token.Encode(),
+		"Teacher":    teacher,
+		"Weekdays":   daysInOrder,
+		"NewWindows": []int{1, 2, 3},
+	}
+	if err := availabilityPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
+
+// slotDay is the open slots on a single day, for display.
+type slotDay struct {
+	Date  time.Time
+	Slots []classes.Occurrence
+}
+
+func slotsByDay(slots []classes.Occurrence, loc *time.Location) []*slotDay {
+	days := []*slotDay{}
+	for _, slot := range slots {
+		y, m, d := slot.Start.In(loc).Date()
+		if n := len(days); n > 0 {
+			if dy, dm, dd := days[n-1].Date.In(loc).Date(); dy == y && dm == m && dd == d {
+				days[n-1].Slots = append(days[n-1].Slots, slot)
+				continue
+			}
+		}
+		days = append(days, &slotDay{slot.Start, []classes.Occurrence{slot}})
+	}
+	return days
+}
+
+// parseBookingLength returns the slot length named in a request, which
+// must be one of bookingLengths; defaults to the longest.
+func parseBookingLength(r *http.Request) (time.Duration, bool) {
+	s := r.FormValue("length")
+	if s == "" {
+		return time.Duration(bookingLengths[len(bookingLengths)-1]) * time.Minute, true
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, false
+	}
+	for _, l := range bookingLengths {
+		if n == l {
+			return time.Duration(n) * time.Minute, true
+		}
+	}
+	return 0, false
+}
+
+// bookingSlots shows a teacher's open slots, which logged-in users may
+// book directly.
+func bookingSlots(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	teacher, err := classes.TeacherWithID(c, r.FormValue("teacher"))
+	if err != nil {
+		return invalidData(w, "No such teacher")
+	}
+	length, ok := parseBookingLength(r)
+	if !ok {
+		return invalidData(w, "Invalid length")
+	}
+	loc := config.Current().Location()
+	now := time.Now()
+	slots, err := bookings.OpenSlots(c, teacher, now.Add(bookingNotice), now.Add(bookingHorizon), length, loc)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to find open slots for %q: %s", teacher.ID, err))
+	}
+	data := map[string]interface{}{
+		"Teacher": teacher,
+		"Days":    slotsByDay(slots, loc),
+		"Lengths": bookingLengths,
+		"Length":  int(length.Minutes()),
+		"Kinds":   []bookings.Kind{bookings.Private, bookings.SmallGroup},
+	}
+	if u := user.Current(c); u != nil {
+		if acct, err := maybeOldAccount(c, u); err == nil {
+			data["User"] = acct
+			token, err := storeNewToken(c, acct.ID, "/bookings/book")
+			if err != nil {
+				return webapp.InternalError(fmt.Errorf("failed to store token: %s", err))
+			}
+			data["Token"] = token.Encode()
+		}
+	}
+	if err := bookingSlotsPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
+
+// bookSlot books the current user into one of a teacher's open slots.
+func bookSlot(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Method not allowed")
+		return nil
+	}
+	c := appengine.NewContext(r)
+	acct, ok := userContext(r)
+	if !ok {
+		return badRequest(w, "Must be logged in.")
+	}
+	token, ok := checkToken(c, acct.ID, r.URL.Path, r.FormValue(auth.TokenFieldName))
+	if !ok {
+		return webapp.UnauthorizedError(fmt.Errorf("Invalid auth token"))
+	}
+	teacher, err := classes.TeacherWithID(c, r.FormValue("teacher"))
+	if err != nil {
+		return invalidData(w, "No such teacher")
+	}
+	length, ok := parseBookingLength(r)
+	if !ok {
+		return invalidData(w, "Invalid length")
+	}
+	unix, err := strconv.ParseInt(r.FormValue("slot"), 10, 64)
+	if err != nil {
+		return invalidData(w, "Please choose a time.")
+	}
+	now := time.Now()
+	start := time.Unix(unix, 0)
+	if start.Before(now.Add(bookingNotice)) {
+		return invalidData(w, "That time is too soon to book online; please contact the studio.")
+	}
+	size, err := strconv.ParseInt(r.FormValue("size"), 10, 32)
+	if err != nil {
+		return invalidData(w, "Please enter how many people will attend.")
+	}
+	kind := bookings.Kind(r.FormValue("kind"))
+	if kind != bookings.Private && kind != bookings.SmallGroup {
+		return invalidData(w, "Only private and small group lessons can be booked online.")
+	}
+	b := bookings.New(acct, kind, int32(size), nil, "", strings.TrimSpace(r.FormValue("notes")), now)
+	slot := classes.Occurrence{Start: start, End: start.Add(length)}
+	switch err := b.Reserve(c, teacher, slot, config.Current().Location(), now); err {
+	case nil:
+		break
+	case bookings.ErrSlotTaken:
+		return invalidData(w, "Sorry, that time is no longer available; please choose another.")
+	case bookings.ErrInvalidBooking:
+		return invalidData(w, "Please enter how many people will attend.")
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to book %q with %q: %s", acct.Email, teacher.ID, err))
+	}
+	c.Infof("%s booked %d with %q", acct.Email, b.ID, teacher.ID)
+	token.Delete(c)
+	http.Redirect(w, r, "/bookings", http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,99 @@
+package innerhearth
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"appengine"
+
+	"github.com/gorilla/mux"
+
+	"github.com/decitrig/innerhearth/auth"
+	"github.com/decitrig/innerhearth/config"
+	"github.com/decitrig/innerhearth/feeds"
+	"github.com/decitrig/innerhearth/ical"
+	"github.com/decitrig/innerhearth/schedule"
+	"github.com/decitrig/innerhearth/webapp"
+)
+
+var (
+	calendarPage = newPage("templates/account/calendar.html", nil)
+)
+
+func init() {
+	webapp.HandleFunc("/calendar.ics", studioCalendar)
+	webapp.HandleFunc("/calendar/{token:[A-Za-z0-9_=-]+}.ics", accountCalendar)
+	webapp.HandleFunc("/account/calendar", userContextHandler(webapp.HandlerFunc(calendarLink)))
+}
+
+func writeCalendar(w http.ResponseWriter, cal *ical.Calendar, now time.Time) *webapp.Error {
+	w.Header().Set("Content-Type", ical.ContentType)
+	if err := cal.Write(w, now); err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to write calendar: %s", err))
+	}
+	return nil
+}
+
+func studioCalendar(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	now := time.Now()
+	sched := schedule.Get(c, scheduleCache, now)
+	return writeCalendar(w, feeds.Studio(sched, now, config.Current()), now)
+}
+
+func accountCalendar(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	token, err := feeds.WithToken(c, mux.Vars(r)["token"])
+	switch err {
+	case nil:
+		break
+	case feeds.ErrTokenNotFound:
+		http.NotFound(w, r)
+		return nil
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to look up feed token: %s", err))
+	}
+	now := time.Now()
+	return writeCalendar(w, feeds.ForAccount(c, token.AccountID, now, config.Current()), now)
+}
+
+// calendarLink shows the current user the private address of their
+// calendar feed, creating it the first time it's asked for. Posting
+// replaces the address with a new one.
+func calendarLink(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	acct, ok := userContext(r)
+	if !ok {
+		return badRequest(w, "Must be logged in.")
+	}
+	if r.Method == "POST" {
+		token, ok := checkToken(c, acct.ID, r.URL.Path, r.FormValue(auth.TokenFieldName))
+		if !ok {
+			return webapp.UnauthorizedError(fmt.Errorf("Invalid auth token"))
+		}
+		if _, err := feeds.ResetToken(c, acct.ID, time.Now()); err != nil {
+			return webapp.InternalError(fmt.Errorf("failed to reset calendar feed for %q: %s", acct.ID, err))
+		}
+		c.Infof("%s reset their calendar feed", acct.Email)
+		token.Delete(c)
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return nil
+	}
+	feedToken, err := feeds.TokenForAccount(c, acct.ID, time.Now())
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to get calendar feed for %q: %s", acct.ID, err))
+	}
+	token, err := storeNewToken(c, acct.ID, r.URL.Path)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to store token: %s", err))
+	}
+	data := map[string]interface{}{
+		"Token":         token.Encode(),
+		"CalendarToken": feedToken.Token,
+	}
+	if err := calendarPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/gorilla/context"
 
 	"github.com/decitrig/innerhearth/account"
+	"github.com/decitrig/innerhearth/apikeys"
 	"github.com/decitrig/innerhearth/staff"
 	"github.com/decitrig/innerhearth/webapp"
 )
@@ -18,6 +19,7 @@ const (
 	userAccountKey = iota
 	staffKey
 	teacherKey
+	apiKeyKey
 )
 
 func userContext(r *http.Request) (*account.Account, bool) {
@@ -83,3 +85,63 @@ func staffContextHandler(handler webapp.Handler) webapp.HandlerFunc {
 		}
 	}
 }
+
+func apiKeyContext(r *http.Request) (*apikeys.Key, bool) {
+	if key, ok := context.GetOk(r, apiKeyKey); ok {
+		return key.(*apikeys.Key), true
+	}
+	return nil, false
+}
+
+func setAPIKeyContext(r *http.Request, key *apikeys.Key) {
+	context.Set(r, apiKeyKey, key)
+}
+
+// apiKeyHandler authenticates a request by the API key it presents,
+// which must have been granted scope. The key and the account on
+// whose behalf it acts are stored in the request context.
+func apiKeyHandler(scope apikeys.Scope, handler webapp.Handler) webapp.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) *webapp.Error {
+		credential := apikeys.Credential(r)
+		if credential == "" {
+			webapp.JSONError(w, http.StatusUnauthorized, "API key required")
+			return nil
+		}
+		c := appengine.NewContext(r)
+		key, err := apikeys.Authenticate(c, credential)
+		switch err {
+		case nil:
+			break
+		case apikeys.ErrInvalidKey, apikeys.ErrKeyRevoked:
+			webapp.JSONError(w, http.StatusUnauthorized, "invalid API key")
+			return nil
+		default:
+			return webapp.InternalError(fmt.Errorf("failed to authenticate API key: %s", err))
+		}
+		if !key.Allows(scope) {
+			webapp.JSONError(w, http.StatusForbidden, fmt.Sprintf("API key lacks scope %s", scope))
+			return nil
+		}
+		acct, err := account.WithID(c, key.AccountID)
+		if err != nil {
+			c.Errorf("API key %s belongs to missing account %q: %s", key.ID, key.AccountID, err)
+			webapp.JSONError(w, http.StatusUnauthorized, "invalid API key")
+			return nil
+		}
+		setAPIKeyContext(r, key)
+		setUserContext(r, acct)
+		return handler.Serve(w, r)
+	}
+}
+
+// optionalAPIKeyHandler serves public requests, but if a request
+// presents an API key, the key must be valid and have been granted
+// scope.
+func optionalAPIKeyHandler(scope apikeys.Scope, handler webapp.Handler) webapp.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) *webapp.Error {
+		if apikeys.Credential(r) == "" {
+			return handler.Serve(w, r)
+		}
+		return apiKeyHandler(scope, handler)(w, r)
+	}
+}
@@ -0,0 +1,178 @@
+package innerhearth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+
+	"github.com/gorilla/mux"
+
+	"github.com/decitrig/innerhearth/auth"
+	"github.com/decitrig/innerhearth/images"
+	"github.com/decitrig/innerhearth/webapp"
+)
+
+const (
+	// How many uploads the staff image library shows.
+	recentImages = 60
+
+	// How long browsers may cache an uploaded image. Uploads are never
+	// changed in place, so this can be long.
+	imageMaxAge = 30 * 24 * time.Hour
+)
+
+var (
+	staffImagesPage = newPage("templates/staff/images.html", nil)
+
+	// imageStore keeps uploaded images in the datastore, unless
+	// INNERHEARTH_IMAGE_DIR names a local directory to use instead
+	// (e.g., on the development server).
+	imageStore images.Store = images.DatastoreStore{}
+)
+
+func init() {
+	if dir := os.Getenv("INNERHEARTH_IMAGE_DIR"); dir != "" {
+		imageStore = images.FileStore{Dir: dir}
+	}
+	webapp.HandleFunc("/uploads/{id:[0-9]+}/{variant:[a-z]+}", serveImage)
+}
+
+func serveImage(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	img, err := images.WithID(c, id)
+	switch err {
+	case nil:
+		break
+	case images.ErrImageNotFound:
+		http.NotFound(w, r)
+		return nil
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to look up image %d: %s", id, err))
+	}
+	blob, err := img.Get(c, imageStore, vars["variant"])
+	switch err {
+	case nil:
+		break
+	case images.ErrVariantNotFound, images.ErrBlobNotFound:
+		http.NotFound(w, r)
+		return nil
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to read image %d: %s", id, err))
+	}
+	w.Header().Set("Content-Type", blob.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(imageMaxAge.Seconds())))
+	w.Write(blob.Data)
+	return nil
+}
+
+// uploadImage stores the image uploaded in a form's file field, and
+// returns the URL of its given variant. If no file was uploaded, it
+// returns an empty URL.
+func uploadImage(c appengine.Context, r *http.Request, field, variant, createdBy string) (string, error) {
+	file, header, err := r.FormFile(field)
+	switch err {
+	case nil:
+		break
+	case http.ErrMissingFile:
+		return "", nil
+	default:
+		return "", fmt.Errorf("failed to read uploaded image: %s", err)
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read uploaded image: %s", err)
+	}
+	img, err := images.New(header.Filename, data, createdBy, time.Now())
+	switch err {
+	case nil:
+		break
+	case images.ErrTooLarge:
+		return "", fmt.Errorf("images may be at most %dMB", images.MaxSize>>20)
+	case images.ErrTooManyPixels:
+		return "", fmt.Errorf("image dimensions are too large; please shrink it first")
+	default:
+		return "", fmt.Errorf("images must be JPEG, PNG or GIF files")
+	}
+	img.Description = strings.TrimSpace(r.FormValue(field + "description"))
+	if err := img.Insert(c, imageStore, data); err != nil {
+		c.Errorf("Failed to store image %q: %s", header.Filename, err)
+		return "", fmt.Errorf("failed to store the image; please try again")
+	}
+	c.Infof("%s uploaded image %d (%q)", createdBy, img.ID, img.Filename)
+	return img.URL(variant), nil
+}
+
+// staffImages lists uploaded images, and uploads and deletes them.
+func staffImages(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	staffAccount, ok := staffContext(r)
+	if !ok {
+		return webapp.UnauthorizedError(fmt.Errorf("only staff may manage images"))
+	}
+	if r.Method == "POST" {
+		token, ok := checkToken(c, staffAccount.ID, r.URL.Path, r.FormValue(auth.TokenFieldName))
+		if !ok {
+			return webapp.UnauthorizedError(fmt.Errorf("invalid auth token"))
+		}
+		switch r.FormValue("action") {
+		case "upload":
+			url, err := uploadImage(c, r, "image", images.Original, staffAccount.Email)
+			if err != nil {
+				return invalidData(w, fmt.Sprintf("Invalid image: %s", err))
+			}
+			if url == "" {
+				return missingFields(w)
+			}
+		case "delete":
+			id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+			if err != nil {
+				return invalidData(w, "Invalid image ID")
+			}
+			img, err := images.WithID(c, id)
+			if err != nil {
+				return invalidData(w, "No such image")
+			}
+			if err := img.Delete(c, imageStore); err != nil {
+				return webapp.InternalError(fmt.Errorf("failed to delete image %d: %s", id, err))
+			}
+			c.Infof("%s deleted image %d (%q)", staffAccount.Email, id, img.Filename)
+		default:
+			return invalidData(w, "Unknown action")
+		}
+		token.Delete(c)
+		http.Redirect(w, r, "/staff/images", http.StatusSeeOther)
+		return nil
+	}
+	recent, err := images.Recent(c, recentImages)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to list images: %s", err))
+	}
+	token, err := storeNewToken(c, staffAccount.ID, r.URL.Path)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to store token: %s", err))
+	}
+	data := map[string]interface{}{
+		"Token":    token.Encode(),
+		"Images":   recent,
+		"Variants": images.VariantNames(),
+		"MaxSize":  images.MaxSize >> 20,
+	}
+	if err := staffImagesPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
@@ -28,29 +28,48 @@ import (
 
 	"github.com/decitrig/innerhearth/account"
 	"github.com/decitrig/innerhearth/auth"
+	"github.com/decitrig/innerhearth/bookings"
+	"github.com/decitrig/innerhearth/cache"
 	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/config"
+	"github.com/decitrig/innerhearth/ledger"
+	"github.com/decitrig/innerhearth/makeups"
+	"github.com/decitrig/innerhearth/memberships"
+	"github.com/decitrig/innerhearth/passes"
+	"github.com/decitrig/innerhearth/pricing"
+	"github.com/decitrig/innerhearth/schedule"
 	"github.com/decitrig/innerhearth/staff"
 	"github.com/decitrig/innerhearth/students"
 	"github.com/decitrig/innerhearth/webapp"
-	"github.com/decitrig/innerhearth/yogassage"
 )
 
 var (
-	indexPage = template.Must(template.New("base.html").Funcs(template.FuncMap{
+	indexPage = newPage("templates/index.html", template.FuncMap{
 		"ClassesByDay": classesByDay,
 		"FormatLocal":  formatLocal,
 		"TeacherName":  teacherName,
-	}).ParseFiles("templates/base.html", "templates/index.html"))
-	loginPage = template.Must(template.ParseFiles("templates/base.html", "templates/login.html"))
-	classPage = template.Must(template.New("base.html").Funcs(template.FuncMap{
+	})
+	loginPage = newPage("templates/login.html", nil)
+	classPage = newPage("templates/class.html", template.FuncMap{
 		"WeekdayAsInt": weekdayAsInt,
 		"FormatLocal":  formatLocal,
-	}).ParseFiles("templates/base.html", "templates/class.html"))
-	rosterPage = template.Must(template.New("base.html").Funcs(template.FuncMap{
+	})
+	rosterPage = newPage("templates/roster.html", template.FuncMap{
 		"WeekdayAsInt": weekdayAsInt,
-	}).ParseFiles("templates/base.html", "templates/roster.html"))
+	})
 )
 
+// newPage parses a page template along with the base template. All
+// pages may use the site configuration functions in addition to
+// funcs.
+func newPage(file string, funcs template.FuncMap) *template.Template {
+	t := template.New("base.html").Funcs(config.TemplateFuncs)
+	if funcs != nil {
+		t = t.Funcs(funcs)
+	}
+	return template.Must(t.ParseFiles("templates/base.html", file))
+}
+
 func weekdayEquals(a, b time.Weekday) bool { return a == b }
 func weekdayAsInt(w time.Weekday) int      { return int(w) }
 func minutes(d time.Duration) int64        { return int64(d.Minutes()) }
@@ -61,23 +80,25 @@ func teacherHasEmail(t *classes.Teacher, email string) bool {
 	return t.Email == email
 }
 func formatLocal(layout string, t time.Time) string {
-	return t.In(local).Format(layout)
+	return t.In(config.Current().Location()).Format(layout)
 }
 
+// scheduleCache holds the assembled public schedule between changes.
+var scheduleCache cache.Cache = cache.Memcache{}
+
 // This is necessary when a Teacher is field inside another struct.
 func teacherName(t *classes.Teacher) string { return t.DisplayName() }
 
+// The formats in which dates and times are entered into forms. These
+// match the date pickers in the templates, and so are not
+// configurable.
 const (
 	dateFormat = "01/02/2006"
 	timeFormat = "3:04pm"
 )
 
-var (
-	local *time.Location
-)
-
 func parseLocalTime(s string) (time.Time, error) {
-	t, err := time.ParseInLocation(timeFormat, s, local)
+	t, err := time.ParseInLocation(timeFormat, s, config.Current().Location())
 	if err != nil {
 		return t, err
 	}
@@ -85,7 +106,7 @@ func parseLocalTime(s string) (time.Time, error) {
 }
 
 func parseLocalDate(s string) (time.Time, error) {
-	t, err := time.ParseInLocation(dateFormat, s, local)
+	t, err := time.ParseInLocation(dateFormat, s, config.Current().Location())
 	if err != nil {
 		return t, err
 	}
@@ -96,43 +117,30 @@ func classesByDay(clsses []*classes.Class) map[time.Weekday][]*classes.Class {
 	return classes.GroupedByDay(clsses)
 }
 
-func staticTemplate(file string) webapp.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) *webapp.Error {
-		t, err := template.ParseFiles("templates/base.html", file)
-		if err != nil {
-			return webapp.InternalError(fmt.Errorf("Error parsing template %s: %s", file, err))
+// withConfig loads the site configuration before serving each
+// request, so that code without a request context (e.g., template
+// functions) sees the current settings.
+func withConfig(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := appengine.NewContext(r)
+		if _, err := config.Get(c); err != nil {
+			c.Errorf("Failed to load site config: %s", err)
 		}
-		if err := t.Execute(w, nil); err != nil {
-			return webapp.InternalError(fmt.Errorf("Error rendering template %s: %s", file, err))
-		}
-		return nil
-	}
+		h.ServeHTTP(w, r)
+	})
 }
 
 func init() {
-	var err error
-	local, err = time.LoadLocation("America/New_York")
-	if err != nil {
+	if err := config.LoadDefaults("config.json"); err != nil {
 		panic(err)
 	}
-	http.Handle("/", webapp.Router)
+	http.Handle("/", withConfig(webapp.Router))
 	webapp.HandleFunc("/", index)
 	webapp.HandleFunc("/class", class)
 	webapp.Handle("/roster", userContextHandler(webapp.HandlerFunc(roster)))
 	if appengine.IsDevAppServer() {
 		webapp.HandleFunc("/error", throwError)
 	}
-
-	for url, template := range map[string]string{
-		"/about":           "templates/about.html",
-		"/pricing":         "templates/pricing.html",
-		"/privates-groups": "templates/privates-groups.html",
-		"/teachers":        "templates/teachers.html",
-		"/workshops":       "templates/workshops.html",
-		"/mailinglist":     "templates/mailinglist.html",
-	} {
-		webapp.HandleFunc(url, staticTemplate(template))
-	}
 }
 
 func badRequest(w http.ResponseWriter, message string) *webapp.Error {
@@ -215,6 +223,7 @@ func maybeOldTeacher(c appengine.Context, a *account.Account, u *user.User) (*cl
 	if err := teacher.Put(c); err != nil {
 		return nil, fmt.Errorf("failed to store new teacher for %s: %s", a.Email, err)
 	}
+	schedule.Invalidate(c, scheduleCache)
 	return teacher, nil
 }
 
@@ -264,12 +273,6 @@ func checkToken(c appengine.Context, userID, path, encoded string) (*auth.Token,
 	return nil, false
 }
 
-type sessionSchedule struct {
-	Session         *classes.Session
-	ClassesByDay    map[time.Weekday][]*classes.Class
-	TeachersByClass map[int64]*classes.Teacher
-}
-
 type registration struct {
 	Class   *classes.Class
 	Teacher *classes.Teacher
@@ -295,39 +298,14 @@ func registrationsForUser(c appengine.Context, userID string) []*registration {
 	return regs
 }
 
-func dateOnly(t time.Time) time.Time {
-	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
-}
-
 func index(w http.ResponseWriter, r *http.Request) *webapp.Error {
 	c := appengine.NewContext(r)
-	announcements := staff.CurrentAnnouncements(c, time.Now())
-	sort.Sort(staff.AnnouncementsByExpiration(announcements))
-	sessions := classes.Sessions(c, time.Now())
-	schedules := []sessionSchedule{}
-	for _, session := range sessions {
-		sessionClasses := session.Classes(c)
-		if len(sessionClasses) == 0 {
-			continue
-		}
-		sched := sessionSchedule{
-			Session:         session,
-			ClassesByDay:    classes.GroupedByDay(sessionClasses),
-			TeachersByClass: classes.TeachersByClass(c, sessionClasses),
-		}
-		schedules = append(schedules, sched)
-	}
-	classesBySession := make(map[int64][]*classes.Class)
-	for _, session := range sessions {
-		classesBySession[session.ID] = session.Classes(c)
-	}
-	yins := yogassage.Classes(c, dateOnly(time.Now()))
-	sort.Sort(yogassage.ByDate(yins))
+	sched := schedule.Get(c, scheduleCache, time.Now())
 	data := map[string]interface{}{
-		"Announcements": announcements,
-		"Schedules":     schedules,
+		"Announcements": sched.Announcements,
+		"Schedules":     sched.Sessions,
 		"DaysInOrder":   daysInOrder,
-		"YinYogassage":  yins,
+		"YinYogassage":  sched.YinYogassage,
 	}
 	if u := user.Current(c); u != nil {
 		acct, err := maybeOldAccount(c, u)
@@ -356,11 +334,43 @@ func index(w http.ResponseWriter, r *http.Request) *webapp.Error {
 			return webapp.InternalError(err)
 		}
 		data["Admin"] = user.IsAdmin(c)
+		switch teacher, err := maybeOldTeacher(c, acct, u); err {
+		case nil:
+			data["Teacher"] = teacher
+			if upcoming, err := bookings.UpcomingForTeacher(c, teacher, time.Now()); err != nil {
+				c.Errorf("Failed to find bookings for teacher %q: %s", teacher.ID, err)
+			} else {
+				data["TeacherBookings"] = upcoming
+			}
+		case classes.ErrUserIsNotTeacher:
+			break
+		default:
+			c.Errorf("Failed to look up teacher for %q: %s", acct.ID, err)
+		}
 		regs := registrationsForUser(c, acct.ID)
 		if len(regs) == 0 {
 			regs = registrationsForUser(c, u.ID)
 		}
 		data["Registrations"] = regs
+		if cancelToken, err := storeNewToken(c, acct.ID, "/register/cancel"); err != nil {
+			c.Errorf("Failed to store token: %s", err)
+		} else {
+			data["CancelToken"] = cancelToken.Encode()
+		}
+		if all, err := passes.ForAccount(c, acct.ID); err != nil {
+			c.Errorf("Failed to find passes for %q: %s", acct.ID, err)
+		} else {
+			current := []*passes.Pass{}
+			for _, p := range all {
+				if p.Remaining > 0 && !p.Expired(time.Now()) {
+					current = append(current, p)
+				}
+			}
+			data["Passes"] = current
+		}
+		data["Memberships"] = currentMemberships(c, acct.ID, time.Now())
+		data["MakeUps"] = availableMakeUps(c, acct.ID, time.Now())
+		data["Credit"] = creditBalance(c, acct.ID)
 	}
 	if err := indexPage.Execute(w, data); err != nil {
 		return webapp.InternalError(err)
@@ -393,6 +403,18 @@ func class(w http.ResponseWriter, r *http.Request) *webapp.Error {
 	default:
 		return webapp.InternalError(fmt.Errorf("failed to find class %d: %s", id, err))
 	}
+	if class.Workshop != 0 {
+		http.Redirect(w, r, fmt.Sprintf("/workshops#workshop-%d", class.Workshop), http.StatusSeeOther)
+		return nil
+	}
+	if class.Series != 0 {
+		http.Redirect(w, r, fmt.Sprintf("/workshops#series-%d", class.Series), http.StatusSeeOther)
+		return nil
+	}
+	if class.YinYogassage != 0 {
+		http.Redirect(w, r, fmt.Sprintf("/yin-yogassage#yin-%d", class.YinYogassage), http.StatusSeeOther)
+		return nil
+	}
 	teacher := class.TeacherEntity(c)
 	data := map[string]interface{}{
 		"Class":   class,
@@ -414,9 +436,30 @@ func class(w http.ResponseWriter, r *http.Request) *webapp.Error {
 				return webapp.InternalError(fmt.Errorf("failed to store token: %s"))
 			}
 			data["OneDayToken"] = oneDayToken.Encode()
+			data["Member"] = memberships.IsMember(c, a.ID, class.Session)
+			data["Verified"] = pricing.VerifiedCategory(c, a.ID) != pricing.Regular
+			data["Credit"] = creditBalance(c, a.ID)
+			if usable, err := passes.Usable(c, a.ID, classes.Regular, time.Now()); err != nil {
+				c.Errorf("Failed to find passes for %q: %s", a.ID, err)
+			} else {
+				data["Passes"] = usable
+			}
+			if credits, err := makeups.Available(c, a.ID, class.Session, time.Now()); err != nil {
+				c.Errorf("Failed to find make-up credits for %q: %s", a.ID, err)
+			} else {
+				data["MakeUps"] = credits
+			}
 			switch student, err := maybeOldStudent(c, a, u, class); err {
 			case nil:
 				data["Student"] = student
+				if !student.DropIn {
+					data["Upcoming"], data["Missed"] = missedMeetings(c, student, class, time.Now())
+					missedToken, err := storeNewToken(c, a.ID, "/register/missed")
+					if err != nil {
+						return webapp.InternalError(fmt.Errorf("failed to store token: %s", err))
+					}
+					data["MissedToken"] = missedToken.Encode()
+				}
 			case students.ErrStudentNotFound:
 				break
 			default:
@@ -456,19 +499,44 @@ func roster(w http.ResponseWriter, r *http.Request) *webapp.Error {
 	if !canViewRoster(staff, acct, class.TeacherEntity(c)) {
 		return webapp.UnauthorizedError(fmt.Errorf("only staff or teachers can view rosters"))
 	}
-	classStudents := students.In(c, class, time.Now())
-	sort.Sort(students.ByName(classStudents))
+	classStudents := rosterFor(c, class, time.Now())
 	token, err := storeNewToken(c, acct.ID, "/register/paper")
 	if err != nil {
 		return webapp.InternalError(fmt.Errorf("Failed to store token: %s", err))
 	}
+	paymentToken, err := storeNewToken(c, acct.ID, "/roster/payment")
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("Failed to store token: %s", err))
+	}
+	cancelToken, err := storeNewToken(c, acct.ID, "/roster/cancel")
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("Failed to store token: %s", err))
+	}
+	missed, err := makeups.ForClass(c, class.ID)
+	if err != nil {
+		c.Errorf("Failed to find make-up credits for %d: %s", class.ID, err)
+	}
 	data := map[string]interface{}{
-		"Class":    class,
-		"Students": classStudents,
-		"Token":    token.Encode(),
+		"Class":          class,
+		"Students":       classStudents,
+		"Missed":         missed,
+		"Token":          token.Encode(),
+		"PaymentToken":   paymentToken.Encode(),
+		"CancelToken":    cancelToken.Encode(),
+		"PaymentMethods": students.PaymentMethods,
+		"IsStaff":        staff != nil,
+		"Resolutions":    ledger.Resolutions,
 	}
 	if err := rosterPage.Execute(w, data); err != nil {
 		return webapp.InternalError(err)
 	}
 	return nil
 }
+
+// rosterFor returns the students currently registered for a class,
+// sorted by name.
+func rosterFor(c appengine.Context, class *classes.Class, now time.Time) []*students.Student {
+	classStudents := students.In(c, class, now)
+	sort.Sort(students.ByName(classStudents))
+	return classStudents
+}
@@ -0,0 +1,245 @@
+package innerhearth
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+
+	"github.com/decitrig/innerhearth/account"
+	"github.com/decitrig/innerhearth/auth"
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/config"
+	"github.com/decitrig/innerhearth/ledger"
+	"github.com/decitrig/innerhearth/makeups"
+	"github.com/decitrig/innerhearth/passes"
+	"github.com/decitrig/innerhearth/pricing"
+	"github.com/decitrig/innerhearth/promos"
+	"github.com/decitrig/innerhearth/students"
+	"github.com/decitrig/innerhearth/webapp"
+)
+
+var (
+	ledgerPage = newPage("templates/staff/ledger.html", nil)
+)
+
+func parseResolution(s string) (ledger.Resolution, bool) {
+	for _, res := range ledger.Resolutions {
+		if string(res) == s {
+			return res, true
+		}
+	}
+	return "", false
+}
+
+// firstMeeting returns the start of the first class covered by a
+// registration. session is not used for drop-ins or series, and may be
+// nil.
+func firstMeeting(class *classes.Class, session *classes.Session, student *students.Student) time.Time {
+	if class.Series != 0 {
+		return student.Date
+	}
+	loc := config.Current().Location()
+	if student.DropIn {
+		return class.OccurrenceOn(student.Date, loc).Start
+	}
+	if meetings := class.Occurrences(session, session.Start, loc); len(meetings) > 0 {
+		return meetings[0].Start
+	}
+	return session.Start
+}
+
+// rulesOn returns the pricing rules of the session running at t, for
+// classes such as workshops which belong to no session. If no session
+// is running, the rules of the next session to start are used, and the
+// default rules if there is none.
+func rulesOn(c appengine.Context, t time.Time) (*pricing.Rules, error) {
+	var session *classes.Session
+	for _, s := range classes.Sessions(c, t) {
+		if session == nil || s.Start.Before(session.Start) {
+			session = s
+		}
+	}
+	if session == nil {
+		return pricing.Default(), nil
+	}
+	rules, err := pricing.ForSession(c, session.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find prices for session %d: %s", session.ID, err)
+	}
+	return rules, nil
+}
+
+// cancelRegistration cancels a registration. Pass and make-up credits
+// used to pay for it are returned to the student, as is the use of any
+// promotional code, and any money paid is refunded or credited to
+// their account according to res.
+func cancelRegistration(c appengine.Context, student *students.Student, class *classes.Class, res ledger.Resolution, by string, now time.Time) error {
+	switch {
+	case student.MakeUpID != "":
+		return makeups.Cancel(c, student, now)
+	case student.PassID != 0:
+		return passes.Cancel(c, student, now)
+	}
+	var returnPromo func(c appengine.Context) error
+	if student.PromoCode != "" {
+		returnPromo = func(c appengine.Context) error {
+			return promos.Return(c, student.PromoCode)
+		}
+	}
+	if class.Workshop != 0 || class.Series != 0 || class.YinYogassage != 0 {
+		first := firstMeeting(class, nil, student)
+		rules, err := rulesOn(c, first)
+		if err != nil {
+			return err
+		}
+		refund, credit := res.Split(student, first, rules.RefundCutoff(), now)
+		return ledger.CancelWith(c, student, refund, credit, by, now, returnPromo)
+	}
+	session, err := classes.SessionWithID(c, class.Session)
+	if err != nil {
+		return fmt.Errorf("failed to find session %d: %s", class.Session, err)
+	}
+	rules, err := pricing.ForSession(c, session.ID)
+	if err != nil {
+		return fmt.Errorf("failed to find prices for session %d: %s", session.ID, err)
+	}
+	refund, credit := res.Split(student, firstMeeting(class, session, student), rules.RefundCutoff(), now)
+	return ledger.CancelWith(c, student, refund, credit, by, now, returnPromo)
+}
+
+// creditBalance returns an account's credit balance. Errors are logged
+// and treated as no credit.
+func creditBalance(c appengine.Context, accountID string) pricing.Cents {
+	balance, err := ledger.Balance(c, accountID)
+	if err != nil {
+		c.Errorf("Failed to find credit balance of %q: %s", accountID, err)
+		return 0
+	}
+	return balance
+}
+
+// parseSignedCents parses an amount in dollars which may be negative.
+func parseSignedCents(s string) (pricing.Cents, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "-") {
+		amount, err := pricing.ParseCents(s[1:])
+		return -amount, err
+	}
+	return pricing.ParseCents(s)
+}
+
+// refundEntry is an outstanding refund together with its account, for
+// display.
+type refundEntry struct {
+	*ledger.Entry
+	Account *account.Account
+}
+
+// staffLedger lists outstanding refunds and shows a single account's
+// ledger. Staff can record that refunds have been paid and adjust an
+// account's credit.
+func staffLedger(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	staffAccount, ok := staffContext(r)
+	if !ok {
+		return webapp.UnauthorizedError(fmt.Errorf("only staff may view the ledger"))
+	}
+	if r.Method == "POST" {
+		token, err := auth.TokenForRequest(c, staffAccount.ID, r.URL.Path)
+		if err != nil {
+			return webapp.UnauthorizedError(fmt.Errorf("didn't find an auth token"))
+		}
+		if !token.IsValid(r.FormValue(auth.TokenFieldName), time.Now()) {
+			return webapp.UnauthorizedError(fmt.Errorf("invalid auth token"))
+		}
+		// Paper registrations have no stored account, so entries are
+		// identified by account ID alone.
+		accountID := r.FormValue("account")
+		if accountID == "" {
+			return missingFields(w)
+		}
+		redirect := "/staff/ledger"
+		switch r.FormValue("action") {
+		case "settle":
+			id, err := strconv.ParseInt(r.FormValue("entry"), 10, 64)
+			if err != nil {
+				return invalidData(w, "Invalid entry ID")
+			}
+			switch err := ledger.Settle(c, accountID, id, staffAccount.Email, time.Now()); err {
+			case nil, ledger.ErrAlreadySettled:
+				break
+			case ledger.ErrEntryNotFound:
+				return invalidData(w, "No such refund")
+			default:
+				return webapp.InternalError(fmt.Errorf("failed to settle refund %d: %s", id, err))
+			}
+		case "adjust":
+			amount, err := parseSignedCents(r.FormValue("amount"))
+			if err != nil || amount == 0 {
+				return invalidData(w, "Invalid amount; please enter dollars, e.g. 15 or -12.50")
+			}
+			description := strings.TrimSpace(r.FormValue("description"))
+			if description == "" {
+				return invalidData(w, "Please give a reason for the adjustment")
+			}
+			e := ledger.NewEntry(accountID, ledger.Adjustment, amount, 0, description, staffAccount.Email, time.Now())
+			if err := e.Put(c); err != nil {
+				return webapp.InternalError(fmt.Errorf("failed to store adjustment: %s", err))
+			}
+			c.Infof("%s adjusted credit of %q by %s", staffAccount.Email, accountID, amount)
+			redirect = "/staff/ledger?email=" + url.QueryEscape(r.FormValue("email"))
+		default:
+			return invalidData(w, "Unknown action")
+		}
+		token.Delete(c)
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return nil
+	}
+	token, err := auth.NewToken(staffAccount.ID, r.URL.Path, time.Now())
+	if err != nil {
+		return webapp.InternalError(err)
+	}
+	if err := token.Store(c); err != nil {
+		return webapp.InternalError(err)
+	}
+	data := map[string]interface{}{
+		"Token": token.Encode(),
+	}
+	if email := r.FormValue("email"); email != "" {
+		acct, err := account.WithEmail(c, email)
+		if err != nil {
+			return invalidData(w, fmt.Sprintf("No account found for %q", email))
+		}
+		entries, err := ledger.ForAccount(c, acct.ID)
+		if err != nil {
+			return webapp.InternalError(fmt.Errorf("failed to find ledger for %q: %s", acct.ID, err))
+		}
+		data["Account"] = acct
+		data["Entries"] = entries
+		data["Balance"] = ledger.BalanceOf(entries)
+	}
+	outstanding, err := ledger.OutstandingRefunds(c)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to list refunds: %s", err))
+	}
+	refunds := make([]*refundEntry, len(outstanding))
+	var total pricing.Cents
+	for i, e := range outstanding {
+		refunds[i] = &refundEntry{Entry: e}
+		if acct, err := account.WithID(c, e.AccountID); err == nil {
+			refunds[i].Account = acct
+		}
+		total += e.Amount
+	}
+	data["Refunds"] = refunds
+	data["RefundTotal"] = total
+	if err := ledgerPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
@@ -2,7 +2,6 @@ package innerhearth
 
 import (
 	"fmt"
-	"html/template"
 	"net/http"
 	"strings"
 	"time"
@@ -17,7 +16,7 @@ import (
 )
 
 var (
-	newAccountPage = template.Must(template.ParseFiles("templates/base.html", "templates/new-account.html"))
+	newAccountPage = newPage("templates/new-account.html", nil)
 )
 
 func init() {
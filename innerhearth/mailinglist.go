@@ -0,0 +1,361 @@
+package innerhearth
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+
+	"github.com/decitrig/innerhearth/auth"
+	"github.com/decitrig/innerhearth/mailinglist"
+	"github.com/decitrig/innerhearth/pages"
+	"github.com/decitrig/innerhearth/webapp"
+)
+
+var (
+	mailingListStatusPage = newPage("templates/mailinglist-status.html", nil)
+	unsubscribePage       = newPage("templates/mailinglist-unsubscribe.html", nil)
+	staffMailingListPage  = newPage("templates/staff/mailinglist.html", nil)
+	newslettersPage       = newPage("templates/staff/newsletters.html", nil)
+	newsletterPage        = newPage("templates/staff/newsletter.html", nil)
+)
+
+func init() {
+	webapp.HandleFunc("/mailinglist/subscribe", subscribe)
+	webapp.HandleFunc(mailinglist.ConfirmPath, confirmSubscription)
+	webapp.HandleFunc(mailinglist.UnsubscribePath, unsubscribe)
+}
+
+// mailingListStatus shows the outcome of a change to a subscription.
+func mailingListStatus(w http.ResponseWriter, title, message string) *webapp.Error {
+	data := map[string]interface{}{
+		"Title":   title,
+		"Message": message,
+	}
+	if err := mailingListStatusPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
+
+// subscribe adds an address to the mailing list, pending its
+// confirmation by email.
+func subscribe(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	if r.Method != "POST" {
+		http.Redirect(w, r, "/mailinglist", http.StatusSeeOther)
+		return nil
+	}
+	c := appengine.NewContext(r)
+	first := strings.TrimSpace(r.FormValue("firstname"))
+	last := strings.TrimSpace(r.FormValue("lastname"))
+	s, err := mailinglist.Subscribe(c, r.FormValue("email"), first, last, time.Now())
+	switch err {
+	case nil:
+		break
+	case mailinglist.ErrInvalidEmail:
+		return invalidData(w, "Please enter a valid email address.")
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to subscribe %q: %s", r.FormValue("email"), err))
+	}
+	if s.Status == mailinglist.Subscribed {
+		return mailingListStatus(w, "You're Subscribed", fmt.Sprintf("%s is already on our mailing list.", s.Email))
+	}
+	c.Infof("Sent mailing list confirmation to %q", s.Email)
+	return mailingListStatus(w, "Check Your Email", fmt.Sprintf("We've sent a confirmation link to %s. Follow it to start receiving our newsletter.", s.Email))
+}
+
+func confirmSubscription(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	s, err := mailinglist.WithEmail(c, r.FormValue("email"))
+	switch err {
+	case nil:
+		break
+	case mailinglist.ErrSubscriberNotFound:
+		return invalidData(w, "This confirmation link is not valid.")
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to find subscriber %q: %s", r.FormValue("email"), err))
+	}
+	switch err := s.Confirm(c, r.FormValue("code"), time.Now()); err {
+	case nil:
+		break
+	case mailinglist.ErrWrongConfirmationCode:
+		return invalidData(w, "This confirmation link is not valid, or has already been used.")
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to confirm subscriber %q: %s", s.Email, err))
+	}
+	return mailingListStatus(w, "You're Subscribed", fmt.Sprintf("Thank you! %s will now receive our newsletter.", s.Email))
+}
+
+// unsubscribe removes an address from the list using the signed link
+// in a newsletter. Following the link shows a button with which to
+// confirm, so that mail scanners which follow links don't unsubscribe
+// anyone; mail programs may POST to the link to unsubscribe in one
+// click.
+func unsubscribe(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	if r.Method != "POST" {
+		email, err := mailinglist.CheckUnsubscribe(c, r.FormValue("email"), r.FormValue("sig"))
+		if err != nil {
+			return invalidData(w, "This unsubscribe link is not valid.")
+		}
+		data := map[string]interface{}{
+			"Email":     email,
+			"Signature": r.FormValue("sig"),
+		}
+		if err := unsubscribePage.Execute(w, data); err != nil {
+			return webapp.InternalError(err)
+		}
+		return nil
+	}
+	s, err := mailinglist.Unsubscribe(c, r.FormValue("email"), r.FormValue("sig"), time.Now())
+	switch err {
+	case nil:
+		break
+	case mailinglist.ErrInvalidSignature, mailinglist.ErrSubscriberNotFound:
+		return invalidData(w, "This unsubscribe link is not valid.")
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to unsubscribe %q: %s", r.FormValue("email"), err))
+	}
+	c.Infof("Unsubscribed %q from the mailing list", s.Email)
+	return mailingListStatus(w, "You're Unsubscribed", fmt.Sprintf("%s has been removed from our mailing list. You can subscribe again at any time.", s.Email))
+}
+
+// staffMailingList shows the list of subscribers, and imports and
+// exports it.
+func staffMailingList(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	staffAccount, ok := staffContext(r)
+	if !ok {
+		return webapp.UnauthorizedError(fmt.Errorf("only staff may manage the mailing list"))
+	}
+	if r.Method == "POST" {
+		token, ok := checkToken(c, staffAccount.ID, r.URL.Path, r.FormValue(auth.TokenFieldName))
+		if !ok {
+			return webapp.UnauthorizedError(fmt.Errorf("invalid auth token"))
+		}
+		switch r.FormValue("action") {
+		case "import":
+			file, _, err := r.FormFile("csv")
+			if err != nil {
+				return missingFields(w)
+			}
+			defer file.Close()
+			result, err := mailinglist.ImportCSV(c, file, time.Now())
+			if err != nil {
+				return invalidData(w, fmt.Sprintf("Couldn't import subscribers: %s", err))
+			}
+			c.Infof("%s imported %d subscribers", staffAccount.Email, result.Added)
+			token, err = storeNewToken(c, staffAccount.ID, r.URL.Path)
+			if err != nil {
+				return webapp.InternalError(fmt.Errorf("failed to store token: %s", err))
+			}
+			return renderStaffMailingList(w, c, token.Encode(), result)
+		case "unsubscribe":
+			s, err := mailinglist.WithEmail(c, r.FormValue("email"))
+			if err != nil {
+				return invalidData(w, "No such subscriber")
+			}
+			if err := s.Unsubscribe(c, time.Now()); err != nil {
+				return webapp.InternalError(fmt.Errorf("failed to unsubscribe %q: %s", s.Email, err))
+			}
+			c.Infof("%s unsubscribed %q", staffAccount.Email, s.Email)
+		default:
+			return invalidData(w, "Unknown action")
+		}
+		token.Delete(c)
+		http.Redirect(w, r, "/staff/mailinglist", http.StatusSeeOther)
+		return nil
+	}
+	if r.FormValue("format") == "csv" {
+		all, err := mailinglist.All(c)
+		if err != nil {
+			return webapp.InternalError(fmt.Errorf("failed to list subscribers: %s", err))
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="subscribers.csv"`)
+		if err := mailinglist.WriteCSV(w, all); err != nil {
+			return webapp.InternalError(fmt.Errorf("failed to export subscribers: %s", err))
+		}
+		return nil
+	}
+	token, err := storeNewToken(c, staffAccount.ID, r.URL.Path)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to store token: %s", err))
+	}
+	return renderStaffMailingList(w, c, token.Encode(), nil)
+}
+
+func renderStaffMailingList(w http.ResponseWriter, c appengine.Context, token string, imported *mailinglist.ImportResult) *webapp.Error {
+	counts, err := mailinglist.Counts(c)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to count subscribers: %s", err))
+	}
+	subscribers, err := mailinglist.Subscribers(c)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to list subscribers: %s", err))
+	}
+	data := map[string]interface{}{
+		"Token":        token,
+		"Subscribed":   counts[mailinglist.Subscribed],
+		"Pending":      counts[mailinglist.Pending],
+		"Unsubscribed": counts[mailinglist.Unsubscribed],
+		"Subscribers":  subscribers,
+		"Imported":     imported,
+	}
+	if err := staffMailingListPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
+
+// staffNewsletters lists newsletters and starts new ones.
+func staffNewsletters(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	staffAccount, ok := staffContext(r)
+	if !ok {
+		return webapp.UnauthorizedError(fmt.Errorf("only staff may write newsletters"))
+	}
+	if r.Method == "POST" {
+		token, ok := checkToken(c, staffAccount.ID, r.URL.Path, r.FormValue(auth.TokenFieldName))
+		if !ok {
+			return webapp.UnauthorizedError(fmt.Errorf("invalid auth token"))
+		}
+		n := mailinglist.NewNewsletter(r.FormValue("subject"), r.FormValue("body"), staffAccount.Email, time.Now())
+		if !n.Valid() {
+			return invalidData(w, "A newsletter needs a subject and a message.")
+		}
+		if err := n.Insert(c); err != nil {
+			return webapp.InternalError(fmt.Errorf("failed to store newsletter: %s", err))
+		}
+		token.Delete(c)
+		http.Redirect(w, r, fmt.Sprintf("/staff/newsletter?id=%d", n.ID), http.StatusSeeOther)
+		return nil
+	}
+	newsletters, err := mailinglist.Newsletters(c)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to list newsletters: %s", err))
+	}
+	token, err := storeNewToken(c, staffAccount.ID, r.URL.Path)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to store token: %s", err))
+	}
+	data := map[string]interface{}{
+		"Token":       token.Encode(),
+		"Newsletters": newsletters,
+	}
+	if err := newslettersPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
+
+// staffNewsletter edits, tests and sends a newsletter, and shows how
+// its delivery is progressing.
+func staffNewsletter(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	staffAccount, ok := staffContext(r)
+	if !ok {
+		return webapp.UnauthorizedError(fmt.Errorf("only staff may send newsletters"))
+	}
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		return invalidData(w, "Invalid newsletter ID")
+	}
+	n, err := mailinglist.NewsletterWithID(c, id)
+	switch err {
+	case nil:
+		break
+	case mailinglist.ErrNewsletterNotFound:
+		return invalidData(w, "No such newsletter")
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to find newsletter %d: %s", id, err))
+	}
+	if r.Method == "POST" {
+		token, ok := checkToken(c, staffAccount.ID, r.URL.Path, r.FormValue(auth.TokenFieldName))
+		if !ok {
+			return webapp.UnauthorizedError(fmt.Errorf("invalid auth token"))
+		}
+		redirect := fmt.Sprintf("/staff/newsletter?id=%d", n.ID)
+		// A newsletter which couldn't be queued may be sent again.
+		if n.Status != mailinglist.Draft && r.FormValue("action") != "send" {
+			return invalidData(w, "This newsletter has already been sent.")
+		}
+		switch r.FormValue("action") {
+		case "save":
+			edited := mailinglist.NewNewsletter(r.FormValue("subject"), r.FormValue("body"), staffAccount.Email, time.Now())
+			if !edited.Valid() {
+				return invalidData(w, "A newsletter needs a subject and a message.")
+			}
+			n.Subject, n.Body, n.Updated = edited.Subject, edited.Body, edited.Updated
+			if err := n.Put(c); err != nil {
+				return webapp.InternalError(fmt.Errorf("failed to store newsletter %d: %s", n.ID, err))
+			}
+		case "test":
+			if err := n.SendTest(c, staffAccount.Email); err != nil {
+				return webapp.InternalError(fmt.Errorf("failed to send test of newsletter %d: %s", n.ID, err))
+			}
+		case "send":
+			switch err := n.Send(c, staffAccount.Email, time.Now()); err {
+			case nil:
+				c.Infof("%s sent newsletter %d to %d subscribers", staffAccount.Email, n.ID, n.Recipients)
+			case mailinglist.ErrNoSubscribers:
+				return invalidData(w, "There is no one on the mailing list yet.")
+			case mailinglist.ErrAlreadySent:
+				return invalidData(w, "This newsletter has already been sent.")
+			default:
+				return webapp.InternalError(fmt.Errorf("failed to send newsletter %d: %s", n.ID, err))
+			}
+		case "delete":
+			if err := n.Delete(c); err != nil {
+				return webapp.InternalError(fmt.Errorf("failed to delete newsletter %d: %s", n.ID, err))
+			}
+			redirect = "/staff/newsletters"
+		default:
+			return invalidData(w, "Unknown action")
+		}
+		token.Delete(c)
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return nil
+	}
+	deliveries, err := n.Deliveries(c)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to list deliveries of newsletter %d: %s", n.ID, err))
+	}
+	counts := mailinglist.DeliveryCounts(deliveries)
+	statusCounts := []map[string]interface{}{}
+	for _, status := range mailinglist.DeliveryStatuses {
+		statusCounts = append(statusCounts, map[string]interface{}{
+			"Status": status,
+			"Count":  counts[status],
+		})
+	}
+	problems := []*mailinglist.Delivery{}
+	for _, d := range deliveries {
+		if d.Status == mailinglist.Failed {
+			problems = append(problems, d)
+		}
+	}
+	token, err := storeNewToken(c, staffAccount.ID, r.URL.Path)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to store token: %s", err))
+	}
+	data := map[string]interface{}{
+		"Token":      token.Encode(),
+		"Newsletter": n,
+		"Draft":      n.Status == mailinglist.Draft,
+		"Unqueued":   n.Status == mailinglist.Sending && n.Batches == 0,
+		"Preview":    pages.Render(pages.Markdown, n.BodyText()),
+		"Counts":     statusCounts,
+		"Failed":     problems,
+		"Deliveries": deliveries,
+		"StaffEmail": staffAccount.Email,
+		"BatchSize":  mailinglist.BatchSize,
+	}
+	if err := newsletterPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
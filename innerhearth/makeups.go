@@ -0,0 +1,177 @@
+package innerhearth
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"appengine"
+
+	"github.com/decitrig/innerhearth/auth"
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/config"
+	"github.com/decitrig/innerhearth/makeups"
+	"github.com/decitrig/innerhearth/memberships"
+	"github.com/decitrig/innerhearth/students"
+	"github.com/decitrig/innerhearth/webapp"
+)
+
+func init() {
+	webapp.HandleFunc("/register/missed", userContextHandler(webapp.HandlerFunc(markMissed)))
+}
+
+// registerWithMakeUp adds a drop-in registration paid for with one of
+// the student's make-up credits.
+func registerWithMakeUp(w http.ResponseWriter, r *http.Request, student *students.Student, class *classes.Class) *webapp.Error {
+	c := appengine.NewContext(r)
+	if memberships.IsMember(c, student.ID, class.Session) {
+		// Members register for free; don't use up a credit.
+		return register(w, r, student, class)
+	}
+	now := time.Now()
+	confirmed := fmt.Sprintf("/register/confirmed?class=%d", class.ID)
+	switch existing, err := students.WithIDInClass(c, student.ID, class, now); err {
+	case nil:
+		if !existing.DropIn {
+			return invalidData(w, "You are already registered for this class for the whole session; please choose another class to make up your missed class.")
+		}
+		http.Redirect(w, r, confirmed, http.StatusSeeOther)
+		return nil
+	case students.ErrStudentNotFound:
+		break
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to find student %q in %d: %s", student.ID, class.ID, err))
+	}
+	setPrice(c, student, class, now)
+	switch err := makeups.Redeem(c, r.FormValue("makeup"), student, class.Session, now); err {
+	case nil, students.ErrAlreadyRegistered:
+		break
+	case students.ErrClassIsFull:
+		if err := classFullPage.Execute(w, class); err != nil {
+			return webapp.InternalError(err)
+		}
+		return nil
+	case makeups.ErrCreditNotFound, makeups.ErrWrongAccount:
+		return invalidData(w, "No such make-up credit")
+	case makeups.ErrCreditUsed:
+		return invalidData(w, "That make-up credit has already been used.")
+	case makeups.ErrCreditExpired:
+		return invalidData(w, "Make-up classes must be taken before the end of the session.")
+	case makeups.ErrWrongSession:
+		return invalidData(w, "Make-up classes must be taken in the same session as the missed class.")
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to redeem make-up credit %s: %s", r.FormValue("makeup"), err))
+	}
+	http.Redirect(w, r, confirmed, http.StatusSeeOther)
+	return nil
+}
+
+// markMissed lets a session student mark an upcoming meeting of their
+// class as missed, issuing them a make-up credit.
+func markMissed(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Method not allowed")
+		return nil
+	}
+	c := appengine.NewContext(r)
+	acct, ok := userContext(r)
+	if !ok {
+		return badRequest(w, "Must be logged in.")
+	}
+	token, ok := checkToken(c, acct.ID, r.URL.Path, r.FormValue(auth.TokenFieldName))
+	if !ok {
+		return webapp.UnauthorizedError(fmt.Errorf("Invalid auth token"))
+	}
+	id, err := strconv.ParseInt(r.FormValue("class"), 10, 64)
+	if err != nil {
+		return invalidData(w, "Invalid class ID")
+	}
+	class, err := classes.ClassWithID(c, id)
+	if err != nil {
+		return invalidData(w, "No such class.")
+	}
+	session, err := classes.SessionWithID(c, class.Session)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to find session %d: %s", class.Session, err))
+	}
+	date, err := parseLocalDate(r.FormValue("date"))
+	if err != nil {
+		return invalidData(w, "Invalid date; please use mm/dd/yyyy format")
+	}
+	now := time.Now()
+	student, err := students.WithIDInClass(c, acct.ID, class, now)
+	switch err {
+	case nil:
+		break
+	case students.ErrStudentNotFound:
+		return invalidData(w, "You are not registered for this class.")
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to find student %q in %d: %s", acct.ID, class.ID, err))
+	}
+	switch _, err := makeups.MarkMissed(c, student, class, session, date, config.Current().Location(), now); err {
+	case nil:
+		break
+	case makeups.ErrNotSessionStudent:
+		return invalidData(w, "Only students registered for the whole session can make up missed classes.")
+	case makeups.ErrNotUpcoming:
+		return invalidData(w, "The class doesn't meet on that date, or the class has already started.")
+	case makeups.ErrAlreadyMissed:
+		return invalidData(w, "You have already marked that class as missed.")
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to mark %q missed in %d: %s", student.Email, class.ID, err))
+	}
+	c.Infof("%q will miss %d on %s", student.Email, class.ID, date.Format(dateFormat))
+	token.Delete(c)
+	http.Redirect(w, r, fmt.Sprintf("/class?id=%d", class.ID), http.StatusSeeOther)
+	return nil
+}
+
+// missedMeetings returns the upcoming meetings of a session student's
+// class which they have not already marked as missed, and the credits
+// issued for those they have.
+func missedMeetings(c appengine.Context, student *students.Student, class *classes.Class, now time.Time) ([]classes.Occurrence, []*makeups.Credit) {
+	session, err := classes.SessionWithID(c, class.Session)
+	if err != nil {
+		c.Errorf("Failed to find session %d: %s", class.Session, err)
+		return nil, nil
+	}
+	all, err := makeups.ForAccount(c, student.ID)
+	if err != nil {
+		c.Errorf("Failed to find make-up credits for %q: %s", student.ID, err)
+		return nil, nil
+	}
+	missed := make(map[int64]bool)
+	credits := []*makeups.Credit{}
+	for _, credit := range all {
+		if credit.ClassID == class.ID {
+			missed[credit.Missed.Unix()] = true
+			credits = append(credits, credit)
+		}
+	}
+	upcoming := []classes.Occurrence{}
+	for _, o := range class.Occurrences(session, now, config.Current().Location()) {
+		if o.Start.After(now) && !missed[o.Start.Unix()] {
+			upcoming = append(upcoming, o)
+		}
+	}
+	return upcoming, credits
+}
+
+// availableMakeUps returns an account's unused, unexpired make-up
+// credits in any session.
+func availableMakeUps(c appengine.Context, accountID string, now time.Time) []*makeups.Credit {
+	all, err := makeups.ForAccount(c, accountID)
+	if err != nil {
+		c.Errorf("Failed to find make-up credits for %q: %s", accountID, err)
+		return nil
+	}
+	available := []*makeups.Credit{}
+	for _, credit := range all {
+		if !credit.Used() && !credit.Expired(now) {
+			available = append(available, credit)
+		}
+	}
+	return available
+}
@@ -0,0 +1,194 @@
+package innerhearth
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"appengine"
+
+	"github.com/decitrig/innerhearth/account"
+	"github.com/decitrig/innerhearth/auth"
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/config"
+	"github.com/decitrig/innerhearth/memberships"
+	"github.com/decitrig/innerhearth/pricing"
+	"github.com/decitrig/innerhearth/staff"
+	"github.com/decitrig/innerhearth/students"
+	"github.com/decitrig/innerhearth/webapp"
+)
+
+var (
+	membershipsPage = newPage("templates/staff/memberships.html", nil)
+)
+
+// membershipEntry is a membership together with its session and
+// holder, for display.
+type membershipEntry struct {
+	*memberships.Membership
+	Session *classes.Session
+	Account *account.Account
+	Usage   *memberships.Usage
+}
+
+// currentMemberships returns an account's memberships in sessions
+// which have not yet ended. Errors are logged and the affected
+// memberships skipped.
+func currentMemberships(c appengine.Context, accountID string, now time.Time) []*membershipEntry {
+	all, err := memberships.ForAccount(c, accountID)
+	if err != nil {
+		c.Errorf("Failed to find memberships for %q: %s", accountID, err)
+		return nil
+	}
+	current := []*membershipEntry{}
+	for _, m := range all {
+		session, err := classes.SessionWithID(c, m.SessionID)
+		if err != nil {
+			c.Errorf("Failed to find session %d: %s", m.SessionID, err)
+			continue
+		}
+		if session.End.Before(now) {
+			continue
+		}
+		current = append(current, &membershipEntry{Membership: m, Session: session})
+	}
+	return current
+}
+
+type membershipsByName []*membershipEntry
+
+func (l membershipsByName) Len() int      { return len(l) }
+func (l membershipsByName) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l membershipsByName) Less(i, j int) bool {
+	a, b := l[i].Account, l[j].Account
+	if a == nil || b == nil {
+		return b != nil
+	}
+	if a.LastName != b.LastName {
+		return a.LastName < b.LastName
+	}
+	return a.FirstName < b.FirstName
+}
+
+// updateMembership handles a staff request to issue or revoke a
+// membership in a session.
+func updateMembership(w http.ResponseWriter, r *http.Request, c appengine.Context, staffAccount *staff.Staff, session *classes.Session) *webapp.Error {
+	switch r.FormValue("action") {
+	case "issue":
+		acct, err := account.WithEmail(c, r.FormValue("email"))
+		if err != nil {
+			return invalidData(w, fmt.Sprintf("No account found for %q", r.FormValue("email")))
+		}
+		var price pricing.Cents
+		if s := r.FormValue("price"); s != "" {
+			if price, err = pricing.ParseCents(s); err != nil {
+				return invalidData(w, "Invalid price; please enter dollars, e.g. 250")
+			}
+		}
+		m := memberships.New(acct.ID, session.ID, price, staffAccount.Email, time.Now())
+		if err := m.Put(c); err != nil {
+			return webapp.InternalError(fmt.Errorf("failed to store membership: %s", err))
+		}
+		c.Infof("%s issued a membership in %d to %q", staffAccount.Email, session.ID, acct.Email)
+		recordMembershipOrder(c, m, session, fmt.Sprintf("%s %s", acct.FirstName, acct.LastName), acct.Email, m.Created)
+	case "revoke":
+		m, err := memberships.ForSession(c, r.FormValue("account"), session.ID)
+		switch err {
+		case nil:
+			break
+		case memberships.ErrMembershipNotFound:
+			return invalidData(w, "No such membership")
+		default:
+			return webapp.InternalError(fmt.Errorf("failed to find membership: %s", err))
+		}
+		if err := m.Delete(c); err != nil {
+			return webapp.InternalError(fmt.Errorf("failed to revoke membership: %s", err))
+		}
+		c.Infof("%s revoked the membership of %q in %d", staffAccount.Email, m.AccountID, session.ID)
+	default:
+		return invalidData(w, "Unknown action")
+	}
+	return nil
+}
+
+// staffMemberships lists the memberships in a session along with how
+// much each has been used, and issues and revokes memberships.
+func staffMemberships(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	staffAccount, ok := staffContext(r)
+	if !ok {
+		return webapp.UnauthorizedError(fmt.Errorf("only staff may manage memberships"))
+	}
+	id, err := strconv.ParseInt(r.FormValue("session"), 10, 64)
+	if err != nil {
+		return invalidData(w, "Couldn't parse session ID")
+	}
+	session, err := classes.SessionWithID(c, id)
+	switch err {
+	case nil:
+		break
+	case classes.ErrSessionNotFound:
+		return invalidData(w, "No such session")
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to find session %d: %s", id, err))
+	}
+	if r.Method == "POST" {
+		token, err := auth.TokenForRequest(c, staffAccount.ID, r.URL.Path)
+		if err != nil {
+			return webapp.UnauthorizedError(fmt.Errorf("didn't find an auth token"))
+		}
+		if !token.IsValid(r.FormValue(auth.TokenFieldName), time.Now()) {
+			return webapp.UnauthorizedError(fmt.Errorf("invalid auth token"))
+		}
+		if werr := updateMembership(w, r, c, staffAccount, session); werr != nil {
+			return werr
+		}
+		token.Delete(c)
+		http.Redirect(w, r, fmt.Sprintf("/staff/memberships?session=%d", session.ID), http.StatusSeeOther)
+		return nil
+	}
+	all, err := memberships.InSession(c, session.ID)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to list memberships in %d: %s", session.ID, err))
+	}
+	sessionClasses := session.Classes(c)
+	loc := config.Current().Location()
+	entries := make([]*membershipEntry, len(all))
+	total := &memberships.Usage{}
+	var revenue pricing.Cents
+	for i, m := range all {
+		entries[i] = &membershipEntry{
+			Membership: m,
+			Session:    session,
+			Usage:      memberships.UsageOf(session, sessionClasses, students.WithID(c, m.AccountID), loc),
+		}
+		if acct, err := account.WithID(c, m.AccountID); err == nil {
+			entries[i].Account = acct
+		}
+		total.SessionClasses += entries[i].Usage.SessionClasses
+		total.DropIns += entries[i].Usage.DropIns
+		total.Meetings += entries[i].Usage.Meetings
+		revenue += m.Price
+	}
+	sort.Sort(membershipsByName(entries))
+	token, err := auth.NewToken(staffAccount.ID, r.URL.Path, time.Now())
+	if err != nil {
+		return webapp.InternalError(err)
+	}
+	if err := token.Store(c); err != nil {
+		return webapp.InternalError(err)
+	}
+	data := map[string]interface{}{
+		"Token":       token.Encode(),
+		"Session":     session,
+		"Memberships": entries,
+		"Total":       total,
+		"Revenue":     revenue,
+	}
+	if err := membershipsPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
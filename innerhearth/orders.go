@@ -0,0 +1,165 @@
+package innerhearth
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"appengine"
+
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/config"
+	"github.com/decitrig/innerhearth/memberships"
+	"github.com/decitrig/innerhearth/orders"
+	"github.com/decitrig/innerhearth/passes"
+	"github.com/decitrig/innerhearth/pricing"
+	"github.com/decitrig/innerhearth/students"
+	"github.com/decitrig/innerhearth/webapp"
+)
+
+var (
+	ordersPage  = newPage("templates/account/orders.html", nil)
+	receiptPage = newPage("templates/account/receipt.html", nil)
+)
+
+func init() {
+	webapp.HandleFunc("/account/orders", userContextHandler(webapp.HandlerFunc(orderHistory)))
+	webapp.HandleFunc("/account/orders/receipt", userContextHandler(webapp.HandlerFunc(receipt)))
+}
+
+// registrationDescription describes a registration for a receipt.
+func registrationDescription(c appengine.Context, student *students.Student, class *classes.Class) string {
+	cfg := config.Current()
+	if class.Workshop != 0 {
+		return fmt.Sprintf("%s, workshop on %s at %s", class.Title, cfg.FormatDate(student.Date), cfg.FormatTime(student.Date))
+	}
+	if class.YinYogassage != 0 {
+		return fmt.Sprintf("%s on %s at %s", class.Title, cfg.FormatDate(student.Date), cfg.FormatTime(student.Date))
+	}
+	if class.Series != 0 {
+		return fmt.Sprintf("%s, series starting %s at %s", class.Title, cfg.FormatDate(student.Date), cfg.FormatTime(student.Date))
+	}
+	if student.DropIn {
+		return fmt.Sprintf("%s, drop-in class on %s", class.Title, cfg.FormatDate(student.Date))
+	}
+	description := fmt.Sprintf("%s, %ss at %s", class.Title, class.Weekday, cfg.FormatTime(class.StartTime))
+	if session, err := classes.SessionWithID(c, class.Session); err == nil {
+		description = fmt.Sprintf("%s (%s session, %s - %s)", description, session.Name, cfg.FormatDate(session.Start), cfg.FormatDate(session.End))
+	}
+	return description
+}
+
+// registrationOrder returns an order for a registration, itemized
+// with any promotional discount taken off its price.
+func registrationOrder(c appengine.Context, id string, student *students.Student, class *classes.Class, now time.Time) *orders.Order {
+	o := orders.New(id, student.ID, fmt.Sprintf("%s %s", student.FirstName, student.LastName), student.Email, now)
+	price := student.Price
+	if !student.Priced {
+		price = student.AmountPaid
+	}
+	o.Add(registrationDescription(c, student, class), price+student.PromoDiscount)
+	if student.PromoDiscount > 0 {
+		o.Add(fmt.Sprintf("Promo code %s", student.PromoCode), -student.PromoDiscount)
+	}
+	return o
+}
+
+// recordOrder stores a new order and sends its receipt. Errors are
+// logged; a purchase which has already been recorded is ignored.
+func recordOrder(c appengine.Context, o *orders.Order) {
+	switch err := o.Insert(c); err {
+	case nil, orders.ErrOrderExists:
+		break
+	default:
+		c.Errorf("Failed to record order %q for %q: %s", o.ID, o.Email, err)
+	}
+}
+
+// recordCreditOrder records the order for a registration paid for, in
+// whole or in part, with account credit and without an online payment.
+func recordCreditOrder(c appengine.Context, student *students.Student, class *classes.Class, now time.Time) {
+	id := fmt.Sprintf("credit-%s-%d-%d", student.ID, class.ID, now.UnixNano())
+	o := registrationOrder(c, id, student, class, now)
+	o.Pay(students.AccountCredit, student.CreditApplied)
+	recordOrder(c, o)
+}
+
+// recordDeskOrder records the order for a payment towards a
+// registration taken at the studio. previous is the amount which had
+// already been paid.
+func recordDeskOrder(c appengine.Context, student *students.Student, class *classes.Class, previous, amount pricing.Cents, method students.PaymentMethod, now time.Time) {
+	id := fmt.Sprintf("desk-%s-%d-%d", student.ID, class.ID, now.UnixNano())
+	o := registrationOrder(c, id, student, class, now)
+	o.Pay(orders.Earlier, previous)
+	o.Pay(method, amount)
+	recordOrder(c, o)
+}
+
+// recordPassOrder records the sale of a pass by staff.
+func recordPassOrder(c appengine.Context, pass *passes.Pass, name, email string, now time.Time) {
+	if pass.Price == 0 {
+		return
+	}
+	o := orders.New(fmt.Sprintf("pass-%d", pass.ID), pass.AccountID, name, email, now)
+	o.Add(fmt.Sprintf("%s (%d classes)", pass.Name, pass.Credits), pass.Price)
+	o.Pay(orders.AtStudio, pass.Price)
+	recordOrder(c, o)
+}
+
+// recordMembershipOrder records the sale of a membership by staff.
+func recordMembershipOrder(c appengine.Context, m *memberships.Membership, session *classes.Session, name, email string, now time.Time) {
+	if m.Price == 0 {
+		return
+	}
+	o := orders.New(fmt.Sprintf("membership-%s-%d-%d", m.AccountID, m.SessionID, now.UnixNano()), m.AccountID, name, email, now)
+	cfg := config.Current()
+	o.Add(fmt.Sprintf("Unlimited membership, %s session (%s - %s)", session.Name, cfg.FormatDate(session.Start), cfg.FormatDate(session.End)), m.Price)
+	o.Pay(orders.AtStudio, m.Price)
+	recordOrder(c, o)
+}
+
+// orderHistory lists the orders made by the current user.
+func orderHistory(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	acct, ok := userContext(r)
+	if !ok {
+		return badRequest(w, "Must be logged in.")
+	}
+	list, err := orders.ForAccount(c, acct.ID)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to find orders for %q: %s", acct.ID, err))
+	}
+	data := map[string]interface{}{
+		"Orders": list,
+	}
+	if err := ordersPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
+
+// receipt shows a printable receipt for one of the current user's
+// orders.
+func receipt(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	acct, ok := userContext(r)
+	if !ok {
+		return badRequest(w, "Must be logged in.")
+	}
+	o, err := orders.WithID(c, r.FormValue("id"))
+	switch err {
+	case nil:
+		break
+	case orders.ErrOrderNotFound:
+		return invalidData(w, "No such order")
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to find order: %s", err))
+	}
+	if o.AccountID != acct.ID {
+		return webapp.UnauthorizedError(fmt.Errorf("order %q does not belong to %q", o.ID, acct.ID))
+	}
+	if err := receiptPage.Execute(w, o); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package innerhearth
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"appengine"
+
+	"github.com/decitrig/innerhearth/auth"
+	"github.com/decitrig/innerhearth/cache"
+	"github.com/decitrig/innerhearth/pages"
+	"github.com/decitrig/innerhearth/webapp"
+)
+
+var (
+	aboutPage       = newPage("templates/about.html", nil)
+	mailingListPage = newPage("templates/mailinglist.html", nil)
+	staffPagesPage  = newPage("templates/staff/pages.html", nil)
+	editPagePage    = newPage("templates/staff/edit-page.html", nil)
+
+	// pageCache holds the current content of editable pages.
+	pageCache cache.Cache = cache.Memcache{}
+)
+
+// An editablePage is a page whose content staff may change at
+// /staff/pages. Until its content is first saved, a page shows the
+// "PageContent" template defined in its template file.
+type editablePage struct {
+	Slug  string
+	Path  string
+	Title string
+
+	template *template.Template
+}
+
+var editablePages = []*editablePage{
+	{"about", "/about", "About Us", aboutPage},
+	{"pricing", "/pricing", "Pricing & Policies", pricingPage},
+	{"privates-groups", "/privates-groups", "Private & Group Lessons", privatesGroupsPage},
+	{"mailinglist", "/mailinglist", "Mailing List", mailingListPage},
+}
+
+func init() {
+	webapp.HandleFunc("/about", contentPage(editablePages[0]))
+	webapp.HandleFunc("/mailinglist", contentPage(editablePages[3]))
+}
+
+func editablePageWithSlug(slug string) *editablePage {
+	for _, p := range editablePages {
+		if p.Slug == slug {
+			return p
+		}
+	}
+	return nil
+}
+
+// defaultContent returns the page's built-in content, as it would be
+// stored if saved as HTML.
+func (p *editablePage) defaultContent() (string, error) {
+	buf := &bytes.Buffer{}
+	if err := p.template.ExecuteTemplate(buf, "PageContent", nil); err != nil {
+		return "", err
+	}
+	return pages.Clean(pages.HTML, buf.String()), nil
+}
+
+// pageContent returns the saved content of an editable page, or nil
+// if the page should show its built-in content.
+func pageContent(c appengine.Context, slug string) *pages.Page {
+	switch p, err := pages.Cached(c, pageCache, slug); err {
+	case nil:
+		return p
+	case pages.ErrPageNotFound:
+		return nil
+	default:
+		c.Errorf("Failed to find content for page %q: %s", slug, err)
+		return nil
+	}
+}
+
+// contentPage serves an editable page which has no other data.
+func contentPage(p *editablePage) webapp.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) *webapp.Error {
+		c := appengine.NewContext(r)
+		data := map[string]interface{}{
+			"Page": pageContent(c, p.Slug),
+		}
+		if err := p.template.Execute(w, data); err != nil {
+			return webapp.InternalError(fmt.Errorf("failed to render page %q: %s", p.Slug, err))
+		}
+		return nil
+	}
+}
+
+// pageSummary is an editable page along with its saved content, if
+// any.
+type pageSummary struct {
+	*editablePage
+	Content *pages.Page
+}
+
+// staffPages lists the pages which staff may edit.
+func staffPages(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	summaries := make([]*pageSummary, len(editablePages))
+	for i, p := range editablePages {
+		content, err := pages.WithSlug(c, p.Slug)
+		if err != nil && err != pages.ErrPageNotFound {
+			return webapp.InternalError(fmt.Errorf("failed to find page %q: %s", p.Slug, err))
+		}
+		summaries[i] = &pageSummary{p, content}
+	}
+	data := map[string]interface{}{
+		"Pages": summaries,
+	}
+	if err := staffPagesPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
+
+// editPage edits the content of a page, previews changes, and
+// restores earlier revisions.
+func editPage(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	staffAccount, ok := staffContext(r)
+	if !ok {
+		return webapp.UnauthorizedError(fmt.Errorf("only staff may edit pages"))
+	}
+	p := editablePageWithSlug(r.FormValue("page"))
+	if p == nil {
+		return invalidData(w, "No such page")
+	}
+	redirect := fmt.Sprintf("/staff/edit-page?page=%s", p.Slug)
+	data := map[string]interface{}{
+		"Page":    p,
+		"Formats": pages.Formats,
+	}
+	if r.Method == "POST" {
+		token, ok := checkToken(c, staffAccount.ID, r.URL.Path, r.FormValue(auth.TokenFieldName))
+		if !ok {
+			return webapp.UnauthorizedError(fmt.Errorf("invalid auth token"))
+		}
+		switch action := r.FormValue("action"); action {
+		case "preview", "save":
+			format, err := pages.ParseFormat(r.FormValue("format"))
+			if err != nil {
+				return invalidData(w, "Unknown page format")
+			}
+			if action == "preview" {
+				// Looking up the token removed it from the datastore;
+				// store it again so that the previewed page can be saved.
+				if err := token.Store(c); err != nil {
+					return webapp.InternalError(err)
+				}
+				body := pages.Clean(format, r.FormValue("body"))
+				data["Token"] = token.Encode()
+				data["Format"] = format
+				data["Body"] = body
+				data["Note"] = r.FormValue("note")
+				data["Preview"] = pages.Render(format, body)
+				return renderEditPage(w, c, p, data)
+			}
+			rev, err := pages.Revise(c, pageCache, p.Slug, format, r.FormValue("body"), r.FormValue("note"), staffAccount.Email, time.Now())
+			if err != nil {
+				return webapp.InternalError(fmt.Errorf("failed to save page %q: %s", p.Slug, err))
+			}
+			c.Infof("%s saved revision %d of page %q", staffAccount.Email, rev.Number, p.Slug)
+		case "rollback":
+			number, err := strconv.Atoi(r.FormValue("revision"))
+			if err != nil {
+				return invalidData(w, "Invalid revision")
+			}
+			switch rev, err := pages.Rollback(c, pageCache, p.Slug, number, staffAccount.Email, time.Now()); err {
+			case nil:
+				c.Infof("%s restored revision %d of page %q as %d", staffAccount.Email, number, p.Slug, rev.Number)
+			case pages.ErrRevisionNotFound:
+				return invalidData(w, "No such revision")
+			default:
+				return webapp.InternalError(fmt.Errorf("failed to restore page %q: %s", p.Slug, err))
+			}
+		default:
+			return invalidData(w, "Unknown action")
+		}
+		token.Delete(c)
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return nil
+	}
+	token, err := storeNewToken(c, staffAccount.ID, r.URL.Path)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to store token: %s", err))
+	}
+	data["Token"] = token.Encode()
+	if n := r.FormValue("revision"); n != "" {
+		number, err := strconv.Atoi(n)
+		if err != nil {
+			return invalidData(w, "Invalid revision")
+		}
+		rev, err := pages.RevisionWithNumber(c, p.Slug, number)
+		if err != nil {
+			return invalidData(w, "No such revision")
+		}
+		data["Viewing"] = rev
+		data["Format"] = rev.Format
+		data["Body"] = rev.BodyText()
+		data["Preview"] = pages.Render(rev.Format, rev.BodyText())
+		return renderEditPage(w, c, p, data)
+	}
+	switch content, err := pages.WithSlug(c, p.Slug); err {
+	case nil:
+		data["Format"] = content.Format
+		data["Body"] = content.BodyText()
+	case pages.ErrPageNotFound:
+		body, err := p.defaultContent()
+		if err != nil {
+			return webapp.InternalError(fmt.Errorf("failed to render content of page %q: %s", p.Slug, err))
+		}
+		data["Format"] = pages.HTML
+		data["Body"] = body
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to find page %q: %s", p.Slug, err))
+	}
+	return renderEditPage(w, c, p, data)
+}
+
+func renderEditPage(w http.ResponseWriter, c appengine.Context, p *editablePage, data map[string]interface{}) *webapp.Error {
+	revs, err := pages.Revisions(c, p.Slug)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to list revisions of page %q: %s", p.Slug, err))
+	}
+	data["Revisions"] = revs
+	if err := editPagePage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package innerhearth
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+
+	"github.com/decitrig/innerhearth/account"
+	"github.com/decitrig/innerhearth/auth"
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/ledger"
+	"github.com/decitrig/innerhearth/memberships"
+	"github.com/decitrig/innerhearth/passes"
+	"github.com/decitrig/innerhearth/pricing"
+	"github.com/decitrig/innerhearth/staff"
+	"github.com/decitrig/innerhearth/students"
+	"github.com/decitrig/innerhearth/webapp"
+)
+
+var (
+	passesPage = newPage("templates/staff/passes.html", nil)
+)
+
+func init() {
+	webapp.HandleFunc("/register/cancel", userContextHandler(webapp.HandlerFunc(cancelOwnRegistration)))
+	webapp.HandleFunc("/roster/cancel", userContextHandler(webapp.HandlerFunc(cancelStudent)))
+}
+
+// registerWithPass adds a drop-in registration paid for with a credit
+// from one of the student's passes.
+func registerWithPass(w http.ResponseWriter, r *http.Request, student *students.Student, class *classes.Class) *webapp.Error {
+	c := appengine.NewContext(r)
+	if memberships.IsMember(c, student.ID, class.Session) {
+		// Members register for free; don't use up a credit.
+		return register(w, r, student, class)
+	}
+	passID, err := strconv.ParseInt(r.FormValue("pass"), 10, 64)
+	if err != nil {
+		return invalidData(w, "Couldn't parse pass ID")
+	}
+	now := time.Now()
+	confirmed := fmt.Sprintf("/register/confirmed?class=%d", class.ID)
+	if _, err := students.WithIDInClass(c, student.ID, class, now); err == nil {
+		http.Redirect(w, r, confirmed, http.StatusSeeOther)
+		return nil
+	}
+	setPrice(c, student, class, now)
+	switch err := passes.Redeem(c, passID, student, now); err {
+	case nil, students.ErrAlreadyRegistered:
+		break
+	case students.ErrClassIsFull:
+		if err := classFullPage.Execute(w, class); err != nil {
+			return webapp.InternalError(err)
+		}
+		return nil
+	case passes.ErrPassNotFound, passes.ErrWrongAccount:
+		return invalidData(w, "No such pass")
+	case passes.ErrNoCredits:
+		return invalidData(w, "Your pass has no credits remaining.")
+	case passes.ErrPassExpired:
+		return invalidData(w, "Your pass has expired.")
+	case passes.ErrNotEligible:
+		return invalidData(w, "Your pass can't be used for this class.")
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to redeem pass %d: %s", passID, err))
+	}
+	http.Redirect(w, r, confirmed, http.StatusSeeOther)
+	return nil
+}
+
+// studentForCancel returns the class and registration named in a
+// cancellation request.
+func studentForCancel(w http.ResponseWriter, r *http.Request, studentID string) (*classes.Class, *students.Student, *webapp.Error) {
+	c := appengine.NewContext(r)
+	id, err := strconv.ParseInt(r.FormValue("class"), 10, 64)
+	if err != nil {
+		return nil, nil, invalidData(w, "Invalid class ID")
+	}
+	class, err := classes.ClassWithID(c, id)
+	if err != nil {
+		return nil, nil, invalidData(w, "No such class.")
+	}
+	student, err := students.WithIDInClass(c, studentID, class, time.Now())
+	switch err {
+	case nil:
+		return class, student, nil
+	case students.ErrStudentNotFound:
+		return nil, nil, invalidData(w, "No such registration.")
+	default:
+		return nil, nil, webapp.InternalError(fmt.Errorf("failed to find student %q in %d: %s", studentID, class.ID, err))
+	}
+}
+
+// cancelOwnRegistration lets a student cancel one of their own
+// registrations.
+func cancelOwnRegistration(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Method not allowed")
+		return nil
+	}
+	c := appengine.NewContext(r)
+	acct, ok := userContext(r)
+	if !ok {
+		return badRequest(w, "Must be logged in.")
+	}
+	token, ok := checkToken(c, acct.ID, r.URL.Path, r.FormValue(auth.TokenFieldName))
+	if !ok {
+		return webapp.UnauthorizedError(fmt.Errorf("Invalid auth token"))
+	}
+	class, student, werr := studentForCancel(w, r, acct.ID)
+	if student == nil {
+		return werr
+	}
+	if err := cancelRegistration(c, student, class, ledger.ByPolicy, acct.Email, time.Now()); err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to cancel %q in %d: %s", student.Email, class.ID, err))
+	}
+	token.Delete(c)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
+}
+
+// cancelStudent lets staff or a class's teacher cancel a student's
+// registration from the roster.
+func cancelStudent(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Method not allowed")
+		return nil
+	}
+	c := appengine.NewContext(r)
+	acct, ok := userContext(r)
+	if !ok {
+		return badRequest(w, "Must be logged in.")
+	}
+	token, ok := checkToken(c, acct.ID, r.URL.Path, r.FormValue(auth.TokenFieldName))
+	if !ok {
+		return webapp.UnauthorizedError(fmt.Errorf("Invalid auth token"))
+	}
+	class, student, werr := studentForCancel(w, r, r.FormValue("student"))
+	if student == nil {
+		return werr
+	}
+	staffer, _ := staff.WithID(c, acct.ID)
+	if !canViewRoster(staffer, acct, class.TeacherEntity(c)) {
+		return webapp.UnauthorizedError(fmt.Errorf("only staff or teachers can cancel registrations"))
+	}
+	res, ok := parseResolution(r.FormValue("resolution"))
+	if !ok {
+		return invalidData(w, "Unknown resolution")
+	}
+	if res != ledger.ByPolicy && staffer == nil {
+		return webapp.UnauthorizedError(fmt.Errorf("only staff can override the refund policy"))
+	}
+	if err := cancelRegistration(c, student, class, res, acct.Email, time.Now()); err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to cancel %q in %d: %s", student.Email, class.ID, err))
+	}
+	c.Infof("%s cancelled registration of %q in %d (%s)", acct.Email, student.Email, class.ID, res)
+	token.Delete(c)
+	http.Redirect(w, r, fmt.Sprintf("/roster?class=%d", class.ID), http.StatusSeeOther)
+	return nil
+}
+
+func parsePass(r *http.Request, acct *account.Account, createdBy string, now time.Time) (*passes.Pass, error) {
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		return nil, fmt.Errorf("a name is required")
+	}
+	credits, err := strconv.Atoi(r.FormValue("credits"))
+	if err != nil || credits <= 0 {
+		return nil, fmt.Errorf("invalid number of credits %q", r.FormValue("credits"))
+	}
+	var expires time.Time
+	if s := r.FormValue("expires"); s != "" {
+		if expires, err = parseLocalDate(s); err != nil {
+			return nil, fmt.Errorf("invalid expiration date; please use mm/dd/yyyy format")
+		}
+		// Passes are good through the end of their expiration date.
+		expires = expires.AddDate(0, 0, 1)
+	}
+	types := []classes.Type{}
+	for _, t := range classes.Types {
+		if r.FormValue(fmt.Sprintf("type%d", int(t))) != "" {
+			types = append(types, t)
+		}
+	}
+	var price pricing.Cents
+	if s := r.FormValue("price"); s != "" {
+		if price, err = pricing.ParseCents(s); err != nil {
+			return nil, err
+		}
+	}
+	return passes.New(acct.ID, name, credits, expires, types, price, createdBy, now), nil
+}
+
+// passEntry is a pass together with its owner, for display.
+type passEntry struct {
+	*passes.Pass
+	Account *account.Account
+}
+
+// staffPasses lists recently issued passes and issues new passes to
+// students.
+func staffPasses(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	staffAccount, ok := staffContext(r)
+	if !ok {
+		return webapp.UnauthorizedError(fmt.Errorf("only staff may issue passes"))
+	}
+	if r.Method == "POST" {
+		token, err := auth.TokenForRequest(c, staffAccount.ID, r.URL.Path)
+		if err != nil {
+			return webapp.UnauthorizedError(fmt.Errorf("didn't find an auth token"))
+		}
+		if !token.IsValid(r.FormValue(auth.TokenFieldName), time.Now()) {
+			return webapp.UnauthorizedError(fmt.Errorf("invalid auth token"))
+		}
+		acct, err := account.WithEmail(c, r.FormValue("email"))
+		if err != nil {
+			return invalidData(w, fmt.Sprintf("No account found for %q", r.FormValue("email")))
+		}
+		pass, err := parsePass(r, acct, staffAccount.Email, time.Now())
+		if err != nil {
+			return invalidData(w, fmt.Sprintf("Invalid pass: %s", err))
+		}
+		if err := pass.Insert(c); err != nil {
+			return webapp.InternalError(fmt.Errorf("failed to store pass: %s", err))
+		}
+		recordPassOrder(c, pass, fmt.Sprintf("%s %s", acct.FirstName, acct.LastName), acct.Email, pass.Created)
+		token.Delete(c)
+		http.Redirect(w, r, "/staff/passes", http.StatusSeeOther)
+		return nil
+	}
+	recent, err := passes.Recent(c, 50)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to list passes: %s", err))
+	}
+	entries := make([]*passEntry, len(recent))
+	for i, p := range recent {
+		entries[i] = &passEntry{Pass: p}
+		if acct, err := account.WithID(c, p.AccountID); err == nil {
+			entries[i].Account = acct
+		}
+	}
+	token, err := auth.NewToken(staffAccount.ID, r.URL.Path, time.Now())
+	if err != nil {
+		return webapp.InternalError(err)
+	}
+	if err := token.Store(c); err != nil {
+		return webapp.InternalError(err)
+	}
+	data := map[string]interface{}{
+		"Token":  token.Encode(),
+		"Passes": entries,
+		"Types":  classes.Types,
+	}
+	if err := passesPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package innerhearth
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"appengine"
+
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/config"
+	"github.com/decitrig/innerhearth/ledger"
+	"github.com/decitrig/innerhearth/payments"
+	"github.com/decitrig/innerhearth/promos"
+	"github.com/decitrig/innerhearth/students"
+	"github.com/decitrig/innerhearth/webapp"
+)
+
+var (
+	fakeCheckoutPage  = newPage("templates/payments/fake-checkout.html", nil)
+	paymentFailedPage = newPage("templates/payments/failed.html", nil)
+)
+
+func init() {
+	webapp.HandleFunc("/payments/return", userContextHandler(webapp.HandlerFunc(paymentReturn)))
+	webapp.HandleFunc("/payments/fake-checkout", userContextHandler(webapp.HandlerFunc(fakeCheckout)))
+	webapp.HandleFunc("/task/release-expired-reservations", releaseExpiredReservations)
+}
+
+// fakeProcessor takes pretend payments on the development server.
+var fakeProcessor = payments.Fake{CheckoutPath: "/payments/fake-checkout"}
+
+// processorFor returns the processor which takes payment for
+// registrations, as configured on the admin payments page. The
+// development server uses the fake processor unless a real one is
+// configured. If it returns nil, students register without paying and
+// pay at the studio.
+func processorFor(c appengine.Context) payments.Processor {
+	settings, err := payments.GetSettings(c)
+	if err != nil {
+		c.Errorf("Failed to load payment settings: %s", err)
+	} else if proc := settings.Processor(); proc != nil {
+		return proc
+	}
+	if appengine.IsDevAppServer() {
+		return fakeProcessor
+	}
+	if err == nil {
+		c.Errorf("No payment processor is configured; online payment is disabled until one is set up at /admin/payments")
+	}
+	return nil
+}
+
+// register adds a student's registration in a class. If payment is
+// required, the student's spot is reserved and they are sent to the
+// payment processor; otherwise they are sent to the confirmation
+// page.
+func register(w http.ResponseWriter, r *http.Request, student *students.Student, class *classes.Class) *webapp.Error {
+	c := appengine.NewContext(r)
+	now := time.Now()
+	confirmed := fmt.Sprintf("/register/confirmed?class=%d", class.ID)
+	if _, err := students.WithIDInClass(c, student.ID, class, now); err == nil {
+		http.Redirect(w, r, confirmed, http.StatusSeeOther)
+		return nil
+	}
+	q, err := quote(c, student, class, now)
+	if err != nil {
+		return webapp.InternalError(err)
+	}
+	var usePromo func(c appengine.Context) error
+	if code := promos.Normalize(r.FormValue("promo")); code != "" && !q.Member {
+		promo, err := promos.WithCode(c, code)
+		switch err {
+		case nil:
+			break
+		case promos.ErrCodeNotFound:
+			return invalidData(w, fmt.Sprintf("Unknown promo code %q", code))
+		default:
+			return webapp.InternalError(fmt.Errorf("failed to find promo %q: %s", code, err))
+		}
+		if err := promo.Check(class, now); err != nil {
+			return invalidData(w, promoError(err))
+		}
+		q.ApplyPromo(promo.Code, promo.DiscountOn(q.Total))
+		student.PromoCode = q.PromoCode
+		student.PromoDiscount = q.Promo
+		usePromo = func(c appengine.Context) error {
+			return promos.Use(c, promo.Code, class, now)
+		}
+	}
+	student.SetPrice(q.Total)
+	if q.Member {
+		student.RecordPayment(0, students.Membership, "membership", now)
+	}
+	if r.FormValue("usecredit") != "" && q.Total > 0 {
+		if applied := creditBalance(c, student.ID); applied > 0 {
+			if applied > q.Total {
+				applied = q.Total
+			}
+			student.RecordPayment(applied, students.AccountCredit, "account credit", now)
+			student.CreditApplied = applied
+		}
+	}
+	addWith := func(c appengine.Context) error {
+		if usePromo != nil {
+			if err := usePromo(c); err != nil {
+				return err
+			}
+		}
+		if student.CreditApplied > 0 {
+			return ledger.Apply(c, student.ID, student.CreditApplied, class.ID, now)
+		}
+		return nil
+	}
+	var payment *payments.Payment
+	proc := processorFor(c)
+	if owed := student.Balance(); proc != nil && owed > 0 {
+		payment, err = payments.New(student, registrationDescription(c, student, class), owed, now)
+		if err != nil {
+			return webapp.InternalError(err)
+		}
+		student.Reserve(payment.ID, payment.Expires)
+	}
+	switch err := student.AddWith(c, now, addWith); err {
+	case nil:
+		break
+	case students.ErrAlreadyRegistered:
+		http.Redirect(w, r, confirmed, http.StatusSeeOther)
+		return nil
+	case students.ErrClassIsFull:
+		if err := classFullPage.Execute(w, class); err != nil {
+			return webapp.InternalError(err)
+		}
+		return nil
+	case promos.ErrNotStarted, promos.ErrCodeExpired, promos.ErrNoUsesRemaining, promos.ErrNotApplicable:
+		return invalidData(w, promoError(err))
+	case ledger.ErrInsufficientCredit:
+		return invalidData(w, "Your account credit has changed; please try again.")
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to write student: %s", err))
+	}
+	if payment == nil {
+		if student.CreditApplied > 0 {
+			recordCreditOrder(c, student, class, now)
+		}
+		http.Redirect(w, r, confirmed, http.StatusSeeOther)
+		return nil
+	}
+	returnURL := config.Current().URL("/payments/return?payment=" + payment.ID)
+	checkoutURL, err := payments.Start(c, proc, payment, returnURL)
+	if err != nil {
+		if err := student.Delete(c); err != nil {
+			c.Errorf("Failed to release reservation of %q in %d: %s", student.ID, class.ID, err)
+		}
+		if student.PromoCode != "" {
+			if err := promos.Return(c, student.PromoCode); err != nil {
+				c.Errorf("Failed to return use of promo %q: %s", student.PromoCode, err)
+			}
+		}
+		if student.CreditApplied > 0 {
+			e := ledger.NewEntry(student.ID, ledger.Credit, student.CreditApplied, class.ID, "Checkout failed", student.ID, now)
+			if err := e.Put(c); err != nil {
+				c.Errorf("Failed to return %s credit to %q: %s", student.CreditApplied, student.ID, err)
+			}
+		}
+		return webapp.InternalError(err)
+	}
+	http.Redirect(w, r, checkoutURL, http.StatusSeeOther)
+	return nil
+}
+
+// paymentForRequest returns the payment named in a request, if it
+// belongs to the current user.
+func paymentForRequest(w http.ResponseWriter, r *http.Request) (*payments.Payment, *webapp.Error) {
+	c := appengine.NewContext(r)
+	acct, ok := userContext(r)
+	if !ok {
+		return nil, badRequest(w, "Must be logged in.")
+	}
+	payment, err := payments.WithID(c, r.FormValue("payment"))
+	switch err {
+	case nil:
+		break
+	case payments.ErrPaymentNotFound:
+		return nil, invalidData(w, "No such payment")
+	default:
+		return nil, webapp.InternalError(fmt.Errorf("failed to find payment: %s", err))
+	}
+	if payment.AccountID != acct.ID {
+		return nil, webapp.UnauthorizedError(fmt.Errorf("payment %s does not belong to %q", payment.ID, acct.ID))
+	}
+	return payment, nil
+}
+
+func paymentReturn(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	payment, werr := paymentForRequest(w, r)
+	if payment == nil {
+		return werr
+	}
+	confirmed := fmt.Sprintf("/register/confirmed?class=%d", payment.ClassID)
+	// A payment which was given up on may still have been paid, so its
+	// outcome is checked too.
+	if proc := processorFor(c); payment.Status != payments.Succeeded && proc != nil {
+		status, err := proc.Result(c, payment, r)
+		if err != nil {
+			return webapp.InternalError(fmt.Errorf("failed to get result of payment %s: %s", payment.ID, err))
+		}
+		now := time.Now()
+		switch status {
+		case payments.Succeeded:
+			err = payments.Complete(c, payment, now)
+		case payments.Failed:
+			err = payments.Release(c, proc, payment, payments.Failed, now)
+		}
+		switch err {
+		case nil, payments.ErrNotPending:
+			break
+		case payments.ErrReservationExpired:
+			c.Errorf("Payment %s from %q needs a refund: %s", payment.ID, payment.Email, err)
+		default:
+			return webapp.InternalError(fmt.Errorf("failed to update payment %s: %s", payment.ID, err))
+		}
+	}
+	if payment.Status == payments.Succeeded {
+		if _, err := students.ForPayment(c, payment.AccountID, payment.ClassID, payment.ID); err == nil {
+			http.Redirect(w, r, confirmed, http.StatusSeeOther)
+			return nil
+		}
+	}
+	data := map[string]interface{}{
+		"Payment": payment,
+	}
+	if err := paymentFailedPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
+
+func fakeCheckout(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	if _, ok := processorFor(appengine.NewContext(r)).(payments.Fake); !ok {
+		http.NotFound(w, r)
+		return nil
+	}
+	payment, werr := paymentForRequest(w, r)
+	if payment == nil {
+		return werr
+	}
+	returnURL := "/payments/return?payment=" + payment.ID
+	data := map[string]interface{}{
+		"Payment": payment,
+		"Success": payments.FakeReturnURL(returnURL, true),
+		"Failure": payments.FakeReturnURL(returnURL, false),
+	}
+	if err := fakeCheckoutPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
+
+func releaseExpiredReservations(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	n, err := payments.ReleaseExpired(c, processorFor(c), time.Now())
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to release expired reservations: %s", err))
+	}
+	if n > 0 {
+		c.Infof("Released %d expired reservations", n)
+	}
+	return nil
+}
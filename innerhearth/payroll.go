@@ -0,0 +1,180 @@
+package innerhearth
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"appengine"
+
+	"github.com/decitrig/innerhearth/auth"
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/config"
+	"github.com/decitrig/innerhearth/payroll"
+	"github.com/decitrig/innerhearth/pricing"
+	"github.com/decitrig/innerhearth/webapp"
+)
+
+var (
+	payrollPage = newPage("templates/staff/payroll.html", template.FuncMap{
+		"FormatLocal": formatLocal,
+	})
+)
+
+func parsePayKind(s string) (payroll.Kind, bool) {
+	for _, k := range payroll.Kinds {
+		if string(k) == s {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+func parseFormula(r *http.Request, updatedBy string, now time.Time) (*payroll.Formula, error) {
+	kind, ok := parsePayKind(r.FormValue("kind"))
+	if !ok {
+		return nil, fmt.Errorf("unknown kind of formula")
+	}
+	f := &payroll.Formula{
+		TeacherID: r.FormValue("teacher"),
+		Kind:      kind,
+		Updated:   now,
+		UpdatedBy: updatedBy,
+	}
+	var err error
+	if s := r.FormValue("base"); s != "" {
+		if f.Base, err = pricing.ParseCents(s); err != nil {
+			return nil, fmt.Errorf("invalid base rate %q", s)
+		}
+	}
+	if s := r.FormValue("perhead"); s != "" {
+		if f.PerHead, err = pricing.ParseCents(s); err != nil {
+			return nil, fmt.Errorf("invalid rate per student %q", s)
+		}
+	}
+	if s := r.FormValue("threshold"); s != "" {
+		if f.Threshold, err = strconv.Atoi(s); err != nil || f.Threshold < 0 {
+			return nil, fmt.Errorf("invalid threshold %q", s)
+		}
+	}
+	if !f.Valid() {
+		return nil, fmt.Errorf("please enter the amounts used by a %s formula", kind.Label())
+	}
+	return f, nil
+}
+
+// payrollDates returns the range of dates covered by a payroll
+// report, defaulting to the current month through today. The end of
+// the range is exclusive.
+func payrollDates(r *http.Request, now time.Time) (from, to time.Time, err error) {
+	today := now.In(config.Current().Location())
+	from = time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, today.Location())
+	to = time.Date(today.Year(), today.Month(), today.Day()+1, 0, 0, 0, 0, today.Location())
+	if s := r.FormValue("from"); s != "" {
+		if from, err = parseLocalDate(s); err != nil {
+			return from, to, fmt.Errorf("invalid start date; please use mm/dd/yyyy format")
+		}
+	}
+	if s := r.FormValue("through"); s != "" {
+		if to, err = parseLocalDate(s); err != nil {
+			return from, to, fmt.Errorf("invalid end date; please use mm/dd/yyyy format")
+		}
+		to = to.AddDate(0, 0, 1)
+	}
+	if !from.Before(to) {
+		return from, to, fmt.Errorf("the start date must not be after the end date")
+	}
+	return from, to, nil
+}
+
+// staffPayroll reports what teachers are owed for the classes they
+// taught over a range of dates, either as a page or as CSV, and sets
+// each teacher's pay formula.
+func staffPayroll(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	staffAccount, ok := staffContext(r)
+	if !ok {
+		return webapp.UnauthorizedError(fmt.Errorf("only staff may view payroll"))
+	}
+	if r.Method == "POST" {
+		token, err := auth.TokenForRequest(c, staffAccount.ID, r.URL.Path)
+		if err != nil {
+			return webapp.UnauthorizedError(fmt.Errorf("didn't find an auth token"))
+		}
+		if !token.IsValid(r.FormValue(auth.TokenFieldName), time.Now()) {
+			return webapp.UnauthorizedError(fmt.Errorf("invalid auth token"))
+		}
+		teacher, err := classes.TeacherWithID(c, r.FormValue("teacher"))
+		if err != nil {
+			return invalidData(w, "No such teacher")
+		}
+		f, err := parseFormula(r, staffAccount.Email, time.Now())
+		if err != nil {
+			return invalidData(w, fmt.Sprintf("Invalid pay formula: %s", err))
+		}
+		if err := f.Put(c); err != nil {
+			return webapp.InternalError(fmt.Errorf("failed to store pay formula for %q: %s", teacher.ID, err))
+		}
+		c.Infof("%s set pay formula for %q to %+v", staffAccount.Email, teacher.Email, f)
+		token.Delete(c)
+		http.Redirect(w, r, "/staff/payroll", http.StatusSeeOther)
+		return nil
+	}
+	from, to, err := payrollDates(r, time.Now())
+	if err != nil {
+		return invalidData(w, fmt.Sprintf("Invalid dates: %s", err))
+	}
+	teachers := classes.Teachers(c)
+	if id := r.FormValue("teacher"); id != "" {
+		teacher, err := classes.TeacherWithID(c, id)
+		if err != nil {
+			return invalidData(w, "No such teacher")
+		}
+		teachers = []*classes.Teacher{teacher}
+	}
+	sort.Sort(classes.TeachersByName(teachers))
+	loc := config.Current().Location()
+	reports := []*payroll.Report{}
+	var total pricing.Cents
+	for _, teacher := range teachers {
+		report, err := payroll.ReportFor(c, teacher, from, to, loc)
+		if err != nil {
+			return webapp.InternalError(fmt.Errorf("failed to compute payroll for %q: %s", teacher.ID, err))
+		}
+		reports = append(reports, report)
+		total += report.Total
+	}
+	if r.FormValue("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"payroll-%s-%s.csv\"",
+			from.Format("20060102"), to.AddDate(0, 0, -1).Format("20060102")))
+		if err := payroll.WriteCSV(w, reports, loc); err != nil {
+			return webapp.InternalError(fmt.Errorf("failed to write payroll: %s", err))
+		}
+		return nil
+	}
+	token, err := auth.NewToken(staffAccount.ID, r.URL.Path, time.Now())
+	if err != nil {
+		return webapp.InternalError(err)
+	}
+	if err := token.Store(c); err != nil {
+		return webapp.InternalError(err)
+	}
+	data := map[string]interface{}{
+		"Token":    token.Encode(),
+		"Reports":  reports,
+		"Total":    total,
+		"Kinds":    payroll.Kinds,
+		"Teacher":  r.FormValue("teacher"),
+		"From":     from.Format(dateFormat),
+		"Through":  to.AddDate(0, 0, -1).Format(dateFormat),
+		"Teachers": classes.Teachers(c),
+	}
+	if err := payrollPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+package innerhearth
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"appengine"
+
+	"github.com/decitrig/innerhearth/auth"
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/memberships"
+	"github.com/decitrig/innerhearth/pricing"
+	"github.com/decitrig/innerhearth/schedule"
+	"github.com/decitrig/innerhearth/series"
+	"github.com/decitrig/innerhearth/students"
+	"github.com/decitrig/innerhearth/webapp"
+	"github.com/decitrig/innerhearth/workshops"
+	"github.com/decitrig/innerhearth/yogassage"
+)
+
+var (
+	pricingPage      = newPage("templates/pricing.html", nil)
+	editPricingPage  = newPage("templates/staff/pricing.html", nil)
+	confirmationPage = newPage("templates/registration/confirmed.html", nil)
+)
+
+func init() {
+	webapp.HandleFunc("/pricing", prices)
+	webapp.HandleFunc("/register/confirmed", userContextHandler(webapp.HandlerFunc(registrationConfirmed)))
+}
+
+// otherSessionClasses returns the number of classes in a session,
+// other than the given class, for which an account has a session
+// registration.
+func otherSessionClasses(c appengine.Context, accountID string, class *classes.Class) int {
+	ids := []int64{}
+	for _, s := range students.WithID(c, accountID) {
+		if !s.DropIn && s.ClassID != class.ID {
+			ids = append(ids, s.ClassID)
+		}
+	}
+	n := 0
+	for _, other := range classes.ClassesWithIDs(c, ids) {
+		if other.Session == class.Session {
+			n++
+		}
+	}
+	return n
+}
+
+// quote computes the price of a student's registration in a class as
+// of now. Workshops, Yin Yogassage classes and series have a single
+// price, with no discounts other than promo codes; students joining a
+// series late pay only for the meetings they attend. Session classes
+// are discounted only for a category which staff have verified.
+func quote(c appengine.Context, student *students.Student, class *classes.Class, now time.Time) (*pricing.Quote, error) {
+	if class.Workshop != 0 {
+		w, err := workshops.WithID(c, class.Workshop)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find workshop %d: %s", class.Workshop, err)
+		}
+		return &pricing.Quote{DropIn: true, TierPrice: w.Price, Total: w.Price}, nil
+	}
+	if class.YinYogassage != 0 {
+		yin, err := yogassage.WithID(c, class.YinYogassage)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find yogassage %d: %s", class.YinYogassage, err)
+		}
+		return &pricing.Quote{DropIn: true, TierPrice: yin.Price, Total: yin.Price}, nil
+	}
+	if class.Series != 0 {
+		s, err := series.WithID(c, class.Series)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find series %d: %s", class.Series, err)
+		}
+		price := s.PriceFrom(student.Date)
+		return &pricing.Quote{TierPrice: price, Total: price}, nil
+	}
+	session, err := classes.SessionWithID(c, class.Session)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find session %d: %s", class.Session, err)
+	}
+	rules, err := pricing.ForSession(c, session.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find prices for session %d: %s", session.ID, err)
+	}
+	reg := &pricing.Registration{
+		Session: session,
+		Date:    now,
+		DropIn:  student.DropIn,
+	}
+	if student.Category != pricing.Regular {
+		reg.Category = pricing.VerifiedCategory(c, student.ID)
+	}
+	reg.Member = memberships.IsMember(c, student.ID, session.ID)
+	if !student.DropIn && !reg.Member {
+		reg.OtherClasses = otherSessionClasses(c, student.ID, class)
+	}
+	return rules.Quote(reg), nil
+}
+
+// setPrice records the price of a registration which is about to be
+// added. Failing to find a price is not fatal; the registration is
+// left unpriced.
+func setPrice(c appengine.Context, student *students.Student, class *classes.Class, now time.Time) {
+	q, err := quote(c, student, class, now)
+	if err != nil {
+		c.Errorf("Failed to price registration of %q in %d: %s", student.Email, class.ID, err)
+		return
+	}
+	student.SetPrice(q.Total)
+	if q.Member {
+		student.RecordPayment(0, students.Membership, "membership", now)
+	}
+}
+
+// parseCategory returns the discount category claimed in a
+// registration form.
+func parseCategory(r *http.Request) pricing.Category {
+	if r.FormValue("category") == string(pricing.Discounted) {
+		return pricing.Discounted
+	}
+	return pricing.Regular
+}
+
+// studentCategory returns the discount category of an account's
+// registration: its verified category if staff have verified one,
+// and otherwise the category claimed in the registration form. A
+// claimed category is recorded so that staff can check it at the
+// desk, but is not priced until it has been verified.
+func studentCategory(c appengine.Context, accountID string, r *http.Request) pricing.Category {
+	if category := pricing.VerifiedCategory(c, accountID); category != pricing.Regular {
+		return category
+	}
+	return parseCategory(r)
+}
+
+// sessionPrices is a session together with its pricing rules, for
+// display.
+type sessionPrices struct {
+	Session *classes.Session
+	Rules   *pricing.Rules
+	Weeks   int
+}
+
+// PerClass returns the per-class price of a tier.
+func (p *sessionPrices) PerClass(tier int) pricing.Cents {
+	return p.Rules.PerClass(tier, p.Session)
+}
+
+func prices(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	sched := schedule.Get(c, scheduleCache, time.Now())
+	sessions := []*sessionPrices{}
+	for _, s := range sched.Sessions {
+		rules, err := pricing.ForSession(c, s.Session.ID)
+		if err != nil {
+			return webapp.InternalError(fmt.Errorf("failed to find prices for session %d: %s", s.Session.ID, err))
+		}
+		sessions = append(sessions, &sessionPrices{
+			Session: s.Session,
+			Rules:   rules,
+			Weeks:   pricing.Weeks(s.Session),
+		})
+	}
+	data := map[string]interface{}{
+		"Sessions": sessions,
+		"Default":  pricing.Default(),
+		"Page":     pageContent(c, "pricing"),
+	}
+	if err := pricingPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
+
+func registrationConfirmed(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	acct, ok := userContext(r)
+	if !ok {
+		return badRequest(w, "Must be logged in.")
+	}
+	id, err := strconv.ParseInt(r.FormValue("class"), 10, 64)
+	if err != nil {
+		return invalidData(w, "Couldn't parse class ID")
+	}
+	class, err := classes.ClassWithID(c, id)
+	switch err {
+	case nil:
+		break
+	case classes.ErrClassNotFound:
+		return invalidData(w, "No such class")
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to find class %d: %s", id, err))
+	}
+	now := time.Now()
+	student, err := students.WithIDInClass(c, acct.ID, class, now)
+	switch err {
+	case nil:
+		break
+	case students.ErrStudentNotFound:
+		return invalidData(w, "You are not registered for this class.")
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to find student %q in %d: %s", acct.ID, class.ID, err))
+	}
+	q, err := quote(c, student, class, now)
+	if err != nil {
+		return webapp.InternalError(err)
+	}
+	if student.PromoCode != "" {
+		q.ApplyPromo(student.PromoCode, student.PromoDiscount)
+	}
+	if student.Priced && q.Total != student.Price {
+		// Prices, or the student's other registrations, have changed
+		// since they registered; show what they were charged rather
+		// than a breakdown of today's price.
+		q = &pricing.Quote{DropIn: q.DropIn, Member: q.Member, Total: student.Price}
+	}
+	data := map[string]interface{}{
+		"Class":    class,
+		"Teacher":  class.TeacherEntity(c),
+		"Student":  student,
+		"Quote":    q,
+		"Verified": pricing.VerifiedCategory(c, student.ID) != pricing.Regular,
+	}
+	if err := confirmationPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
+
+func parseRate(r *http.Request, prefix string) (pricing.Rate, error) {
+	session, err := pricing.ParseCents(r.FormValue(prefix + "session"))
+	if err != nil {
+		return pricing.Rate{}, err
+	}
+	weekly, err := pricing.ParseCents(r.FormValue(prefix + "weekly"))
+	if err != nil {
+		return pricing.Rate{}, err
+	}
+	return pricing.Rate{Session: session, Weekly: weekly}, nil
+}
+
+func parseRules(r *http.Request, sessionID int64) (*pricing.Rules, error) {
+	rules := &pricing.Rules{SessionID: sessionID}
+	var err error
+	if rules.DropIn, err = pricing.ParseCents(r.FormValue("dropin")); err != nil {
+		return nil, err
+	}
+	if rules.DiscountedDropIn, err = pricing.ParseCents(r.FormValue("discounteddropin")); err != nil {
+		return nil, err
+	}
+	if rules.OneClass, err = parseRate(r, "oneclass"); err != nil {
+		return nil, err
+	}
+	if rules.TwoClasses, err = parseRate(r, "twoclasses"); err != nil {
+		return nil, err
+	}
+	if rules.Unlimited, err = parseRate(r, "unlimited"); err != nil {
+		return nil, err
+	}
+	percent, err := strconv.ParseInt(r.FormValue("discountpercent"), 10, 64)
+	if err != nil || percent < 0 || percent > 100 {
+		return nil, fmt.Errorf("invalid discount percentage %q", r.FormValue("discountpercent"))
+	}
+	rules.DiscountPercent = percent
+	hours, err := strconv.ParseInt(r.FormValue("refundcutoff"), 10, 64)
+	if err != nil || hours < 1 {
+		return nil, fmt.Errorf("invalid refund cutoff %q", r.FormValue("refundcutoff"))
+	}
+	rules.RefundCutoffHours = hours
+	return rules, nil
+}
+
+func editPricing(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	staffAccount, ok := staffContext(r)
+	if !ok {
+		return webapp.UnauthorizedError(fmt.Errorf("only staff may edit prices"))
+	}
+	id, err := strconv.ParseInt(r.FormValue("session"), 10, 64)
+	if err != nil {
+		return invalidData(w, "Couldn't parse session ID")
+	}
+	session, err := classes.SessionWithID(c, id)
+	switch err {
+	case nil:
+		break
+	case classes.ErrSessionNotFound:
+		return invalidData(w, "No such session")
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to find session %d: %s", id, err))
+	}
+	if r.Method == "POST" {
+		token, err := auth.TokenForRequest(c, staffAccount.ID, r.URL.Path)
+		if err != nil {
+			return webapp.UnauthorizedError(fmt.Errorf("didn't find an auth token"))
+		}
+		if !token.IsValid(r.FormValue(auth.TokenFieldName), time.Now()) {
+			return webapp.UnauthorizedError(fmt.Errorf("invalid auth token"))
+		}
+		rules, err := parseRules(r, session.ID)
+		if err != nil {
+			return invalidData(w, fmt.Sprintf("Invalid prices: %s", err))
+		}
+		if err := rules.Put(c); err != nil {
+			return webapp.InternalError(fmt.Errorf("failed to store prices for session %d: %s", session.ID, err))
+		}
+		token.Delete(c)
+		http.Redirect(w, r, fmt.Sprintf("/staff/session?id=%d", session.ID), http.StatusSeeOther)
+		return nil
+	}
+	rules, err := pricing.ForSession(c, session.ID)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to find prices for session %d: %s", session.ID, err))
+	}
+	token, err := auth.NewToken(staffAccount.ID, r.URL.Path, time.Now())
+	if err != nil {
+		return webapp.InternalError(err)
+	}
+	if err := token.Store(c); err != nil {
+		return webapp.InternalError(err)
+	}
+	data := map[string]interface{}{
+		"Token":   token.Encode(),
+		"Session": session,
+		"Rules":   rules,
+	}
+	if err := editPricingPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package innerhearth
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+
+	"github.com/decitrig/innerhearth/account"
+	"github.com/decitrig/innerhearth/auth"
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/pricing"
+	"github.com/decitrig/innerhearth/promos"
+	"github.com/decitrig/innerhearth/webapp"
+)
+
+var (
+	promosPage    = newPage("templates/staff/promos.html", nil)
+	discountsPage = newPage("templates/staff/discounts.html", nil)
+)
+
+// promoError returns a message explaining to a student why their
+// promo code can't be used.
+func promoError(err error) string {
+	switch err {
+	case promos.ErrNotStarted:
+		return "That promo code can't be used yet."
+	case promos.ErrCodeExpired:
+		return "That promo code has expired."
+	case promos.ErrNoUsesRemaining:
+		return "That promo code has been used up."
+	case promos.ErrNotApplicable:
+		return "That promo code can't be used for this class."
+	default:
+		return "That promo code can't be used."
+	}
+}
+
+func parseIDs(values []string) ([]int64, error) {
+	ids := []int64{}
+	for _, v := range values {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func parsePromo(r *http.Request, createdBy string, now time.Time) (*promos.Promo, error) {
+	p := &promos.Promo{
+		Code:        promos.Normalize(r.FormValue("code")),
+		Description: strings.TrimSpace(r.FormValue("description")),
+		Created:     now,
+		CreatedBy:   createdBy,
+	}
+	if p.Code == "" {
+		return nil, fmt.Errorf("a code is required")
+	}
+	discount := strings.TrimSpace(r.FormValue("discount"))
+	if strings.HasSuffix(discount, "%") {
+		percent, err := strconv.Atoi(strings.TrimSuffix(discount, "%"))
+		if err != nil || percent <= 0 || percent > 100 {
+			return nil, fmt.Errorf("invalid percentage %q", discount)
+		}
+		p.Percent = percent
+	} else {
+		amount, err := pricing.ParseCents(discount)
+		if err != nil || amount <= 0 {
+			return nil, fmt.Errorf("invalid discount %q; enter e.g. 10%% or $5", discount)
+		}
+		p.Amount = amount
+	}
+	if s := r.FormValue("maxuses"); s != "" {
+		max, err := strconv.Atoi(s)
+		if err != nil || max < 0 {
+			return nil, fmt.Errorf("invalid number of uses %q", s)
+		}
+		p.MaxUses = max
+	}
+	var err error
+	if s := r.FormValue("starts"); s != "" {
+		if p.Starts, err = parseLocalDate(s); err != nil {
+			return nil, fmt.Errorf("invalid start date; please use mm/dd/yyyy format")
+		}
+	}
+	if s := r.FormValue("ends"); s != "" {
+		if p.Ends, err = parseLocalDate(s); err != nil {
+			return nil, fmt.Errorf("invalid end date; please use mm/dd/yyyy format")
+		}
+		// Codes are good through the end of their last day.
+		p.Ends = p.Ends.AddDate(0, 0, 1)
+	}
+	if p.SessionIDs, err = parseIDs(r.Form["session"]); err != nil {
+		return nil, fmt.Errorf("invalid session")
+	}
+	if p.ClassIDs, err = parseIDs(r.Form["class"]); err != nil {
+		return nil, fmt.Errorf("invalid class")
+	}
+	return p, nil
+}
+
+// sessionClasses is a session together with its classes, for
+// choosing which a promo applies to.
+type sessionClasses struct {
+	Session *classes.Session
+	Classes []*classes.Class
+}
+
+// staffPromos lists promo codes, and creates and deletes them.
+func staffPromos(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	staffAccount, ok := staffContext(r)
+	if !ok {
+		return webapp.UnauthorizedError(fmt.Errorf("only staff may manage promo codes"))
+	}
+	if r.Method == "POST" {
+		token, err := auth.TokenForRequest(c, staffAccount.ID, r.URL.Path)
+		if err != nil {
+			return webapp.UnauthorizedError(fmt.Errorf("didn't find an auth token"))
+		}
+		if !token.IsValid(r.FormValue(auth.TokenFieldName), time.Now()) {
+			return webapp.UnauthorizedError(fmt.Errorf("invalid auth token"))
+		}
+		switch r.FormValue("action") {
+		case "create":
+			p, err := parsePromo(r, staffAccount.Email, time.Now())
+			if err != nil {
+				return invalidData(w, fmt.Sprintf("Invalid promo code: %s", err))
+			}
+			switch err := p.Insert(c); err {
+			case nil:
+				break
+			case promos.ErrCodeExists:
+				return invalidData(w, fmt.Sprintf("The code %q is already in use.", p.Code))
+			default:
+				return webapp.InternalError(fmt.Errorf("failed to store promo: %s", err))
+			}
+		case "delete":
+			p, err := promos.WithCode(c, r.FormValue("code"))
+			switch err {
+			case nil:
+				break
+			case promos.ErrCodeNotFound:
+				return invalidData(w, "No such promo code")
+			default:
+				return webapp.InternalError(fmt.Errorf("failed to find promo: %s", err))
+			}
+			if err := p.Delete(c); err != nil {
+				return webapp.InternalError(fmt.Errorf("failed to delete promo: %s", err))
+			}
+		default:
+			return invalidData(w, "Unknown action")
+		}
+		token.Delete(c)
+		http.Redirect(w, r, "/staff/promos", http.StatusSeeOther)
+		return nil
+	}
+	all, err := promos.All(c)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to list promos: %s", err))
+	}
+	sessions := classes.Sessions(c, time.Now())
+	sort.Sort(classes.SessionsByStartDate(sessions))
+	choices := make([]*sessionClasses, len(sessions))
+	for i, s := range sessions {
+		classList := s.Classes(c)
+		sort.Sort(classes.ClassesByStartTime(classList))
+		choices[i] = &sessionClasses{Session: s, Classes: classList}
+	}
+	token, err := auth.NewToken(staffAccount.ID, r.URL.Path, time.Now())
+	if err != nil {
+		return webapp.InternalError(err)
+	}
+	if err := token.Store(c); err != nil {
+		return webapp.InternalError(err)
+	}
+	data := map[string]interface{}{
+		"Token":    token.Encode(),
+		"Promos":   all,
+		"Sessions": choices,
+	}
+	if err := promosPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
+
+// verificationEntry is a verification together with the verified
+// account, for display.
+type verificationEntry struct {
+	*pricing.Verification
+	Account *account.Account
+}
+
+// staffDiscounts lists the accounts whose discount category has been
+// verified, and verifies and revokes categories.
+func staffDiscounts(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	staffAccount, ok := staffContext(r)
+	if !ok {
+		return webapp.UnauthorizedError(fmt.Errorf("only staff may verify discounts"))
+	}
+	if r.Method == "POST" {
+		token, err := auth.TokenForRequest(c, staffAccount.ID, r.URL.Path)
+		if err != nil {
+			return webapp.UnauthorizedError(fmt.Errorf("didn't find an auth token"))
+		}
+		if !token.IsValid(r.FormValue(auth.TokenFieldName), time.Now()) {
+			return webapp.UnauthorizedError(fmt.Errorf("invalid auth token"))
+		}
+		switch r.FormValue("action") {
+		case "verify":
+			acct, err := account.WithEmail(c, r.FormValue("email"))
+			if err != nil {
+				return invalidData(w, fmt.Sprintf("No account found for %q", r.FormValue("email")))
+			}
+			v := pricing.NewVerification(acct.ID, pricing.Discounted, staffAccount.Email, time.Now())
+			if err := v.Put(c); err != nil {
+				return webapp.InternalError(fmt.Errorf("failed to store verification: %s", err))
+			}
+			c.Infof("%s verified discount for %q", staffAccount.Email, acct.Email)
+		case "revoke":
+			v, err := pricing.VerificationFor(c, r.FormValue("account"))
+			switch err {
+			case nil:
+				break
+			case pricing.ErrNotVerified:
+				return invalidData(w, "No such verification")
+			default:
+				return webapp.InternalError(fmt.Errorf("failed to find verification: %s", err))
+			}
+			if err := v.Delete(c); err != nil {
+				return webapp.InternalError(fmt.Errorf("failed to revoke verification: %s", err))
+			}
+			c.Infof("%s revoked discount for %q", staffAccount.Email, v.AccountID)
+		default:
+			return invalidData(w, "Unknown action")
+		}
+		token.Delete(c)
+		http.Redirect(w, r, "/staff/discounts", http.StatusSeeOther)
+		return nil
+	}
+	verified, err := pricing.Verifications(c, pricing.Discounted)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to list verifications: %s", err))
+	}
+	entries := make([]*verificationEntry, len(verified))
+	for i, v := range verified {
+		entries[i] = &verificationEntry{Verification: v}
+		if acct, err := account.WithID(c, v.AccountID); err == nil {
+			entries[i].Account = acct
+		}
+	}
+	token, err := auth.NewToken(staffAccount.ID, r.URL.Path, time.Now())
+	if err != nil {
+		return webapp.InternalError(err)
+	}
+	if err := token.Store(c); err != nil {
+		return webapp.InternalError(err)
+	}
+	data := map[string]interface{}{
+		"Token":    token.Encode(),
+		"Verified": entries,
+	}
+	if err := discountsPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
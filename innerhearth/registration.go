@@ -2,7 +2,6 @@ package innerhearth
 
 import (
 	"fmt"
-	"html/template"
 	"net/http"
 	"strconv"
 	"time"
@@ -13,12 +12,16 @@ import (
 	"github.com/decitrig/innerhearth/account"
 	"github.com/decitrig/innerhearth/auth"
 	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/pricing"
+	"github.com/decitrig/innerhearth/series"
 	"github.com/decitrig/innerhearth/students"
 	"github.com/decitrig/innerhearth/webapp"
+	"github.com/decitrig/innerhearth/workshops"
+	"github.com/decitrig/innerhearth/yogassage"
 )
 
 var (
-	classFullPage = template.Must(template.ParseFiles("templates/base.html", "templates/registration/class-full.html"))
+	classFullPage = newPage("templates/registration/class-full.html", nil)
 )
 
 func init() {
@@ -27,7 +30,29 @@ func init() {
 	webapp.HandleFunc("/register/paper", registerPaperStudent)
 }
 
+// classAndUser returns the current user and the session class named in
+// the request. Workshops, series and Yin Yogassage classes are
+// rejected; students register for them from their own pages.
 func classAndUser(w http.ResponseWriter, r *http.Request) (*account.Account, *classes.Class, *webapp.Error) {
+	a, class, werr := anyClassAndUser(w, r)
+	if werr != nil {
+		return nil, nil, werr
+	}
+	if class.Workshop != 0 {
+		return nil, nil, invalidData(w, "Please register for workshops from the workshops page.")
+	}
+	if class.Series != 0 {
+		return nil, nil, invalidData(w, "Please register for series from the workshops page.")
+	}
+	if class.YinYogassage != 0 {
+		return nil, nil, invalidData(w, "Please register for Yin Yogassage from the Yin Yogassage page.")
+	}
+	return a, class, nil
+}
+
+// anyClassAndUser returns the current user and the class named in the
+// request, which may be of any kind.
+func anyClassAndUser(w http.ResponseWriter, r *http.Request) (*account.Account, *classes.Class, *webapp.Error) {
 	c := appengine.NewContext(r)
 	u := user.Current(c)
 	if u == nil {
@@ -53,6 +78,58 @@ func classAndUser(w http.ResponseWriter, r *http.Request) (*account.Account, *cl
 	return a, class, nil
 }
 
+// An offeringClosed error explains why a workshop, series or Yin
+// Yogassage class no longer takes registrations. Its message may be
+// shown to the user.
+type offeringClosed string
+
+func (e offeringClosed) Error() string {
+	return string(e)
+}
+
+// offeringStudent returns a registration for an account in the class
+// behind a workshop slot, series or Yin Yogassage class, made as the
+// offering's own registration page makes it. Returns a nil Student
+// for a session class.
+func offeringStudent(c appengine.Context, acct *account.Account, class *classes.Class, now time.Time) (*students.Student, error) {
+	switch {
+	case class.Workshop != 0:
+		w, err := workshops.WithID(c, class.Workshop)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find workshop %d: %s", class.Workshop, err)
+		}
+		slot, err := w.Slot(class.ID)
+		if err != nil {
+			return nil, offeringClosed("This workshop time slot has been removed.")
+		}
+		if !slot.Start.After(now) {
+			return nil, offeringClosed("This workshop has already started.")
+		}
+		return workshops.NewStudent(acct, class, slot), nil
+	case class.Series != 0:
+		s, err := series.WithID(c, class.Series)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find series %d: %s", class.Series, err)
+		}
+		student, err := series.NewStudent(acct, class, s, now)
+		if err != nil {
+			return nil, offeringClosed("Registration for this series is closed.")
+		}
+		return student, nil
+	case class.YinYogassage != 0:
+		yin, err := yogassage.WithID(c, class.YinYogassage)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find yogassage %d: %s", class.YinYogassage, err)
+		}
+		if !yin.Date.After(now) {
+			return nil, offeringClosed("This class has already started.")
+		}
+		return yin.NewStudent(acct, class), nil
+	default:
+		return nil, nil
+	}
+}
+
 func registerForSession(w http.ResponseWriter, r *http.Request) *webapp.Error {
 	if r.Method != "POST" {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -69,19 +146,9 @@ func registerForSession(w http.ResponseWriter, r *http.Request) *webapp.Error {
 		return webapp.UnauthorizedError(fmt.Errorf("Invalid auth token"))
 	}
 	student := students.New(user, class)
-	switch err := student.Add(c, time.Now()); err {
-	case nil:
-		break
-	case students.ErrClassIsFull:
-		if err := classFullPage.Execute(w, class); err != nil {
-			return webapp.InternalError(err)
-		}
-	default:
-		return webapp.InternalError(fmt.Errorf("failed to write student: %s", err))
-	}
+	student.Category = studentCategory(c, user.ID, r)
 	token.Delete(c)
-	http.Redirect(w, r, "/", http.StatusSeeOther)
-	return nil
+	return register(w, r, student, class)
 }
 
 func registerForOneDay(w http.ResponseWriter, r *http.Request) *webapp.Error {
@@ -106,19 +173,15 @@ func registerForOneDay(w http.ResponseWriter, r *http.Request) *webapp.Error {
 	// TODO(rwsims): The date here should really be the end time of the
 	// class on the given day.
 	student := students.NewDropIn(user, class, date)
-	switch err := student.Add(c, time.Now()); err {
-	case nil:
-		break
-	case students.ErrClassIsFull:
-		if err := classFullPage.Execute(w, class); err != nil {
-			return webapp.InternalError(err)
-		}
-	default:
-		return webapp.InternalError(fmt.Errorf("failed to write student: %s", err))
-	}
+	student.Category = studentCategory(c, user.ID, r)
 	token.Delete(c)
-	http.Redirect(w, r, "/", http.StatusSeeOther)
-	return nil
+	if r.FormValue("makeup") != "" {
+		return registerWithMakeUp(w, r, student, class)
+	}
+	if r.FormValue("pass") != "" {
+		return registerWithPass(w, r, student, class)
+	}
+	return register(w, r, student, class)
 }
 
 func registerPaperStudent(w http.ResponseWriter, r *http.Request) *webapp.Error {
@@ -128,7 +191,7 @@ func registerPaperStudent(w http.ResponseWriter, r *http.Request) *webapp.Error
 		return nil
 	}
 	c := appengine.NewContext(r)
-	user, class, werr := classAndUser(w, r)
+	user, class, werr := anyClassAndUser(w, r)
 	if werr != nil {
 		return werr
 	}
@@ -140,40 +203,31 @@ func registerPaperStudent(w http.ResponseWriter, r *http.Request) *webapp.Error
 	if err != nil {
 		return missingFields(w)
 	}
-	acct, err := account.WithEmail(c, fields["email"])
-	switch err {
-	case nil:
-		// Register with existing account
-		break
-	case account.ErrUserNotFound:
-		// Need to create a paper account for this registration. This account will not be stored.
-		info := account.Info{
-			FirstName: fields["firstname"],
-			LastName:  fields["lastname"],
-			Email:     fields["email"],
-		}
-		if phone := fields["phone"]; phone != "" {
-			info.Phone = phone
-		}
-		acct = account.Paper(info, class.ID)
-		break
-	default:
-		return webapp.InternalError(fmt.Errorf("failed to look up account for %q: %s", fields["email"], err))
+	info := account.Info{
+		FirstName: fields["firstname"],
+		LastName:  fields["lastname"],
+		Email:     fields["email"],
+		Phone:     r.FormValue("phone"),
 	}
-	var student *students.Student
-	if fields["type"] == "dropin" {
+	var date time.Time
+	dropIn := fields["type"] == "dropin"
+	if dropIn {
 		// TODO(rwsims): The date here should really be the end time of the
 		// class on the given day.
-		date, err := parseLocalDate(r.FormValue("date"))
+		date, err = parseLocalDate(r.FormValue("date"))
 		if err != nil {
 			return invalidData(w, "Invalid date; please use mm/dd/yyyy format")
 		}
-		student = students.NewDropIn(acct, class, date)
-	} else {
-		student = students.New(acct, class)
 	}
+	student, err := paperStudent(c, class, info, dropIn, date, time.Now())
+	if msg, ok := err.(offeringClosed); ok {
+		return invalidData(w, string(msg))
+	} else if err != nil {
+		return webapp.InternalError(err)
+	}
+	setPrice(c, student, class, time.Now())
 	switch err := student.Add(c, time.Now()); err {
-	case nil:
+	case nil, students.ErrAlreadyRegistered:
 		break
 	case students.ErrClassIsFull:
 		if err := classFullPage.Execute(w, class); err != nil {
@@ -186,3 +240,39 @@ func registerPaperStudent(w http.ResponseWriter, r *http.Request) *webapp.Error
 	http.Redirect(w, r, fmt.Sprintf("/roster?class=%d", class.ID), http.StatusSeeOther)
 	return nil
 }
+
+// paperStudent returns a registration for a student registered by
+// staff or a teacher rather than by the student themself. If the
+// student has an account, the registration is made under it;
+// otherwise a stand-in paper account is used. The account's verified
+// discount category, if any, applies to the registration. A student
+// in a workshop, series or Yin Yogassage class is registered as the
+// offering's own page would register them, ignoring dropIn and date;
+// an offering which no longer takes registrations returns an
+// offeringClosed error.
+func paperStudent(c appengine.Context, class *classes.Class, info account.Info, dropIn bool, date, now time.Time) (*students.Student, error) {
+	acct, err := account.WithEmail(c, info.Email)
+	switch err {
+	case nil:
+		// Register with existing account
+		break
+	case account.ErrUserNotFound:
+		// Need to create a paper account for this registration. This account will not be stored.
+		acct = account.Paper(info, class.ID)
+	default:
+		return nil, fmt.Errorf("failed to look up account for %q: %s", info.Email, err)
+	}
+	student, err := offeringStudent(c, acct, class, now)
+	switch {
+	case err != nil:
+		return nil, err
+	case student != nil:
+		break
+	case dropIn:
+		student = students.NewDropIn(acct, class, date)
+	default:
+		student = students.New(acct, class)
+	}
+	student.Category = pricing.VerifiedCategory(c, acct.ID)
+	return student, nil
+}
@@ -0,0 +1,341 @@
+package innerhearth
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+
+	"github.com/decitrig/innerhearth/auth"
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/config"
+	"github.com/decitrig/innerhearth/images"
+	"github.com/decitrig/innerhearth/pricing"
+	"github.com/decitrig/innerhearth/series"
+	"github.com/decitrig/innerhearth/students"
+	"github.com/decitrig/innerhearth/webapp"
+)
+
+var (
+	staffSeriesPage = newPage("templates/staff/series.html", nil)
+	editSeriesPage  = newPage("templates/staff/edit-series.html", template.FuncMap{
+		"TeacherHasEmail": teacherHasEmail,
+		"Minutes":         minutes,
+	})
+)
+
+func init() {
+	webapp.HandleFunc("/series/register", userContextHandler(webapp.HandlerFunc(registerForSeries)))
+}
+
+// seriesEntry is a series together with its registrations, for
+// display.
+type seriesEntry struct {
+	*series.Series
+	Teacher    *classes.Teacher
+	Registered int
+	Remaining  int32
+
+	// Whether students may register as of now, and the price they
+	// would pay.
+	Open         bool
+	CurrentPrice pricing.Cents
+
+	// Whether the series has already begun.
+	Started bool
+
+	// Whether the current user is registered for the series.
+	Student *students.Student
+}
+
+// seriesEntries returns the upcoming series along with how many
+// students are registered in each. If accountID is not empty, each
+// entry records whether that account is registered for the series.
+func seriesEntries(c appengine.Context, accountID string, now time.Time) ([]*seriesEntry, error) {
+	upcoming, err := series.Upcoming(c, now)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*seriesEntry, len(upcoming))
+	for i, s := range upcoming {
+		class := &classes.Class{ID: s.ClassID}
+		entry := &seriesEntry{
+			Series:     s,
+			Teacher:    s.TeacherEntity(c),
+			Registered: len(students.In(c, class, now)),
+			Started:    !s.Start().After(now),
+		}
+		if entry.Remaining = s.Capacity - int32(entry.Registered); entry.Remaining < 0 {
+			entry.Remaining = 0
+		}
+		if price, err := s.PriceAt(now); err == nil {
+			entry.Open = true
+			entry.CurrentPrice = price
+		}
+		if accountID != "" {
+			if student, err := students.WithIDInClass(c, accountID, class, now); err == nil {
+				entry.Student = student
+			}
+		}
+		entries[i] = entry
+	}
+	return entries, nil
+}
+
+// registerForSeries registers the current user for every remaining
+// meeting of a series.
+func registerForSeries(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Method not allowed")
+		return nil
+	}
+	c := appengine.NewContext(r)
+	acct, ok := userContext(r)
+	if !ok {
+		return badRequest(w, "Must be logged in.")
+	}
+	id, err := strconv.ParseInt(r.FormValue("series"), 10, 64)
+	if err != nil {
+		return invalidData(w, "Couldn't parse series ID")
+	}
+	s, err := series.WithID(c, id)
+	switch err {
+	case nil:
+		break
+	case series.ErrSeriesNotFound:
+		return invalidData(w, "No such series")
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to find series %d: %s", id, err))
+	}
+	class, err := classes.ClassWithID(c, s.ClassID)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to find class for series %d: %s", s.ID, err))
+	}
+	token, ok := checkToken(c, acct.ID, r.URL.Path, r.FormValue(auth.TokenFieldName))
+	if !ok {
+		return webapp.UnauthorizedError(fmt.Errorf("Invalid auth token"))
+	}
+	student, err := series.NewStudent(acct, class, s, time.Now())
+	if err != nil {
+		return invalidData(w, "Registration for this series is closed.")
+	}
+	token.Delete(c)
+	return register(w, r, student, class)
+}
+
+// parseSeriesDetails sets a series's details from a staff form. An
+// uploaded image replaces the series's image URL.
+func parseSeriesDetails(c appengine.Context, r *http.Request, s *series.Series, uploadedBy string) error {
+	s.Title = strings.TrimSpace(r.FormValue("title"))
+	s.Description = []byte(r.FormValue("description"))
+	s.Image = strings.TrimSpace(r.FormValue("image"))
+	if s.Title == "" {
+		return fmt.Errorf("a title is required")
+	}
+	price, err := pricing.ParseCents(r.FormValue("price"))
+	if err != nil {
+		return fmt.Errorf("invalid price; please enter dollars, e.g. 100")
+	}
+	s.Price = price
+	s.LatePrice = 0
+	if late := strings.TrimSpace(r.FormValue("lateprice")); late != "" {
+		if s.LatePrice, err = pricing.ParseCents(late); err != nil {
+			return fmt.Errorf("invalid late price; please enter dollars per meeting, e.g. 30")
+		}
+	}
+	capacity, err := strconv.ParseInt(r.FormValue("capacity"), 10, 32)
+	if err != nil || capacity <= 0 {
+		return fmt.Errorf("invalid capacity")
+	}
+	s.Capacity = int32(capacity)
+	s.Teacher = nil
+	if email := r.FormValue("teacher"); email != "" {
+		teacher, err := classes.TeacherWithEmail(c, email)
+		if err != nil {
+			return fmt.Errorf("invalid teacher selected")
+		}
+		s.Teacher = teacher.Key(c)
+	}
+	url, err := uploadImage(c, r, "imagefile", images.Medium, uploadedBy)
+	if err != nil {
+		return err
+	}
+	if url != "" {
+		s.Image = url
+	}
+	return nil
+}
+
+// staffSeries lists upcoming series and creates new ones.
+func staffSeries(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	staffAccount, ok := staffContext(r)
+	if !ok {
+		return webapp.UnauthorizedError(fmt.Errorf("only staff may manage series"))
+	}
+	if r.Method == "POST" {
+		token, err := auth.TokenForRequest(c, staffAccount.ID, r.URL.Path)
+		if err != nil {
+			return webapp.UnauthorizedError(fmt.Errorf("didn't find an auth token"))
+		}
+		if !token.IsValid(r.FormValue(auth.TokenFieldName), time.Now()) {
+			return webapp.UnauthorizedError(fmt.Errorf("invalid auth token"))
+		}
+		s := &series.Series{
+			Created:   time.Now(),
+			CreatedBy: staffAccount.Email,
+		}
+		if err := parseSeriesDetails(c, r, s, staffAccount.Email); err != nil {
+			return invalidData(w, fmt.Sprintf("Invalid series: %s", err))
+		}
+		dates, starts, lengths := r.Form["meetingdate"], r.Form["meetingstart"], r.Form["meetinglength"]
+		if len(starts) != len(dates) || len(lengths) != len(dates) {
+			return missingFields(w)
+		}
+		for i, date := range dates {
+			if date == "" {
+				continue
+			}
+			start, length, err := parseSlot(date, starts[i], lengths[i])
+			if err != nil {
+				return invalidData(w, fmt.Sprintf("Invalid meeting: %s", err))
+			}
+			s.AddMeeting(start, length)
+		}
+		switch err := s.Insert(c, config.Current().Location()); err {
+		case nil:
+			break
+		case series.ErrNoMeetings:
+			return invalidData(w, "Please enter at least one meeting for the series.")
+		default:
+			return webapp.InternalError(fmt.Errorf("failed to add series: %s", err))
+		}
+		c.Infof("%s added series %d", staffAccount.Email, s.ID)
+		token.Delete(c)
+		http.Redirect(w, r, "/staff/series", http.StatusSeeOther)
+		return nil
+	}
+	entries, err := seriesEntries(c, "", time.Now())
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to list series: %s", err))
+	}
+	token, err := auth.NewToken(staffAccount.ID, r.URL.Path, time.Now())
+	if err != nil {
+		return webapp.InternalError(err)
+	}
+	if err := token.Store(c); err != nil {
+		return webapp.InternalError(err)
+	}
+	data := map[string]interface{}{
+		"Token":       token.Encode(),
+		"Series":      entries,
+		"Teachers":    classes.Teachers(c),
+		"NewMeetings": []int{1, 2, 3, 4, 5, 6},
+	}
+	if err := staffSeriesPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
+
+// editSeries changes a series's details and meetings, and deletes
+// series.
+func editSeries(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	staffAccount, ok := staffContext(r)
+	if !ok {
+		return webapp.UnauthorizedError(fmt.Errorf("only staff may manage series"))
+	}
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		return invalidData(w, "Couldn't parse series ID")
+	}
+	s, err := series.WithID(c, id)
+	switch err {
+	case nil:
+		break
+	case series.ErrSeriesNotFound:
+		return invalidData(w, "No such series")
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to find series %d: %s", id, err))
+	}
+	loc := config.Current().Location()
+	if r.Method == "POST" {
+		token, err := auth.TokenForRequest(c, staffAccount.ID, r.URL.Path)
+		if err != nil {
+			return webapp.UnauthorizedError(fmt.Errorf("didn't find an auth token"))
+		}
+		if !token.IsValid(r.FormValue(auth.TokenFieldName), time.Now()) {
+			return webapp.UnauthorizedError(fmt.Errorf("invalid auth token"))
+		}
+		redirect := fmt.Sprintf("/staff/edit-series?id=%d", s.ID)
+		switch r.FormValue("action") {
+		case "update":
+			if err := parseSeriesDetails(c, r, s, staffAccount.Email); err != nil {
+				return invalidData(w, fmt.Sprintf("Invalid series: %s", err))
+			}
+		case "addmeeting":
+			start, length, err := parseSlot(r.FormValue("meetingdate"), r.FormValue("meetingstart"), r.FormValue("meetinglength"))
+			if err != nil {
+				return invalidData(w, fmt.Sprintf("Invalid meeting: %s", err))
+			}
+			s.AddMeeting(start, length)
+		case "removemeeting":
+			unix, err := strconv.ParseInt(r.FormValue("meeting"), 10, 64)
+			if err != nil {
+				return invalidData(w, "Couldn't parse meeting")
+			}
+			switch err := s.RemoveMeeting(time.Unix(unix, 0)); err {
+			case nil:
+				break
+			case series.ErrMeetingNotFound:
+				return invalidData(w, "No such meeting")
+			case series.ErrNoMeetings:
+				return invalidData(w, "A series must have at least one meeting; delete the series instead.")
+			default:
+				return webapp.InternalError(err)
+			}
+		case "delete":
+			if err := cancelClassRegistrations(c, s.ClassID, staffAccount.Email, time.Now()); err != nil {
+				return webapp.InternalError(err)
+			}
+			if err := s.Delete(c); err != nil {
+				return webapp.InternalError(fmt.Errorf("failed to delete series %d: %s", s.ID, err))
+			}
+			c.Infof("%s deleted series %d", staffAccount.Email, s.ID)
+			token.Delete(c)
+			http.Redirect(w, r, "/staff/series", http.StatusSeeOther)
+			return nil
+		default:
+			return invalidData(w, "Unknown action")
+		}
+		if err := s.Put(c, loc); err != nil {
+			return webapp.InternalError(fmt.Errorf("failed to update series %d: %s", s.ID, err))
+		}
+		token.Delete(c)
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return nil
+	}
+	token, err := auth.NewToken(staffAccount.ID, r.URL.Path, time.Now())
+	if err != nil {
+		return webapp.InternalError(err)
+	}
+	if err := token.Store(c); err != nil {
+		return webapp.InternalError(err)
+	}
+	data := map[string]interface{}{
+		"Token":    token.Encode(),
+		"Series":   s,
+		"Teacher":  s.TeacherEntity(c),
+		"Teachers": classes.Teachers(c),
+	}
+	if err := editSeriesPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
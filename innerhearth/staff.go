@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"appengine"
@@ -13,35 +14,40 @@ import (
 	"github.com/decitrig/innerhearth/account"
 	"github.com/decitrig/innerhearth/auth"
 	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/config"
+	"github.com/decitrig/innerhearth/images"
+	"github.com/decitrig/innerhearth/ledger"
+	"github.com/decitrig/innerhearth/schedule"
 	"github.com/decitrig/innerhearth/staff"
+	"github.com/decitrig/innerhearth/students"
 	"github.com/decitrig/innerhearth/webapp"
 	"github.com/decitrig/innerhearth/yogassage"
 )
 
 var (
-	staffPage      = template.Must(template.ParseFiles("templates/base.html", "templates/staff/index.html"))
-	addTeacherPage = template.Must(template.ParseFiles("templates/base.html", "templates/staff/add-teacher.html"))
-	addClassPage   = template.Must(template.New("base.html").Funcs(template.FuncMap{
+	staffPage      = newPage("templates/staff/index.html", nil)
+	addTeacherPage = newPage("templates/staff/add-teacher.html", nil)
+	addClassPage   = newPage("templates/staff/add-class.html", template.FuncMap{
 		"WeekdayAsInt": weekdayAsInt,
-	}).ParseFiles("templates/base.html", "templates/staff/add-class.html"))
-	addSessionPage  = template.Must(template.ParseFiles("templates/base.html", "templates/staff/add-session.html"))
-	deleteClassPage = template.Must(template.New("base.html").Funcs(template.FuncMap{
+	})
+	addSessionPage  = newPage("templates/staff/add-session.html", nil)
+	deleteClassPage = newPage("templates/staff/delete-class.html", template.FuncMap{
 		"FormatLocal": formatLocal,
-	}).ParseFiles("templates/base.html", "templates/staff/delete-class.html"))
-	editClassPage = template.Must(template.New("base.html").Funcs(template.FuncMap{
+	})
+	editClassPage = newPage("templates/staff/edit-class.html", template.FuncMap{
 		"FormatLocal":     formatLocal,
 		"WeekdayAsInt":    weekdayAsInt,
 		"WeekdayEquals":   weekdayEquals,
 		"TeacherHasEmail": teacherHasEmail,
 		"Minutes":         minutes,
-	}).ParseFiles("templates/base.html", "templates/staff/edit-class.html"))
-	sessionPage = template.Must(template.New("base.html").Funcs(template.FuncMap{
+	})
+	sessionPage = newPage("templates/staff/session.html", template.FuncMap{
 		"FormatLocal": formatLocal,
-	}).ParseFiles("templates/base.html", "templates/staff/session.html"))
-	addAnnouncementPage    = template.Must(template.ParseFiles("templates/base.html", "templates/staff/add-announcement.html"))
-	deleteAnnouncementPage = template.Must(template.ParseFiles("templates/base.html", "templates/staff/delete-announcement.html"))
-	yinYogassagePage       = template.Must(template.ParseFiles("templates/base.html", "templates/staff/yin-yogassage.html"))
-	deleteYinYogassagePage = template.Must(template.ParseFiles("templates/base.html", "templates/staff/delete-yin-yogassage.html"))
+	})
+	addAnnouncementPage    = newPage("templates/staff/add-announcement.html", nil)
+	deleteAnnouncementPage = newPage("templates/staff/delete-announcement.html", nil)
+	yinYogassagePage       = newPage("templates/staff/yin-yogassage.html", nil)
+	deleteYinYogassagePage = newPage("templates/staff/delete-yin-yogassage.html", nil)
 )
 
 func init() {
@@ -57,6 +63,26 @@ func init() {
 		"/staff/add-class":            addClass,
 		"/staff/edit-class":           editClass,
 		"/staff/delete-class":         deleteClass,
+		"/staff/pricing":              editPricing,
+		"/staff/balances":             balances,
+		"/staff/passes":               staffPasses,
+		"/staff/memberships":          staffMemberships,
+		"/staff/promos":               staffPromos,
+		"/staff/discounts":            staffDiscounts,
+		"/staff/ledger":               staffLedger,
+		"/staff/payroll":              staffPayroll,
+		"/staff/workshops":            staffWorkshops,
+		"/staff/edit-workshop":        editWorkshop,
+		"/staff/series":               staffSeries,
+		"/staff/edit-series":          editSeries,
+		"/staff/recurring-yin":        recurringYinYogassage,
+		"/staff/edit-yin-yogassage":   editYinYogassage,
+		"/staff/images":               staffImages,
+		"/staff/pages":                staffPages,
+		"/staff/edit-page":            editPage,
+		"/staff/mailinglist":          staffMailingList,
+		"/staff/newsletters":          staffNewsletters,
+		"/staff/newsletter":           staffNewsletter,
 	} {
 		webapp.HandleFunc(url, userContextHandler(staffContextHandler(fn)))
 	}
@@ -120,6 +146,7 @@ func addTeacher(w http.ResponseWriter, r *http.Request) *webapp.Error {
 		if err := teacher.Put(c); err != nil {
 			return webapp.InternalError(fmt.Errorf("Couldn't store teacher for %q: %s", account.Email, err))
 		}
+		schedule.Invalidate(c, scheduleCache)
 		token.Delete(c)
 		http.Redirect(w, r, "/staff", http.StatusSeeOther)
 		return nil
@@ -165,9 +192,13 @@ func addAnnouncement(w http.ResponseWriter, r *http.Request) *webapp.Error {
 		}
 		c.Infof("expiration: %s", expiration)
 		announce := staff.NewAnnouncement(fields["text"], expiration)
+		if announce.Image, err = uploadImage(c, r, "imagefile", images.Medium, staffAccount.Email); err != nil {
+			return invalidData(w, fmt.Sprintf("Invalid image: %s", err))
+		}
 		if err := staffAccount.AddAnnouncement(c, announce); err != nil {
 			return webapp.InternalError(fmt.Errorf("staff: failed to add announcement: %s", err))
 		}
+		schedule.Invalidate(c, scheduleCache)
 		token.Delete(c)
 		http.Redirect(w, r, "/staff", http.StatusSeeOther)
 		return nil
@@ -217,6 +248,7 @@ func deleteAnnouncement(w http.ResponseWriter, r *http.Request) *webapp.Error {
 		if err := announce.Delete(c); err != nil {
 			return webapp.InternalError(fmt.Errorf("failed to delete announcement %d: %s", announce.ID, err))
 		}
+		schedule.Invalidate(c, scheduleCache)
 		token.Delete(c)
 		http.Redirect(w, r, "/staff", http.StatusSeeOther)
 		return nil
@@ -268,6 +300,7 @@ func addSession(w http.ResponseWriter, r *http.Request) *webapp.Error {
 		if err := session.Insert(c); err != nil {
 			return webapp.InternalError(fmt.Errorf("failed to put session: %s", err))
 		}
+		schedule.Invalidate(c, scheduleCache)
 		token.Delete(c)
 		http.Redirect(w, r, "/staff", http.StatusSeeOther)
 		return nil
@@ -336,18 +369,23 @@ func yinYogassage(w http.ResponseWriter, r *http.Request) *webapp.Error {
 		if !token.IsValid(r.FormValue(auth.TokenFieldName), time.Now()) {
 			return webapp.UnauthorizedError(fmt.Errorf("invalid auth token"))
 		}
-		fields, err := webapp.ParseRequiredValues(r, "date", "signup")
+		fields, err := webapp.ParseRequiredValues(r, "date", "start", "length")
 		if err != nil {
 			return missingFields(w)
 		}
-		date, err := parseLocalDate(fields["date"])
+		date, length, err := parseSlot(fields["date"], fields["start"], fields["length"])
 		if err != nil {
-			return invalidData(w, "Invalid date; please use mm/dd/yyyy format.")
+			return invalidData(w, fmt.Sprintf("Invalid class time: %s", err))
+		}
+		yin := yogassage.New(date, strings.TrimSpace(r.FormValue("signup")))
+		yin.Length = length
+		if err := parseYinDetails(c, r, yin); err != nil {
+			return invalidData(w, fmt.Sprintf("Invalid class: %s", err))
 		}
-		yin := yogassage.New(date, fields["signup"])
-		if err := yin.Insert(c); err != nil {
+		if err := yin.Insert(c, config.Current().Location()); err != nil {
 			return webapp.InternalError(fmt.Errorf("failed to write yogassage: %s", err))
 		}
+		schedule.Invalidate(c, scheduleCache)
 		token.Delete(c)
 		http.Redirect(w, r, "/staff", http.StatusSeeOther)
 		return nil
@@ -360,7 +398,8 @@ func yinYogassage(w http.ResponseWriter, r *http.Request) *webapp.Error {
 		return webapp.InternalError(err)
 	}
 	data := map[string]interface{}{
-		"Token": token.Encode(),
+		"Token":    token.Encode(),
+		"Teachers": classes.Teachers(c),
 	}
 	if err := yinYogassagePage.Execute(w, data); err != nil {
 		return webapp.InternalError(err)
@@ -394,9 +433,23 @@ func deleteYinYogassage(w http.ResponseWriter, r *http.Request) *webapp.Error {
 		if !token.IsValid(r.FormValue(auth.TokenFieldName), time.Now()) {
 			return webapp.UnauthorizedError(fmt.Errorf("invalid auth token"))
 		}
-		if err := yin.Delete(c); err != nil {
-			return webapp.InternalError(fmt.Errorf("failed to delete yogassage %d: %s", yin.ID, err))
+		yins := []*yogassage.YinYogassage{yin}
+		if r.FormValue("scope") == "following" && yin.Recurrence != 0 {
+			if yins, err = yogassage.InRecurrence(c, yin.Recurrence, yin.Date); err != nil {
+				return webapp.InternalError(fmt.Errorf("failed to find classes in recurrence %d: %s", yin.Recurrence, err))
+			}
 		}
+		for _, y := range yins {
+			if y.ClassID != 0 {
+				if err := cancelClassRegistrations(c, y.ClassID, staffAccount.Email, time.Now()); err != nil {
+					return webapp.InternalError(err)
+				}
+			}
+			if err := y.Delete(c); err != nil {
+				return webapp.InternalError(fmt.Errorf("failed to delete yogassage %d: %s", y.ID, err))
+			}
+		}
+		schedule.Invalidate(c, scheduleCache)
 		token.Delete(c)
 		http.Redirect(w, r, "/staff", http.StatusSeeOther)
 		return nil
@@ -512,6 +565,7 @@ func addClass(w http.ResponseWriter, r *http.Request) *webapp.Error {
 			return webapp.InternalError(fmt.Errorf("failed to add class: %s", err))
 		}
 		c.Infof("class ID: %d", class.ID)
+		schedule.Invalidate(c, scheduleCache)
 		token.Delete(c)
 		http.Redirect(w, r, "/staff", http.StatusSeeOther)
 		return nil
@@ -606,6 +660,7 @@ func editClass(w http.ResponseWriter, r *http.Request) *webapp.Error {
 		if err := class.Update(c); err != nil {
 			return webapp.InternalError(fmt.Errorf("failed to update class %d: %s", class.ID, err))
 		}
+		schedule.Invalidate(c, scheduleCache)
 		token.Delete(c)
 		http.Redirect(w, r, "/staff", http.StatusSeeOther)
 		return nil
@@ -662,9 +717,18 @@ func deleteClass(w http.ResponseWriter, r *http.Request) *webapp.Error {
 		if !token.IsValid(r.FormValue(auth.TokenFieldName), time.Now()) {
 			return webapp.UnauthorizedError(fmt.Errorf("invalid auth token"))
 		}
+		// The studio cancelled the class, so its students get back
+		// everything they paid.
+		now := time.Now()
+		for _, student := range students.In(c, class, now) {
+			if err := cancelRegistration(c, student, class, ledger.FullRefund, staffAccount.Email, now); err != nil {
+				return webapp.InternalError(fmt.Errorf("failed to cancel %q in %d: %s", student.Email, class.ID, err))
+			}
+		}
 		if err := class.Delete(c); err != nil {
 			return webapp.InternalError(fmt.Errorf("failed to delete class %d: %s", class.ID, err))
 		}
+		schedule.Invalidate(c, scheduleCache)
 		token.Delete(c)
 		http.Redirect(w, r, "/staff", http.StatusSeeOther)
 		return nil
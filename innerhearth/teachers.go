@@ -0,0 +1,165 @@
+package innerhearth
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+
+	"github.com/decitrig/innerhearth/account"
+	"github.com/decitrig/innerhearth/auth"
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/images"
+	"github.com/decitrig/innerhearth/schedule"
+	"github.com/decitrig/innerhearth/staff"
+	"github.com/decitrig/innerhearth/webapp"
+)
+
+var (
+	teachersPage       = newPage("templates/teachers.html", nil)
+	teacherProfilePage = newPage("templates/teacher-profile.html", nil)
+)
+
+func init() {
+	webapp.HandleFunc("/teachers", teachersList)
+	webapp.HandleFunc("/teacher/profile", userContextHandler(webapp.HandlerFunc(editTeacherProfile)))
+}
+
+// teacherForEditing returns the teacher whose profile or availability
+// the current user may edit: a teacher may edit their own, and staff
+// may edit any teacher's, named by the teacher field.
+func teacherForEditing(w http.ResponseWriter, r *http.Request, acct *account.Account) (*classes.Teacher, *webapp.Error) {
+	c := appengine.NewContext(r)
+	if id := r.FormValue("teacher"); id != "" && id != acct.ID {
+		if _, err := staff.WithID(c, acct.ID); err != nil {
+			return nil, webapp.UnauthorizedError(fmt.Errorf("only staff may edit other teachers"))
+		}
+		teacher, err := classes.TeacherWithID(c, id)
+		if err != nil {
+			return nil, invalidData(w, "No such teacher")
+		}
+		return teacher, nil
+	}
+	teacher, err := classes.TeacherForUser(c, acct)
+	if err != nil {
+		return nil, webapp.UnauthorizedError(fmt.Errorf("only teachers have profiles"))
+	}
+	return teacher, nil
+}
+
+// teacherProfile is a teacher along with the classes they teach in the
+// current sessions, for display.
+type teacherProfile struct {
+	*classes.Teacher
+	Classes []*teacherClass
+}
+
+type teacherClass struct {
+	*classes.Class
+	Session *classes.Session
+}
+
+// teachersList shows the profiles of the studio's teachers.
+func teachersList(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	sched := schedule.Get(c, scheduleCache, time.Now())
+	byTeacher := make(map[string][]*teacherClass)
+	for _, s := range sched.Sessions {
+		for _, class := range s.Classes {
+			if teacher, ok := s.TeachersByClass[class.ID]; ok {
+				byTeacher[teacher.ID] = append(byTeacher[teacher.ID], &teacherClass{class, s.Session})
+			}
+		}
+	}
+	profiles := []*teacherProfile{}
+	// The studio's older bios are shown for teachers who haven't yet
+	// written profiles; they're matched by name.
+	profiled := make(map[string]bool)
+	for _, t := range classes.Profiles(c) {
+		profiles = append(profiles, &teacherProfile{t, byTeacher[t.ID]})
+		profiled[strings.ToLower(t.DisplayName())] = true
+	}
+	data := map[string]interface{}{
+		"Teachers": profiles,
+		"Profiled": profiled,
+	}
+	if err := teachersPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
+
+// parseSpecialties splits a comma-separated list of specialties.
+func parseSpecialties(s string) []string {
+	specialties := []string{}
+	for _, sp := range strings.Split(s, ",") {
+		if sp = strings.TrimSpace(sp); sp != "" {
+			specialties = append(specialties, sp)
+		}
+	}
+	return specialties
+}
+
+// editTeacherProfile shows and sets a teacher's public profile. Only
+// staff may change a teacher's display order.
+func editTeacherProfile(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	acct, ok := userContext(r)
+	if !ok {
+		return badRequest(w, "Must be logged in.")
+	}
+	teacher, werr := teacherForEditing(w, r, acct)
+	if teacher == nil {
+		return werr
+	}
+	staffer, _ := staff.WithID(c, acct.ID)
+	if r.Method == "POST" {
+		token, ok := checkToken(c, acct.ID, r.URL.Path, r.FormValue(auth.TokenFieldName))
+		if !ok {
+			return webapp.UnauthorizedError(fmt.Errorf("Invalid auth token"))
+		}
+		if staffer != nil {
+			order, err := strconv.Atoi(r.FormValue("order"))
+			if err != nil {
+				return invalidData(w, "Invalid display order")
+			}
+			teacher.Order = order
+		}
+		teacher.Credentials = strings.TrimSpace(r.FormValue("credentials"))
+		teacher.Bio = []byte(strings.TrimSpace(r.FormValue("bio")))
+		teacher.Headshot = strings.TrimSpace(r.FormValue("headshot"))
+		headshot, err := uploadImage(c, r, "headshotfile", images.Medium, acct.Email)
+		if err != nil {
+			return invalidData(w, fmt.Sprintf("Invalid headshot: %s", err))
+		}
+		if headshot != "" {
+			teacher.Headshot = headshot
+		}
+		teacher.Specialties = parseSpecialties(r.FormValue("specialties"))
+		if err := teacher.Put(c); err != nil {
+			return webapp.InternalError(fmt.Errorf("failed to store profile for %q: %s", teacher.ID, err))
+		}
+		schedule.Invalidate(c, scheduleCache)
+		c.Infof("%s updated profile for %q", acct.Email, teacher.ID)
+		token.Delete(c)
+		http.Redirect(w, r, fmt.Sprintf("/teacher/profile?teacher=%s", teacher.ID), http.StatusSeeOther)
+		return nil
+	}
+	token, err := storeNewToken(c, acct.ID, r.URL.Path)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to store token: %s", err))
+	}
+	data := map[string]interface{}{
+		"Token":       token.Encode(),
+		"Teacher":     teacher,
+		"Specialties": strings.Join(teacher.Specialties, ", "),
+		"IsStaff":     staffer != nil,
+	}
+	if err := teacherProfilePage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
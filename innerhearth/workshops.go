@@ -0,0 +1,430 @@
+package innerhearth
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/user"
+
+	"github.com/decitrig/innerhearth/auth"
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/config"
+	"github.com/decitrig/innerhearth/images"
+	"github.com/decitrig/innerhearth/ledger"
+	"github.com/decitrig/innerhearth/pricing"
+	"github.com/decitrig/innerhearth/students"
+	"github.com/decitrig/innerhearth/webapp"
+	"github.com/decitrig/innerhearth/workshops"
+)
+
+var (
+	workshopsPage      = newPage("templates/workshops.html", nil)
+	staffWorkshopsPage = newPage("templates/staff/workshops.html", nil)
+	editWorkshopPage   = newPage("templates/staff/edit-workshop.html", template.FuncMap{
+		"TeacherHasEmail": teacherHasEmail,
+		"Minutes":         minutes,
+	})
+)
+
+func init() {
+	webapp.HandleFunc("/workshops", workshopList)
+	webapp.HandleFunc("/workshops/register", userContextHandler(webapp.HandlerFunc(registerForWorkshop)))
+}
+
+// slotEntry is a workshop time slot together with its registrations,
+// for display.
+type slotEntry struct {
+	workshops.Slot
+	Registered int
+	Remaining  int32
+
+	// Whether the slot is yet to start.
+	Upcoming bool
+
+	// Whether the current user is registered for the slot.
+	Student *students.Student
+}
+
+// workshopEntry is a workshop together with its teacher and slots, for
+// display.
+type workshopEntry struct {
+	*workshops.Workshop
+	Teacher *classes.Teacher
+	Slots   []*slotEntry
+}
+
+// workshopEntries returns the upcoming workshops along with how many
+// students are registered in each slot. If accountID is not empty, each
+// slot records whether that account is registered for it.
+func workshopEntries(c appengine.Context, accountID string, now time.Time) ([]*workshopEntry, error) {
+	upcoming, err := workshops.Upcoming(c, now)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*workshopEntry, len(upcoming))
+	for i, w := range upcoming {
+		entry := &workshopEntry{Workshop: w, Teacher: w.TeacherEntity(c)}
+		for _, s := range w.Slots {
+			class := &classes.Class{ID: s.ClassID}
+			slot := &slotEntry{
+				Slot:       s,
+				Registered: len(students.In(c, class, now)),
+				Upcoming:   s.Start.After(now),
+			}
+			if slot.Remaining = w.Capacity - int32(slot.Registered); slot.Remaining < 0 {
+				slot.Remaining = 0
+			}
+			if accountID != "" {
+				if student, err := students.WithIDInClass(c, accountID, class, now); err == nil {
+					slot.Student = student
+				}
+			}
+			entry.Slots = append(entry.Slots, slot)
+		}
+		entries[i] = entry
+	}
+	return entries, nil
+}
+
+// workshopList shows the upcoming workshops and series, with sign-up
+// forms for logged-in students.
+func workshopList(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	data := map[string]interface{}{}
+	accountID := ""
+	if u := user.Current(c); u != nil {
+		if acct, err := maybeOldAccount(c, u); err == nil {
+			accountID = acct.ID
+			data["User"] = acct
+			token, err := storeNewToken(c, acct.ID, "/workshops/register")
+			if err != nil {
+				return webapp.InternalError(fmt.Errorf("failed to store token: %s", err))
+			}
+			data["Token"] = token.Encode()
+			seriesToken, err := storeNewToken(c, acct.ID, "/series/register")
+			if err != nil {
+				return webapp.InternalError(fmt.Errorf("failed to store token: %s", err))
+			}
+			data["SeriesToken"] = seriesToken.Encode()
+		}
+	}
+	now := time.Now()
+	entries, err := workshopEntries(c, accountID, now)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to list workshops: %s", err))
+	}
+	data["Workshops"] = entries
+	courses, err := seriesEntries(c, accountID, now)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to list series: %s", err))
+	}
+	data["Series"] = courses
+	if err := workshopsPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
+
+// registerForWorkshop registers the current user for a time slot of a
+// workshop.
+func registerForWorkshop(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Method not allowed")
+		return nil
+	}
+	c := appengine.NewContext(r)
+	acct, ok := userContext(r)
+	if !ok {
+		return badRequest(w, "Must be logged in.")
+	}
+	id, err := strconv.ParseInt(r.FormValue("slot"), 10, 64)
+	if err != nil {
+		return invalidData(w, "Couldn't parse time slot")
+	}
+	class, err := classes.ClassWithID(c, id)
+	if err != nil || class.Workshop == 0 {
+		return invalidData(w, "No such workshop")
+	}
+	workshop, err := workshops.WithID(c, class.Workshop)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to find workshop %d: %s", class.Workshop, err))
+	}
+	slot, err := workshop.Slot(class.ID)
+	if err != nil {
+		return invalidData(w, "No such workshop")
+	}
+	if !slot.Start.After(time.Now()) {
+		return invalidData(w, "This workshop has already started.")
+	}
+	token, ok := checkToken(c, acct.ID, r.URL.Path, r.FormValue(auth.TokenFieldName))
+	if !ok {
+		return webapp.UnauthorizedError(fmt.Errorf("Invalid auth token"))
+	}
+	student := workshops.NewStudent(acct, class, slot)
+	token.Delete(c)
+	return register(w, r, student, class)
+}
+
+// parseSlot parses the start and length of a workshop time slot.
+func parseSlot(date, start, length string) (time.Time, time.Duration, error) {
+	day, err := parseLocalDate(date)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid date %q; please use mm/dd/yyyy format", date)
+	}
+	clock, err := parseLocalTime(start)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid start time %q; please use HH:MMpm format (e.g., 3:04pm)", start)
+	}
+	d, err := parseMinutes(length)
+	if err != nil || d <= 0 {
+		return time.Time{}, 0, fmt.Errorf("invalid length %q", length)
+	}
+	loc := config.Current().Location()
+	return time.Date(day.Year(), day.Month(), day.Day(), clock.Hour(), clock.Minute(), 0, 0, loc), d, nil
+}
+
+// parseWorkshopDetails sets a workshop's details from a staff form. An
+// uploaded image replaces the workshop's image URL.
+func parseWorkshopDetails(c appengine.Context, r *http.Request, w *workshops.Workshop, uploadedBy string) error {
+	w.Title = strings.TrimSpace(r.FormValue("title"))
+	w.Description = []byte(r.FormValue("description"))
+	w.Image = strings.TrimSpace(r.FormValue("image"))
+	if w.Title == "" {
+		return fmt.Errorf("a title is required")
+	}
+	price, err := pricing.ParseCents(r.FormValue("price"))
+	if err != nil {
+		return fmt.Errorf("invalid price; please enter dollars, e.g. 25")
+	}
+	w.Price = price
+	capacity, err := strconv.ParseInt(r.FormValue("capacity"), 10, 32)
+	if err != nil || capacity <= 0 {
+		return fmt.Errorf("invalid capacity")
+	}
+	w.Capacity = int32(capacity)
+	w.Teacher = nil
+	if email := r.FormValue("teacher"); email != "" {
+		teacher, err := classes.TeacherWithEmail(c, email)
+		if err != nil {
+			return fmt.Errorf("invalid teacher selected")
+		}
+		w.Teacher = teacher.Key(c)
+	}
+	url, err := uploadImage(c, r, "imagefile", images.Medium, uploadedBy)
+	if err != nil {
+		return err
+	}
+	if url != "" {
+		w.Image = url
+	}
+	return nil
+}
+
+// staffWorkshops lists upcoming workshops and creates new ones.
+func staffWorkshops(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	staffAccount, ok := staffContext(r)
+	if !ok {
+		return webapp.UnauthorizedError(fmt.Errorf("only staff may manage workshops"))
+	}
+	if r.Method == "POST" {
+		token, err := auth.TokenForRequest(c, staffAccount.ID, r.URL.Path)
+		if err != nil {
+			return webapp.UnauthorizedError(fmt.Errorf("didn't find an auth token"))
+		}
+		if !token.IsValid(r.FormValue(auth.TokenFieldName), time.Now()) {
+			return webapp.UnauthorizedError(fmt.Errorf("invalid auth token"))
+		}
+		workshop := &workshops.Workshop{
+			Created:   time.Now(),
+			CreatedBy: staffAccount.Email,
+		}
+		if err := parseWorkshopDetails(c, r, workshop, staffAccount.Email); err != nil {
+			return invalidData(w, fmt.Sprintf("Invalid workshop: %s", err))
+		}
+		dates, starts, lengths := r.Form["slotdate"], r.Form["slotstart"], r.Form["slotlength"]
+		if len(starts) != len(dates) || len(lengths) != len(dates) {
+			return missingFields(w)
+		}
+		for i, date := range dates {
+			if date == "" {
+				continue
+			}
+			start, length, err := parseSlot(date, starts[i], lengths[i])
+			if err != nil {
+				return invalidData(w, fmt.Sprintf("Invalid time slot: %s", err))
+			}
+			workshop.AddSlot(start, length)
+		}
+		switch err := workshop.Insert(c, config.Current().Location()); err {
+		case nil:
+			break
+		case workshops.ErrNoSlots:
+			return invalidData(w, "Please enter at least one date for the workshop.")
+		case workshops.ErrTooManySlots:
+			return invalidData(w, fmt.Sprintf("A workshop may have at most %d dates.", workshops.MaxSlots))
+		default:
+			return webapp.InternalError(fmt.Errorf("failed to add workshop: %s", err))
+		}
+		c.Infof("%s added workshop %d", staffAccount.Email, workshop.ID)
+		token.Delete(c)
+		http.Redirect(w, r, "/staff/workshops", http.StatusSeeOther)
+		return nil
+	}
+	entries, err := workshopEntries(c, "", time.Now())
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to list workshops: %s", err))
+	}
+	token, err := auth.NewToken(staffAccount.ID, r.URL.Path, time.Now())
+	if err != nil {
+		return webapp.InternalError(err)
+	}
+	if err := token.Store(c); err != nil {
+		return webapp.InternalError(err)
+	}
+	data := map[string]interface{}{
+		"Token":     token.Encode(),
+		"Workshops": entries,
+		"Teachers":  classes.Teachers(c),
+		"NewSlots":  []int{1, 2, 3},
+	}
+	if err := staffWorkshopsPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
+
+// cancelClassRegistrations cancels every registration in the class
+// backing a workshop time slot or a series. The studio cancelled the
+// class, so its students get back everything they paid.
+func cancelClassRegistrations(c appengine.Context, classID int64, by string, now time.Time) error {
+	class, err := classes.ClassWithID(c, classID)
+	switch err {
+	case nil:
+		break
+	case classes.ErrClassNotFound:
+		return nil
+	default:
+		return err
+	}
+	for _, student := range students.In(c, class, now) {
+		if err := cancelRegistration(c, student, class, ledger.FullRefund, by, now); err != nil {
+			return fmt.Errorf("failed to cancel %q in %d: %s", student.Email, class.ID, err)
+		}
+	}
+	return nil
+}
+
+// editWorkshop changes a workshop's details and time slots, and
+// deletes workshops.
+func editWorkshop(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	staffAccount, ok := staffContext(r)
+	if !ok {
+		return webapp.UnauthorizedError(fmt.Errorf("only staff may manage workshops"))
+	}
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		return invalidData(w, "Couldn't parse workshop ID")
+	}
+	workshop, err := workshops.WithID(c, id)
+	switch err {
+	case nil:
+		break
+	case workshops.ErrWorkshopNotFound:
+		return invalidData(w, "No such workshop")
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to find workshop %d: %s", id, err))
+	}
+	loc := config.Current().Location()
+	if r.Method == "POST" {
+		token, err := auth.TokenForRequest(c, staffAccount.ID, r.URL.Path)
+		if err != nil {
+			return webapp.UnauthorizedError(fmt.Errorf("didn't find an auth token"))
+		}
+		if !token.IsValid(r.FormValue(auth.TokenFieldName), time.Now()) {
+			return webapp.UnauthorizedError(fmt.Errorf("invalid auth token"))
+		}
+		now := time.Now()
+		redirect := fmt.Sprintf("/staff/edit-workshop?id=%d", workshop.ID)
+		switch r.FormValue("action") {
+		case "update":
+			if err := parseWorkshopDetails(c, r, workshop, staffAccount.Email); err != nil {
+				return invalidData(w, fmt.Sprintf("Invalid workshop: %s", err))
+			}
+			if err := workshop.Put(c, loc); err != nil {
+				return webapp.InternalError(fmt.Errorf("failed to update workshop %d: %s", workshop.ID, err))
+			}
+		case "addslot":
+			start, length, err := parseSlot(r.FormValue("slotdate"), r.FormValue("slotstart"), r.FormValue("slotlength"))
+			if err != nil {
+				return invalidData(w, fmt.Sprintf("Invalid time slot: %s", err))
+			}
+			workshop.AddSlot(start, length)
+			switch err := workshop.Put(c, loc); err {
+			case nil:
+				break
+			case workshops.ErrTooManySlots:
+				return invalidData(w, fmt.Sprintf("A workshop may have at most %d time slots.", workshops.MaxSlots))
+			default:
+				return webapp.InternalError(fmt.Errorf("failed to add slot to workshop %d: %s", workshop.ID, err))
+			}
+		case "removeslot":
+			classID, err := strconv.ParseInt(r.FormValue("slot"), 10, 64)
+			if err != nil {
+				return invalidData(w, "Couldn't parse time slot")
+			}
+			if _, err := workshop.Slot(classID); err != nil {
+				return invalidData(w, "No such time slot")
+			}
+			if len(workshop.Slots) == 1 {
+				return invalidData(w, "A workshop must have at least one time slot; delete the workshop instead.")
+			}
+			if err := cancelClassRegistrations(c, classID, staffAccount.Email, now); err != nil {
+				return webapp.InternalError(err)
+			}
+			if err := workshop.RemoveSlot(c, classID, loc); err != nil {
+				return webapp.InternalError(fmt.Errorf("failed to remove slot from workshop %d: %s", workshop.ID, err))
+			}
+		case "delete":
+			for _, s := range workshop.Slots {
+				if err := cancelClassRegistrations(c, s.ClassID, staffAccount.Email, now); err != nil {
+					return webapp.InternalError(err)
+				}
+			}
+			if err := workshop.Delete(c); err != nil {
+				return webapp.InternalError(fmt.Errorf("failed to delete workshop %d: %s", workshop.ID, err))
+			}
+			c.Infof("%s deleted workshop %d", staffAccount.Email, workshop.ID)
+			redirect = "/staff/workshops"
+		default:
+			return invalidData(w, "Unknown action")
+		}
+		token.Delete(c)
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return nil
+	}
+	token, err := auth.NewToken(staffAccount.ID, r.URL.Path, time.Now())
+	if err != nil {
+		return webapp.InternalError(err)
+	}
+	if err := token.Store(c); err != nil {
+		return webapp.InternalError(err)
+	}
+	data := map[string]interface{}{
+		"Token":    token.Encode(),
+		"Workshop": workshop,
+		"Teacher":  workshop.TeacherEntity(c),
+		"Teachers": classes.Teachers(c),
+	}
+	if err := editWorkshopPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
@@ -0,0 +1,501 @@
+package innerhearth
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/user"
+
+	"github.com/decitrig/innerhearth/auth"
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/config"
+	"github.com/decitrig/innerhearth/pricing"
+	"github.com/decitrig/innerhearth/schedule"
+	"github.com/decitrig/innerhearth/students"
+	"github.com/decitrig/innerhearth/webapp"
+	"github.com/decitrig/innerhearth/yogassage"
+)
+
+var (
+	yinYogassageListPage      = newPage("templates/yin-yogassage.html", nil)
+	recurringYinYogassagePage = newPage("templates/staff/recurring-yin.html", template.FuncMap{
+		"WeekdayAsInt": weekdayAsInt,
+	})
+	editYinYogassagePage = newPage("templates/staff/edit-yin-yogassage.html", template.FuncMap{
+		"TeacherHasEmail": teacherHasEmail,
+		"Minutes":         minutes,
+		"FormatLocal":     formatLocal,
+	})
+)
+
+func init() {
+	webapp.HandleFunc("/yin-yogassage", yinYogassageList)
+	webapp.HandleFunc("/yin-yogassage/register", userContextHandler(webapp.HandlerFunc(registerForYinYogassage)))
+}
+
+// yinEntry is a Yin Yogassage offering together with its
+// registrations, for display.
+type yinEntry struct {
+	*yogassage.YinYogassage
+	Teacher    *classes.Teacher
+	Registered int
+	Remaining  int32
+
+	// Whether the current user is registered for the class.
+	Student *students.Student
+}
+
+// yinEntries returns the upcoming Yin Yogassage offerings along with
+// how many students are registered for each. If accountID is not
+// empty, each entry records whether that account is registered.
+func yinEntries(c appengine.Context, accountID string, now time.Time) []*yinEntry {
+	yins := yogassage.Classes(c, now)
+	sort.Sort(yogassage.ByDate(yins))
+	entries := make([]*yinEntry, len(yins))
+	for i, y := range yins {
+		entry := &yinEntry{YinYogassage: y, Teacher: y.TeacherEntity(c)}
+		if y.ClassID != 0 {
+			class := &classes.Class{ID: y.ClassID}
+			entry.Registered = len(students.In(c, class, now))
+			if entry.Remaining = y.Capacity - int32(entry.Registered); entry.Remaining < 0 {
+				entry.Remaining = 0
+			}
+			if accountID != "" {
+				if student, err := students.WithIDInClass(c, accountID, class, now); err == nil {
+					entry.Student = student
+				}
+			}
+		}
+		entries[i] = entry
+	}
+	return entries
+}
+
+// yinYogassageList shows the upcoming Yin Yogassage classes, with
+// sign-up forms for logged-in students.
+func yinYogassageList(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	data := map[string]interface{}{}
+	accountID := ""
+	if u := user.Current(c); u != nil {
+		if acct, err := maybeOldAccount(c, u); err == nil {
+			accountID = acct.ID
+			data["User"] = acct
+			token, err := storeNewToken(c, acct.ID, "/yin-yogassage/register")
+			if err != nil {
+				return webapp.InternalError(fmt.Errorf("failed to store token: %s", err))
+			}
+			data["Token"] = token.Encode()
+		}
+	}
+	data["Classes"] = yinEntries(c, accountID, time.Now())
+	if err := yinYogassageListPage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
+
+// registerForYinYogassage registers the current user for a Yin
+// Yogassage class.
+func registerForYinYogassage(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Method not allowed")
+		return nil
+	}
+	c := appengine.NewContext(r)
+	acct, ok := userContext(r)
+	if !ok {
+		return badRequest(w, "Must be logged in.")
+	}
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		return invalidData(w, "Couldn't parse class ID")
+	}
+	yin, err := yogassage.WithID(c, id)
+	switch err {
+	case nil:
+		break
+	case classes.ErrClassNotFound:
+		return invalidData(w, "No such class")
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to find yogassage %d: %s", id, err))
+	}
+	if yin.ClassID == 0 {
+		return invalidData(w, "This class doesn't take registrations here; please use its signup link.")
+	}
+	if !yin.Date.After(time.Now()) {
+		return invalidData(w, "This class has already started.")
+	}
+	class, err := classes.ClassWithID(c, yin.ClassID)
+	if err != nil {
+		return webapp.InternalError(fmt.Errorf("failed to find class for yogassage %d: %s", yin.ID, err))
+	}
+	token, ok := checkToken(c, acct.ID, r.URL.Path, r.FormValue(auth.TokenFieldName))
+	if !ok {
+		return webapp.UnauthorizedError(fmt.Errorf("Invalid auth token"))
+	}
+	student := yin.NewStudent(acct, class)
+	token.Delete(c)
+	return register(w, r, student, class)
+}
+
+// parseYinDetails sets the teacher, price and capacity of a Yin
+// Yogassage class from a staff form. A class with no capacity must
+// have a signup link.
+func parseYinDetails(c appengine.Context, r *http.Request, yin *yogassage.YinYogassage) error {
+	yin.Price = 0
+	if price := strings.TrimSpace(r.FormValue("price")); price != "" {
+		var err error
+		if yin.Price, err = pricing.ParseCents(price); err != nil {
+			return fmt.Errorf("invalid price; please enter dollars, e.g. 30")
+		}
+	}
+	yin.Capacity = 0
+	if capacity := strings.TrimSpace(r.FormValue("capacity")); capacity != "" {
+		n, err := strconv.ParseInt(capacity, 10, 32)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid capacity")
+		}
+		yin.Capacity = int32(n)
+	}
+	if yin.Capacity == 0 && yin.SignupLink == "" {
+		return fmt.Errorf("either a capacity or a signup link is required")
+	}
+	yin.Teacher = nil
+	if email := r.FormValue("teacher"); email != "" {
+		teacher, err := classes.TeacherWithEmail(c, email)
+		if err != nil {
+			return fmt.Errorf("invalid teacher selected")
+		}
+		yin.Teacher = teacher.Key(c)
+	}
+	return nil
+}
+
+// recurrenceFields are the fields of the form describing a recurrence,
+// which are carried over from the form to its preview.
+var recurrenceFields = []string{
+	"frequency", "week", "weekday", "from", "until", "start", "length",
+	"teacher", "price", "capacity", "signup", "skip",
+}
+
+// parseRecurrence returns the recurrence described by a staff form.
+func parseRecurrence(c appengine.Context, r *http.Request) (*yogassage.Recurrence, error) {
+	rec := &yogassage.Recurrence{}
+	switch f := yogassage.Frequency(r.FormValue("frequency")); f {
+	case yogassage.Weekly, yogassage.Monthly:
+		rec.Frequency = f
+	default:
+		return nil, fmt.Errorf("unknown frequency %q", f)
+	}
+	weekday, err := strconv.ParseInt(r.FormValue("weekday"), 10, 64)
+	if err != nil || weekday < 0 || weekday > 6 {
+		return nil, fmt.Errorf("invalid weekday")
+	}
+	rec.Weekday = time.Weekday(weekday)
+	if rec.Frequency == yogassage.Monthly {
+		week, err := strconv.ParseInt(r.FormValue("week"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid week of the month")
+		}
+		rec.Week = int(week)
+	}
+	start, length, err := parseSlot(r.FormValue("from"), r.FormValue("start"), r.FormValue("length"))
+	if err != nil {
+		return nil, err
+	}
+	rec.Start, rec.Length = start, length
+	if rec.Until, err = parseLocalDate(r.FormValue("until")); err != nil {
+		return nil, fmt.Errorf("invalid end date; please use mm/dd/yyyy format")
+	}
+	for _, s := range strings.FieldsFunc(r.FormValue("skip"), func(r rune) bool { return r == ',' || r == '\n' || r == ' ' || r == '\r' }) {
+		skip, err := parseLocalDate(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date to skip %q; please use mm/dd/yyyy format", s)
+		}
+		rec.Skip = append(rec.Skip, skip)
+	}
+	details := &yogassage.YinYogassage{SignupLink: strings.TrimSpace(r.FormValue("signup"))}
+	if err := parseYinDetails(c, r, details); err != nil {
+		return nil, err
+	}
+	rec.SignupLink = details.SignupLink
+	rec.Teacher = details.Teacher
+	rec.Price = details.Price
+	rec.Capacity = details.Capacity
+	if !rec.Valid() {
+		return nil, fmt.Errorf("the schedule doesn't describe any classes")
+	}
+	return rec, nil
+}
+
+// previewDate is a date generated by a recurrence, for display before
+// the recurrence's classes are created.
+type previewDate struct {
+	Date    time.Time
+	Skipped bool
+
+	// An existing Yin Yogassage class on the same day, if any.
+	Conflict *yogassage.YinYogassage
+}
+
+// previewRecurrence returns the dates generated by a recurrence, noting
+// those which are skipped or fall on the same day as an existing class.
+func previewRecurrence(c appengine.Context, rec *yogassage.Recurrence, loc *time.Location) []*previewDate {
+	existing := make(map[string]*yogassage.YinYogassage)
+	for _, yin := range yogassage.Classes(c, rec.Start.AddDate(0, 0, -1)) {
+		existing[yin.Date.In(loc).Format(dateFormat)] = yin
+	}
+	dates := []*previewDate{}
+	for _, date := range rec.Dates(loc) {
+		dates = append(dates, &previewDate{
+			Date:     date,
+			Skipped:  rec.Skips(date, loc),
+			Conflict: existing[date.In(loc).Format(dateFormat)],
+		})
+	}
+	return dates
+}
+
+// recurringYinYogassage adds Yin Yogassage classes in bulk from a
+// recurring schedule. Staff first preview the dates the schedule
+// generates, then choose which of them to create.
+func recurringYinYogassage(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	staffAccount, ok := staffContext(r)
+	if !ok {
+		return webapp.UnauthorizedError(fmt.Errorf("only staff may add yins"))
+	}
+	loc := config.Current().Location()
+	data := map[string]interface{}{
+		"Teachers":    classes.Teachers(c),
+		"Weekdays":    daysInOrder,
+		"Frequencies": yogassage.Frequencies,
+	}
+	if r.Method == "POST" {
+		token, err := auth.TokenForRequest(c, staffAccount.ID, r.URL.Path)
+		if err != nil {
+			return webapp.UnauthorizedError(fmt.Errorf("didn't find an auth token"))
+		}
+		if !token.IsValid(r.FormValue(auth.TokenFieldName), time.Now()) {
+			return webapp.UnauthorizedError(fmt.Errorf("invalid auth token"))
+		}
+		rec, err := parseRecurrence(c, r)
+		if err != nil {
+			return invalidData(w, fmt.Sprintf("Invalid schedule: %s", err))
+		}
+		if r.FormValue("action") == "create" {
+			dates := []time.Time{}
+			for _, s := range r.Form["date"] {
+				unix, err := strconv.ParseInt(s, 10, 64)
+				if err != nil {
+					return invalidData(w, "Invalid date")
+				}
+				dates = append(dates, time.Unix(unix, 0))
+			}
+			rec.Created = time.Now()
+			rec.CreatedBy = staffAccount.Email
+			yins, err := rec.Insert(c, dates, loc)
+			if err != nil {
+				return webapp.InternalError(fmt.Errorf("failed to add recurring yogassage: %s", err))
+			}
+			c.Infof("%s added %d yogassage classes %s", staffAccount.Email, len(yins), rec.Describe())
+			schedule.Invalidate(c, scheduleCache)
+			token.Delete(c)
+			http.Redirect(w, r, "/staff", http.StatusSeeOther)
+			return nil
+		}
+		fields := make(map[string]string)
+		for _, name := range recurrenceFields {
+			fields[name] = r.FormValue(name)
+		}
+		// Looking up the token removed it from the datastore; store it
+		// again so that the previewed schedule can be created.
+		if err := token.Store(c); err != nil {
+			return webapp.InternalError(err)
+		}
+		data["Token"] = token.Encode()
+		data["Recurrence"] = rec
+		data["Fields"] = fields
+		data["Dates"] = previewRecurrence(c, rec, loc)
+		if err := recurringYinYogassagePage.Execute(w, data); err != nil {
+			return webapp.InternalError(err)
+		}
+		return nil
+	}
+	token, err := auth.NewToken(staffAccount.ID, r.URL.Path, time.Now())
+	if err != nil {
+		return webapp.InternalError(err)
+	}
+	if err := token.Store(c); err != nil {
+		return webapp.InternalError(err)
+	}
+	data["Token"] = token.Encode()
+	if err := recurringYinYogassagePage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
+
+// atTimeOf returns the given date at the time of day of clock, in loc.
+func atTimeOf(date, clock time.Time, loc *time.Location) time.Time {
+	y, m, d := date.In(loc).Date()
+	hour, min, _ := clock.In(loc).Clock()
+	return time.Date(y, m, d, hour, min, 0, 0, loc)
+}
+
+// moveYinStudents moves the registrations for a Yin Yogassage class to
+// the class's date. It runs in the transaction which stores the
+// class, whose students share its entity group, so that the class and
+// its students never disagree.
+func moveYinStudents(c appengine.Context, yin *yogassage.YinYogassage, now time.Time) error {
+	if yin.ClassID == 0 {
+		return nil
+	}
+	for _, student := range students.In(c, &classes.Class{ID: yin.ClassID}, now) {
+		if student.Date.Equal(yin.Date) {
+			continue
+		}
+		student.Date = yin.Date
+		if err := student.Put(c); err != nil {
+			return fmt.Errorf("failed to move %q to %s: %s", student.Email, yin.Date, err)
+		}
+	}
+	return nil
+}
+
+// editYinYogassage changes a Yin Yogassage class. Changes to a class
+// generated by a recurrence can be made to that class alone or to it
+// and every later class in the recurrence.
+func editYinYogassage(w http.ResponseWriter, r *http.Request) *webapp.Error {
+	c := appengine.NewContext(r)
+	staffAccount, ok := staffContext(r)
+	if !ok {
+		return webapp.UnauthorizedError(fmt.Errorf("only staff may edit yins"))
+	}
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		return invalidData(w, "Invalid yogassage ID")
+	}
+	yin, err := yogassage.WithID(c, id)
+	switch err {
+	case nil:
+		break
+	case classes.ErrClassNotFound:
+		return invalidData(w, "No such class")
+	default:
+		return webapp.InternalError(fmt.Errorf("failed to find yogassage %d: %s", id, err))
+	}
+	loc := config.Current().Location()
+	if r.Method == "POST" {
+		token, err := auth.TokenForRequest(c, staffAccount.ID, r.URL.Path)
+		if err != nil {
+			return webapp.UnauthorizedError(fmt.Errorf("didn't find an auth token"))
+		}
+		if !token.IsValid(r.FormValue(auth.TokenFieldName), time.Now()) {
+			return webapp.UnauthorizedError(fmt.Errorf("invalid auth token"))
+		}
+		fields, err := webapp.ParseRequiredValues(r, "date", "start", "length")
+		if err != nil {
+			return missingFields(w)
+		}
+		date, length, err := parseSlot(fields["date"], fields["start"], fields["length"])
+		if err != nil {
+			return invalidData(w, fmt.Sprintf("Invalid class time: %s", err))
+		}
+		details := &yogassage.YinYogassage{SignupLink: strings.TrimSpace(r.FormValue("signup"))}
+		if err := parseYinDetails(c, r, details); err != nil {
+			return invalidData(w, fmt.Sprintf("Invalid class: %s", err))
+		}
+		yins := []*yogassage.YinYogassage{yin}
+		following := r.FormValue("scope") == "following" && yin.Recurrence != 0
+		if following {
+			if yins, err = yogassage.InRecurrence(c, yin.Recurrence, yin.Date); err != nil {
+				return webapp.InternalError(fmt.Errorf("failed to find classes in recurrence %d: %s", yin.Recurrence, err))
+			}
+		}
+		now := time.Now()
+		for _, y := range yins {
+			// Without a capacity a class's registrations are closed and
+			// its backing class removed, which would strand any
+			// students already registered.
+			if y.ClassID != 0 && details.Capacity == 0 && len(students.In(c, &classes.Class{ID: y.ClassID}, now)) > 0 {
+				return invalidData(w, "Classes with registrations must have a capacity; cancel the registrations first.")
+			}
+		}
+		for _, y := range yins {
+			when := atTimeOf(y.Date, date, loc)
+			if y.ID == yin.ID {
+				when = date
+			}
+			y.Date = when
+			y.Length = length
+			y.SignupLink = details.SignupLink
+			y.Teacher = details.Teacher
+			y.Price = details.Price
+			y.Capacity = details.Capacity
+			updateRecurrence := func(c appengine.Context) error { return nil }
+			if following && y.ID == yin.ID {
+				// Later changes to the recurrence start from its
+				// current details, so they are kept with the edited
+				// class.
+				updateRecurrence = func(c appengine.Context) error {
+					rec, err := yogassage.RecurrenceWithID(c, yin.Recurrence)
+					if err != nil {
+						return err
+					}
+					rec.Start = atTimeOf(rec.Start, date, loc)
+					rec.Length = length
+					rec.SignupLink = details.SignupLink
+					rec.Teacher = details.Teacher
+					rec.Price = details.Price
+					rec.Capacity = details.Capacity
+					return rec.Put(c)
+				}
+			}
+			err := y.PutWith(c, loc, func(c appengine.Context) error {
+				if err := moveYinStudents(c, y, now); err != nil {
+					return err
+				}
+				return updateRecurrence(c)
+			})
+			if err != nil {
+				return webapp.InternalError(fmt.Errorf("failed to update yogassage %d: %s", y.ID, err))
+			}
+		}
+		c.Infof("%s updated %d yogassage classes from %d", staffAccount.Email, len(yins), yin.ID)
+		schedule.Invalidate(c, scheduleCache)
+		token.Delete(c)
+		http.Redirect(w, r, "/staff", http.StatusSeeOther)
+		return nil
+	}
+	token, err := auth.NewToken(staffAccount.ID, r.URL.Path, time.Now())
+	if err != nil {
+		return webapp.InternalError(err)
+	}
+	if err := token.Store(c); err != nil {
+		return webapp.InternalError(err)
+	}
+	data := map[string]interface{}{
+		"Token":    token.Encode(),
+		"Class":    yin,
+		"Teacher":  yin.TeacherEntity(c),
+		"Teachers": classes.Teachers(c),
+	}
+	if yin.Recurrence != 0 {
+		if rec, err := yogassage.RecurrenceWithID(c, yin.Recurrence); err == nil {
+			data["Recurrence"] = rec
+		}
+	}
+	if err := editYinYogassagePage.Execute(w, data); err != nil {
+		return webapp.InternalError(err)
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+// Package ledger keeps a record of the money the studio owes each
+// account: credit which can be applied to future registrations, and
+// refunds to be paid back to the student.
+package ledger
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/decitrig/innerhearth/pricing"
+	"github.com/decitrig/innerhearth/students"
+)
+
+var (
+	ErrEntryNotFound      = fmt.Errorf("ledger: entry not found")
+	ErrInsufficientCredit = fmt.Errorf("ledger: not enough account credit")
+	ErrAlreadySettled     = fmt.Errorf("ledger: refund has already been paid")
+)
+
+// A Kind is the type of a ledger entry.
+type Kind string
+
+const (
+	// Credit adds to an account's balance.
+	Credit Kind = "credit"
+
+	// Applied entries record credit spent on a registration.
+	Applied Kind = "applied"
+
+	// Adjustment entries are changes to the balance made by staff.
+	Adjustment Kind = "adjustment"
+
+	// Refund entries record money to be paid back to the student. They
+	// don't affect the account's balance.
+	Refund Kind = "refund"
+)
+
+// An Entry is a single change to an account's ledger.
+type Entry struct {
+	ID        int64  `datastore:"-"`
+	AccountID string `datastore:"-"`
+
+	// The email address of the account, for entries made for paper
+	// registrations which have no stored account.
+	Email string `datastore:",noindex"`
+
+	Kind Kind
+
+	// The change to the account's balance, or for refunds the amount
+	// to be paid back.
+	Amount pricing.Cents `datastore:",noindex"`
+
+	// The class whose registration led to the entry, if any.
+	ClassID     int64  `datastore:",noindex"`
+	Description string `datastore:",noindex"`
+
+	Created   time.Time `datastore:",noindex"`
+	CreatedBy string    `datastore:",noindex"`
+
+	// Refunds are Outstanding until staff record that they have been
+	// paid.
+	Outstanding bool
+	Settled     time.Time `datastore:",noindex"`
+	SettledBy   string    `datastore:",noindex"`
+}
+
+// NewEntry returns a new entry in an account's ledger.
+func NewEntry(accountID string, kind Kind, amount pricing.Cents, classID int64, description, createdBy string, now time.Time) *Entry {
+	return &Entry{
+		AccountID:   accountID,
+		Kind:        kind,
+		Amount:      amount,
+		ClassID:     classID,
+		Description: description,
+		Created:     now,
+		CreatedBy:   createdBy,
+		Outstanding: kind == Refund,
+	}
+}
+
+// All of an account's entries share a parent, so that its balance can
+// be checked and updated in a single transaction.
+func ledgerKey(c appengine.Context, accountID string) *datastore.Key {
+	return datastore.NewKey(c, "Ledger", accountID, 0, nil)
+}
+
+func entryKey(c appengine.Context, accountID string, id int64) *datastore.Key {
+	return datastore.NewKey(c, "LedgerEntry", "", id, ledgerKey(c, accountID))
+}
+
+// WithID returns an entry in an account's ledger.
+func WithID(c appengine.Context, accountID string, id int64) (*Entry, error) {
+	e := &Entry{}
+	switch err := datastore.Get(c, entryKey(c, accountID, id), e); err {
+	case nil:
+		e.ID = id
+		e.AccountID = accountID
+		return e, nil
+	case datastore.ErrNoSuchEntity:
+		return nil, ErrEntryNotFound
+	default:
+		return nil, err
+	}
+}
+
+func getAll(c appengine.Context, q *datastore.Query) ([]*Entry, error) {
+	entries := []*Entry{}
+	keys, err := q.GetAll(c, &entries)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		entries[i].ID = key.IntID()
+		entries[i].AccountID = key.Parent().StringID()
+	}
+	return entries, nil
+}
+
+type byCreated []*Entry
+
+func (l byCreated) Len() int           { return len(l) }
+func (l byCreated) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byCreated) Less(i, j int) bool { return l[i].Created.After(l[j].Created) }
+
+// ForAccount returns all entries in an account's ledger, newest first.
+func ForAccount(c appengine.Context, accountID string) ([]*Entry, error) {
+	q := datastore.NewQuery("LedgerEntry").
+		Ancestor(ledgerKey(c, accountID))
+	entries, err := getAll(c, q)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(byCreated(entries))
+	return entries, nil
+}
+
+// OutstandingRefunds returns all refunds which have not yet been paid.
+func OutstandingRefunds(c appengine.Context) ([]*Entry, error) {
+	q := datastore.NewQuery("LedgerEntry").
+		Filter("Outstanding =", true)
+	entries, err := getAll(c, q)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(byCreated(entries))
+	return entries, nil
+}
+
+// BalanceOf returns the credit balance given by a list of entries.
+func BalanceOf(entries []*Entry) pricing.Cents {
+	var balance pricing.Cents
+	for _, e := range entries {
+		if e.Kind != Refund {
+			balance += e.Amount
+		}
+	}
+	return balance
+}
+
+// Balance returns an account's credit balance.
+func Balance(c appengine.Context, accountID string) (pricing.Cents, error) {
+	entries, err := ForAccount(c, accountID)
+	if err != nil {
+		return 0, err
+	}
+	return BalanceOf(entries), nil
+}
+
+// Put stores the entry, adding it to its account's ledger if it is new.
+func (e *Entry) Put(c appengine.Context) error {
+	key := datastore.NewIncompleteKey(c, "LedgerEntry", ledgerKey(c, e.AccountID))
+	if e.ID != 0 {
+		key = entryKey(c, e.AccountID, e.ID)
+	}
+	key, err := datastore.Put(c, key, e)
+	if err != nil {
+		return err
+	}
+	e.ID = key.IntID()
+	return nil
+}
+
+// Apply spends an amount of an account's credit on a registration in
+// a class, failing if the balance is too small. It does not start a
+// transaction of its own, and should be run inside one.
+func Apply(c appengine.Context, accountID string, amount pricing.Cents, classID int64, now time.Time) error {
+	balance, err := Balance(c, accountID)
+	if err != nil {
+		return err
+	}
+	if balance < amount {
+		return ErrInsufficientCredit
+	}
+	return NewEntry(accountID, Applied, -amount, classID, "Applied to registration", accountID, now).Put(c)
+}
+
+// Settle records that an outstanding refund has been paid.
+func Settle(c appengine.Context, accountID string, id int64, settledBy string, now time.Time) error {
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		e, err := WithID(c, accountID, id)
+		if err != nil {
+			return err
+		}
+		if !e.Outstanding {
+			return ErrAlreadySettled
+		}
+		e.Outstanding = false
+		e.Settled = now
+		e.SettledBy = settledBy
+		return e.Put(c)
+	}, nil)
+}
+
+// A Resolution decides how the money paid for a cancelled
+// registration is returned.
+type Resolution string
+
+const (
+	// ByPolicy refunds registrations cancelled before the cutoff and
+	// gives account credit for later cancellations.
+	ByPolicy Resolution = ""
+
+	// FullRefund refunds everything paid, other than with account
+	// credit.
+	FullRefund Resolution = "refund"
+
+	// AccountCredit returns everything paid as account credit.
+	AccountCredit Resolution = "credit"
+
+	// NoReturn keeps the money paid.
+	NoReturn Resolution = "none"
+)
+
+// Resolutions lists the ways staff may resolve a cancellation.
+var Resolutions = []Resolution{ByPolicy, FullRefund, AccountCredit, NoReturn}
+
+// Label returns a description of the resolution for staff.
+func (r Resolution) Label() string {
+	switch r {
+	case ByPolicy:
+		return "By policy"
+	case FullRefund:
+		return "Full refund"
+	case AccountCredit:
+		return "Account credit"
+	case NoReturn:
+		return "Keep payment"
+	default:
+		return string(r)
+	}
+}
+
+// Split divides the money paid for a registration, cancelled at now,
+// into the amounts to refund and to return as credit. start is the
+// beginning of the registration's first meeting. Money paid with
+// passes, make-up credits and memberships is returned elsewhere, and
+// money paid with account credit is only ever returned as credit.
+func (r Resolution) Split(s *students.Student, start time.Time, cutoff time.Duration, now time.Time) (refund, credit pricing.Cents) {
+	switch s.PaymentMethod {
+	case students.Pass, students.MakeUp, students.Membership:
+		return 0, 0
+	}
+	paid := s.AmountPaid - s.CreditApplied
+	switch r {
+	case NoReturn:
+		return 0, 0
+	case AccountCredit:
+		return 0, s.AmountPaid
+	case FullRefund:
+		return paid, s.CreditApplied
+	}
+	if now.Add(cutoff).After(start) {
+		return 0, s.AmountPaid
+	}
+	return paid, s.CreditApplied
+}
+
+// Cancel cancels a registration, adding the refund and credit owed for
+// it to the account's ledger in the same transaction.
+func Cancel(c appengine.Context, s *students.Student, refund, credit pricing.Cents, by string, now time.Time) error {
+	return CancelWith(c, s, refund, credit, by, now, nil)
+}
+
+// CancelWith is like Cancel, but also runs f, if it is not nil, in the
+// same transaction.
+func CancelWith(c appengine.Context, s *students.Student, refund, credit pricing.Cents, by string, now time.Time, f func(c appengine.Context) error) error {
+	return s.CancelWith(c, now, func(c appengine.Context) error {
+		if f != nil {
+			if err := f(c); err != nil {
+				return err
+			}
+		}
+		if refund > 0 {
+			e := NewEntry(s.ID, Refund, refund, s.ClassID, "Refund for cancelled registration", by, now)
+			e.Email = s.Email
+			if err := e.Put(c); err != nil {
+				return err
+			}
+		}
+		if credit > 0 {
+			e := NewEntry(s.ID, Credit, credit, s.ClassID, "Credit for cancelled registration", by, now)
+			e.Email = s.Email
+			if err := e.Put(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
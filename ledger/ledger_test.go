@@ -0,0 +1,100 @@
+package ledger
+
+import (
+	"testing"
+	"time"
+
+	"appengine/aetest"
+
+	"github.com/decitrig/innerhearth/account"
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/pricing"
+	"github.com/decitrig/innerhearth/students"
+)
+
+func TestSplit(t *testing.T) {
+	start := time.Unix(1000000, 0)
+	cutoff := 24 * time.Hour
+	early := start.Add(-48 * time.Hour)
+	late := start.Add(-time.Hour)
+	cash := &students.Student{AmountPaid: 1500, PaymentMethod: students.Cash}
+	mixed := &students.Student{AmountPaid: 1500, CreditApplied: 500, PaymentMethod: students.Card}
+	pass := &students.Student{AmountPaid: 1500, PaymentMethod: students.Pass}
+	tests := []struct {
+		res            Resolution
+		student        *students.Student
+		now            time.Time
+		refund, credit pricing.Cents
+	}{
+		{ByPolicy, cash, early, 1500, 0},
+		{ByPolicy, cash, late, 0, 1500},
+		{ByPolicy, mixed, early, 1000, 500},
+		{ByPolicy, mixed, late, 0, 1500},
+		{ByPolicy, pass, early, 0, 0},
+		{FullRefund, cash, late, 1500, 0},
+		{FullRefund, mixed, late, 1000, 500},
+		{AccountCredit, cash, early, 0, 1500},
+		{NoReturn, cash, early, 0, 0},
+	}
+	for i, test := range tests {
+		refund, credit := test.res.Split(test.student, start, cutoff, test.now)
+		if refund != test.refund || credit != test.credit {
+			t.Errorf("%d: expected refund %s and credit %s; got %s and %s", i, test.refund, test.credit, refund, credit)
+		}
+	}
+}
+
+func TestCancelAndApply(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	now := time.Unix(100000, 0)
+	class := &classes.Class{Title: "class", Capacity: 10}
+	if err := class.Insert(c); err != nil {
+		t.Fatal(err)
+	}
+	acct := &account.Account{ID: "0x1", Info: account.Info{Email: "a@example.com"}}
+	student := students.New(acct, class)
+	student.SetPrice(1500)
+	student.RecordPayment(1500, students.Cash, "staff", now)
+	if err := student.Add(c, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := Cancel(c, student, 1000, 500, "staff", now); err != nil {
+		t.Fatalf("Failed to cancel: %s", err)
+	}
+	if _, err := students.WithIDInClass(c, acct.ID, class, now); err != students.ErrStudentNotFound {
+		t.Errorf("Expected registration to be cancelled; got %v", err)
+	}
+	if balance, err := Balance(c, acct.ID); err != nil {
+		t.Fatal(err)
+	} else if balance != 500 {
+		t.Errorf("Expected $5 balance; got %s", balance)
+	}
+	refunds, err := OutstandingRefunds(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refunds) != 1 || refunds[0].Amount != 1000 {
+		t.Fatalf("Expected one $10 refund; got %v", refunds)
+	}
+	if err := Settle(c, acct.ID, refunds[0].ID, "staff", now); err != nil {
+		t.Fatalf("Failed to settle refund: %s", err)
+	}
+	if err := Settle(c, acct.ID, refunds[0].ID, "staff", now); err != ErrAlreadySettled {
+		t.Errorf("Expected ErrAlreadySettled; got %v", err)
+	}
+
+	if err := Apply(c, acct.ID, 600, class.ID, now); err != ErrInsufficientCredit {
+		t.Errorf("Expected ErrInsufficientCredit; got %v", err)
+	}
+	if err := Apply(c, acct.ID, 500, class.ID, now); err != nil {
+		t.Fatalf("Failed to apply credit: %s", err)
+	}
+	if balance, _ := Balance(c, acct.ID); balance != 0 {
+		t.Errorf("Expected credit to be used up; got %s", balance)
+	}
+}
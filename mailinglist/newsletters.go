@@ -0,0 +1,490 @@
+package mailinglist
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+	"appengine/mail"
+	"appengine/taskqueue"
+
+	"github.com/decitrig/innerhearth/config"
+	"github.com/decitrig/innerhearth/pages"
+)
+
+var (
+	ErrNewsletterNotFound = fmt.Errorf("mailinglist: newsletter not found")
+	ErrAlreadySent        = fmt.Errorf("mailinglist: newsletter has already been sent")
+	ErrNoSubscribers      = fmt.Errorf("mailinglist: there are no subscribers")
+)
+
+// Newsletters are sent in batches of BatchSize messages, one batch
+// every BatchInterval, to stay within the mail service's rate limits.
+const (
+	BatchSize     = 50
+	BatchInterval = time.Minute
+)
+
+var (
+	delayedSendBatch = delay.Func("sendNewsletterBatch", func(c appengine.Context, id int64, batch int) error {
+		n, err := NewsletterWithID(c, id)
+		if err != nil {
+			c.Errorf("Failed to find newsletter %d: %s", id, err)
+			return nil
+		}
+		return n.sendBatch(c, batch, time.Now())
+	})
+)
+
+// A NewsletterStatus is the state of a newsletter.
+type NewsletterStatus string
+
+const (
+	Draft   NewsletterStatus = "draft"
+	Sending NewsletterStatus = "sending"
+	Sent    NewsletterStatus = "sent"
+)
+
+// A Newsletter is an email written by staff for everyone on the list.
+type Newsletter struct {
+	ID int64 `datastore:"-"`
+
+	Subject string `datastore:",noindex"`
+
+	// The body of the newsletter, in Markdown.
+	Body []byte `datastore:",noindex"`
+
+	Status NewsletterStatus `datastore:",noindex"`
+
+	// The number of subscribers to whom the newsletter is being sent,
+	// and the number of batches in which it is sent. Batches is set
+	// once every batch has been queued.
+	Recipients int `datastore:",noindex"`
+	Batches    int `datastore:",noindex"`
+
+	// The batches which have been sent.
+	SentBatches []int `datastore:",noindex"`
+
+	Created   time.Time
+	CreatedBy string    `datastore:",noindex"`
+	Updated   time.Time `datastore:",noindex"`
+	SendStart time.Time `datastore:",noindex"`
+	SentBy    string    `datastore:",noindex"`
+	Finished  time.Time `datastore:",noindex"`
+}
+
+// NewNewsletter returns a new draft newsletter. It must be inserted
+// to store it.
+func NewNewsletter(subject, body, createdBy string, now time.Time) *Newsletter {
+	return &Newsletter{
+		Subject:   strings.TrimSpace(subject),
+		Body:      []byte(strings.TrimSpace(body)),
+		Status:    Draft,
+		Created:   now,
+		CreatedBy: createdBy,
+		Updated:   now,
+	}
+}
+
+// BodyText returns the newsletter's body as written.
+func (n *Newsletter) BodyText() string {
+	return string(n.Body)
+}
+
+// Valid reports whether the newsletter has a subject and body.
+func (n *Newsletter) Valid() bool {
+	return n.Subject != "" && len(n.Body) > 0
+}
+
+func newsletterKey(c appengine.Context, id int64) *datastore.Key {
+	return datastore.NewKey(c, "Newsletter", "", id, nil)
+}
+
+// Insert stores a new newsletter.
+func (n *Newsletter) Insert(c appengine.Context) error {
+	key, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Newsletter", nil), n)
+	if err != nil {
+		return err
+	}
+	n.ID = key.IntID()
+	return nil
+}
+
+// Put stores changes to an existing newsletter.
+func (n *Newsletter) Put(c appengine.Context) error {
+	_, err := datastore.Put(c, newsletterKey(c, n.ID), n)
+	return err
+}
+
+// NewsletterWithID returns the newsletter with the given ID, if one
+// exists.
+func NewsletterWithID(c appengine.Context, id int64) (*Newsletter, error) {
+	n := &Newsletter{}
+	switch err := datastore.Get(c, newsletterKey(c, id), n); err {
+	case nil:
+		n.ID = id
+		return n, nil
+	case datastore.ErrNoSuchEntity:
+		return nil, ErrNewsletterNotFound
+	default:
+		return nil, err
+	}
+}
+
+// Newsletters returns all newsletters, newest first.
+func Newsletters(c appengine.Context) ([]*Newsletter, error) {
+	q := datastore.NewQuery("Newsletter").
+		Order("-Created")
+	newsletters := []*Newsletter{}
+	keys, err := q.GetAll(c, &newsletters)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		newsletters[i].ID = key.IntID()
+	}
+	return newsletters, nil
+}
+
+// Delete deletes a draft newsletter.
+func (n *Newsletter) Delete(c appengine.Context) error {
+	if n.Status != Draft {
+		return ErrAlreadySent
+	}
+	return datastore.Delete(c, newsletterKey(c, n.ID))
+}
+
+// A DeliveryStatus is the state of a single newsletter message.
+type DeliveryStatus string
+
+const (
+	Queued DeliveryStatus = "queued"
+	// Delivered messages were accepted by the mail service.
+	Delivered DeliveryStatus = "sent"
+	Failed    DeliveryStatus = "failed"
+	// Skipped messages were for subscribers who left the list after
+	// the newsletter was queued.
+	Skipped DeliveryStatus = "skipped"
+)
+
+// DeliveryStatuses lists the states of a message in the order they
+// are reported.
+var DeliveryStatuses = []DeliveryStatus{Queued, Delivered, Failed, Skipped}
+
+// A Delivery records the sending of a newsletter to one subscriber.
+type Delivery struct {
+	Email string `datastore:"-"`
+
+	Batch     int
+	Status    DeliveryStatus `datastore:",noindex"`
+	Error     string         `datastore:",noindex"`
+	Attempted time.Time      `datastore:",noindex"`
+}
+
+func deliveryKey(c appengine.Context, newsletterID int64, email string) *datastore.Key {
+	return datastore.NewKey(c, "Delivery", email, 0, newsletterKey(c, newsletterID))
+}
+
+// The most entities written, or tasks added, in one call.
+const (
+	putBatch  = 500
+	taskBatch = 100
+)
+
+// Send queues the newsletter for delivery to every confirmed
+// subscriber. Messages are sent in batches by the task queue.
+//
+// The newsletter is marked as sending before anything is queued, so
+// that it can't be sent twice. If queueing fails part way through,
+// Send may be called again to finish; batches which were already
+// queued are not queued again.
+func (n *Newsletter) Send(c appengine.Context, sentBy string, now time.Time) error {
+	switch {
+	case n.Status == Draft:
+		if err := n.addDeliveries(c, sentBy, now); err != nil {
+			return err
+		}
+	case n.Status != Sending || n.Batches > 0:
+		return ErrAlreadySent
+	}
+	return n.queueBatches(c, now)
+}
+
+// update runs f on the current state of the newsletter in a
+// transaction, and stores the newsletter if f succeeds.
+func (n *Newsletter) update(c appengine.Context, f func(current *Newsletter) error) error {
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		current, err := NewsletterWithID(c, n.ID)
+		if err != nil {
+			return err
+		}
+		if err := f(current); err != nil {
+			return err
+		}
+		if err := current.Put(c); err != nil {
+			return err
+		}
+		*n = *current
+		return nil
+	}, nil)
+}
+
+// addDeliveries marks a draft newsletter as sending and records a
+// queued delivery for each subscriber. If the deliveries can't be
+// stored, the newsletter is returned to draft.
+func (n *Newsletter) addDeliveries(c appengine.Context, sentBy string, now time.Time) error {
+	subscribers, err := Subscribers(c)
+	if err != nil {
+		return err
+	}
+	if len(subscribers) == 0 {
+		return ErrNoSubscribers
+	}
+	err = n.update(c, func(current *Newsletter) error {
+		if current.Status != Draft {
+			return ErrAlreadySent
+		}
+		current.Status = Sending
+		current.SendStart = now
+		current.SentBy = sentBy
+		current.Recipients = len(subscribers)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	keys := make([]*datastore.Key, len(subscribers))
+	deliveries := make([]*Delivery, len(subscribers))
+	for i, s := range subscribers {
+		keys[i] = deliveryKey(c, n.ID, s.Email)
+		deliveries[i] = &Delivery{Email: s.Email, Batch: i / BatchSize, Status: Queued}
+	}
+	for i := 0; i < len(keys); i += putBatch {
+		end := i + putBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if _, err := datastore.PutMulti(c, keys[i:end], deliveries[i:end]); err != nil {
+			// Nothing has been queued yet, so the newsletter can
+			// safely be sent again from the start.
+			rerr := n.update(c, func(current *Newsletter) error {
+				current.Status = Draft
+				current.Recipients = 0
+				return nil
+			})
+			if rerr != nil {
+				c.Criticalf("Failed to return newsletter %d to draft: %s", n.ID, rerr)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// batchTaskName returns the name of the task which sends a batch of a
+// newsletter, so that the batch is never queued twice.
+func batchTaskName(id int64, batch int) string {
+	return fmt.Sprintf("newsletter-%d-%d", id, batch)
+}
+
+// queueBatches queues a task to send each batch of the newsletter, and
+// records that the newsletter has been queued.
+func (n *Newsletter) queueBatches(c appengine.Context, now time.Time) error {
+	batches := (n.Recipients + BatchSize - 1) / BatchSize
+	tasks := []*taskqueue.Task{}
+	for batch := 0; batch < batches; batch++ {
+		t, err := delayedSendBatch.Task(n.ID, batch)
+		if err != nil {
+			return fmt.Errorf("mailinglist: couldn't create task: %s", err)
+		}
+		t.Name = batchTaskName(n.ID, batch)
+		t.Delay = time.Duration(batch) * BatchInterval
+		t.RetryOptions = &taskqueue.RetryOptions{
+			RetryLimit: 3,
+		}
+		tasks = append(tasks, t)
+	}
+	for i := 0; i < len(tasks); i += taskBatch {
+		end := i + taskBatch
+		if end > len(tasks) {
+			end = len(tasks)
+		}
+		if _, err := taskqueue.AddMulti(c, tasks[i:end], ""); err != nil && !alreadyAdded(err) {
+			return fmt.Errorf("mailinglist: couldn't queue newsletter: %s", err)
+		}
+	}
+	return n.update(c, func(current *Newsletter) error {
+		current.Batches = batches
+		current.finishIfDone(now)
+		return nil
+	})
+}
+
+// alreadyAdded reports whether an error from adding tasks means only
+// that some of the tasks had already been added.
+func alreadyAdded(err error) bool {
+	errs, ok := err.(appengine.MultiError)
+	if !ok {
+		return err == taskqueue.ErrTaskAlreadyAdded
+	}
+	for _, err := range errs {
+		if err != nil && err != taskqueue.ErrTaskAlreadyAdded {
+			return false
+		}
+	}
+	return true
+}
+
+// message returns the newsletter as addressed to one subscriber, with
+// their unsubscribe link.
+func (n *Newsletter) message(c appengine.Context, cfg *config.Config, email string) (*mail.Message, error) {
+	data := map[string]interface{}{
+		"Newsletter": n,
+		"Config":     cfg,
+		"HTML":       pages.Render(pages.Markdown, n.BodyText()),
+	}
+	unsubscribe, err := SignedUnsubscribePath(c, email)
+	if err != nil {
+		return nil, err
+	}
+	data["Unsubscribe"] = cfg.URL(unsubscribe)
+	text, html := &bytes.Buffer{}, &bytes.Buffer{}
+	if err := newsletterEmail.Execute(text, data); err != nil {
+		return nil, err
+	}
+	if err := newsletterHTMLEmail.Execute(html, data); err != nil {
+		return nil, err
+	}
+	return &mail.Message{
+		Sender:   cfg.Sender(c),
+		To:       []string{email},
+		Subject:  n.Subject,
+		Body:     text.String(),
+		HTMLBody: html.String(),
+		Headers: map[string][]string{
+			"List-Unsubscribe": {"<" + cfg.URL(unsubscribe) + ">"},
+		},
+	}, nil
+}
+
+// SendTest sends the newsletter to a single address, such as a staff
+// member's, so that it can be checked before it is sent to the list.
+func (n *Newsletter) SendTest(c appengine.Context, email string) error {
+	cfg, err := config.Get(c)
+	if err != nil {
+		c.Errorf("Failed to load site config; using defaults: %s", err)
+	}
+	msg, err := n.message(c, cfg, email)
+	if err != nil {
+		return err
+	}
+	msg.Subject = "[Test] " + msg.Subject
+	return mail.Send(c, msg)
+}
+
+// sendBatch sends those messages in a batch which haven't been sent
+// yet, recording the outcome of each. A message which the mail service
+// rejects is recorded as failed and not tried again. If the batch
+// can't be completed, its task is retried up to its RetryLimit; only
+// messages which are still queued are sent, so a retry doesn't send
+// anyone the newsletter twice unless their delivery couldn't be
+// recorded.
+func (n *Newsletter) sendBatch(c appengine.Context, batch int, now time.Time) error {
+	cfg, err := config.Get(c)
+	if err != nil {
+		c.Errorf("Failed to load site config; using defaults: %s", err)
+	}
+	q := datastore.NewQuery("Delivery").
+		Ancestor(newsletterKey(c, n.ID)).
+		Filter("Batch =", batch)
+	deliveries := []*Delivery{}
+	keys, err := q.GetAll(c, &deliveries)
+	if err != nil {
+		return err
+	}
+	for i, d := range deliveries {
+		d.Email = keys[i].StringID()
+		if d.Status != Queued {
+			continue
+		}
+		d.Attempted = now
+		switch s, err := WithEmail(c, d.Email); {
+		case err == ErrSubscriberNotFound || err == nil && s.Status != Subscribed:
+			d.Status = Skipped
+		case err != nil:
+			return err
+		default:
+			d.Status = Delivered
+			msg, err := n.message(c, cfg, d.Email)
+			if err == nil {
+				err = mail.Send(c, msg)
+			}
+			if err != nil {
+				c.Errorf("Failed to send newsletter %d to %q: %s", n.ID, d.Email, err)
+				d.Status = Failed
+				d.Error = err.Error()
+			}
+		}
+		if _, err := datastore.Put(c, keys[i], d); err != nil {
+			c.Criticalf("Failed to record delivery of newsletter %d to %q: %s", n.ID, d.Email, err)
+		}
+	}
+	return n.update(c, func(current *Newsletter) error {
+		for _, b := range current.SentBatches {
+			if b == batch {
+				return nil
+			}
+		}
+		current.SentBatches = append(current.SentBatches, batch)
+		current.finishIfDone(now)
+		return nil
+	})
+}
+
+// BatchesLeft returns the number of the newsletter's batches which
+// have yet to be sent.
+func (n *Newsletter) BatchesLeft() int {
+	if n.Status == Sent {
+		return 0
+	}
+	return n.Batches - len(n.SentBatches)
+}
+
+// finishIfDone marks the newsletter as sent once every batch has been
+// queued and sent.
+func (n *Newsletter) finishIfDone(now time.Time) {
+	if n.Status == Sending && n.Batches > 0 && len(n.SentBatches) >= n.Batches {
+		n.Status = Sent
+		n.Finished = now
+	}
+}
+
+// Deliveries returns the record of each message of the newsletter,
+// sorted by address.
+func (n *Newsletter) Deliveries(c appengine.Context) ([]*Delivery, error) {
+	q := datastore.NewQuery("Delivery").
+		Ancestor(newsletterKey(c, n.ID))
+	deliveries := []*Delivery{}
+	keys, err := q.GetAll(c, &deliveries)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		deliveries[i].Email = key.StringID()
+	}
+	return deliveries, nil
+}
+
+// DeliveryCounts returns the number of the newsletter's messages in
+// each state.
+func DeliveryCounts(deliveries []*Delivery) map[DeliveryStatus]int {
+	counts := make(map[DeliveryStatus]int)
+	for _, d := range deliveries {
+		counts[d.Status]++
+	}
+	return counts
+}
@@ -0,0 +1,77 @@
+package mailinglist
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"appengine/aetest"
+)
+
+func TestSendNewsletter(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	now := time.Unix(1000, 0)
+	n := NewNewsletter("Summer hours", "We're open **late** in July.", "staff@example.com", now)
+	if err := n.Insert(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Send(c, "staff@example.com", now); err != ErrNoSubscribers {
+		t.Errorf("Expected no subscribers; got %v", err)
+	}
+	for i := 0; i < BatchSize+1; i++ {
+		s := &Subscriber{Email: fmt.Sprintf("s%03d@example.com", i), Status: Subscribed}
+		if err := s.Put(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := n.Send(c, "staff@example.com", now); err != nil {
+		t.Fatalf("Failed to send: %s", err)
+	}
+	if n.Status != Sending || n.Recipients != BatchSize+1 || n.Batches != 2 {
+		t.Errorf("Wrong newsletter after sending: %+v", n)
+	}
+	if err := n.Send(c, "staff@example.com", now); err != ErrAlreadySent {
+		t.Errorf("Expected already sent; got %v", err)
+	}
+	left, err := WithEmail(c, "s000@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := left.Unsubscribe(c, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.sendBatch(c, 0, now); err != nil {
+		t.Fatalf("Failed to send batch 0: %s", err)
+	}
+	if err := n.sendBatch(c, 0, now); err != nil {
+		t.Fatalf("Failed to retry batch 0: %s", err)
+	}
+	if n.Status != Sending || n.BatchesLeft() != 1 {
+		t.Errorf("Expected one batch left: %+v", n)
+	}
+	if err := n.sendBatch(c, 1, now); err != nil {
+		t.Fatalf("Failed to send batch 1: %s", err)
+	}
+	deliveries, err := n.Deliveries(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := DeliveryCounts(deliveries)
+	if counts[Delivered] != BatchSize || counts[Skipped] != 1 || counts[Queued] != 0 {
+		t.Errorf("Wrong delivery counts: %v", counts)
+	}
+	got, err := NewsletterWithID(c, n.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != Sent || !got.Finished.Equal(now) {
+		t.Errorf("Expected newsletter to be finished: %+v", got)
+	}
+	if err := got.Delete(c); err != ErrAlreadySent {
+		t.Errorf("Shouldn't be able to delete a sent newsletter; got %v", err)
+	}
+}
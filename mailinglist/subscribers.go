@@ -0,0 +1,479 @@
+// Package mailinglist keeps the studio's email newsletter list. People
+// subscribe on the site and confirm by email before they receive
+// anything; each newsletter carries a signed link with which a
+// subscriber can leave the list in one click.
+package mailinglist
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"io"
+	netmail "net/mail"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+	"appengine/mail"
+
+	"github.com/decitrig/innerhearth/auth"
+	"github.com/decitrig/innerhearth/config"
+)
+
+var (
+	ErrSubscriberNotFound    = fmt.Errorf("mailinglist: subscriber not found")
+	ErrInvalidEmail          = fmt.Errorf("mailinglist: invalid email address")
+	ErrWrongConfirmationCode = fmt.Errorf("mailinglist: wrong confirmation code")
+	ErrInvalidSignature      = fmt.Errorf("mailinglist: invalid unsubscribe link")
+)
+
+// The paths at which subscribers confirm and leave the list.
+const (
+	ConfirmPath     = "/mailinglist/confirm"
+	UnsubscribePath = "/mailinglist/unsubscribe"
+)
+
+var (
+	delayedSendConfirmation = delay.Func("sendMailingListConfirmation", func(c appengine.Context, email string) error {
+		s, err := WithEmail(c, email)
+		if err != nil {
+			c.Errorf("Failed to find subscriber %q for confirmation: %s", email, err)
+			return nil
+		}
+		if s.Status != Pending {
+			return nil
+		}
+		cfg, err := config.Get(c)
+		if err != nil {
+			c.Errorf("Failed to load site config; using defaults: %s", err)
+		}
+		buf := &bytes.Buffer{}
+		data := map[string]interface{}{
+			"Subscriber": s,
+			"Config":     cfg,
+			"Link":       cfg.URL(s.ConfirmPath()),
+		}
+		if err := confirmationEmail.Execute(buf, data); err != nil {
+			c.Criticalf("Couldn't execute mailing list confirmation email: %s", err)
+			return nil
+		}
+		msg := &mail.Message{
+			Sender:  cfg.Sender(c),
+			To:      []string{s.Email},
+			Subject: fmt.Sprintf("Confirm your subscription to %s", cfg.StudioName),
+			Body:    buf.String(),
+		}
+		if err := mail.Send(c, msg); err != nil {
+			c.Criticalf("Couldn't send confirmation to %q: %s", s.Email, err)
+			return fmt.Errorf("failed to send email")
+		}
+		return nil
+	})
+)
+
+// A Status is the state of a subscription.
+type Status string
+
+const (
+	// Pending subscribers have signed up but not yet confirmed their
+	// address.
+	Pending      Status = "pending"
+	Subscribed   Status = "subscribed"
+	Unsubscribed Status = "unsubscribed"
+)
+
+// A Subscriber is an email address on the mailing list.
+type Subscriber struct {
+	// Addresses are stored in lower case.
+	Email string `datastore:"-"`
+
+	FirstName string `datastore:",noindex"`
+	LastName  string `datastore:",noindex"`
+	Status    Status
+
+	ConfirmationCode string `datastore:",noindex"`
+
+	// Where the subscriber signed up: "web" or "import".
+	Source string `datastore:",noindex"`
+
+	Created      time.Time `datastore:",noindex"`
+	Confirmed    time.Time `datastore:",noindex"`
+	Unsubscribed time.Time `datastore:",noindex"`
+}
+
+// NormalizeEmail checks that s is a plain email address, and returns
+// it in lower case.
+func NormalizeEmail(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	addr, err := netmail.ParseAddress(s)
+	if err != nil || addr.Name != "" || addr.Address != s {
+		return "", ErrInvalidEmail
+	}
+	return strings.ToLower(addr.Address), nil
+}
+
+func newConfirmationCode() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+func subscriberKey(c appengine.Context, email string) *datastore.Key {
+	return datastore.NewKey(c, "Subscriber", email, 0, nil)
+}
+
+// WithEmail returns the subscriber with the given address, if one
+// exists.
+func WithEmail(c appengine.Context, email string) (*Subscriber, error) {
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return nil, ErrSubscriberNotFound
+	}
+	s := &Subscriber{}
+	switch err := datastore.Get(c, subscriberKey(c, email), s); err {
+	case nil:
+		s.Email = email
+		return s, nil
+	case datastore.ErrNoSuchEntity:
+		return nil, ErrSubscriberNotFound
+	default:
+		return nil, err
+	}
+}
+
+// Put stores the subscriber, replacing any subscriber with the same
+// address.
+func (s *Subscriber) Put(c appengine.Context) error {
+	_, err := datastore.Put(c, subscriberKey(c, s.Email), s)
+	return err
+}
+
+// Name returns the subscriber's full name, if known.
+func (s *Subscriber) Name() string {
+	return strings.TrimSpace(s.FirstName + " " + s.LastName)
+}
+
+// ConfirmPath returns the path of the link which confirms a pending
+// subscription.
+func (s *Subscriber) ConfirmPath() string {
+	return fmt.Sprintf("%s?email=%s&code=%s", ConfirmPath, url.QueryEscape(s.Email), url.QueryEscape(s.ConfirmationCode))
+}
+
+func unsubscribeMessage(email string) string {
+	return "unsubscribe:" + email
+}
+
+// SignedUnsubscribePath returns the path of a signed link which
+// removes an address from the list.
+func SignedUnsubscribePath(c appengine.Context, email string) (string, error) {
+	sig, err := auth.Sign(c, unsubscribeMessage(email))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s?email=%s&sig=%s", UnsubscribePath, url.QueryEscape(email), url.QueryEscape(sig)), nil
+}
+
+// Subscribe adds an address to the list, pending confirmation, and
+// emails the subscriber a link with which to confirm. Addresses which
+// are already subscribed are left as they are; pending addresses are
+// sent their confirmation link again.
+func Subscribe(c appengine.Context, email, firstName, lastName string, now time.Time) (*Subscriber, error) {
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	code, err := newConfirmationCode()
+	if err != nil {
+		return nil, fmt.Errorf("mailinglist: couldn't create confirmation code: %s", err)
+	}
+	var s *Subscriber
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var err error
+		switch s, err = WithEmail(c, email); err {
+		case nil:
+			break
+		case ErrSubscriberNotFound:
+			s = &Subscriber{Email: email, Source: "web", Created: now}
+		default:
+			return err
+		}
+		if s.Status == Subscribed {
+			return nil
+		}
+		if s.Status != Pending {
+			s.Status = Pending
+			s.ConfirmationCode = code
+		}
+		if firstName != "" || lastName != "" {
+			s.FirstName, s.LastName = firstName, lastName
+		}
+		if err := s.Put(c); err != nil {
+			return err
+		}
+		delayedSendConfirmation.Call(c, s.Email)
+		return nil
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Confirm completes a pending subscription. Confirming an address
+// which is already subscribed does nothing.
+func (s *Subscriber) Confirm(c appengine.Context, code string, now time.Time) error {
+	switch {
+	case s.Status == Subscribed:
+		return nil
+	case s.Status != Pending || code != s.ConfirmationCode:
+		return ErrWrongConfirmationCode
+	}
+	s.Status = Subscribed
+	s.Confirmed = now
+	s.ConfirmationCode = ""
+	return s.Put(c)
+}
+
+// CheckUnsubscribe checks the signature from an address's unsubscribe
+// link, and returns the address. Returns ErrInvalidSignature if the
+// link is not valid.
+func CheckUnsubscribe(c appengine.Context, email, signature string) (string, error) {
+	email, err := NormalizeEmail(email)
+	if err != nil || !auth.ValidSignature(c, unsubscribeMessage(email), signature) {
+		return "", ErrInvalidSignature
+	}
+	return email, nil
+}
+
+// Unsubscribe removes an address from the list using the signature
+// from its unsubscribe link. The subscriber is kept, so that an import
+// can't add them back.
+func Unsubscribe(c appengine.Context, email, signature string, now time.Time) (*Subscriber, error) {
+	email, err := CheckUnsubscribe(c, email, signature)
+	if err != nil {
+		return nil, err
+	}
+	s, err := WithEmail(c, email)
+	if err != nil {
+		return nil, err
+	}
+	return s, s.Unsubscribe(c, now)
+}
+
+// Unsubscribe removes the subscriber from the list.
+func (s *Subscriber) Unsubscribe(c appengine.Context, now time.Time) error {
+	if s.Status == Unsubscribed {
+		return nil
+	}
+	s.Status = Unsubscribed
+	s.Unsubscribed = now
+	s.ConfirmationCode = ""
+	return s.Put(c)
+}
+
+type byEmail []*Subscriber
+
+func (l byEmail) Len() int           { return len(l) }
+func (l byEmail) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byEmail) Less(i, j int) bool { return l[i].Email < l[j].Email }
+
+func getSubscribers(c appengine.Context, q *datastore.Query) ([]*Subscriber, error) {
+	subscribers := []*Subscriber{}
+	keys, err := q.GetAll(c, &subscribers)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		subscribers[i].Email = key.StringID()
+	}
+	sort.Sort(byEmail(subscribers))
+	return subscribers, nil
+}
+
+// Subscribers returns all confirmed subscribers, sorted by address.
+func Subscribers(c appengine.Context) ([]*Subscriber, error) {
+	return getSubscribers(c, datastore.NewQuery("Subscriber").Filter("Status =", Subscribed))
+}
+
+// All returns every address which has ever been on the list, sorted
+// by address.
+func All(c appengine.Context) ([]*Subscriber, error) {
+	return getSubscribers(c, datastore.NewQuery("Subscriber"))
+}
+
+// Counts returns the number of addresses with each status.
+func Counts(c appengine.Context) (map[Status]int, error) {
+	counts := make(map[Status]int)
+	for _, status := range []Status{Pending, Subscribed, Unsubscribed} {
+		n, err := datastore.NewQuery("Subscriber").Filter("Status =", status).Count(c)
+		if err != nil {
+			return nil, err
+		}
+		counts[status] = n
+	}
+	return counts, nil
+}
+
+// exportHeader is the first row of an exported subscriber list.
+var exportHeader = []string{"email", "first name", "last name", "status", "source", "created", "confirmed", "unsubscribed"}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// csvCell returns a value as written to an exported list. Values which
+// a spreadsheet would read as a formula are prefixed with a quote.
+func csvCell(s string) string {
+	if s != "" && strings.ContainsAny(s[:1], "=+-@") {
+		return "'" + s
+	}
+	return s
+}
+
+// WriteCSV writes a list of subscribers as CSV, with a header row.
+func WriteCSV(w io.Writer, subscribers []*Subscriber) error {
+	out := csv.NewWriter(w)
+	if err := out.Write(exportHeader); err != nil {
+		return err
+	}
+	for _, s := range subscribers {
+		row := []string{s.Email, s.FirstName, s.LastName, string(s.Status), s.Source,
+			formatTime(s.Created), formatTime(s.Confirmed), formatTime(s.Unsubscribed)}
+		for i := range row {
+			row[i] = csvCell(row[i])
+		}
+		if err := out.Write(row); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// An ImportResult summarizes an import of subscribers.
+type ImportResult struct {
+	// The number of addresses added to the list.
+	Added int
+
+	// The number of addresses which were already subscribed, or which
+	// had unsubscribed and so were left off the list.
+	Existing     int
+	Unsubscribed int
+
+	// Rows which had no valid address.
+	Invalid []string
+}
+
+// The most subscribers read or written in one datastore call.
+const importBatch = 500
+
+// ImportCSV adds subscribers from a CSV file whose columns are email,
+// first name and last name; a header row is skipped. Imported
+// addresses are subscribed without confirmation, since they were
+// collected elsewhere, but anyone who has unsubscribed stays off the
+// list.
+func ImportCSV(c appengine.Context, r io.Reader, now time.Time) (*ImportResult, error) {
+	in := csv.NewReader(r)
+	in.FieldsPerRecord = -1
+	in.TrimLeadingSpace = true
+	rows, err := in.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("mailinglist: couldn't read CSV: %s", err)
+	}
+	result := &ImportResult{}
+	seen := make(map[string]bool)
+	imported := []*Subscriber{}
+	for i, row := range rows {
+		if len(row) == 0 || strings.Join(row, "") == "" {
+			continue
+		}
+		email, err := NormalizeEmail(row[0])
+		if err != nil {
+			if i > 0 || !strings.EqualFold(strings.TrimSpace(row[0]), "email") {
+				result.Invalid = append(result.Invalid, strings.Join(row, ","))
+			}
+			continue
+		}
+		if seen[email] {
+			continue
+		}
+		seen[email] = true
+		s := &Subscriber{Email: email, Status: Subscribed, Source: "import", Created: now, Confirmed: now}
+		if len(row) > 1 {
+			s.FirstName = strings.TrimSpace(row[1])
+		}
+		if len(row) > 2 {
+			s.LastName = strings.TrimSpace(row[2])
+		}
+		imported = append(imported, s)
+	}
+	for len(imported) > 0 {
+		n := importBatch
+		if n > len(imported) {
+			n = len(imported)
+		}
+		if err := importBatchOf(c, imported[:n], result); err != nil {
+			return nil, err
+		}
+		imported = imported[n:]
+	}
+	return result, nil
+}
+
+// importBatchOf stores those of a batch of imported subscribers who
+// aren't already on the list.
+func importBatchOf(c appengine.Context, batch []*Subscriber, result *ImportResult) error {
+	keys := make([]*datastore.Key, len(batch))
+	existing := make([]*Subscriber, len(batch))
+	for i, s := range batch {
+		keys[i] = subscriberKey(c, s.Email)
+		existing[i] = &Subscriber{}
+	}
+	errs := make([]error, len(batch))
+	switch err := datastore.GetMulti(c, keys, existing); err.(type) {
+	case nil:
+		break
+	case datastore.MultiError:
+		errs = err.(datastore.MultiError)
+	default:
+		return err
+	}
+	putKeys := []*datastore.Key{}
+	put := []*Subscriber{}
+	for i, s := range batch {
+		switch err := errs[i]; {
+		case err == datastore.ErrNoSuchEntity:
+			putKeys = append(putKeys, keys[i])
+			put = append(put, s)
+			result.Added++
+		case err != nil:
+			return err
+		case existing[i].Status == Unsubscribed:
+			result.Unsubscribed++
+		case existing[i].Status == Subscribed:
+			result.Existing++
+		default:
+			// Imported addresses confirm pending subscriptions.
+			s.Created = existing[i].Created
+			putKeys = append(putKeys, keys[i])
+			put = append(put, s)
+			result.Added++
+		}
+	}
+	if len(put) == 0 {
+		return nil
+	}
+	_, err := datastore.PutMulti(c, putKeys, put)
+	return err
+}
@@ -0,0 +1,146 @@
+package mailinglist
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"appengine/aetest"
+
+	"github.com/decitrig/innerhearth/auth"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	for i, test := range []struct {
+		in, want string
+		err      error
+	}{
+		{"jill@example.com", "jill@example.com", nil},
+		{"  Jill@Example.COM ", "jill@example.com", nil},
+		{"Jill <jill@example.com>", "", ErrInvalidEmail},
+		{"jill", "", ErrInvalidEmail},
+		{"", "", ErrInvalidEmail},
+	} {
+		if got, err := NormalizeEmail(test.in); got != test.want || err != test.err {
+			t.Errorf("%d: NormalizeEmail(%q) = %q, %v; want %q, %v", i, test.in, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	now := time.Unix(1000, 0)
+	s, err := Subscribe(c, "Jill@Example.com", "Jill", "", now)
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %s", err)
+	}
+	if s.Email != "jill@example.com" || s.Status != Pending || s.ConfirmationCode == "" {
+		t.Fatalf("Wrong new subscriber: %+v", s)
+	}
+	if err := s.Confirm(c, "wrong", now); err != ErrWrongConfirmationCode {
+		t.Errorf("Expected wrong code; got %v", err)
+	}
+	if err := s.Confirm(c, s.ConfirmationCode, now); err != nil {
+		t.Fatalf("Failed to confirm: %s", err)
+	}
+	got, err := WithEmail(c, "jill@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != Subscribed || got.FirstName != "Jill" || !got.Confirmed.Equal(now) {
+		t.Errorf("Wrong confirmed subscriber: %+v", got)
+	}
+	if again, err := Subscribe(c, "jill@example.com", "", "", now); err != nil || again.Status != Subscribed {
+		t.Errorf("Subscribing again should leave subscription alone; got %+v, %v", again, err)
+	}
+	other, err := auth.Sign(c, "unsubscribe:lauren@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Unsubscribe(c, "jill@example.com", other, now); err != ErrInvalidSignature {
+		t.Errorf("Expected invalid signature; got %v", err)
+	}
+	path, err := SignedUnsubscribePath(c, "jill@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := url.Parse(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Unsubscribe(c, link.Query().Get("email"), link.Query().Get("sig"), now); err != nil {
+		t.Fatalf("Failed to unsubscribe: %s", err)
+	}
+	if got, _ := WithEmail(c, "jill@example.com"); got.Status != Unsubscribed {
+		t.Errorf("Expected unsubscribed; got %+v", got)
+	}
+	if again, err := Subscribe(c, "jill@example.com", "", "", now); err != nil || again.Status != Pending || again.ConfirmationCode == "" {
+		t.Errorf("Expected new pending subscription; got %+v, %v", again, err)
+	}
+}
+
+func TestImportExport(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	now := time.Unix(1000, 0)
+	gone := &Subscriber{Email: "gone@example.com", Status: Unsubscribed}
+	if err := gone.Put(c); err != nil {
+		t.Fatal(err)
+	}
+	csv := "Email,First Name,Last Name\n" +
+		"jill@example.com,Jill,Smith\n" +
+		"LAUREN@example.com, Lauren\n" +
+		"jill@example.com,Jill,Smith\n" +
+		"gone@example.com,Gone,Away\n" +
+		"not an address,Who\n"
+	result, err := ImportCSV(c, strings.NewReader(csv), now)
+	if err != nil {
+		t.Fatalf("Failed to import: %s", err)
+	}
+	if result.Added != 2 || result.Unsubscribed != 1 || len(result.Invalid) != 1 {
+		t.Errorf("Wrong import result: %+v", result)
+	}
+	if result, err := ImportCSV(c, strings.NewReader(csv), now); err != nil || result.Existing != 2 || result.Added != 0 {
+		t.Errorf("Wrong result of second import: %+v, %v", result, err)
+	}
+	subscribers, err := Subscribers(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subscribers) != 2 || subscribers[0].Email != "jill@example.com" || subscribers[1].FirstName != "Lauren" {
+		t.Errorf("Wrong subscribers: %v", subscribers)
+	}
+	all, err := All(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := WriteCSV(buf, all); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[1], "gone@example.com,,,unsubscribed") {
+		t.Errorf("Wrong export:\n%s", buf.String())
+	}
+}
+
+func TestWriteCSVEscapesFormulas(t *testing.T) {
+	buf := &bytes.Buffer{}
+	subscribers := []*Subscriber{{Email: "jill@example.com", FirstName: "=HYPERLINK(\"x\")", LastName: "-Smith", Source: "@import", Status: Subscribed}}
+	if err := WriteCSV(buf, subscribers); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if want := `jill@example.com,"'=HYPERLINK(""x"")",'-Smith,subscribed,'@import,,,`; len(lines) != 2 || lines[1] != want {
+		t.Errorf("Wrong export: got %q, want %q", lines, want)
+	}
+}
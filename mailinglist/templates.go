@@ -0,0 +1,46 @@
+package mailinglist
+
+import (
+	htmltemplate "html/template"
+	"text/template"
+)
+
+var (
+	confirmationEmail = template.Must(template.New("confirmation").Parse(`{{with .Subscriber.FirstName}}Dear {{.}},
+
+{{end}}Thank you for signing up for the {{.Config.StudioName}} mailing list. To confirm your subscription, visit
+
+{{.Link}}
+
+If you didn't sign up, you can ignore this email and you won't hear from us again.
+
+{{.Config.StudioName}}
+{{.Config.ContactEmail}}
+{{.Config.ContactPhone}}
+{{.Config.BaseURL}}`))
+
+	newsletterEmail = template.Must(template.New("newsletter").Parse(`{{.Newsletter.BodyText}}
+
+--
+{{.Config.StudioName}}
+{{.Config.ContactEmail}}
+{{.Config.ContactPhone}}
+{{.Config.BaseURL}}
+
+You are receiving this because you subscribed to our mailing list. To unsubscribe, visit
+{{.Unsubscribe}}`))
+
+	newsletterHTMLEmail = htmltemplate.Must(htmltemplate.New("newsletter").Parse(`<html>
+<body>
+{{.HTML}}
+<hr>
+<p>
+{{.Config.StudioName}}<br>
+<a href="mailto:{{.Config.ContactEmail}}">{{.Config.ContactEmail}}</a><br>
+{{.Config.ContactPhone}}<br>
+<a href="{{.Config.BaseURL}}">{{.Config.BaseURL}}</a>
+</p>
+<p><small>You are receiving this because you subscribed to our mailing list. <a href="{{.Unsubscribe}}">Unsubscribe</a></small></p>
+</body>
+</html>`))
+)
@@ -0,0 +1,250 @@
+// Package makeups manages make-up credits. A student registered for a
+// whole session who will miss one of their class's meetings can mark
+// it as missed and receive a credit, which they can redeem for a
+// drop-in registration in any class in the same session before the
+// session ends.
+package makeups
+
+import (
+	"fmt"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/students"
+)
+
+var (
+	ErrCreditNotFound    = fmt.Errorf("makeups: credit not found")
+	ErrNotSessionStudent = fmt.Errorf("makeups: only session registrations can be made up")
+	ErrNotUpcoming       = fmt.Errorf("makeups: no upcoming meeting of the class on that date")
+	ErrAlreadyMissed     = fmt.Errorf("makeups: meeting was already marked as missed")
+	ErrCreditUsed        = fmt.Errorf("makeups: credit has already been used")
+	ErrCreditExpired     = fmt.Errorf("makeups: credit has expired")
+	ErrWrongSession      = fmt.Errorf("makeups: credit cannot be used in another session")
+	ErrWrongAccount      = fmt.Errorf("makeups: credit belongs to another account")
+)
+
+// A Credit is issued for a single missed meeting of a session class.
+type Credit struct {
+	ID string `datastore:"-"`
+
+	AccountID string
+	Email     string `datastore:",noindex"`
+	SessionID int64  `datastore:",noindex"`
+
+	// The class and the start time of the meeting which was missed.
+	ClassID int64
+	Missed  time.Time `datastore:",noindex"`
+
+	// The credit can't be used for classes after Expires.
+	Expires time.Time `datastore:",noindex"`
+	Created time.Time `datastore:",noindex"`
+
+	// The class and date of the drop-in for which the credit was
+	// redeemed, if it has been used.
+	UsedClassID int64     `datastore:",noindex"`
+	UsedDate    time.Time `datastore:",noindex"`
+}
+
+// A student can miss each meeting only once, so credits are keyed by
+// the account, class and meeting.
+func creditID(accountID string, classID int64, missed time.Time) string {
+	return fmt.Sprintf("%s:%d:%d", accountID, classID, missed.Unix())
+}
+
+func creditKey(c appengine.Context, id string) *datastore.Key {
+	return datastore.NewKey(c, "MakeUpCredit", id, 0, nil)
+}
+
+// WithID returns the credit with the given ID, if one exists.
+func WithID(c appengine.Context, id string) (*Credit, error) {
+	credit := &Credit{}
+	switch err := datastore.Get(c, creditKey(c, id), credit); err {
+	case nil:
+		credit.ID = id
+		return credit, nil
+	case datastore.ErrNoSuchEntity:
+		return nil, ErrCreditNotFound
+	default:
+		return nil, err
+	}
+}
+
+func getAll(c appengine.Context, q *datastore.Query) ([]*Credit, error) {
+	credits := []*Credit{}
+	keys, err := q.GetAll(c, &credits)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		credits[i].ID = key.StringID()
+	}
+	return credits, nil
+}
+
+// ForAccount returns all credits issued to an account.
+func ForAccount(c appengine.Context, accountID string) ([]*Credit, error) {
+	q := datastore.NewQuery("MakeUpCredit").
+		Filter("AccountID =", accountID)
+	return getAll(c, q)
+}
+
+// ForClass returns all credits issued for missed meetings of a class.
+func ForClass(c appengine.Context, classID int64) ([]*Credit, error) {
+	q := datastore.NewQuery("MakeUpCredit").
+		Filter("ClassID =", classID)
+	return getAll(c, q)
+}
+
+// Available returns an account's credits which can still be redeemed
+// in a session.
+func Available(c appengine.Context, accountID string, sessionID int64, now time.Time) ([]*Credit, error) {
+	all, err := ForAccount(c, accountID)
+	if err != nil {
+		return nil, err
+	}
+	available := []*Credit{}
+	for _, credit := range all {
+		if credit.SessionID == sessionID && !credit.Used() && !credit.Expired(now) {
+			available = append(available, credit)
+		}
+	}
+	return available, nil
+}
+
+// Put stores the credit.
+func (credit *Credit) Put(c appengine.Context) error {
+	if _, err := datastore.Put(c, creditKey(c, credit.ID), credit); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Used returns true if the credit has been redeemed.
+func (credit *Credit) Used() bool {
+	return credit.UsedClassID != 0
+}
+
+// Expired returns true if the credit can no longer be used as of now.
+func (credit *Credit) Expired(now time.Time) bool {
+	return !now.Before(credit.Expires)
+}
+
+// GoodThrough returns the last moment at which the credit can be used.
+func (credit *Credit) GoodThrough() time.Time {
+	return credit.Expires.Add(-time.Nanosecond)
+}
+
+// expiration returns the end of a session's last day in loc, after
+// which its credits can't be used.
+func expiration(session *classes.Session, loc *time.Location) time.Time {
+	end := session.End.In(loc)
+	return time.Date(end.Year(), end.Month(), end.Day()+1, 0, 0, 0, 0, loc)
+}
+
+// MarkMissed records that a session student will miss the meeting of
+// their class on the given date, and issues them a make-up credit.
+func MarkMissed(c appengine.Context, student *students.Student, class *classes.Class, session *classes.Session, date time.Time, loc *time.Location, now time.Time) (*Credit, error) {
+	if student.DropIn {
+		return nil, ErrNotSessionStudent
+	}
+	var missed *classes.Occurrence
+	date = date.In(loc)
+	for _, o := range class.Occurrences(session, now, loc) {
+		start := o.Start.In(loc)
+		if start.Year() == date.Year() && start.YearDay() == date.YearDay() && o.Start.After(now) {
+			missed = &o
+			break
+		}
+	}
+	if missed == nil {
+		return nil, ErrNotUpcoming
+	}
+	credit := &Credit{
+		ID:        creditID(student.ID, class.ID, missed.Start),
+		AccountID: student.ID,
+		Email:     student.Email,
+		SessionID: session.ID,
+		ClassID:   class.ID,
+		Missed:    missed.Start,
+		Expires:   expiration(session, loc),
+		Created:   now,
+	}
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		switch _, err := WithID(c, credit.ID); err {
+		case nil:
+			return ErrAlreadyMissed
+		case ErrCreditNotFound:
+			return credit.Put(c)
+		default:
+			return err
+		}
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return credit, nil
+}
+
+// Redeem adds a drop-in registration in a class of the given session,
+// paid for with a make-up credit. The credit is used only if the
+// registration succeeds.
+func Redeem(c appengine.Context, creditID string, student *students.Student, sessionID int64, now time.Time) error {
+	if !student.DropIn {
+		return ErrNotSessionStudent
+	}
+	// The transaction may be retried, so the payment is recorded
+	// against what had been paid before it began.
+	paid := student.AmountPaid
+	return student.AddWith(c, now, func(c appengine.Context) error {
+		credit, err := WithID(c, creditID)
+		if err != nil {
+			return err
+		}
+		switch {
+		case credit.AccountID != student.ID:
+			return ErrWrongAccount
+		case credit.Used():
+			return ErrCreditUsed
+		case credit.SessionID != sessionID:
+			return ErrWrongSession
+		case credit.Expired(now) || credit.Expired(student.Date):
+			return ErrCreditExpired
+		}
+		credit.UsedClassID = student.ClassID
+		credit.UsedDate = student.Date
+		if err := credit.Put(c); err != nil {
+			return err
+		}
+		student.MakeUpID = credit.ID
+		student.AmountPaid = paid
+		student.RecordPayment(student.Price, students.MakeUp, "make-up", now)
+		return nil
+	})
+}
+
+// Cancel cancels a make-up registration, returning its credit so that
+// it can be used again.
+func Cancel(c appengine.Context, student *students.Student, now time.Time) error {
+	if student.MakeUpID == "" {
+		return student.CancelWith(c, now, nil)
+	}
+	return student.CancelWith(c, now, func(c appengine.Context) error {
+		credit, err := WithID(c, student.MakeUpID)
+		switch err {
+		case nil:
+			break
+		case ErrCreditNotFound:
+			c.Warningf("Make-up credit %s for %q not found; not returning it", student.MakeUpID, student.Email)
+			return nil
+		default:
+			return err
+		}
+		credit.UsedClassID = 0
+		credit.UsedDate = time.Time{}
+		return credit.Put(c)
+	})
+}
@@ -0,0 +1,84 @@
+package makeups
+
+import (
+	"testing"
+	"time"
+
+	"appengine/aetest"
+
+	"github.com/decitrig/innerhearth/account"
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/students"
+)
+
+func TestMissAndMakeUp(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	loc := time.UTC
+	session := classes.NewSession("fall", time.Date(2013, 9, 2, 0, 0, 0, 0, loc), time.Date(2013, 9, 29, 0, 0, 0, 0, loc))
+	if err := session.Insert(c); err != nil {
+		t.Fatal(err)
+	}
+	nine := time.Date(0, 1, 1, 9, 0, 0, 0, loc)
+	monday := &classes.Class{Title: "monday", Weekday: time.Monday, StartTime: nine, Length: time.Hour, Capacity: 10, Session: session.ID}
+	if err := monday.Insert(c); err != nil {
+		t.Fatal(err)
+	}
+	friday := &classes.Class{Title: "friday", Weekday: time.Friday, StartTime: nine, Length: time.Hour, Capacity: 10, Session: session.ID}
+	if err := friday.Insert(c); err != nil {
+		t.Fatal(err)
+	}
+	acct := &account.Account{ID: "0x1", Info: account.Info{Email: "a@example.com"}}
+	student := students.New(acct, monday)
+	now := time.Date(2013, 9, 3, 0, 0, 0, 0, loc)
+
+	if _, err := MarkMissed(c, student, monday, session, time.Date(2013, 9, 2, 0, 0, 0, 0, loc), loc, now); err != ErrNotUpcoming {
+		t.Errorf("Expected ErrNotUpcoming for a past meeting; got %v", err)
+	}
+	if _, err := MarkMissed(c, student, monday, session, time.Date(2013, 9, 10, 0, 0, 0, 0, loc), loc, now); err != ErrNotUpcoming {
+		t.Errorf("Expected ErrNotUpcoming for a day the class doesn't meet; got %v", err)
+	}
+	credit, err := MarkMissed(c, student, monday, session, time.Date(2013, 9, 9, 0, 0, 0, 0, loc), loc, now)
+	if err != nil {
+		t.Fatalf("Failed to mark class missed: %s", err)
+	}
+	if _, err := MarkMissed(c, student, monday, session, time.Date(2013, 9, 9, 0, 0, 0, 0, loc), loc, now); err != ErrAlreadyMissed {
+		t.Errorf("Expected ErrAlreadyMissed; got %v", err)
+	}
+
+	late := students.NewDropIn(acct, friday, time.Date(2013, 9, 30, 0, 0, 0, 0, loc))
+	if err := Redeem(c, credit.ID, late, session.ID, now); err != ErrCreditExpired {
+		t.Errorf("Expected ErrCreditExpired after the session; got %v", err)
+	}
+	dropIn := students.NewDropIn(acct, friday, time.Date(2013, 9, 13, 0, 0, 0, 0, loc))
+	if err := Redeem(c, credit.ID, dropIn, session.ID+1, now); err != ErrWrongSession {
+		t.Errorf("Expected ErrWrongSession; got %v", err)
+	}
+	if err := Redeem(c, credit.ID, dropIn, session.ID, now); err != nil {
+		t.Fatalf("Failed to redeem credit: %s", err)
+	}
+	if got, _ := WithID(c, credit.ID); !got.Used() || got.UsedClassID != friday.ID {
+		t.Errorf("Expected credit to be used in %d; got %+v", friday.ID, got)
+	}
+	added, err := students.WithIDInClass(c, acct.ID, friday, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added.MakeUpID != credit.ID {
+		t.Errorf("Expected make-up %s; got %q", credit.ID, added.MakeUpID)
+	}
+	if available, _ := Available(c, acct.ID, session.ID, now); len(available) != 0 {
+		t.Errorf("Expected no available credits; got %d", len(available))
+	}
+
+	if err := Cancel(c, added, now); err != nil {
+		t.Fatalf("Failed to cancel: %s", err)
+	}
+	if available, _ := Available(c, acct.ID, session.ID, now); len(available) != 1 {
+		t.Errorf("Expected credit to be returned; got %d available", len(available))
+	}
+}
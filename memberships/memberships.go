@@ -0,0 +1,150 @@
+// Package memberships manages unlimited session memberships, which
+// let their holders register for any class in a session at no
+// further cost.
+package memberships
+
+import (
+	"fmt"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/pricing"
+	"github.com/decitrig/innerhearth/students"
+)
+
+var (
+	ErrMembershipNotFound = fmt.Errorf("memberships: membership not found")
+)
+
+// A Membership grants an account unlimited classes for one session.
+type Membership struct {
+	AccountID string
+	SessionID int64
+
+	Price     pricing.Cents `datastore:",noindex"`
+	Created   time.Time     `datastore:",noindex"`
+	CreatedBy string        `datastore:",noindex"`
+}
+
+// New returns a new membership for an account in a session.
+func New(accountID string, sessionID int64, price pricing.Cents, createdBy string, now time.Time) *Membership {
+	return &Membership{
+		AccountID: accountID,
+		SessionID: sessionID,
+		Price:     price,
+		Created:   now,
+		CreatedBy: createdBy,
+	}
+}
+
+// An account has at most one membership in each session, so
+// memberships are keyed by both.
+func membershipKey(c appengine.Context, accountID string, sessionID int64) *datastore.Key {
+	return datastore.NewKey(c, "Membership", fmt.Sprintf("%s:%d", accountID, sessionID), 0, nil)
+}
+
+// ForSession returns an account's membership in a session, if it has
+// one.
+func ForSession(c appengine.Context, accountID string, sessionID int64) (*Membership, error) {
+	m := &Membership{}
+	switch err := datastore.Get(c, membershipKey(c, accountID, sessionID), m); err {
+	case nil:
+		return m, nil
+	case datastore.ErrNoSuchEntity:
+		return nil, ErrMembershipNotFound
+	default:
+		return nil, err
+	}
+}
+
+// IsMember returns true if an account has a membership in a session.
+// Errors are logged and treated as no membership.
+func IsMember(c appengine.Context, accountID string, sessionID int64) bool {
+	switch _, err := ForSession(c, accountID, sessionID); err {
+	case nil:
+		return true
+	case ErrMembershipNotFound:
+		return false
+	default:
+		c.Errorf("Failed to look up membership of %q in %d: %s", accountID, sessionID, err)
+		return false
+	}
+}
+
+func getAll(c appengine.Context, q *datastore.Query) ([]*Membership, error) {
+	memberships := []*Membership{}
+	if _, err := q.GetAll(c, &memberships); err != nil {
+		return nil, err
+	}
+	return memberships, nil
+}
+
+// ForAccount returns all of an account's memberships.
+func ForAccount(c appengine.Context, accountID string) ([]*Membership, error) {
+	q := datastore.NewQuery("Membership").
+		Filter("AccountID =", accountID)
+	return getAll(c, q)
+}
+
+// InSession returns all memberships in a session.
+func InSession(c appengine.Context, sessionID int64) ([]*Membership, error) {
+	q := datastore.NewQuery("Membership").
+		Filter("SessionID =", sessionID)
+	return getAll(c, q)
+}
+
+// Put stores the membership, replacing any existing membership of the
+// account in the session.
+func (m *Membership) Put(c appengine.Context) error {
+	if _, err := datastore.Put(c, membershipKey(c, m.AccountID, m.SessionID), m); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Delete revokes the membership.
+func (m *Membership) Delete(c appengine.Context) error {
+	return datastore.Delete(c, membershipKey(c, m.AccountID, m.SessionID))
+}
+
+// Usage summarizes how much a member has used their membership.
+type Usage struct {
+	// The number of classes for which the member has session
+	// registrations.
+	SessionClasses int
+
+	// The number of drop-in registrations the member has made.
+	DropIns int
+
+	// The total number of class meetings covered by those
+	// registrations.
+	Meetings int
+}
+
+// UsageOf computes how much a member has used their membership in a
+// session, given the session, its classes and the member's
+// registrations.
+func UsageOf(session *classes.Session, sessionClasses []*classes.Class, registrations []*students.Student, loc *time.Location) *Usage {
+	byID := make(map[int64]*classes.Class)
+	for _, class := range sessionClasses {
+		byID[class.ID] = class
+	}
+	u := &Usage{}
+	for _, s := range registrations {
+		class, ok := byID[s.ClassID]
+		if !ok {
+			continue
+		}
+		if s.DropIn {
+			u.DropIns++
+			u.Meetings++
+			continue
+		}
+		u.SessionClasses++
+		u.Meetings += len(class.Occurrences(session, session.Start, loc))
+	}
+	return u
+}
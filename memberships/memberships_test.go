@@ -0,0 +1,80 @@
+package memberships
+
+import (
+	"testing"
+	"time"
+
+	"appengine/aetest"
+
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/students"
+)
+
+func TestForSession(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	now := time.Unix(100000, 0)
+	m := New("0x1", 10, 25000, "staff@example.com", now)
+	if err := m.Put(c); err != nil {
+		t.Fatal(err)
+	}
+	if !IsMember(c, "0x1", 10) {
+		t.Errorf("0x1 should be a member of session 10")
+	}
+	if IsMember(c, "0x1", 11) {
+		t.Errorf("0x1 should not be a member of session 11")
+	}
+	if IsMember(c, "0x2", 10) {
+		t.Errorf("0x2 should not be a member of session 10")
+	}
+	if err := New("0x2", 10, 0, "staff@example.com", now).Put(c); err != nil {
+		t.Fatal(err)
+	}
+	// Reissuing a membership replaces it.
+	if err := New("0x1", 10, 20000, "staff@example.com", now).Put(c); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ForSession(c, "0x1", 10); err != nil {
+		t.Fatal(err)
+	} else if got.Price != 20000 {
+		t.Errorf("Expected reissued price of 20000; got %d", got.Price)
+	}
+	if all, err := InSession(c, 10); err != nil {
+		t.Fatal(err)
+	} else if len(all) != 2 {
+		t.Errorf("Expected 2 memberships in session 10; got %d", len(all))
+	}
+	if err := m.Delete(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ForSession(c, "0x1", 10); err != ErrMembershipNotFound {
+		t.Errorf("Expected ErrMembershipNotFound after revoking; got %v", err)
+	}
+}
+
+func TestUsageOf(t *testing.T) {
+	loc := time.UTC
+	session := &classes.Session{
+		ID:    1,
+		Start: time.Date(2013, 9, 2, 0, 0, 0, 0, loc),
+		End:   time.Date(2013, 9, 29, 0, 0, 0, 0, loc),
+	}
+	nine := time.Date(0, 1, 1, 9, 0, 0, 0, loc)
+	monday := &classes.Class{ID: 1, Weekday: time.Monday, StartTime: nine, Length: time.Hour, Session: 1}
+	friday := &classes.Class{ID: 2, Weekday: time.Friday, StartTime: nine, Length: time.Hour, Session: 1}
+	registrations := []*students.Student{
+		{ClassID: 1},
+		{ClassID: 2, DropIn: true},
+		{ClassID: 2, DropIn: true},
+		// A class in another session doesn't count.
+		{ClassID: 3},
+	}
+	u := UsageOf(session, []*classes.Class{monday, friday}, registrations, loc)
+	if u.SessionClasses != 1 || u.DropIns != 2 || u.Meetings != 6 {
+		t.Errorf("Expected 1 session class, 2 drop-ins and 6 meetings; got %+v", u)
+	}
+}
@@ -0,0 +1,220 @@
+// Package orders keeps a record of what students have bought, so that
+// they can be sent itemized receipts and look back over past
+// purchases.
+package orders
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+	"appengine/mail"
+
+	"github.com/decitrig/innerhearth/config"
+	"github.com/decitrig/innerhearth/pricing"
+	"github.com/decitrig/innerhearth/students"
+)
+
+var (
+	ErrOrderNotFound = fmt.Errorf("orders: order not found")
+	ErrOrderExists   = fmt.Errorf("orders: order already recorded")
+)
+
+var (
+	delayedSendReceipt = delay.Func("sendReceipt", func(c appengine.Context, id string) error {
+		o, err := WithID(c, id)
+		if err != nil {
+			c.Errorf("Failed to find order %q for receipt: %s", id, err)
+			return nil
+		}
+		cfg, err := config.Get(c)
+		if err != nil {
+			c.Errorf("Failed to load site config; using defaults: %s", err)
+		}
+		buf := &bytes.Buffer{}
+		data := map[string]interface{}{
+			"Order":  o,
+			"Config": cfg,
+			"Link":   cfg.URL(ReceiptPath(o.ID)),
+		}
+		if err := receiptEmail.Execute(buf, data); err != nil {
+			c.Criticalf("Couldn't execute receipt email: %s", err)
+			return nil
+		}
+		msg := &mail.Message{
+			Sender:  cfg.Sender(c),
+			To:      []string{o.Email},
+			Subject: fmt.Sprintf("Your receipt from %s", cfg.StudioName),
+			Body:    buf.String(),
+		}
+		if err := mail.Send(c, msg); err != nil {
+			c.Criticalf("Couldn't send receipt to %q: %s", o.Email, err)
+			return fmt.Errorf("failed to send email")
+		}
+		return nil
+	})
+)
+
+// An Item is a single line of an order.
+type Item struct {
+	Description string
+	Amount      pricing.Cents
+}
+
+// A Payment is an amount paid towards an order.
+type Payment struct {
+	Method students.PaymentMethod
+	Amount pricing.Cents
+}
+
+// Sales made by staff don't record how they were paid for, and are
+// recorded as paid AtStudio.
+const AtStudio students.PaymentMethod = "at the studio"
+
+// Earlier is the amount already paid towards a registration before the
+// payment for which an order was made.
+const Earlier students.PaymentMethod = "earlier payments"
+
+// An Order is a single purchase: a registration, a pass or a
+// membership. Its ID is derived from what was bought, so that the same
+// purchase is never recorded twice.
+type Order struct {
+	ID        string `datastore:"-"`
+	AccountID string
+	Name      string `datastore:",noindex"`
+	Email     string `datastore:",noindex"`
+
+	Items    []Item    `datastore:",noindex"`
+	Payments []Payment `datastore:",noindex"`
+
+	Created time.Time
+}
+
+// New returns a new, empty order for an account.
+func New(id, accountID, name, email string, now time.Time) *Order {
+	return &Order{
+		ID:        id,
+		AccountID: accountID,
+		Name:      name,
+		Email:     email,
+		Created:   now,
+	}
+}
+
+// Add adds a line to the order. Discounts are added as lines with
+// negative amounts.
+func (o *Order) Add(description string, amount pricing.Cents) {
+	o.Items = append(o.Items, Item{description, amount})
+}
+
+// Pay records a payment towards the order.
+func (o *Order) Pay(method students.PaymentMethod, amount pricing.Cents) {
+	if amount == 0 {
+		return
+	}
+	o.Payments = append(o.Payments, Payment{method, amount})
+}
+
+// Total returns the sum of the order's lines.
+func (o *Order) Total() pricing.Cents {
+	var total pricing.Cents
+	for _, item := range o.Items {
+		total += item.Amount
+	}
+	return total
+}
+
+// Paid returns the sum of the payments made towards the order.
+func (o *Order) Paid() pricing.Cents {
+	var paid pricing.Cents
+	for _, p := range o.Payments {
+		paid += p.Amount
+	}
+	return paid
+}
+
+// Balance returns the amount still owed on the order.
+func (o *Order) Balance() pricing.Cents {
+	return o.Total() - o.Paid()
+}
+
+// ReceiptPath returns the path of the page showing an order's
+// receipt.
+func ReceiptPath(id string) string {
+	return "/account/orders/receipt?id=" + url.QueryEscape(id)
+}
+
+func orderKey(c appengine.Context, id string) *datastore.Key {
+	return datastore.NewKey(c, "Order", id, 0, nil)
+}
+
+// WithID returns the order with the given ID, if one exists.
+func WithID(c appengine.Context, id string) (*Order, error) {
+	o := &Order{}
+	switch err := datastore.Get(c, orderKey(c, id), o); err {
+	case nil:
+		o.ID = id
+		return o, nil
+	case datastore.ErrNoSuchEntity:
+		return nil, ErrOrderNotFound
+	default:
+		return nil, err
+	}
+}
+
+type byCreated []*Order
+
+func (l byCreated) Len() int           { return len(l) }
+func (l byCreated) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byCreated) Less(i, j int) bool { return l[i].Created.After(l[j].Created) }
+
+// ForAccount returns all of an account's orders, newest first.
+func ForAccount(c appengine.Context, accountID string) ([]*Order, error) {
+	q := datastore.NewQuery("Order").
+		Filter("AccountID =", accountID)
+	orders := []*Order{}
+	keys, err := q.GetAll(c, &orders)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		orders[i].ID = key.StringID()
+	}
+	sort.Sort(byCreated(orders))
+	return orders, nil
+}
+
+// Put stores the order.
+func (o *Order) Put(c appengine.Context) error {
+	if _, err := datastore.Put(c, orderKey(c, o.ID), o); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Insert stores a new order and emails its receipt to the purchaser.
+// Returns ErrOrderExists if the purchase has already been recorded.
+func (o *Order) Insert(c appengine.Context) error {
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		switch _, err := WithID(c, o.ID); err {
+		case nil:
+			return ErrOrderExists
+		case ErrOrderNotFound:
+			break
+		default:
+			return err
+		}
+		if err := o.Put(c); err != nil {
+			return err
+		}
+		if o.Email != "" {
+			delayedSendReceipt.Call(c, o.ID)
+		}
+		return nil
+	}, nil)
+}
@@ -0,0 +1,87 @@
+package orders
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"appengine/aetest"
+
+	"github.com/decitrig/innerhearth/config"
+	"github.com/decitrig/innerhearth/students"
+)
+
+func TestTotals(t *testing.T) {
+	o := New("payment-1", "0x1", "Ann Lee", "ann@example.com", time.Unix(0, 0))
+	o.Add("Monday Flow", 12000)
+	o.Add("Promo code SPRING", -2000)
+	o.Pay(students.AccountCredit, 1500)
+	o.Pay(students.Cash, 0)
+	o.Pay(students.Card, 5000)
+	if got := o.Total(); got != 10000 {
+		t.Errorf("Expected total of $100; got %s", got)
+	}
+	if len(o.Payments) != 2 {
+		t.Errorf("Expected zero payments to be skipped; got %+v", o.Payments)
+	}
+	if got := o.Paid(); got != 6500 {
+		t.Errorf("Expected $65 paid; got %s", got)
+	}
+	if got := o.Balance(); got != 3500 {
+		t.Errorf("Expected balance of $35; got %s", got)
+	}
+
+	buf := &bytes.Buffer{}
+	data := map[string]interface{}{
+		"Order":  o,
+		"Config": config.Defaults(),
+		"Link":   config.Defaults().URL(ReceiptPath(o.ID)),
+	}
+	if err := receiptEmail.Execute(buf, data); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"Monday Flow: $120",
+		"Promo code SPRING: -$20",
+		"Total: $100",
+		"Paid (card): $50",
+		"Balance due: $35",
+		"/account/orders/receipt?id=payment-1",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("Expected receipt to contain %q; got\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestInsert(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	o := New("pass-1", "0x1", "Ann Lee", "", time.Unix(100, 0))
+	o.Add("10 class pass", 15000)
+	o.Pay(AtStudio, 15000)
+	if err := o.Insert(c); err != nil {
+		t.Fatalf("Failed to insert order: %s", err)
+	}
+	if err := o.Insert(c); err != ErrOrderExists {
+		t.Errorf("Expected ErrOrderExists; got %v", err)
+	}
+	if err := New("pass-2", "0x1", "Ann Lee", "", time.Unix(200, 0)).Insert(c); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ForAccount(c, "0x1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].ID != "pass-2" || got[1].ID != "pass-1" {
+		t.Errorf("Expected orders newest first; got %+v", got)
+	}
+	if got[1].Total() != 15000 || got[1].Balance() != 0 {
+		t.Errorf("Expected a paid $150 order; got %+v", got[1])
+	}
+}
@@ -0,0 +1,29 @@
+package orders
+
+import (
+	"text/template"
+)
+
+var (
+	receiptEmail = template.Must(template.New("receipt").Parse(`Thank you for your purchase from {{.Config.StudioName}}. This is your receipt.
+
+Receipt: {{.Order.ID}}
+Date: {{.Config.FormatDate .Order.Created}}
+Purchased by: {{.Order.Name}} <{{.Order.Email}}>
+{{range .Order.Items}}
+  {{.Description}}: {{.Amount}}{{end}}
+
+Total: {{.Order.Total}}{{range .Order.Payments}}
+Paid ({{.Method}}): {{.Amount}}{{end}}{{with .Order.Balance}}
+Balance due: {{.}}{{end}}
+
+You can view and print this receipt at any time at
+
+{{.Link}}
+
+{{.Config.StudioName}}
+{{.Config.Address}}
+{{.Config.ContactEmail}}
+{{.Config.ContactPhone}}
+{{.Config.BaseURL}}`))
+)
@@ -0,0 +1,180 @@
+package pages
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strings"
+)
+
+// renderMarkdown renders a simple dialect of Markdown as HTML. It supports
+// paragraphs separated by blank lines, "#" headings, "-", "*" and "1."
+// lists, ">" quotes, "---" rules, **bold**, *italic*, `code`,
+// [links](url) and ![images](url). Any HTML in the source is shown as
+// text.
+func renderMarkdown(src string) string {
+	buf := &bytes.Buffer{}
+	lines := strings.Split(strings.Replace(src, "\r\n", "\n", -1), "\n")
+	for i := 0; i < len(lines); {
+		line := strings.TrimSpace(lines[i])
+		switch {
+		case line == "":
+			i++
+		case strings.HasPrefix(line, "#"):
+			level := len(line) - len(strings.TrimLeft(line, "#"))
+			if level > 4 {
+				level = 4
+			}
+			tag := fmt.Sprintf("h%d", level)
+			buf.WriteString("<" + tag + ">" + inline(strings.TrimSpace(strings.TrimLeft(line, "#"))) + "</" + tag + ">\n")
+			i++
+		case line == "---" || line == "***":
+			buf.WriteString("<hr>\n")
+			i++
+		case listMarker(line) != "":
+			i = writeList(buf, lines, i)
+		case strings.HasPrefix(line, ">"):
+			quote := []string{}
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				quote = append(quote, strings.TrimPrefix(strings.TrimSpace(lines[i]), ">"))
+			}
+			buf.WriteString("<blockquote>\n" + renderMarkdown(strings.Join(quote, "\n")) + "</blockquote>\n")
+		default:
+			para := []string{}
+			for ; i < len(lines); i++ {
+				l := strings.TrimSpace(lines[i])
+				if l == "" || strings.HasPrefix(l, "#") || strings.HasPrefix(l, ">") || listMarker(l) != "" {
+					break
+				}
+				para = append(para, l)
+			}
+			buf.WriteString("<p>" + inline(strings.Join(para, "\n")) + "</p>\n")
+		}
+	}
+	return buf.String()
+}
+
+// listMarker returns "ul" or "ol" if a line starts a list item, or an
+// empty string if it doesn't.
+func listMarker(line string) string {
+	if strings.HasPrefix(line, "- ") || strings.HasPrefix(line, "* ") {
+		return "ul"
+	}
+	digits := len(line) - len(strings.TrimLeft(line, "0123456789"))
+	if digits > 0 && strings.HasPrefix(line[digits:], ". ") {
+		return "ol"
+	}
+	return ""
+}
+
+func itemText(line string) string {
+	if listMarker(line) == "ul" {
+		return line[2:]
+	}
+	return line[strings.Index(line, ". ")+2:]
+}
+
+// writeList writes the list starting at lines[i], and returns the
+// index of the first line after it. Lines which don't start with a
+// marker continue the previous item.
+func writeList(buf *bytes.Buffer, lines []string, i int) int {
+	kind := listMarker(strings.TrimSpace(lines[i]))
+	items := []string{}
+	for ; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		marker := listMarker(line)
+		if line == "" || marker != "" && marker != kind {
+			break
+		}
+		if marker == "" {
+			items[len(items)-1] += "\n" + line
+			continue
+		}
+		items = append(items, itemText(line))
+	}
+	buf.WriteString("<" + kind + ">\n")
+	for _, item := range items {
+		buf.WriteString("<li>" + inline(item) + "</li>\n")
+	}
+	buf.WriteString("</" + kind + ">\n")
+	return i
+}
+
+// emphasis lists the inline markers which wrap text in a tag, longest
+// first.
+var emphasis = []struct {
+	marker, tag string
+}{
+	{"**", "strong"},
+	{"__", "strong"},
+	{"*", "em"},
+	{"_", "em"},
+}
+
+// inline renders the inline markup within a block of text.
+func inline(text string) string {
+	buf := &bytes.Buffer{}
+	for len(text) > 0 {
+		if n := writeInline(buf, text); n > 0 {
+			text = text[n:]
+			continue
+		}
+		buf.WriteString(html.EscapeString(text[:1]))
+		text = text[1:]
+	}
+	return buf.String()
+}
+
+// writeInline writes the markup at the start of text, if there is
+// any, and returns the length of text it used.
+func writeInline(buf *bytes.Buffer, text string) int {
+	switch {
+	case strings.HasPrefix(text, "!["):
+		if label, url, n := parseLink(text[1:]); n > 0 && safeURL(url) {
+			buf.WriteString(`<img src="` + html.EscapeString(url) + `" alt="` + html.EscapeString(label) + `">`)
+			return n + 1
+		}
+	case text[0] == '[':
+		if label, url, n := parseLink(text); n > 0 && safeURL(url) {
+			buf.WriteString(`<a href="` + html.EscapeString(url) + `">` + inline(label) + "</a>")
+			return n
+		}
+	case text[0] == '`':
+		if end := strings.IndexByte(text[1:], '`'); end > 0 {
+			buf.WriteString("<code>" + html.EscapeString(text[1:end+1]) + "</code>")
+			return end + 2
+		}
+	}
+	for _, e := range emphasis {
+		if !strings.HasPrefix(text, e.marker) {
+			continue
+		}
+		m := len(e.marker)
+		end := strings.Index(text[m:], e.marker)
+		if end <= 0 || text[m] == ' ' {
+			continue
+		}
+		buf.WriteString("<" + e.tag + ">" + inline(text[m:m+end]) + "</" + e.tag + ">")
+		return end + 2*m
+	}
+	return 0
+}
+
+// parseLink parses a "[label](url)" link at the start of text, and
+// returns its label and URL along with its length. The length is zero
+// if text doesn't start with a link.
+func parseLink(text string) (label, url string, n int) {
+	mid := strings.Index(text, "](")
+	if mid < 0 {
+		return "", "", 0
+	}
+	end := strings.IndexByte(text[mid:], ')')
+	if end < 0 {
+		return "", "", 0
+	}
+	url = strings.TrimSpace(text[mid+2 : mid+end])
+	if url == "" || strings.ContainsAny(url, " \n") {
+		return "", "", 0
+	}
+	return text[1:mid], url, mid + end + 1
+}
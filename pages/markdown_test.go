@@ -0,0 +1,25 @@
+package pages
+
+import (
+	"testing"
+)
+
+func TestMarkdown(t *testing.T) {
+	for i, test := range []struct {
+		in, want string
+	}{
+		{"Hello, *world*.", "<p>Hello, <em>world</em>.</p>\n"},
+		{"# About\n\nWe **teach** yoga.\nDrop in!", "<h1>About</h1>\n<p>We <strong>teach</strong> yoga.\nDrop in!</p>\n"},
+		{"- one\n- two\n  continued\n\n1. first\n2. second", "<ul>\n<li>one</li>\n<li>two\ncontinued</li>\n</ul>\n<ol>\n<li>first</li>\n<li>second</li>\n</ol>\n"},
+		{"> quoted", "<blockquote>\n<p>quoted</p>\n</blockquote>\n"},
+		{"---", "<hr>\n"},
+		{"[Pricing](/pricing) and ![Studio](/images/studio.jpg)", `<p><a href="/pricing">Pricing</a> and <img src="/images/studio.jpg" alt="Studio"></p>` + "\n"},
+		{"[bad](javascript:alert(1))", "<p>[bad](javascript:alert(1))</p>\n"},
+		{"<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"Use `<b>` for 5 * 3", "<p>Use <code>&lt;b&gt;</code> for 5 * 3</p>\n"},
+	} {
+		if got := renderMarkdown(test.in); got != test.want {
+			t.Errorf("%d: renderMarkdown(%q) = %q, want %q", i, test.in, got, test.want)
+		}
+	}
+}
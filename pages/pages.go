@@ -0,0 +1,264 @@
+// Package pages stores the content of the site's informational pages,
+// such as About Us, so that staff can edit them without a deploy.
+// Every change is kept as a numbered revision which can be restored.
+package pages
+
+import (
+	"fmt"
+	"html/template"
+	"sort"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/decitrig/innerhearth/cache"
+)
+
+var (
+	ErrPageNotFound     = fmt.Errorf("pages: page not found")
+	ErrRevisionNotFound = fmt.Errorf("pages: revision not found")
+	ErrUnknownFormat    = fmt.Errorf("pages: unknown format")
+)
+
+// A Format is the markup in which a page is written.
+type Format string
+
+const (
+	Markdown Format = "markdown"
+	HTML     Format = "html"
+)
+
+// Formats lists the formats in which pages may be written.
+var Formats = []Format{Markdown, HTML}
+
+// ParseFormat returns the format with the given name.
+func ParseFormat(name string) (Format, error) {
+	for _, f := range Formats {
+		if string(f) == name {
+			return f, nil
+		}
+	}
+	return "", ErrUnknownFormat
+}
+
+// Render returns the HTML for a page body written in the given format.
+// HTML bodies are sanitized again, in case they were stored under
+// looser rules.
+func Render(format Format, body string) template.HTML {
+	switch format {
+	case Markdown:
+		return template.HTML(renderMarkdown(body))
+	case HTML:
+		return template.HTML(Sanitize(body))
+	}
+	return ""
+}
+
+// Clean returns a page body as it should be stored: HTML is sanitized
+// and Markdown is kept as written.
+func Clean(format Format, body string) string {
+	body = strings.TrimSpace(strings.Replace(body, "\r\n", "\n", -1))
+	if format == HTML {
+		return Sanitize(body)
+	}
+	return body
+}
+
+// A Page is the current content of a page, identified by a short name
+// such as "about".
+type Page struct {
+	Slug string `datastore:"-"`
+
+	Format Format `datastore:",noindex"`
+	Body   []byte `datastore:",noindex"`
+
+	// The number of the page's current revision; revisions are
+	// numbered from 1.
+	Revision  int       `datastore:",noindex"`
+	Updated   time.Time `datastore:",noindex"`
+	UpdatedBy string    `datastore:",noindex"`
+}
+
+// BodyText returns the page's body as written.
+func (p *Page) BodyText() string {
+	return string(p.Body)
+}
+
+// HTML returns the page's body rendered as HTML.
+func (p *Page) HTML() template.HTML {
+	return Render(p.Format, p.BodyText())
+}
+
+// A Revision is a saved version of a page.
+type Revision struct {
+	Number int `datastore:"-"`
+
+	Format Format `datastore:",noindex"`
+	Body   []byte `datastore:",noindex"`
+
+	// A note describing the change, e.g. "Updated summer hours".
+	Note      string    `datastore:",noindex"`
+	Created   time.Time `datastore:",noindex"`
+	CreatedBy string    `datastore:",noindex"`
+}
+
+// BodyText returns the revision's body as written.
+func (r *Revision) BodyText() string {
+	return string(r.Body)
+}
+
+func pageKey(c appengine.Context, slug string) *datastore.Key {
+	return datastore.NewKey(c, "Page", slug, 0, nil)
+}
+
+func revisionKey(c appengine.Context, slug string, number int) *datastore.Key {
+	return datastore.NewKey(c, "PageRevision", "", int64(number), pageKey(c, slug))
+}
+
+// WithSlug returns the current content of the page with the given
+// name, if it has been saved.
+func WithSlug(c appengine.Context, slug string) (*Page, error) {
+	p := &Page{}
+	switch err := datastore.Get(c, pageKey(c, slug), p); err {
+	case nil:
+		p.Slug = slug
+		return p, nil
+	case datastore.ErrNoSuchEntity:
+		return nil, ErrPageNotFound
+	default:
+		return nil, err
+	}
+}
+
+func cacheKey(slug string) string {
+	return "pages:" + slug
+}
+
+// Cached returns the current content of a page, from the cache if
+// possible. Pages which have never been saved are cached too, as a
+// page with no revision, so that their absence is cheap to check.
+func Cached(c appengine.Context, cc cache.Cache, slug string) (*Page, error) {
+	p := &Page{}
+	switch err := cc.Get(c, cacheKey(slug), p); err {
+	case nil:
+		if p.Revision == 0 {
+			return nil, ErrPageNotFound
+		}
+		p.Slug = slug
+		return p, nil
+	case cache.ErrCacheMiss:
+		break
+	default:
+		c.Warningf("Failed to read cached page %q: %s", slug, err)
+	}
+	p, err := WithSlug(c, slug)
+	switch err {
+	case nil:
+		break
+	case ErrPageNotFound:
+		p = &Page{}
+	default:
+		return nil, err
+	}
+	if err := cc.Set(c, cacheKey(slug), p, 0); err != nil {
+		c.Warningf("Failed to cache page %q: %s", slug, err)
+	}
+	if p.Revision == 0 {
+		return nil, ErrPageNotFound
+	}
+	return p, nil
+}
+
+// Revise saves new content for a page as its next revision, and
+// returns the saved revision. The cached copy of the page, if any, is
+// invalidated.
+func Revise(c appengine.Context, cc cache.Cache, slug string, format Format, body, note, by string, now time.Time) (*Revision, error) {
+	if _, err := ParseFormat(string(format)); err != nil {
+		return nil, err
+	}
+	rev := &Revision{
+		Format:    format,
+		Body:      []byte(Clean(format, body)),
+		Note:      strings.TrimSpace(note),
+		Created:   now,
+		CreatedBy: by,
+	}
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		p, err := WithSlug(c, slug)
+		switch err {
+		case nil:
+			break
+		case ErrPageNotFound:
+			p = &Page{Slug: slug}
+		default:
+			return err
+		}
+		p.Revision++
+		p.Format = rev.Format
+		p.Body = rev.Body
+		p.Updated = now
+		p.UpdatedBy = by
+		rev.Number = p.Revision
+		if _, err := datastore.Put(c, revisionKey(c, slug, rev.Number), rev); err != nil {
+			return err
+		}
+		_, err = datastore.Put(c, pageKey(c, slug), p)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := cc.Delete(c, cacheKey(slug)); err != nil {
+		c.Errorf("Failed to invalidate cached page %q: %s", slug, err)
+	}
+	return rev, nil
+}
+
+// RevisionWithNumber returns the given revision of a page.
+func RevisionWithNumber(c appengine.Context, slug string, number int) (*Revision, error) {
+	rev := &Revision{}
+	switch err := datastore.Get(c, revisionKey(c, slug, number), rev); err {
+	case nil:
+		rev.Number = number
+		return rev, nil
+	case datastore.ErrNoSuchEntity:
+		return nil, ErrRevisionNotFound
+	default:
+		return nil, err
+	}
+}
+
+type byNumber []*Revision
+
+func (l byNumber) Len() int           { return len(l) }
+func (l byNumber) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byNumber) Less(i, j int) bool { return l[i].Number < l[j].Number }
+
+// Revisions returns all revisions of a page, newest first.
+func Revisions(c appengine.Context, slug string) ([]*Revision, error) {
+	q := datastore.NewQuery("PageRevision").
+		Ancestor(pageKey(c, slug))
+	revs := []*Revision{}
+	keys, err := q.GetAll(c, &revs)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		revs[i].Number = int(key.IntID())
+	}
+	sort.Sort(sort.Reverse(byNumber(revs)))
+	return revs, nil
+}
+
+// Rollback restores an earlier revision of a page by saving a copy of
+// it as the page's next revision, so that the history is kept intact.
+func Rollback(c appengine.Context, cc cache.Cache, slug string, number int, by string, now time.Time) (*Revision, error) {
+	old, err := RevisionWithNumber(c, slug, number)
+	if err != nil {
+		return nil, err
+	}
+	note := fmt.Sprintf("Restored revision %d", number)
+	return Revise(c, cc, slug, old.Format, old.BodyText(), note, by, now)
+}
@@ -0,0 +1,67 @@
+package pages
+
+import (
+	"testing"
+	"time"
+
+	"appengine/aetest"
+
+	"github.com/decitrig/innerhearth/cache"
+)
+
+func TestRevisions(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cc := cache.NewMemory()
+	if _, err := Cached(c, cc, "about"); err != ErrPageNotFound {
+		t.Fatalf("Expected no page; got %v", err)
+	}
+	if _, err := Revise(c, cc, "about", Markdown, "# About\n\nHello", "first", "a@example.com", time.Unix(1000, 0)); err != nil {
+		t.Fatalf("Failed to save page: %s", err)
+	}
+	if _, err := Revise(c, cc, "about", HTML, `<p onclick="x()">Changed</p>`, "second", "b@example.com", time.Unix(2000, 0)); err != nil {
+		t.Fatalf("Failed to revise page: %s", err)
+	}
+	if _, err := Revise(c, cc, "about", Format("pdf"), "", "", "b@example.com", time.Unix(2500, 0)); err != ErrUnknownFormat {
+		t.Errorf("Expected unknown format; got %v", err)
+	}
+	p, err := Cached(c, cc, "about")
+	if err != nil {
+		t.Fatalf("Didn't find page: %s", err)
+	}
+	if p.Revision != 2 || p.Format != HTML || p.BodyText() != "<p>Changed</p>" || p.UpdatedBy != "b@example.com" {
+		t.Errorf("Wrong page: %+v", p)
+	}
+	rev, err := Rollback(c, cc, "about", 1, "c@example.com", time.Unix(3000, 0))
+	if err != nil {
+		t.Fatalf("Failed to roll back: %s", err)
+	}
+	if rev.Number != 3 || rev.Note != "Restored revision 1" {
+		t.Errorf("Wrong rollback revision: %+v", rev)
+	}
+	p, err = Cached(c, cc, "about")
+	if err != nil {
+		t.Fatalf("Didn't find page: %s", err)
+	}
+	if p.Revision != 3 || p.Format != Markdown || p.HTML() != "<h1>About</h1>\n<p>Hello</p>\n" {
+		t.Errorf("Wrong page after rollback: %+v", p)
+	}
+	revs, err := Revisions(c, "about")
+	if err != nil {
+		t.Fatalf("Failed to list revisions: %s", err)
+	}
+	if len(revs) != 3 {
+		t.Fatalf("Wrong number of revisions: %d", len(revs))
+	}
+	for i, want := range []int{3, 2, 1} {
+		if revs[i].Number != want {
+			t.Errorf("%d: wrong revision; got %d, want %d", i, revs[i].Number, want)
+		}
+	}
+	if _, err := Rollback(c, cc, "about", 7, "c@example.com", time.Unix(4000, 0)); err != ErrRevisionNotFound {
+		t.Errorf("Expected missing revision; got %v", err)
+	}
+}
@@ -0,0 +1,328 @@
+package pages
+
+import (
+	"bytes"
+	"html"
+	"strings"
+)
+
+// allowedTags maps the tags which may appear in page HTML to the
+// attributes they may have. All tags may have a class attribute. Ids
+// are not allowed, since they could clash with those of the site's own
+// pages and scripts.
+var allowedTags = map[string][]string{
+	"a":          {"href", "title"},
+	"b":          nil,
+	"blockquote": nil,
+	"br":         nil,
+	"code":       nil,
+	"div":        nil,
+	"em":         nil,
+	"h1":         nil,
+	"h2":         nil,
+	"h3":         nil,
+	"h4":         nil,
+	"hr":         nil,
+	"i":          nil,
+	"img":        {"src", "alt", "title", "width", "height"},
+	"li":         nil,
+	"ol":         nil,
+	"p":          nil,
+	"pre":        nil,
+	"span":       nil,
+	"strong":     nil,
+	"table":      nil,
+	"tbody":      nil,
+	"td":         {"colspan", "rowspan"},
+	"th":         {"colspan", "rowspan"},
+	"thead":      nil,
+	"tr":         nil,
+	"u":          nil,
+	"ul":         nil,
+}
+
+// voidTags are allowed tags which have no closing tag.
+var voidTags = map[string]bool{
+	"br":  true,
+	"hr":  true,
+	"img": true,
+}
+
+// droppedTags are tags whose content, as well as the tags themselves,
+// is removed.
+var droppedTags = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"iframe":   true,
+	"object":   true,
+	"embed":    true,
+	"textarea": true,
+	"title":    true,
+}
+
+// safeURL reports whether a link or image URL may appear in a page:
+// relative URLs, and http, https and mailto URLs.
+func safeURL(url string) bool {
+	url = strings.ToLower(strings.TrimSpace(url))
+	colon := strings.Index(url, ":")
+	if colon < 0 || strings.IndexAny(url[:colon], "/?#") >= 0 {
+		return true
+	}
+	switch url[:colon] {
+	case "http", "https", "mailto":
+		return true
+	}
+	return false
+}
+
+type attribute struct {
+	name, value string
+}
+
+// A tag is an HTML tag parsed from the input to Sanitize.
+type tag struct {
+	name    string
+	closing bool
+	attrs   []attribute
+}
+
+func isNameByte(b byte) bool {
+	return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9'
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\f'
+}
+
+// parseTag parses the tag at the start of s, which begins with '<',
+// and returns it along with its length. It returns a nil tag if s
+// does not start with a well-formed tag.
+func parseTag(s string) (*tag, int) {
+	i := 1
+	t := &tag{}
+	if i < len(s) && s[i] == '/' {
+		t.closing = true
+		i++
+	}
+	start := i
+	for i < len(s) && isNameByte(s[i]) {
+		i++
+	}
+	if i == start {
+		return nil, 0
+	}
+	t.name = strings.ToLower(s[start:i])
+	for {
+		for i < len(s) && (isSpace(s[i]) || s[i] == '/') {
+			i++
+		}
+		if i >= len(s) {
+			return nil, 0
+		}
+		if s[i] == '>' {
+			return t, i + 1
+		}
+		start = i
+		for i < len(s) && !isSpace(s[i]) && s[i] != '=' && s[i] != '>' && s[i] != '/' {
+			i++
+		}
+		attr := attribute{name: strings.ToLower(s[start:i])}
+		for i < len(s) && isSpace(s[i]) {
+			i++
+		}
+		if i < len(s) && s[i] == '=' {
+			i++
+			for i < len(s) && isSpace(s[i]) {
+				i++
+			}
+			if i >= len(s) {
+				return nil, 0
+			}
+			if q := s[i]; q == '"' || q == '\'' {
+				end := strings.IndexByte(s[i+1:], q)
+				if end < 0 {
+					return nil, 0
+				}
+				attr.value = s[i+1 : i+1+end]
+				i += end + 2
+			} else {
+				start = i
+				for i < len(s) && !isSpace(s[i]) && s[i] != '>' {
+					i++
+				}
+				attr.value = s[start:i]
+			}
+			attr.value = html.UnescapeString(attr.value)
+		}
+		t.attrs = append(t.attrs, attr)
+	}
+}
+
+// allowed reports whether a tag may have the given attribute.
+func allowed(tagName string, attr attribute) bool {
+	if attr.name == "class" {
+		return true
+	}
+	for _, name := range allowedTags[tagName] {
+		if name == attr.name {
+			if name == "href" || name == "src" {
+				return safeURL(attr.value)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func (t *tag) write(buf *bytes.Buffer) {
+	buf.WriteString("<" + t.name)
+	for _, attr := range t.attrs {
+		if allowed(t.name, attr) {
+			buf.WriteString(" " + attr.name + `="` + html.EscapeString(attr.value) + `"`)
+		}
+	}
+	buf.WriteString(">")
+}
+
+func writeText(buf *bytes.Buffer, text string) {
+	buf.WriteString(html.EscapeString(html.UnescapeString(text)))
+}
+
+// Sanitize returns HTML with everything but a small set of formatting
+// tags and attributes removed. Scripts, styles, forms and event
+// handlers are stripped, links may only use safe URLs, and every
+// element opened is closed.
+func Sanitize(s string) string {
+	buf := &bytes.Buffer{}
+	open := []string{}
+	for len(s) > 0 {
+		lt := strings.IndexByte(s, '<')
+		if lt < 0 {
+			writeText(buf, s)
+			break
+		}
+		writeText(buf, s[:lt])
+		s = s[lt:]
+		if strings.HasPrefix(s, "<!--") {
+			end := strings.Index(s, "-->")
+			if end < 0 {
+				break
+			}
+			s = s[end+3:]
+			continue
+		}
+		t, n := parseTag(s)
+		if t == nil {
+			buf.WriteString("&lt;")
+			s = s[1:]
+			continue
+		}
+		s = s[n:]
+		switch {
+		case droppedTags[t.name] && !t.closing:
+			end := strings.Index(strings.ToLower(s), "</"+t.name)
+			if end < 0 {
+				s = ""
+				continue
+			}
+			s = s[end:]
+			if gt := strings.IndexByte(s, '>'); gt >= 0 {
+				s = s[gt+1:]
+			} else {
+				s = ""
+			}
+		case !allowedTag(t.name):
+			continue
+		case !t.closing:
+			open = closeImplicit(buf, open, t.name)
+			t.write(buf)
+			if !voidTags[t.name] {
+				open = append(open, t.name)
+			}
+		case voidTags[t.name]:
+			continue
+		default:
+			// Close any elements left open inside this one; ignore
+			// closing tags with no matching open tag.
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] != t.name {
+					continue
+				}
+				for j := len(open) - 1; j >= i; j-- {
+					buf.WriteString("</" + open[j] + ">")
+				}
+				open = open[:i]
+				break
+			}
+		}
+	}
+	for i := len(open) - 1; i >= 0; i-- {
+		buf.WriteString("</" + open[i] + ">")
+	}
+	return buf.String()
+}
+
+func allowedTag(name string) bool {
+	_, ok := allowedTags[name]
+	return ok
+}
+
+// An implicitEnd describes the open elements which an opening tag
+// ends, as browsers do for unclosed <p> and <li> tags. The search for
+// an element to end stops at any of the bounds.
+type implicitEnd struct {
+	ends, bounds string
+}
+
+var (
+	endsParagraph = implicitEnd{"p", "div blockquote li td th"}
+	implicitEnds  = map[string]implicitEnd{
+		"li":         {"li p", "ul ol"},
+		"tr":         {"tr td th p", "table"},
+		"td":         {"td th p", "tr table"},
+		"th":         {"td th p", "tr table"},
+		"p":          endsParagraph,
+		"div":        endsParagraph,
+		"ul":         endsParagraph,
+		"ol":         endsParagraph,
+		"h1":         endsParagraph,
+		"h2":         endsParagraph,
+		"h3":         endsParagraph,
+		"h4":         endsParagraph,
+		"table":      endsParagraph,
+		"blockquote": endsParagraph,
+		"pre":        endsParagraph,
+		"hr":         endsParagraph,
+	}
+)
+
+func hasField(fields, name string) bool {
+	for _, f := range strings.Fields(fields) {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// closeImplicit closes the open elements which an opening tag ends,
+// and returns the elements which remain open.
+func closeImplicit(buf *bytes.Buffer, open []string, name string) []string {
+	end, ok := implicitEnds[name]
+	if !ok {
+		return open
+	}
+	last := len(open)
+	for i := len(open) - 1; i >= 0; i-- {
+		if hasField(end.bounds, open[i]) {
+			break
+		}
+		if hasField(end.ends, open[i]) {
+			last = i
+		}
+	}
+	for j := len(open) - 1; j >= last; j-- {
+		buf.WriteString("</" + open[j] + ">")
+	}
+	return open[:last]
+}
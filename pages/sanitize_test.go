@@ -0,0 +1,38 @@
+package pages
+
+import (
+	"testing"
+)
+
+func TestSanitize(t *testing.T) {
+	for i, test := range []struct {
+		in, want string
+	}{
+		{"plain text", "plain text"},
+		{"Fish &amp; chips & peas", "Fish &amp; chips &amp; peas"},
+		{`<p class="intro">Hello</p>`, `<p class="intro">Hello</p>`},
+		{`<p id="navbar" class="intro">Hello</p>`, `<p class="intro">Hello</p>`},
+		{`<P>Hello</P>`, `<p>Hello</p>`},
+		{`<p onclick="steal()">Hi</p>`, `<p>Hi</p>`},
+		{`<script>alert(1)</script>after`, `after`},
+		{`<STYLE>p {}</style>after`, `after`},
+		{`<a href="javascript:alert(1)">x</a>`, `<a>x</a>`},
+		{`<a href=" JavaScript:alert(1)">x</a>`, `<a>x</a>`},
+		{`<a href="/about#mission">x</a>`, `<a href="/about#mission">x</a>`},
+		{`<a href="mailto:info@example.com">x</a>`, `<a href="mailto:info@example.com">x</a>`},
+		{`<img src="/images/a.jpg" alt='Jill &amp; Lauren' onerror="x()">`, `<img src="/images/a.jpg" alt="Jill &amp; Lauren">`},
+		{`<img src=x.jpg/>`, `<img src="x.jpg/">`},
+		{`<form action="/x"><input name="a"></form>text`, `text`},
+		{`<div><b>unclosed`, `<div><b>unclosed</b></div>`},
+		{`stray</div> close`, `stray close`},
+		{`<ul><li>one<li>two</ul>`, `<ul><li>one</li><li>two</li></ul>`},
+		{`<p>one<p>two<ul><li>three</ul>`, `<p>one</p><p>two</p><ul><li>three</li></ul>`},
+		{`<!-- note -->visible`, `visible`},
+		{`1 < 2 > 0`, `1 &lt; 2 &gt; 0`},
+		{`<a title="x" "broken`, `&lt;a title=&#34;x&#34; &#34;broken`},
+	} {
+		if got := Sanitize(test.in); got != test.want {
+			t.Errorf("%d: Sanitize(%q) = %q, want %q", i, test.in, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+// Package passes manages class packs and punch cards: credits bought
+// in advance and redeemed for drop-in registrations.
+package passes
+
+import (
+	"fmt"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/pricing"
+	"github.com/decitrig/innerhearth/students"
+)
+
+var (
+	ErrPassNotFound = fmt.Errorf("passes: pass not found")
+	ErrNoCredits    = fmt.Errorf("passes: no credits remaining")
+	ErrPassExpired  = fmt.Errorf("passes: pass has expired")
+	ErrNotEligible  = fmt.Errorf("passes: pass cannot be used for this class")
+	ErrWrongAccount = fmt.Errorf("passes: pass belongs to another account")
+)
+
+// A Pass is a number of class credits bought by a single account.
+type Pass struct {
+	ID int64 `datastore:"-"`
+
+	AccountID string
+	Name      string `datastore:",noindex"`
+
+	Credits   int `datastore:",noindex"`
+	Remaining int `datastore:",noindex"`
+
+	// The time after which no more credits can be redeemed, or zero if
+	// the pass does not expire.
+	Expires time.Time `datastore:",noindex"`
+
+	// The types of class for which credits can be redeemed. If empty,
+	// the pass can be used for any class.
+	ClassTypes []classes.Type `datastore:",noindex"`
+
+	Price     pricing.Cents `datastore:",noindex"`
+	Created   time.Time
+	CreatedBy string `datastore:",noindex"`
+}
+
+// New returns a new pass for an account.
+func New(accountID, name string, credits int, expires time.Time, types []classes.Type, price pricing.Cents, createdBy string, now time.Time) *Pass {
+	return &Pass{
+		AccountID:  accountID,
+		Name:       name,
+		Credits:    credits,
+		Remaining:  credits,
+		Expires:    expires,
+		ClassTypes: types,
+		Price:      price,
+		Created:    now,
+		CreatedBy:  createdBy,
+	}
+}
+
+func passKey(c appengine.Context, id int64) *datastore.Key {
+	return datastore.NewKey(c, "Pass", "", id, nil)
+}
+
+// WithID returns the pass with the given ID, if one exists.
+func WithID(c appengine.Context, id int64) (*Pass, error) {
+	p := &Pass{}
+	switch err := datastore.Get(c, passKey(c, id), p); err {
+	case nil:
+		p.ID = id
+		return p, nil
+	case datastore.ErrNoSuchEntity:
+		return nil, ErrPassNotFound
+	default:
+		return nil, err
+	}
+}
+
+func getAll(c appengine.Context, q *datastore.Query) ([]*Pass, error) {
+	passes := []*Pass{}
+	keys, err := q.GetAll(c, &passes)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		passes[i].ID = key.IntID()
+	}
+	return passes, nil
+}
+
+// ForAccount returns all passes belonging to an account, including
+// used and expired passes.
+func ForAccount(c appengine.Context, accountID string) ([]*Pass, error) {
+	q := datastore.NewQuery("Pass").
+		Filter("AccountID =", accountID)
+	return getAll(c, q)
+}
+
+// Recent returns the most recently created passes.
+func Recent(c appengine.Context, limit int) ([]*Pass, error) {
+	q := datastore.NewQuery("Pass").
+		Order("-Created").
+		Limit(limit)
+	return getAll(c, q)
+}
+
+// Usable returns those of an account's passes which can currently be
+// redeemed for a class of the given type.
+func Usable(c appengine.Context, accountID string, t classes.Type, now time.Time) ([]*Pass, error) {
+	all, err := ForAccount(c, accountID)
+	if err != nil {
+		return nil, err
+	}
+	usable := []*Pass{}
+	for _, p := range all {
+		if p.check(t, now) == nil {
+			usable = append(usable, p)
+		}
+	}
+	return usable, nil
+}
+
+// Insert writes a new pass to the datastore.
+func (p *Pass) Insert(c appengine.Context) error {
+	key, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Pass", nil), p)
+	if err != nil {
+		return err
+	}
+	p.ID = key.IntID()
+	return nil
+}
+
+// Put stores the pass.
+func (p *Pass) Put(c appengine.Context) error {
+	if _, err := datastore.Put(c, passKey(c, p.ID), p); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Expired returns true if the pass has expired as of now.
+func (p *Pass) Expired(now time.Time) bool {
+	return !p.Expires.IsZero() && p.Expires.Before(now)
+}
+
+// GoodThrough returns the last moment at which the pass can be used,
+// or zero if it does not expire.
+func (p *Pass) GoodThrough() time.Time {
+	if p.Expires.IsZero() {
+		return p.Expires
+	}
+	return p.Expires.Add(-time.Nanosecond)
+}
+
+// Eligible returns true if the pass can be used for a class of the
+// given type.
+func (p *Pass) Eligible(t classes.Type) bool {
+	if len(p.ClassTypes) == 0 {
+		return true
+	}
+	for _, eligible := range p.ClassTypes {
+		if eligible == t {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns an error if a credit can't be redeemed from the pass
+// for a class of the given type.
+func (p *Pass) check(t classes.Type, now time.Time) error {
+	switch {
+	case p.Remaining <= 0:
+		return ErrNoCredits
+	case p.Expired(now):
+		return ErrPassExpired
+	case !p.Eligible(t):
+		return ErrNotEligible
+	default:
+		return nil
+	}
+}
+
+// Redeem adds a drop-in registration paid for with one credit from a
+// pass. The credit is used only if the registration succeeds.
+func Redeem(c appengine.Context, passID int64, student *students.Student, now time.Time) error {
+	// The transaction may be retried, so the payment is recorded
+	// against what had been paid before it began.
+	paid := student.AmountPaid
+	return student.AddWith(c, now, func(c appengine.Context) error {
+		p, err := WithID(c, passID)
+		if err != nil {
+			return err
+		}
+		if p.AccountID != student.ID {
+			return ErrWrongAccount
+		}
+		if err := p.check(student.ClassType, now); err != nil {
+			return err
+		}
+		p.Remaining--
+		if err := p.Put(c); err != nil {
+			return err
+		}
+		student.PassID = p.ID
+		student.AmountPaid = paid
+		student.RecordPayment(student.Price, students.Pass, fmt.Sprintf("pass %d", p.ID), now)
+		return nil
+	})
+}
+
+// Cancel cancels a registration, returning its credit to the pass
+// from which it was redeemed, if any.
+func Cancel(c appengine.Context, student *students.Student, now time.Time) error {
+	if student.PassID == 0 {
+		return student.CancelWith(c, now, nil)
+	}
+	return student.CancelWith(c, now, func(c appengine.Context) error {
+		p, err := WithID(c, student.PassID)
+		switch err {
+		case nil:
+			break
+		case ErrPassNotFound:
+			c.Warningf("Pass %d for %q not found; not refunding credit", student.PassID, student.Email)
+			return nil
+		default:
+			return err
+		}
+		if p.Remaining < p.Credits {
+			p.Remaining++
+		}
+		return p.Put(c)
+	})
+}
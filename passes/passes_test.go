@@ -0,0 +1,91 @@
+package passes
+
+import (
+	"testing"
+	"time"
+
+	"appengine/aetest"
+
+	"github.com/decitrig/innerhearth/account"
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/students"
+)
+
+func TestRedeemAndCancel(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	now := time.Unix(100000, 0)
+	class := &classes.Class{Title: "class", Capacity: 1}
+	if err := class.Insert(c); err != nil {
+		t.Fatal(err)
+	}
+	acct := &account.Account{ID: "0x1", Info: account.Info{Email: "a@example.com"}}
+	pass := New(acct.ID, "2-pack", 2, now.Add(24*time.Hour), nil, 2400, "staff@example.com", now)
+	if err := pass.Insert(c); err != nil {
+		t.Fatal(err)
+	}
+
+	student := students.NewDropIn(acct, class, now.Add(time.Hour))
+	student.SetPrice(1500)
+	if err := Redeem(c, pass.ID, student, now); err != nil {
+		t.Fatalf("Failed to redeem pass: %s", err)
+	}
+	if got, _ := WithID(c, pass.ID); got.Remaining != 1 {
+		t.Errorf("Expected 1 credit remaining; got %d", got.Remaining)
+	}
+	added, err := students.WithIDInClass(c, acct.ID, class, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added.PassID != pass.ID || added.PaymentStatus() != students.Paid {
+		t.Errorf("Registration should be paid with pass %d; got %d, %s", pass.ID, added.PassID, added.PaymentStatus())
+	}
+
+	other := &account.Account{ID: "0x2", Info: account.Info{Email: "b@example.com"}}
+	if err := Redeem(c, pass.ID, students.NewDropIn(other, class, now.Add(time.Hour)), now); err != ErrWrongAccount {
+		t.Errorf("Expected ErrWrongAccount; got %v", err)
+	}
+
+	if err := Cancel(c, added, now); err != nil {
+		t.Fatalf("Failed to cancel: %s", err)
+	}
+	if got, _ := WithID(c, pass.ID); got.Remaining != 2 {
+		t.Errorf("Expected credit to be refunded; got %d remaining", got.Remaining)
+	}
+	if _, err := students.WithIDInClass(c, acct.ID, class, now); err != students.ErrStudentNotFound {
+		t.Errorf("Expected registration to be cancelled; got %v", err)
+	}
+
+	if err := students.New(other, class).Add(c, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := Redeem(c, pass.ID, students.NewDropIn(acct, class, now.Add(time.Hour)), now); err != students.ErrClassIsFull {
+		t.Errorf("Expected ErrClassIsFull; got %v", err)
+	}
+	if got, _ := WithID(c, pass.ID); got.Remaining != 2 {
+		t.Errorf("Credit should not be used when class is full; got %d remaining", got.Remaining)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	now := time.Unix(100000, 0)
+	for _, test := range []struct {
+		name string
+		pass *Pass
+		want error
+	}{
+		{"usable", New("a", "pack", 1, time.Time{}, nil, 0, "", now), nil},
+		{"used", &Pass{Credits: 1, Remaining: 0}, ErrNoCredits},
+		{"expired", New("a", "pack", 1, now.Add(-time.Hour), nil, 0, "", now), ErrPassExpired},
+		{"ineligible", New("a", "pack", 1, time.Time{}, []classes.Type{classes.Workshop}, 0, "", now), ErrNotEligible},
+		{"eligible", New("a", "pack", 1, time.Time{}, []classes.Type{classes.Workshop, classes.Regular}, 0, "", now), nil},
+	} {
+		if got := test.pass.check(classes.Regular, now); got != test.want {
+			t.Errorf("%s: got %v; wanted %v", test.name, got, test.want)
+		}
+	}
+}
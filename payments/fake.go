@@ -0,0 +1,63 @@
+package payments
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"appengine"
+)
+
+// FakeResultField is the form field in which the fake checkout page
+// reports the outcome of a payment.
+const FakeResultField = "fake_result"
+
+// Fake is a Processor for development and tests which takes no real
+// payments. Its checkout page, served by the app at CheckoutPath, lets
+// the payer choose whether the payment succeeds or fails.
+type Fake struct {
+	CheckoutPath string
+}
+
+// Checkout returns the URL of the fake checkout page for a payment.
+func (f Fake) Checkout(c appengine.Context, p *Payment, returnURL string) (string, error) {
+	p.ProcessorRef = "fake-" + p.ID
+	v := url.Values{}
+	v.Set("payment", p.ID)
+	v.Set("return", returnURL)
+	return fmt.Sprintf("%s?%s", f.CheckoutPath, v.Encode()), nil
+}
+
+// Result returns the outcome chosen on the fake checkout page.
+func (f Fake) Result(c appengine.Context, p *Payment, r *http.Request) (Status, error) {
+	if r == nil {
+		return Pending, nil
+	}
+	switch r.FormValue(FakeResultField) {
+	case "success":
+		return Succeeded, nil
+	case "failure":
+		return Failed, nil
+	default:
+		return Pending, nil
+	}
+}
+
+// Expire does nothing; the fake checkout page takes no real payments.
+func (f Fake) Expire(c appengine.Context, p *Payment) error {
+	return nil
+}
+
+// FakeReturnURL returns the URL to which the fake checkout page sends
+// the payer after they choose an outcome.
+func FakeReturnURL(returnURL string, success bool) string {
+	result := "failure"
+	if success {
+		result = "success"
+	}
+	sep := "?"
+	if u, err := url.Parse(returnURL); err == nil && u.RawQuery != "" {
+		sep = "&"
+	}
+	return fmt.Sprintf("%s%s%s=%s", returnURL, sep, FakeResultField, result)
+}
@@ -0,0 +1,412 @@
+// Package payments takes payment for registrations online, through a
+// payment processor's hosted checkout page.
+//
+// A student paying online first reserves a spot in the class with a
+// pending registration. They are then sent to the processor to pay,
+// and the processor sends them back to the site when they are done.
+// The registration becomes final only once the processor reports that
+// the payment succeeded; failed checkouts release the reserved spot
+// immediately, and abandoned checkouts release it once the
+// reservation expires.
+package payments
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/ledger"
+	"github.com/decitrig/innerhearth/orders"
+	"github.com/decitrig/innerhearth/pricing"
+	"github.com/decitrig/innerhearth/promos"
+	"github.com/decitrig/innerhearth/students"
+)
+
+var (
+	ErrPaymentNotFound    = fmt.Errorf("payments: payment not found")
+	ErrNotPending         = fmt.Errorf("payments: payment is not pending")
+	ErrReservationExpired = fmt.Errorf("payments: reservation was released before payment completed")
+	ErrCheckoutComplete   = fmt.Errorf("payments: checkout has already completed")
+)
+
+var (
+	delayedRecordOrder = delay.Func("recordPaymentOrder", func(c appengine.Context, id string) error {
+		p, err := WithID(c, id)
+		if err != nil {
+			c.Errorf("Failed to find payment %s for its order: %s", id, err)
+			return nil
+		}
+		student, err := students.ForPayment(c, p.AccountID, p.ClassID, p.ID)
+		switch err {
+		case nil:
+			break
+		case students.ErrStudentNotFound:
+			return nil
+		default:
+			return err
+		}
+		switch err := Order(p, student).Insert(c); err {
+		case nil, orders.ErrOrderExists:
+			return nil
+		default:
+			return err
+		}
+	})
+)
+
+// ReservationTime is how long a student has to complete a checkout
+// before their reserved spot is released.
+const ReservationTime = 30 * time.Minute
+
+// A Status is the state of a payment.
+type Status string
+
+const (
+	Pending   Status = "pending"
+	Succeeded Status = "succeeded"
+	Failed    Status = "failed"
+
+	// Expired payments were abandoned before the checkout completed.
+	Expired Status = "expired"
+)
+
+// A Processor takes payments through a hosted checkout page.
+type Processor interface {
+	// Checkout starts a checkout for a payment and returns the URL of
+	// the processor's page to which the payer should be sent. When the
+	// payer has finished, the processor sends them to returnURL. The
+	// processor may record its own reference for the checkout in the
+	// payment's ProcessorRef.
+	Checkout(c appengine.Context, p *Payment, returnURL string) (string, error)
+
+	// Result returns the outcome of a payment's checkout, given the
+	// request with which the processor returned the payer to the site.
+	// The request is nil when the payment is checked without the
+	// payer, as when its reservation expires. Returns Pending if the
+	// outcome is not yet known.
+	Result(c appengine.Context, p *Payment, r *http.Request) (Status, error)
+
+	// Expire ends a payment's checkout, so that the payer can no
+	// longer pay. Returns ErrCheckoutComplete if the payer has already
+	// paid.
+	Expire(c appengine.Context, p *Payment) error
+}
+
+// A Payment is a single payment for a registration in a class.
+type Payment struct {
+	ID string `datastore:"-"`
+
+	AccountID   string
+	Email       string `datastore:",noindex"`
+	ClassID     int64
+	Description string        `datastore:",noindex"`
+	Amount      pricing.Cents `datastore:",noindex"`
+
+	Status       Status
+	ProcessorRef string `datastore:",noindex"`
+
+	Created   time.Time `datastore:",noindex"`
+	Expires   time.Time
+	Completed time.Time `datastore:",noindex"`
+}
+
+// New returns a new pending payment for a student's registration. The
+// payment is not stored until its checkout is started.
+func New(student *students.Student, description string, amount pricing.Cents, now time.Time) (*Payment, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("payments: failed to create payment ID: %s", err)
+	}
+	return &Payment{
+		ID:          hex.EncodeToString(b),
+		AccountID:   student.ID,
+		Email:       student.Email,
+		ClassID:     student.ClassID,
+		Description: description,
+		Amount:      amount,
+		Status:      Pending,
+		Created:     now,
+		Expires:     now.Add(ReservationTime),
+	}, nil
+}
+
+func paymentKey(c appengine.Context, id string) *datastore.Key {
+	return datastore.NewKey(c, "Payment", id, 0, nil)
+}
+
+// WithID returns the payment with the given ID, if one exists.
+func WithID(c appengine.Context, id string) (*Payment, error) {
+	p := &Payment{}
+	switch err := datastore.Get(c, paymentKey(c, id), p); err {
+	case nil:
+		p.ID = id
+		return p, nil
+	case datastore.ErrNoSuchEntity:
+		return nil, ErrPaymentNotFound
+	default:
+		return nil, err
+	}
+}
+
+// Put stores the payment.
+func (p *Payment) Put(c appengine.Context) error {
+	if _, err := datastore.Put(c, paymentKey(c, p.ID), p); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Start stores a new payment and begins its checkout with a
+// processor, returning the URL to which the payer should be sent.
+func Start(c appengine.Context, proc Processor, p *Payment, returnURL string) (string, error) {
+	checkoutURL, err := proc.Checkout(c, p, returnURL)
+	if err != nil {
+		return "", fmt.Errorf("payments: failed to start checkout: %s", err)
+	}
+	if err := p.Put(c); err != nil {
+		return "", err
+	}
+	return checkoutURL, nil
+}
+
+// update runs f on the current state of a pending payment in a
+// transaction which may also update the payment's registration, and
+// stores the payment if f succeeds.
+func update(c appengine.Context, p *Payment, f func(c appengine.Context, current *Payment) error) error {
+	opts := &datastore.TransactionOptions{XG: true}
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		current, err := WithID(c, p.ID)
+		if err != nil {
+			return err
+		}
+		if current.Status != Pending {
+			*p = *current
+			return ErrNotPending
+		}
+		if err := f(c, current); err != nil {
+			return err
+		}
+		if err := current.Put(c); err != nil {
+			return err
+		}
+		*p = *current
+		return nil
+	}, opts)
+}
+
+// Complete records that a payment succeeded and makes its registration
+// final. If the registration was released before the payment
+// completed, or its reservation lapsed and the class has since filled
+// up, the payment is still recorded as successful and
+// ErrReservationExpired is returned; the student will need a refund
+// or to be registered by staff. This includes a payment which had
+// already been recorded as failed or expired.
+func Complete(c appengine.Context, p *Payment, now time.Time) error {
+	released := false
+	err := update(c, p, func(c appengine.Context, current *Payment) error {
+		current.Status = Succeeded
+		current.Completed = now
+		released = false
+		student, err := students.ForPayment(c, current.AccountID, current.ClassID, current.ID)
+		switch err {
+		case nil:
+			break
+		case students.ErrStudentNotFound:
+			released = true
+			return nil
+		default:
+			return err
+		}
+		if student.Lapsed(now) {
+			// The reservation ran out before the payment completed but
+			// hasn't been cleaned up yet, so its spot may have been
+			// taken since.
+			class, err := classes.ClassWithID(c, current.ClassID)
+			if err != nil {
+				return err
+			}
+			if int32(len(students.In(c, class, now))) >= class.Capacity {
+				released = true
+				return releaseStudent(c, student, now)
+			}
+			if err := class.Update(c); err != nil {
+				return err
+			}
+		}
+		student.Pending = false
+		student.ReservedUntil = time.Time{}
+		student.RecordPayment(current.Amount, students.Card, "online", now)
+		if err := student.Put(c); err != nil {
+			return err
+		}
+		// The order is recorded by a transactional task, so that it is
+		// recorded exactly when the payment is, however the payment
+		// came to be completed.
+		delayedRecordOrder.Call(c, current.ID)
+		return nil
+	})
+	if err == ErrNotPending && p.Status != Succeeded {
+		err = completeReleased(c, p, now)
+		released = err == nil
+	}
+	if err != nil {
+		return err
+	}
+	if released {
+		c.Errorf("Payment %s from %q succeeded after its reservation in %d was released", p.ID, p.Email, p.ClassID)
+		return ErrReservationExpired
+	}
+	return nil
+}
+
+// completeReleased records that a payment which had been given up as
+// failed or expired succeeded after all. Its registration is long
+// gone, so the payer must be refunded.
+func completeReleased(c appengine.Context, p *Payment, now time.Time) error {
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		current, err := WithID(c, p.ID)
+		if err != nil {
+			return err
+		}
+		if current.Status == Pending || current.Status == Succeeded {
+			*p = *current
+			return ErrNotPending
+		}
+		current.Status = Succeeded
+		current.Completed = now
+		if err := current.Put(c); err != nil {
+			return err
+		}
+		*p = *current
+		return nil
+	}, nil)
+}
+
+// Order returns the order for a completed payment and the registration
+// it paid for, including any account credit applied to the
+// registration.
+func Order(p *Payment, student *students.Student) *orders.Order {
+	o := orders.New("payment-"+p.ID, student.ID, fmt.Sprintf("%s %s", student.FirstName, student.LastName), student.Email, p.Completed)
+	price := student.Price
+	if !student.Priced {
+		price = student.AmountPaid
+	}
+	o.Add(p.Description, price+student.PromoDiscount)
+	if student.PromoDiscount > 0 {
+		o.Add(fmt.Sprintf("Promo code %s", student.PromoCode), -student.PromoDiscount)
+	}
+	o.Pay(students.AccountCredit, student.CreditApplied)
+	o.Pay(students.Card, student.AmountPaid-student.CreditApplied)
+	return o
+}
+
+// Release records that a payment failed or was abandoned, and releases
+// the spot reserved for its registration along with any use of a
+// promotional code and any account credit applied to it. The
+// processor's checkout is expired first, so that the payer can't pay
+// for a spot which is no longer theirs; if they have already paid, the
+// payment is completed instead.
+func Release(c appengine.Context, proc Processor, p *Payment, status Status, now time.Time) error {
+	if proc != nil {
+		switch err := proc.Expire(c, p); err {
+		case nil:
+			break
+		case ErrCheckoutComplete:
+			return Complete(c, p, now)
+		default:
+			return fmt.Errorf("payments: failed to expire checkout: %s", err)
+		}
+	}
+	return update(c, p, func(c appengine.Context, current *Payment) error {
+		current.Status = status
+		current.Completed = now
+		student, err := students.ForPayment(c, current.AccountID, current.ClassID, current.ID)
+		switch err {
+		case nil:
+			break
+		case students.ErrStudentNotFound:
+			return nil
+		default:
+			return err
+		}
+		if !student.Pending {
+			return nil
+		}
+		return releaseStudent(c, student, now)
+	})
+}
+
+// releaseStudent deletes a pending registration and returns its use of
+// a promotional code and any account credit applied to it.
+func releaseStudent(c appengine.Context, student *students.Student, now time.Time) error {
+	if student.PromoCode != "" {
+		if err := promos.Return(c, student.PromoCode); err != nil {
+			return err
+		}
+	}
+	if student.CreditApplied > 0 {
+		e := ledger.NewEntry(student.ID, ledger.Credit, student.CreditApplied, student.ClassID, "Reservation released", "payments", now)
+		if err := e.Put(c); err != nil {
+			return err
+		}
+	}
+	return student.Delete(c)
+}
+
+// ReleaseExpired releases the reservations of all pending payments
+// which expired before now, returning the number released. The
+// processor is asked for the outcome of each payment first, so that a
+// payer who paid but never came back to the site is still registered.
+func ReleaseExpired(c appengine.Context, proc Processor, now time.Time) (int, error) {
+	q := datastore.NewQuery("Payment").
+		Filter("Status =", Pending).
+		Filter("Expires <", now).
+		KeysOnly().
+		Limit(100)
+	keys, err := q.GetAll(c, nil)
+	if err != nil {
+		return 0, err
+	}
+	released := 0
+	for _, key := range keys {
+		p, err := WithID(c, key.StringID())
+		if err != nil {
+			c.Errorf("Failed to load expired payment %s: %s", key.StringID(), err)
+			continue
+		}
+		status := Pending
+		if proc != nil {
+			if status, err = proc.Result(c, p, nil); err != nil {
+				c.Errorf("Failed to get result of expired payment %s: %s", p.ID, err)
+				continue
+			}
+		}
+		if status == Succeeded {
+			switch err := Complete(c, p, now); err {
+			case nil, ErrNotPending:
+				break
+			case ErrReservationExpired:
+				c.Errorf("Expired payment %s needs a refund: %s", p.ID, err)
+			default:
+				c.Errorf("Failed to complete expired payment %s: %s", p.ID, err)
+			}
+			continue
+		}
+		switch err := Release(c, proc, p, Expired, now); err {
+		case nil:
+			released++
+		case ErrNotPending:
+			break
+		default:
+			c.Errorf("Failed to release expired payment %s: %s", p.ID, err)
+		}
+	}
+	return released, nil
+}
@@ -0,0 +1,189 @@
+package payments
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"appengine"
+	"appengine/aetest"
+
+	"github.com/decitrig/innerhearth/account"
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/students"
+)
+
+func reserve(t *testing.T, c appengine.Context, class *classes.Class, id string, now time.Time) (*students.Student, *Payment) {
+	acct := &account.Account{ID: id, Info: account.Info{Email: id + "@example.com"}}
+	student := students.New(acct, class)
+	p, err := New(student, class.Title, 1500, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	student.Reserve(p.ID, p.Expires)
+	if err := student.Add(c, now); err != nil {
+		t.Fatal(err)
+	}
+	checkoutURL, err := Start(c, Fake{CheckoutPath: "/checkout"}, p, "/return?payment="+p.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(checkoutURL, "/checkout?") {
+		t.Errorf("Wrong checkout URL: %s", checkoutURL)
+	}
+	return student, p
+}
+
+func TestPayments(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	class := &classes.Class{Title: "class", Capacity: 1}
+	if err := class.Insert(c); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(10000, 0)
+
+	_, paid := reserve(t, c, class, "paid", now)
+	if err := Complete(c, paid, now); err != nil {
+		t.Fatalf("Failed to complete payment: %s", err)
+	}
+	if got, err := students.WithIDInClass(c, "paid", class, now.Add(time.Hour)); err != nil || got.Pending {
+		t.Errorf("Expected final registration after payment; got %v, %v", got, err)
+	}
+	if err := Complete(c, paid, now); err != ErrNotPending {
+		t.Errorf("Expected ErrNotPending completing twice; got %v", err)
+	}
+
+	class.Capacity = 3
+	if err := class.Update(c); err != nil {
+		t.Fatal(err)
+	}
+	_, failed := reserve(t, c, class, "failed", now)
+	if err := Release(c, Fake{}, failed, Failed, now); err != nil {
+		t.Fatalf("Failed to release payment: %s", err)
+	}
+	if _, err := students.WithIDInClass(c, "failed", class, now); err != students.ErrStudentNotFound {
+		t.Errorf("Failed payment should release reservation; got %v", err)
+	}
+
+	_, abandoned := reserve(t, c, class, "abandoned", now)
+	if n, err := ReleaseExpired(c, Fake{}, now.Add(time.Minute)); err != nil || n != 0 {
+		t.Errorf("Nothing should have expired yet; got %d, %v", n, err)
+	}
+	if n, err := ReleaseExpired(c, Fake{}, now.Add(ReservationTime+time.Minute)); err != nil || n != 1 {
+		t.Errorf("Expected to release one reservation; got %d, %v", n, err)
+	}
+	if got, err := WithID(c, abandoned.ID); err != nil || got.Status != Expired {
+		t.Errorf("Expected expired payment; got %v, %v", got, err)
+	}
+
+	// The payer finishes paying after their reservation was released.
+	paidLate := now.Add(ReservationTime + 2*time.Minute)
+	if err := Complete(c, abandoned, paidLate); err != ErrReservationExpired {
+		t.Errorf("Expected ErrReservationExpired completing expired payment; got %v", err)
+	}
+	if got, err := WithID(c, abandoned.ID); err != nil || got.Status != Succeeded || !got.Completed.Equal(paidLate) {
+		t.Errorf("Late payment should be recorded; got %v, %v", got, err)
+	}
+	if _, err := students.WithIDInClass(c, "abandoned", class, paidLate); err != students.ErrStudentNotFound {
+		t.Errorf("Late payment should not register the student; got %v", err)
+	}
+	if err := Complete(c, abandoned, paidLate); err != ErrNotPending {
+		t.Errorf("Expected ErrNotPending completing twice; got %v", err)
+	}
+}
+
+func TestCompleteAfterLapse(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	class := &classes.Class{Title: "class", Capacity: 2}
+	if err := class.Insert(c); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(10000, 0)
+	late := now.Add(ReservationTime + time.Minute)
+
+	_, roomy := reserve(t, c, class, "roomy", now)
+	if err := Complete(c, roomy, late); err != nil {
+		t.Errorf("Lapsed reservation with room left should complete; got %v", err)
+	}
+	if got, err := students.WithIDInClass(c, "roomy", class, late); err != nil || got.Pending {
+		t.Errorf("Expected final registration; got %v, %v", got, err)
+	}
+
+	_, resold := reserve(t, c, class, "resold", now)
+	walkIn := students.New(&account.Account{ID: "walkin"}, class)
+	if err := walkIn.Add(c, late); err != nil {
+		t.Fatalf("Lapsed reservation should not hold a spot: %s", err)
+	}
+	if err := Complete(c, resold, late); err != ErrReservationExpired {
+		t.Errorf("Expected ErrReservationExpired once the spot was taken; got %v", err)
+	}
+	if got, err := WithID(c, resold.ID); err != nil || got.Status != Succeeded {
+		t.Errorf("Payment should still be recorded; got %v, %v", got, err)
+	}
+	if in := students.In(c, class, late); len(in) != 2 {
+		t.Errorf("Class should hold 2 students; got %d", len(in))
+	}
+}
+
+func TestSettings(t *testing.T) {
+	if proc := (&Settings{}).Processor(); proc != nil {
+		t.Errorf("Expected no processor without a key; got %v", proc)
+	}
+	proc := (&Settings{StripeSecretKey: "sk_test"}).Processor()
+	if s, ok := proc.(Stripe); !ok || s.SecretKey != "sk_test" || s.Currency != DefaultCurrency {
+		t.Errorf("Wrong processor: %#v", proc)
+	}
+}
+
+func TestFakeResult(t *testing.T) {
+	for _, success := range []bool{true, false} {
+		u := FakeReturnURL("/payments/return?payment=abc", success)
+		r, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := Failed
+		if success {
+			want = Succeeded
+		}
+		if got, _ := (Fake{}).Result(nil, &Payment{}, r); got != want {
+			t.Errorf("Wrong result for %s: %s; wanted %s", u, got, want)
+		}
+		if r.FormValue("payment") != "abc" {
+			t.Errorf("Lost payment ID from %s", u)
+		}
+	}
+}
+
+func TestOrder(t *testing.T) {
+	acct := &account.Account{ID: "0x1", Info: account.Info{FirstName: "Ann", LastName: "Lee", Email: "ann@example.com"}}
+	student := students.New(acct, &classes.Class{Title: "class"})
+	student.SetPrice(2000)
+	student.PromoCode, student.PromoDiscount = "SPRING", 500
+	now := time.Unix(10000, 0)
+	student.RecordPayment(700, students.AccountCredit, "account credit", now)
+	student.CreditApplied = 700
+	student.RecordPayment(1300, students.Card, "online", now)
+	p := &Payment{ID: "abc", Description: "class on 1/1/1970", Amount: 1300, Completed: now}
+	o := Order(p, student)
+	if o.ID != "payment-abc" || o.Name != "Ann Lee" || !o.Created.Equal(now) {
+		t.Errorf("Wrong order %#v", o)
+	}
+	if o.Total() != 2000 || len(o.Items) != 2 || o.Items[0].Amount != 2500 {
+		t.Errorf("Wrong items %v", o.Items)
+	}
+	if o.Paid() != 2000 || o.Balance() != 0 {
+		t.Errorf("Wrong payments %v", o.Payments)
+	}
+}
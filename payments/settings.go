@@ -0,0 +1,57 @@
+package payments
+
+import (
+	"strings"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// DefaultCurrency is the currency charged if none is configured.
+const DefaultCurrency = "usd"
+
+// Settings configure the payment processor. They are kept in the
+// datastore rather than in the site's config file so that credentials
+// are never checked in.
+type Settings struct {
+	StripeSecretKey string `datastore:",noindex"`
+	Currency        string `datastore:",noindex"`
+}
+
+func settingsKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "PaymentSettings", "site", 0, nil)
+}
+
+// GetSettings returns the stored payment settings. If none have been
+// stored, no processor is configured.
+func GetSettings(c appengine.Context) (*Settings, error) {
+	s := &Settings{}
+	switch err := datastore.Get(c, settingsKey(c), s); err {
+	case nil, datastore.ErrNoSuchEntity:
+		return s, nil
+	default:
+		return nil, err
+	}
+}
+
+// Put stores the settings.
+func (s *Settings) Put(c appengine.Context) error {
+	s.Currency = strings.ToLower(strings.TrimSpace(s.Currency))
+	if _, err := datastore.Put(c, settingsKey(c), s); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Processor returns the processor which the settings configure, or nil
+// if none is.
+func (s *Settings) Processor() Processor {
+	if s.StripeSecretKey == "" {
+		return nil
+	}
+	currency := s.Currency
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	return Stripe{SecretKey: s.StripeSecretKey, Currency: currency}
+}
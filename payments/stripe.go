@@ -0,0 +1,155 @@
+package payments
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/urlfetch"
+)
+
+const stripeAPI = "https://api.stripe.com/v1"
+
+// stripeExpiryMargin is added to a reservation's expiry to give the
+// expiry time of its Checkout Session, which Stripe requires to be at
+// least 30 minutes away when the session is created. Sessions are
+// expired explicitly when their reservations are released; this only
+// limits how long one can outlive its reservation if that fails.
+const stripeExpiryMargin = 2 * time.Minute
+
+// StripeCancelledField is added to the return URL of a Stripe checkout
+// which the payer cancelled.
+const StripeCancelledField = "cancelled"
+
+// Stripe is a Processor which takes card payments through Stripe's
+// hosted Checkout page.
+type Stripe struct {
+	SecretKey string
+
+	// The ISO code of the currency in which prices are charged, in
+	// lower case.
+	Currency string
+}
+
+// A stripeSession is the part of a Stripe Checkout Session which the
+// site uses.
+type stripeSession struct {
+	ID            string `json:"id"`
+	URL           string `json:"url"`
+	Status        string `json:"status"`
+	PaymentStatus string `json:"payment_status"`
+
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// session calls the Stripe API for a Checkout Session. The form, if
+// any, is posted.
+func (s Stripe) session(c appengine.Context, path string, form url.Values) (*stripeSession, error) {
+	method := "GET"
+	var body io.Reader
+	if form != nil {
+		method = "POST"
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, stripeAPI+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(s.SecretKey, "")
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := urlfetch.Client(c).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("payments: failed to call Stripe: %s", err)
+	}
+	defer resp.Body.Close()
+	session := &stripeSession{}
+	if err := json.NewDecoder(resp.Body).Decode(session); err != nil {
+		return nil, fmt.Errorf("payments: couldn't read Stripe response (%s): %s", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if session.Error != nil {
+			return nil, fmt.Errorf("payments: Stripe error: %s", session.Error.Message)
+		}
+		return nil, fmt.Errorf("payments: Stripe error: %s", resp.Status)
+	}
+	return session, nil
+}
+
+// Checkout creates a Checkout Session for the payment and returns the
+// URL of its page.
+func (s Stripe) Checkout(c appengine.Context, p *Payment, returnURL string) (string, error) {
+	sep := "?"
+	if strings.Contains(returnURL, "?") {
+		sep = "&"
+	}
+	form := url.Values{}
+	form.Set("mode", "payment")
+	form.Set("success_url", returnURL)
+	form.Set("cancel_url", returnURL+sep+StripeCancelledField+"=1")
+	form.Set("client_reference_id", p.ID)
+	form.Set("customer_email", p.Email)
+	form.Set("expires_at", strconv.FormatInt(p.Expires.Add(stripeExpiryMargin).Unix(), 10))
+	form.Set("line_items[0][quantity]", "1")
+	form.Set("line_items[0][price_data][currency]", s.Currency)
+	form.Set("line_items[0][price_data][unit_amount]", strconv.FormatInt(int64(p.Amount), 10))
+	form.Set("line_items[0][price_data][product_data][name]", p.Description)
+	session, err := s.session(c, "/checkout/sessions", form)
+	if err != nil {
+		return "", err
+	}
+	p.ProcessorRef = session.ID
+	return session.URL, nil
+}
+
+// Result looks up the payment's Checkout Session. A checkout which the
+// payer cancelled, or which Stripe has expired, has failed.
+func (s Stripe) Result(c appengine.Context, p *Payment, r *http.Request) (Status, error) {
+	if p.ProcessorRef == "" {
+		return Failed, nil
+	}
+	session, err := s.session(c, "/checkout/sessions/"+url.QueryEscape(p.ProcessorRef), nil)
+	if err != nil {
+		return Pending, err
+	}
+	switch {
+	case session.PaymentStatus == "paid":
+		return Succeeded, nil
+	case session.Status == "expired":
+		return Failed, nil
+	case session.Status == "open" && r != nil && r.FormValue(StripeCancelledField) != "":
+		return Failed, nil
+	default:
+		return Pending, nil
+	}
+}
+
+// Expire expires the payment's Checkout Session, unless it has already
+// expired.
+func (s Stripe) Expire(c appengine.Context, p *Payment) error {
+	if p.ProcessorRef == "" {
+		return nil
+	}
+	path := "/checkout/sessions/" + url.QueryEscape(p.ProcessorRef)
+	session, err := s.session(c, path, nil)
+	if err != nil {
+		return err
+	}
+	switch session.Status {
+	case "expired":
+		return nil
+	case "complete":
+		return ErrCheckoutComplete
+	}
+	_, err = s.session(c, path+"/expire", url.Values{})
+	return err
+}
@@ -0,0 +1,357 @@
+// Package payroll computes what teachers are owed for the classes they
+// teach, from the number of students registered for each meeting and
+// a pay formula set for each teacher.
+package payroll
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/makeups"
+	"github.com/decitrig/innerhearth/pricing"
+	"github.com/decitrig/innerhearth/series"
+	"github.com/decitrig/innerhearth/students"
+)
+
+var (
+	ErrFormulaNotFound = fmt.Errorf("payroll: no pay formula set for teacher")
+	ErrInvalidFormula  = fmt.Errorf("payroll: invalid pay formula")
+)
+
+// A Kind is the way a teacher's pay for a class is computed.
+type Kind string
+
+const (
+	// Flat pays Base for each class, however many students come.
+	Flat Kind = "flat"
+
+	// PerHead pays PerHead for each student.
+	PerHead Kind = "perhead"
+
+	// BasePlus pays Base for each class, plus PerHead for each student
+	// beyond the first Threshold.
+	BasePlus Kind = "baseplus"
+)
+
+// Kinds lists the kinds of pay formula.
+var Kinds = []Kind{Flat, PerHead, BasePlus}
+
+// Label returns a description of the kind of formula for staff.
+func (k Kind) Label() string {
+	switch k {
+	case Flat:
+		return "Flat rate per class"
+	case PerHead:
+		return "Per student"
+	case BasePlus:
+		return "Base rate plus per student over a threshold"
+	default:
+		return string(k)
+	}
+}
+
+// A Formula is the way a teacher's pay for each class they teach is
+// computed.
+type Formula struct {
+	TeacherID string `datastore:"-"`
+
+	Kind      Kind
+	Base      pricing.Cents `datastore:",noindex"`
+	PerHead   pricing.Cents `datastore:",noindex"`
+	Threshold int           `datastore:",noindex"`
+
+	Updated   time.Time `datastore:",noindex"`
+	UpdatedBy string    `datastore:",noindex"`
+}
+
+func formulaKey(c appengine.Context, teacherID string) *datastore.Key {
+	return datastore.NewKey(c, "PayFormula", teacherID, 0, nil)
+}
+
+// ForTeacher returns the pay formula set for a teacher.
+func ForTeacher(c appengine.Context, teacherID string) (*Formula, error) {
+	f := &Formula{}
+	switch err := datastore.Get(c, formulaKey(c, teacherID), f); err {
+	case nil:
+		f.TeacherID = teacherID
+		return f, nil
+	case datastore.ErrNoSuchEntity:
+		return nil, ErrFormulaNotFound
+	default:
+		return nil, err
+	}
+}
+
+// Valid returns true if the formula is of a known kind and sets the
+// amounts that kind uses.
+func (f *Formula) Valid() bool {
+	if f.Base < 0 || f.PerHead < 0 || f.Threshold < 0 {
+		return false
+	}
+	switch f.Kind {
+	case Flat:
+		return f.Base > 0
+	case PerHead:
+		return f.PerHead > 0
+	case BasePlus:
+		return f.Base > 0 || f.PerHead > 0
+	default:
+		return false
+	}
+}
+
+// Put stores the formula, replacing any previously set for the
+// teacher.
+func (f *Formula) Put(c appengine.Context) error {
+	if !f.Valid() {
+		return ErrInvalidFormula
+	}
+	if _, err := datastore.Put(c, formulaKey(c, f.TeacherID), f); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Pay returns what the formula pays for a class with the given number
+// of students.
+func (f *Formula) Pay(headcount int) pricing.Cents {
+	switch f.Kind {
+	case Flat:
+		return f.Base
+	case PerHead:
+		return f.PerHead * pricing.Cents(headcount)
+	case BasePlus:
+		pay := f.Base
+		if over := headcount - f.Threshold; over > 0 {
+			pay += f.PerHead * pricing.Cents(over)
+		}
+		return pay
+	default:
+		return 0
+	}
+}
+
+// Headcount returns the number of students registered for a meeting
+// of a class: its session or series students, less those who said
+// they would miss it, plus drop-ins for that day. Registrations are
+// counted only if they were made before the meeting and not cancelled
+// until after it began, so that the headcount of a past meeting
+// doesn't change; registrations may include the records of cancelled
+// ones and of drop-ins replaced by later registrations. Reservations which were never paid for are not counted.
+func Headcount(o classes.Occurrence, registrations []*students.Student, missed []*makeups.Credit, loc *time.Location) int {
+	start := o.Start.In(loc)
+	count := 0
+	for _, s := range registrations {
+		switch {
+		case s.Pending:
+			continue
+		case !s.Registered.IsZero() && s.Registered.After(o.Start):
+			continue
+		case !s.Cancelled.IsZero() && !s.Cancelled.After(o.Start):
+			continue
+		}
+		if !s.DropIn {
+			// Series students attend from the meeting at which they
+			// joined; session students have no date.
+			if o.Start.Before(s.Date) {
+				continue
+			}
+			count++
+			continue
+		}
+		date := s.Date.In(loc)
+		if date.Year() == start.Year() && date.YearDay() == start.YearDay() {
+			count++
+		}
+	}
+	for _, credit := range missed {
+		if credit.Missed.Equal(o.Start) {
+			count--
+		}
+	}
+	if count < 0 {
+		count = 0
+	}
+	return count
+}
+
+// A Line is a single class meeting in a payroll report.
+type Line struct {
+	Class     *classes.Class
+	Start     time.Time
+	Headcount int
+	Pay       pricing.Cents
+}
+
+// within returns the meetings which start within [from, to).
+func within(meetings []classes.Occurrence, from, to time.Time) []classes.Occurrence {
+	in := []classes.Occurrence{}
+	for _, o := range meetings {
+		if o.Start.Before(from) || !o.Start.Before(to) {
+			continue
+		}
+		in = append(in, o)
+	}
+	return in
+}
+
+// Lines returns a report line for each of a class's meetings which
+// starts within [from, to). If f is nil, the lines record no pay.
+func Lines(class *classes.Class, meetings []classes.Occurrence, registrations []*students.Student, missed []*makeups.Credit, f *Formula, from, to time.Time, loc *time.Location) []*Line {
+	lines := []*Line{}
+	for _, o := range within(meetings, from, to) {
+		l := &Line{
+			Class:     class,
+			Start:     o.Start,
+			Headcount: Headcount(o, registrations, missed, loc),
+		}
+		if f != nil {
+			l.Pay = f.Pay(l.Headcount)
+		}
+		lines = append(lines, l)
+	}
+	return lines
+}
+
+type byStart []*Line
+
+func (l byStart) Len() int           { return len(l) }
+func (l byStart) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byStart) Less(i, j int) bool { return l[i].Start.Before(l[j].Start) }
+
+// A Report lists what a teacher is owed for the classes they taught
+// over a range of dates.
+type Report struct {
+	Teacher *classes.Teacher
+
+	// The teacher's pay formula, or nil if none has been set.
+	Formula *Formula
+
+	Lines     []*Line
+	Headcount int
+	Total     pricing.Cents
+}
+
+// ReportFor builds the payroll report for a teacher covering the
+// classes which start within [from, to), including their workshops,
+// series and Yin Yogassage classes.
+func ReportFor(c appengine.Context, teacher *classes.Teacher, from, to time.Time, loc *time.Location) (*Report, error) {
+	r := &Report{Teacher: teacher}
+	switch f, err := ForTeacher(c, teacher.ID); err {
+	case nil:
+		r.Formula = f
+	case ErrFormulaNotFound:
+		break
+	default:
+		return nil, err
+	}
+	for _, session := range classes.Sessions(c, from) {
+		if !session.Start.Before(to) {
+			continue
+		}
+		for _, class := range session.Classes(c) {
+			if class.Teacher == nil || class.Teacher.StringID() != teacher.ID {
+				continue
+			}
+			if err := r.addLines(c, class, class.Occurrences(session, from, loc), from, to, loc); err != nil {
+				return nil, err
+			}
+		}
+	}
+	others, err := teacher.SessionlessClasses(c)
+	if err != nil {
+		return nil, err
+	}
+	for _, class := range others {
+		meetings := []classes.Occurrence{class.Meeting()}
+		if class.Series != 0 {
+			s, err := series.WithID(c, class.Series)
+			switch err {
+			case nil:
+				meetings = s.Occurrences()
+			case series.ErrSeriesNotFound:
+				continue
+			default:
+				return nil, err
+			}
+		}
+		if err := r.addLines(c, class, meetings, from, to, loc); err != nil {
+			return nil, err
+		}
+	}
+	sort.Sort(byStart(r.Lines))
+	for _, l := range r.Lines {
+		r.Headcount += l.Headcount
+		r.Total += l.Pay
+	}
+	return r, nil
+}
+
+// addLines adds the lines for a class's meetings within [from, to) to
+// the report.
+func (r *Report) addLines(c appengine.Context, class *classes.Class, meetings []classes.Occurrence, from, to time.Time, loc *time.Location) error {
+	if len(within(meetings, from, to)) == 0 {
+		return nil
+	}
+	registrations, err := students.AllIn(c, class)
+	if err != nil {
+		return err
+	}
+	cancelled, err := students.CancelledIn(c, class)
+	if err != nil {
+		return err
+	}
+	replaced, err := students.ReplacedIn(c, class)
+	if err != nil {
+		return err
+	}
+	missed, err := makeups.ForClass(c, class.ID)
+	if err != nil {
+		return err
+	}
+	registrations = append(registrations, cancelled...)
+	registrations = append(registrations, replaced...)
+	r.Lines = append(r.Lines, Lines(class, meetings, registrations, missed, r.Formula, from, to, loc)...)
+	return nil
+}
+
+// dollars formats an amount for a spreadsheet, without a currency
+// sign.
+func dollars(c pricing.Cents) string {
+	sign := ""
+	if c < 0 {
+		sign = "-"
+		c = -c
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, c/100, c%100)
+}
+
+// WriteCSV writes the lines of a set of reports as CSV, one row per
+// class meeting, with times in loc.
+func WriteCSV(w io.Writer, reports []*Report, loc *time.Location) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"Teacher", "Email", "Class", "Date", "Start", "Headcount", "Pay"})
+	for _, r := range reports {
+		for _, l := range r.Lines {
+			start := l.Start.In(loc)
+			out.Write([]string{
+				r.Teacher.DisplayName(),
+				r.Teacher.Email,
+				l.Class.Title,
+				start.Format("2006-01-02"),
+				start.Format("3:04pm"),
+				fmt.Sprint(l.Headcount),
+				dollars(l.Pay),
+			})
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
@@ -0,0 +1,125 @@
+package payroll
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/decitrig/innerhearth/account"
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/makeups"
+	"github.com/decitrig/innerhearth/pricing"
+	"github.com/decitrig/innerhearth/students"
+)
+
+func TestPay(t *testing.T) {
+	for i, test := range []struct {
+		f         *Formula
+		headcount int
+		pay       pricing.Cents
+	}{
+		{&Formula{Kind: Flat, Base: 5000}, 0, 5000},
+		{&Formula{Kind: Flat, Base: 5000}, 12, 5000},
+		{&Formula{Kind: PerHead, PerHead: 700}, 0, 0},
+		{&Formula{Kind: PerHead, PerHead: 700}, 9, 6300},
+		{&Formula{Kind: BasePlus, Base: 4000, PerHead: 500, Threshold: 8}, 3, 4000},
+		{&Formula{Kind: BasePlus, Base: 4000, PerHead: 500, Threshold: 8}, 8, 4000},
+		{&Formula{Kind: BasePlus, Base: 4000, PerHead: 500, Threshold: 8}, 11, 5500},
+	} {
+		if got := test.f.Pay(test.headcount); got != test.pay {
+			t.Errorf("%d: expected %s for %d students; got %s", i, test.pay, test.headcount, got)
+		}
+	}
+}
+
+func TestValid(t *testing.T) {
+	for i, test := range []struct {
+		f     *Formula
+		valid bool
+	}{
+		{&Formula{Kind: Flat, Base: 5000}, true},
+		{&Formula{Kind: Flat}, false},
+		{&Formula{Kind: PerHead, PerHead: 700}, true},
+		{&Formula{Kind: PerHead, Base: 700}, false},
+		{&Formula{Kind: BasePlus, Base: 4000, PerHead: 500, Threshold: 8}, true},
+		{&Formula{Kind: BasePlus, Base: 4000, Threshold: -1}, false},
+		{&Formula{Kind: "hourly", Base: 4000}, false},
+	} {
+		if got := test.f.Valid(); got != test.valid {
+			t.Errorf("%d: expected Valid() = %t; got %t", i, test.valid, got)
+		}
+	}
+}
+
+func TestLines(t *testing.T) {
+	loc := time.UTC
+	session := classes.NewSession("fall", time.Date(2013, 9, 2, 0, 0, 0, 0, loc), time.Date(2013, 9, 29, 0, 0, 0, 0, loc))
+	class := &classes.Class{ID: 1, Title: "monday", Weekday: time.Monday, StartTime: time.Date(0, 1, 1, 9, 0, 0, 0, loc), Length: time.Hour}
+	acct := func(id string) *account.Account { return &account.Account{ID: id} }
+	pending := students.New(acct("0x3"), class)
+	pending.Reserve("payment", time.Date(2013, 9, 1, 0, 0, 0, 0, loc))
+	// One student joined after the first week of the report, and
+	// another cancelled after it; each counts only for the meeting at
+	// which they were registered.
+	late := students.New(acct("0x6"), class)
+	late.Registered = time.Date(2013, 9, 12, 0, 0, 0, 0, loc)
+	cancelled := students.New(acct("0x7"), class)
+	cancelled.Registered = time.Date(2013, 8, 20, 0, 0, 0, 0, loc)
+	cancelled.Cancelled = time.Date(2013, 9, 12, 0, 0, 0, 0, loc)
+	// A drop-in who registered again afterwards counts for their
+	// earlier meeting through the record kept of that registration.
+	replaced := students.NewDropIn(acct("0x8"), class, time.Date(2013, 9, 16, 0, 0, 0, 0, loc))
+	again := students.NewDropIn(acct("0x8"), class, time.Date(2013, 9, 30, 0, 0, 0, 0, loc))
+	again.Registered = time.Date(2013, 9, 20, 0, 0, 0, 0, loc)
+	registrations := []*students.Student{
+		students.New(acct("0x1"), class),
+		students.New(acct("0x2"), class),
+		pending,
+		students.NewDropIn(acct("0x4"), class, time.Date(2013, 9, 9, 0, 0, 0, 0, loc)),
+		students.NewDropIn(acct("0x5"), class, time.Date(2013, 9, 23, 0, 0, 0, 0, loc)),
+		late,
+		cancelled,
+		replaced,
+		again,
+	}
+	missed := []*makeups.Credit{
+		{AccountID: "0x1", ClassID: 1, Missed: time.Date(2013, 9, 16, 9, 0, 0, 0, loc)},
+	}
+	f := &Formula{Kind: PerHead, PerHead: 1000}
+	// The report covers the second through third weeks of the session.
+	from, to := time.Date(2013, 9, 9, 0, 0, 0, 0, loc), time.Date(2013, 9, 23, 0, 0, 0, 0, loc)
+	meetings := class.Occurrences(session, session.Start, loc)
+	lines := Lines(class, meetings, registrations, missed, f, from, to, loc)
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines; got %d", len(lines))
+	}
+	for i, expected := range []struct {
+		day       int
+		headcount int
+	}{{9, 4}, {16, 3}} {
+		l := lines[i]
+		if l.Start.Day() != expected.day || l.Headcount != expected.headcount {
+			t.Errorf("%d: expected %d students on 9/%d; got %d on %s", i, expected.headcount, expected.day, l.Headcount, l.Start)
+		}
+		if l.Pay != pricing.Cents(expected.headcount*1000) {
+			t.Errorf("%d: expected pay for %d students; got %s", i, expected.headcount, l.Pay)
+		}
+	}
+	if unpaid := Lines(class, meetings, registrations, missed, nil, from, to, loc); unpaid[0].Pay != 0 {
+		t.Errorf("Expected no pay without a formula; got %s", unpaid[0].Pay)
+	}
+
+	teacher := &classes.Teacher{ID: "0x9", Info: account.Info{FirstName: "Ann", LastName: "Lee", Email: "ann@example.com"}}
+	buf := &bytes.Buffer{}
+	if err := WriteCSV(buf, []*Report{{Teacher: teacher, Lines: lines}}, loc); err != nil {
+		t.Fatal(err)
+	}
+	rows := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(rows) != 3 {
+		t.Fatalf("Expected a header and 2 rows; got %q", buf.String())
+	}
+	if expected := "Ann Lee,ann@example.com,monday,2013-09-09,9:00am,4,40.00"; rows[1] != expected {
+		t.Errorf("Expected row %q; got %q", expected, rows[1])
+	}
+}
@@ -0,0 +1,97 @@
+package pricing
+
+import (
+	"fmt"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+var (
+	ErrNotVerified = fmt.Errorf("pricing: account's discount category has not been verified")
+)
+
+// A Verification records that staff have checked an account's
+// eligibility for a discount category, so that the category applies
+// to all of the account's future registrations without further
+// checks.
+type Verification struct {
+	AccountID string `datastore:"-"`
+
+	Category   Category
+	VerifiedBy string    `datastore:",noindex"`
+	Verified   time.Time `datastore:",noindex"`
+}
+
+// NewVerification returns a verification of an account's category.
+func NewVerification(accountID string, category Category, verifiedBy string, now time.Time) *Verification {
+	return &Verification{
+		AccountID:  accountID,
+		Category:   category,
+		VerifiedBy: verifiedBy,
+		Verified:   now,
+	}
+}
+
+func verificationKey(c appengine.Context, accountID string) *datastore.Key {
+	return datastore.NewKey(c, "CategoryVerification", accountID, 0, nil)
+}
+
+// VerificationFor returns the verification of an account's category,
+// if it has one.
+func VerificationFor(c appengine.Context, accountID string) (*Verification, error) {
+	v := &Verification{}
+	switch err := datastore.Get(c, verificationKey(c, accountID), v); err {
+	case nil:
+		v.AccountID = accountID
+		return v, nil
+	case datastore.ErrNoSuchEntity:
+		return nil, ErrNotVerified
+	default:
+		return nil, err
+	}
+}
+
+// VerifiedCategory returns an account's verified category, or Regular
+// if it has none. Errors are logged and treated as no verification.
+func VerifiedCategory(c appengine.Context, accountID string) Category {
+	switch v, err := VerificationFor(c, accountID); err {
+	case nil:
+		return v.Category
+	case ErrNotVerified:
+		return Regular
+	default:
+		c.Errorf("Failed to look up category of %q: %s", accountID, err)
+		return Regular
+	}
+}
+
+// Verifications returns all verified accounts in a category.
+func Verifications(c appengine.Context, category Category) ([]*Verification, error) {
+	q := datastore.NewQuery("CategoryVerification").
+		Filter("Category =", category)
+	verifications := []*Verification{}
+	keys, err := q.GetAll(c, &verifications)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		verifications[i].AccountID = key.StringID()
+	}
+	return verifications, nil
+}
+
+// Put stores the verification, replacing any earlier verification of
+// the account.
+func (v *Verification) Put(c appengine.Context) error {
+	if _, err := datastore.Put(c, verificationKey(c, v.AccountID), v); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Delete revokes the verification.
+func (v *Verification) Delete(c appengine.Context) error {
+	return datastore.Delete(c, verificationKey(c, v.AccountID))
+}
@@ -0,0 +1,351 @@
+// Package pricing computes what registrations cost, according to
+// rules which staff can set for each session.
+package pricing
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/decitrig/innerhearth/classes"
+)
+
+// Cents is an amount of money in US cents.
+type Cents int64
+
+// String formats the amount as e.g. "$12" or "$12.50".
+func (c Cents) String() string {
+	sign := ""
+	if c < 0 {
+		sign = "-"
+		c = -c
+	}
+	if c%100 == 0 {
+		return fmt.Sprintf("%s$%d", sign, c/100)
+	}
+	return fmt.Sprintf("%s$%d.%02d", sign, c/100, c%100)
+}
+
+// ParseCents parses an amount written in dollars, such as "12" or
+// "12.50", with or without a leading dollar sign.
+func ParseCents(s string) (Cents, error) {
+	parts := strings.SplitN(strings.TrimPrefix(strings.TrimSpace(s), "$"), ".", 2)
+	dollars, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("pricing: invalid amount %q", s)
+	}
+	var cents uint64
+	if len(parts) == 2 {
+		if len(parts[1]) != 2 {
+			return 0, fmt.Errorf("pricing: invalid amount %q", s)
+		}
+		if cents, err = strconv.ParseUint(parts[1], 10, 8); err != nil {
+			return 0, fmt.Errorf("pricing: invalid amount %q", s)
+		}
+	}
+	return Cents(dollars*100 + cents), nil
+}
+
+// A Category determines which discounts a student is entitled to.
+type Category string
+
+const (
+	Regular Category = ""
+
+	// Students, seniors and military receive a discount on showing
+	// ID at the time of payment.
+	Discounted Category = "discounted"
+)
+
+// A Rate is the price of registering for a session at one tier.
+type Rate struct {
+	// The price of registering before the session starts.
+	Session Cents
+
+	// The amount subtracted from Session for each week of the session
+	// which has already passed.
+	Weekly Cents
+}
+
+// The tiers of session registration. A student's tier depends on the
+// number of classes they take each week.
+const (
+	OneClass   = 1
+	TwoClasses = 2
+	Unlimited  = 3
+)
+
+// Rules are the prices for a single session.
+type Rules struct {
+	SessionID int64 `datastore:"-"`
+
+	DropIn           Cents
+	DiscountedDropIn Cents
+
+	OneClass   Rate
+	TwoClasses Rate
+	Unlimited  Rate
+
+	// The percentage discount on session registrations for students in
+	// the Discounted category.
+	DiscountPercent int64
+
+	// Registrations cancelled at least this many hours before their
+	// first class are refunded; later cancellations receive account
+	// credit instead. Zero means the cutoff is unset, as in rules
+	// stored before there was one, and the default cutoff applies.
+	RefundCutoffHours int64
+}
+
+// RefundCutoff returns how long before a class a registration must be
+// cancelled to be refunded.
+func (r *Rules) RefundCutoff() time.Duration {
+	return time.Duration(r.CutoffHours()) * time.Hour
+}
+
+// CutoffHours returns the refund cutoff in hours, which is the default
+// cutoff if none has been set.
+func (r *Rules) CutoffHours() int64 {
+	if r.RefundCutoffHours <= 0 {
+		return Default().RefundCutoffHours
+	}
+	return r.RefundCutoffHours
+}
+
+// Default returns the rules used for sessions whose prices have not
+// been set by staff.
+func Default() *Rules {
+	return &Rules{
+		DropIn:            1500,
+		DiscountedDropIn:  1200,
+		OneClass:          Rate{Session: 14400, Weekly: 1200},
+		TwoClasses:        Rate{Session: 26400, Weekly: 2200},
+		Unlimited:         Rate{Session: 36000, Weekly: 3000},
+		DiscountPercent:   10,
+		RefundCutoffHours: 24,
+	}
+}
+
+func rulesKey(c appengine.Context, sessionID int64) *datastore.Key {
+	return datastore.NewKey(c, "PricingRules", "", sessionID, nil)
+}
+
+// ForSession returns the rules for a session, or the default rules if
+// none have been set.
+func ForSession(c appengine.Context, sessionID int64) (*Rules, error) {
+	rules := &Rules{}
+	switch err := datastore.Get(c, rulesKey(c, sessionID), rules); err {
+	case nil:
+		break
+	case datastore.ErrNoSuchEntity:
+		rules = Default()
+	default:
+		return nil, err
+	}
+	rules.SessionID = sessionID
+	return rules, nil
+}
+
+// Put stores the rules for their session.
+func (r *Rules) Put(c appengine.Context) error {
+	if r.SessionID == 0 {
+		return fmt.Errorf("pricing: rules have no session")
+	}
+	if _, err := datastore.Put(c, rulesKey(c, r.SessionID), r); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Rate returns the rate for a tier. Tiers past Unlimited are
+// Unlimited.
+func (r *Rules) Rate(tier int) Rate {
+	switch {
+	case tier <= 0:
+		return Rate{}
+	case tier == OneClass:
+		return r.OneClass
+	case tier == TwoClasses:
+		return r.TwoClasses
+	default:
+		return r.Unlimited
+	}
+}
+
+// PerClass returns the undiscounted price per class of a tier, if the
+// student registers before the session starts.
+func (r *Rules) PerClass(tier int, s *classes.Session) Cents {
+	weeks := Weeks(s)
+	if weeks == 0 || tier >= Unlimited {
+		return 0
+	}
+	return r.Rate(tier).Session / Cents(int64(weeks)*int64(tier))
+}
+
+// Weeks returns the number of weeks in a session, counting a partial
+// week as a whole week.
+func Weeks(s *classes.Session) int {
+	return weeksBetween(s.Start, s.End)
+}
+
+// WeeksRemaining returns the number of weeks of the session which
+// have not yet started as of a date, counting the week in progress.
+func WeeksRemaining(s *classes.Session, date time.Time) int {
+	if date.Before(s.Start) {
+		return Weeks(s)
+	}
+	if date.After(s.End) {
+		return 0
+	}
+	total := Weeks(s)
+	passed := int(date.Sub(s.Start) / (7 * 24 * time.Hour))
+	return total - passed
+}
+
+func weeksBetween(start, end time.Time) int {
+	if !end.After(start) {
+		return 0
+	}
+	week := 7 * 24 * time.Hour
+	d := end.Sub(start)
+	weeks := int(d / week)
+	if d%week != 0 {
+		weeks++
+	}
+	return weeks
+}
+
+// prorated returns the price of a tier for a registration with a
+// number of weeks remaining in a session of a number of weeks. In the
+// final week of the session, a session registration costs the same as
+// dropping in to each of its classes.
+func (r *Rules) prorated(tier, weeks, remaining int) Cents {
+	if tier <= 0 || remaining <= 0 {
+		return 0
+	}
+	if remaining == 1 && tier < Unlimited {
+		return r.DropIn * Cents(tier)
+	}
+	rate := r.Rate(tier)
+	price := rate.Session - rate.Weekly*Cents(weeks-remaining)
+	if price < 0 {
+		return 0
+	}
+	return price
+}
+
+func (r *Rules) discount(price Cents, category Category) Cents {
+	if category != Discounted {
+		return 0
+	}
+	return (price*Cents(r.DiscountPercent) + 50) / 100
+}
+
+// A Registration describes a registration to be priced.
+type Registration struct {
+	Session *classes.Session
+
+	// The time at which the student registers.
+	Date time.Time
+
+	DropIn   bool
+	Category Category
+
+	// The number of other classes in the same session for which the
+	// student already has session registrations.
+	OtherClasses int
+
+	// Whether the student has an unlimited membership for the session.
+	Member bool
+}
+
+// A Quote is the computed price of a registration.
+type Quote struct {
+	DropIn bool
+
+	// Whether the registration is covered by a membership.
+	Member bool
+
+	// The tier of a session registration, including the other classes
+	// the student is registered for.
+	Tier int
+
+	// The number of weeks of the session remaining when the student
+	// registered.
+	WeeksRemaining int
+
+	// The undiscounted price of the tier, pro-rated for the weeks
+	// remaining.
+	TierPrice Cents
+
+	// The amount already covered by the student's other registrations.
+	Credit Cents
+
+	Discount Cents
+
+	// A promotional code applied to the registration, and the amount
+	// it took off the total.
+	PromoCode string
+	Promo     Cents
+
+	Total Cents
+}
+
+// ApplyPromo takes the discount given by a promotional code off the
+// quote's total, which never goes below zero.
+func (q *Quote) ApplyPromo(code string, amount Cents) {
+	if amount > q.Total {
+		amount = q.Total
+	}
+	q.PromoCode = code
+	q.Promo = amount
+	q.Total -= amount
+}
+
+// Quote computes the price of a registration. A session registration
+// which moves a student into a higher tier costs the difference
+// between the two tiers, pro-rated as of the registration date; once
+// a student has reached the unlimited tier, further classes are free.
+// Registrations by members are always free.
+func (r *Rules) Quote(reg *Registration) *Quote {
+	if reg.Member {
+		return &Quote{DropIn: reg.DropIn, Member: true}
+	}
+	if reg.DropIn {
+		total := r.DropIn
+		if reg.Category == Discounted {
+			total = r.DiscountedDropIn
+		}
+		return &Quote{
+			DropIn:    true,
+			TierPrice: r.DropIn,
+			Discount:  r.DropIn - total,
+			Total:     total,
+		}
+	}
+	weeks := Weeks(reg.Session)
+	remaining := WeeksRemaining(reg.Session, reg.Date)
+	tier := reg.OtherClasses + 1
+	if tier > Unlimited {
+		tier = Unlimited
+	}
+	q := &Quote{
+		Tier:           tier,
+		WeeksRemaining: remaining,
+		TierPrice:      r.prorated(tier, weeks, remaining),
+	}
+	if reg.OtherClasses > 0 {
+		q.Credit = r.prorated(reg.OtherClasses, weeks, remaining)
+	}
+	if q.Credit > q.TierPrice {
+		q.Credit = q.TierPrice
+	}
+	price := q.TierPrice - q.Credit
+	q.Discount = r.discount(price, reg.Category)
+	q.Total = price - q.Discount
+	return q
+}
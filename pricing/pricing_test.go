@@ -0,0 +1,122 @@
+package pricing
+
+import (
+	"testing"
+	"time"
+
+	"appengine/aetest"
+
+	"github.com/decitrig/innerhearth/classes"
+)
+
+var spring = classes.NewSession("Spring",
+	time.Date(2014, 4, 14, 0, 0, 0, 0, time.UTC),
+	time.Date(2014, 7, 6, 0, 0, 0, 0, time.UTC))
+
+func week(n int) time.Time {
+	return spring.Start.Add(time.Duration(n)*7*24*time.Hour + time.Hour)
+}
+
+func TestQuote(t *testing.T) {
+	rules := Default()
+	if got := Weeks(spring); got != 12 {
+		t.Fatalf("Wrong number of weeks: %d", got)
+	}
+	for _, test := range []struct {
+		name string
+		reg  *Registration
+		want Cents
+	}{
+		{"one class", &Registration{Session: spring, Date: week(-1)}, 14400},
+		{"pro-rated", &Registration{Session: spring, Date: week(2)}, 12000},
+		{"second class", &Registration{Session: spring, Date: week(-1), OtherClasses: 1}, 12000},
+		{"third class", &Registration{Session: spring, Date: week(-1), OtherClasses: 2}, 9600},
+		{"fourth class", &Registration{Session: spring, Date: week(-1), OtherClasses: 3}, 0},
+		{"final week", &Registration{Session: spring, Date: week(11)}, 1500},
+		{"discounted", &Registration{Session: spring, Date: week(-1), Category: Discounted}, 12960},
+		{"drop in", &Registration{Session: spring, DropIn: true}, 1500},
+		{"discounted drop in", &Registration{Session: spring, DropIn: true, Category: Discounted}, 1200},
+		{"after session", &Registration{Session: spring, Date: week(13)}, 0},
+		{"member", &Registration{Session: spring, Date: week(-1), Member: true}, 0},
+		{"member drop in", &Registration{Session: spring, DropIn: true, Member: true}, 0},
+	} {
+		if got := rules.Quote(test.reg).Total; got != test.want {
+			t.Errorf("%s: got %s; wanted %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseCents(t *testing.T) {
+	for s, want := range map[string]Cents{
+		"12":     1200,
+		"$12":    1200,
+		"12.50":  1250,
+		" 0.05 ": 5,
+	} {
+		got, err := ParseCents(s)
+		if err != nil {
+			t.Errorf("Couldn't parse %q: %s", s, err)
+		} else if got != want {
+			t.Errorf("Wrong amount for %q: %s; wanted %s", s, got, want)
+		}
+	}
+	for _, s := range []string{"", "-1", "12.5", "12.505", "twelve"} {
+		if _, err := ParseCents(s); err == nil {
+			t.Errorf("Expected error parsing %q", s)
+		}
+	}
+	if got := Cents(1250).String(); got != "$12.50" {
+		t.Errorf("Wrong string for 1250: %s", got)
+	}
+}
+
+func TestForSession(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	rules, err := ForSession(c, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules.SessionID != 5 || rules.DropIn != Default().DropIn {
+		t.Errorf("Expected default rules for session 5; got %v", rules)
+	}
+	rules.DropIn = 1800
+	if err := rules.Put(c); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ForSession(c, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.DropIn != 1800 {
+		t.Errorf("Wrong drop-in price: %s", got.DropIn)
+	}
+	if other, _ := ForSession(c, 6); other.DropIn != Default().DropIn {
+		t.Errorf("Session 6 should have default rules; got %v", other)
+	}
+}
+
+func TestApplyPromo(t *testing.T) {
+	q := &Quote{Total: 1500}
+	q.ApplyPromo("SPRING", 500)
+	if q.Total != 1000 || q.Promo != 500 || q.PromoCode != "SPRING" {
+		t.Errorf("Expected $5 off $15; got %+v", q)
+	}
+	q.ApplyPromo("BIG", 2000)
+	if q.Total != 0 || q.Promo != 1000 {
+		t.Errorf("Expected promo to be limited to the total; got %+v", q)
+	}
+}
+
+func TestRefundCutoff(t *testing.T) {
+	if got := (&Rules{}).RefundCutoff(); got != 24*time.Hour {
+		t.Errorf("Unset cutoff should be the default; got %s", got)
+	}
+	if got := (&Rules{RefundCutoffHours: 48}).RefundCutoff(); got != 48*time.Hour {
+		t.Errorf("Wrong cutoff: %s", got)
+	}
+}
@@ -0,0 +1,197 @@
+// Package promos manages promotional codes which students can enter
+// when registering to take money off the price.
+package promos
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/pricing"
+)
+
+var (
+	ErrCodeNotFound     = fmt.Errorf("promos: code not found")
+	ErrCodeExists       = fmt.Errorf("promos: code already exists")
+	ErrNotStarted       = fmt.Errorf("promos: code is not valid yet")
+	ErrCodeExpired      = fmt.Errorf("promos: code has expired")
+	ErrNoUsesRemaining  = fmt.Errorf("promos: code has been used the maximum number of times")
+	ErrNotApplicable    = fmt.Errorf("promos: code cannot be used for this class")
+	ErrInvalidPromotion = fmt.Errorf("promos: a code must take either a percentage or an amount off")
+)
+
+// A Promo is a promotional code. It takes either a percentage or a
+// fixed amount off the price of a registration.
+type Promo struct {
+	Code        string `datastore:"-"`
+	Description string `datastore:",noindex"`
+
+	Percent int           `datastore:",noindex"`
+	Amount  pricing.Cents `datastore:",noindex"`
+
+	// The number of times the code may be used, or zero for no limit,
+	// and the number of times it has been used.
+	MaxUses int `datastore:",noindex"`
+	Uses    int `datastore:",noindex"`
+
+	// The code can be used from Starts until Ends. Either may be zero
+	// for no limit.
+	Starts time.Time `datastore:",noindex"`
+	Ends   time.Time `datastore:",noindex"`
+
+	// If either is non-empty, the code can only be used for the listed
+	// sessions and classes.
+	SessionIDs []int64 `datastore:",noindex"`
+	ClassIDs   []int64 `datastore:",noindex"`
+
+	Created   time.Time
+	CreatedBy string `datastore:",noindex"`
+}
+
+// Normalize returns the canonical form of a code as entered by a
+// student. Codes are not case sensitive.
+func Normalize(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func promoKey(c appengine.Context, code string) *datastore.Key {
+	return datastore.NewKey(c, "Promo", Normalize(code), 0, nil)
+}
+
+// WithCode returns the promo with the given code, if one exists.
+func WithCode(c appengine.Context, code string) (*Promo, error) {
+	p := &Promo{}
+	switch err := datastore.Get(c, promoKey(c, code), p); err {
+	case nil:
+		p.Code = Normalize(code)
+		return p, nil
+	case datastore.ErrNoSuchEntity:
+		return nil, ErrCodeNotFound
+	default:
+		return nil, err
+	}
+}
+
+// All returns all promos, newest first.
+func All(c appengine.Context) ([]*Promo, error) {
+	q := datastore.NewQuery("Promo").
+		Order("-Created")
+	promos := []*Promo{}
+	keys, err := q.GetAll(c, &promos)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		promos[i].Code = key.StringID()
+	}
+	return promos, nil
+}
+
+// Insert stores a new promo. Returns ErrCodeExists if its code is
+// already in use.
+func (p *Promo) Insert(c appengine.Context) error {
+	if (p.Percent > 0) == (p.Amount > 0) || p.Percent > 100 {
+		return ErrInvalidPromotion
+	}
+	p.Code = Normalize(p.Code)
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		switch _, err := WithCode(c, p.Code); err {
+		case nil:
+			return ErrCodeExists
+		case ErrCodeNotFound:
+			return p.Put(c)
+		default:
+			return err
+		}
+	}, nil)
+}
+
+// Put stores the promo.
+func (p *Promo) Put(c appengine.Context) error {
+	if _, err := datastore.Put(c, promoKey(c, p.Code), p); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Delete removes the promo so that it can no longer be used.
+func (p *Promo) Delete(c appengine.Context) error {
+	return datastore.Delete(c, promoKey(c, p.Code))
+}
+
+func contains(ids []int64, id int64) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns an error if the code can't be used for a class as of
+// now.
+func (p *Promo) Check(class *classes.Class, now time.Time) error {
+	switch {
+	case !p.Starts.IsZero() && now.Before(p.Starts):
+		return ErrNotStarted
+	case !p.Ends.IsZero() && !now.Before(p.Ends):
+		return ErrCodeExpired
+	case p.MaxUses > 0 && p.Uses >= p.MaxUses:
+		return ErrNoUsesRemaining
+	}
+	if len(p.SessionIDs) == 0 && len(p.ClassIDs) == 0 {
+		return nil
+	}
+	if contains(p.SessionIDs, class.Session) || contains(p.ClassIDs, class.ID) {
+		return nil
+	}
+	return ErrNotApplicable
+}
+
+// DiscountOn returns the amount the code takes off a price.
+func (p *Promo) DiscountOn(price pricing.Cents) pricing.Cents {
+	discount := p.Amount
+	if p.Percent > 0 {
+		discount = price * pricing.Cents(p.Percent) / 100
+	}
+	if discount > price {
+		discount = price
+	}
+	return discount
+}
+
+// Use records one use of a code for a class, failing if the code
+// can't be used. It may be run inside another transaction.
+func Use(c appengine.Context, code string, class *classes.Class, now time.Time) error {
+	p, err := WithCode(c, code)
+	if err != nil {
+		return err
+	}
+	if err := p.Check(class, now); err != nil {
+		return err
+	}
+	p.Uses++
+	return p.Put(c)
+}
+
+// Return gives back a use of a code whose registration was released
+// before it was paid for. It may be run inside another transaction.
+func Return(c appengine.Context, code string) error {
+	p, err := WithCode(c, code)
+	switch err {
+	case nil:
+		break
+	case ErrCodeNotFound:
+		return nil
+	default:
+		return err
+	}
+	if p.Uses > 0 {
+		p.Uses--
+	}
+	return p.Put(c)
+}
@@ -0,0 +1,87 @@
+package promos
+
+import (
+	"testing"
+	"time"
+
+	"appengine/aetest"
+
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/pricing"
+)
+
+func TestCheck(t *testing.T) {
+	now := time.Unix(100000, 0)
+	class := &classes.Class{ID: 1, Session: 10}
+	tests := []struct {
+		promo *Promo
+		err   error
+	}{
+		{&Promo{}, nil},
+		{&Promo{Starts: now.Add(time.Hour)}, ErrNotStarted},
+		{&Promo{Ends: now}, ErrCodeExpired},
+		{&Promo{Ends: now.Add(time.Hour)}, nil},
+		{&Promo{MaxUses: 2, Uses: 2}, ErrNoUsesRemaining},
+		{&Promo{MaxUses: 2, Uses: 1}, nil},
+		{&Promo{SessionIDs: []int64{10}}, nil},
+		{&Promo{SessionIDs: []int64{11}}, ErrNotApplicable},
+		{&Promo{SessionIDs: []int64{11}, ClassIDs: []int64{1}}, nil},
+		{&Promo{ClassIDs: []int64{2}}, ErrNotApplicable},
+	}
+	for i, test := range tests {
+		if err := test.promo.Check(class, now); err != test.err {
+			t.Errorf("%d: expected %v; got %v", i, test.err, err)
+		}
+	}
+}
+
+func TestDiscountOn(t *testing.T) {
+	tests := []struct {
+		promo    *Promo
+		price    pricing.Cents
+		discount pricing.Cents
+	}{
+		{&Promo{Percent: 10}, 1500, 150},
+		{&Promo{Percent: 100}, 1500, 1500},
+		{&Promo{Amount: 500}, 1500, 500},
+		{&Promo{Amount: 2000}, 1500, 1500},
+	}
+	for i, test := range tests {
+		if got := test.promo.DiscountOn(test.price); got != test.discount {
+			t.Errorf("%d: expected %s off %s; got %s", i, test.discount, test.price, got)
+		}
+	}
+}
+
+func TestUse(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	now := time.Unix(100000, 0)
+	class := &classes.Class{ID: 1, Session: 10}
+	if err := (&Promo{Code: "bad", Percent: 10, Amount: 500}).Insert(c); err != ErrInvalidPromotion {
+		t.Errorf("Expected ErrInvalidPromotion; got %v", err)
+	}
+	promo := &Promo{Code: " spring ", Percent: 10, MaxUses: 1, Created: now}
+	if err := promo.Insert(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Promo{Code: "SPRING", Amount: 500}).Insert(c); err != ErrCodeExists {
+		t.Errorf("Expected ErrCodeExists; got %v", err)
+	}
+	if err := Use(c, "Spring", class, now); err != nil {
+		t.Fatalf("Failed to use code: %s", err)
+	}
+	if err := Use(c, "spring", class, now); err != ErrNoUsesRemaining {
+		t.Errorf("Expected ErrNoUsesRemaining; got %v", err)
+	}
+	if err := Return(c, "SPRING"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Use(c, "spring", class, now); err != nil {
+		t.Errorf("Expected returned use to be available; got %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+// Package schedule assembles the public class schedule shown on the
+// homepage, and caches it between changes.
+package schedule
+
+import (
+	"sort"
+	"time"
+
+	"appengine"
+
+	"github.com/decitrig/innerhearth/cache"
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/staff"
+	"github.com/decitrig/innerhearth/yogassage"
+)
+
+const (
+	cacheKey = "schedule:public"
+
+	// Cached schedules are rebuilt at least this often, so that
+	// expired announcements and sessions eventually drop out even
+	// without an explicit invalidation.
+	expiration = 1 * time.Hour
+)
+
+// A Session is a single session together with its classes and their
+// teachers.
+type Session struct {
+	Session *classes.Session
+	Classes []*classes.Class
+
+	// ClassesByDay groups the session's classes by weekday, sorted by
+	// start time.
+	ClassesByDay map[time.Weekday][]*classes.Class
+
+	// TeachersByClass maps from class ID to the class's teacher;
+	// classes without a teacher have no entry.
+	TeachersByClass map[int64]*classes.Teacher
+}
+
+// A Schedule is everything shown publicly about upcoming classes.
+type Schedule struct {
+	Announcements []*staff.Announcement
+	Sessions      []*Session
+	YinYogassage  []*yogassage.YinYogassage
+
+	// The time at which the schedule was assembled from the datastore.
+	Generated time.Time
+}
+
+func dateOnly(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// Build assembles the current schedule from the datastore.
+func Build(c appengine.Context, now time.Time) *Schedule {
+	announcements := staff.CurrentAnnouncements(c, now)
+	sort.Sort(staff.AnnouncementsByExpiration(announcements))
+	sessions := classes.Sessions(c, now)
+	sort.Sort(classes.SessionsByStartDate(sessions))
+	schedules := []*Session{}
+	for _, session := range sessions {
+		sessionClasses := session.Classes(c)
+		if len(sessionClasses) == 0 {
+			continue
+		}
+		sort.Sort(classes.ClassesByStartTime(sessionClasses))
+		schedules = append(schedules, &Session{
+			Session:         session,
+			Classes:         sessionClasses,
+			ClassesByDay:    classes.GroupedByDay(sessionClasses),
+			TeachersByClass: classes.TeachersByClass(c, sessionClasses),
+		})
+	}
+	yins := yogassage.Classes(c, dateOnly(now))
+	sort.Sort(yogassage.ByDate(yins))
+	return &Schedule{
+		Announcements: announcements,
+		Sessions:      schedules,
+		YinYogassage:  yins,
+		Generated:     now,
+	}
+}
+
+// Get returns the schedule as of now, from the cache if possible. On
+// a cache miss, the schedule is rebuilt and stored in the cache.
+func Get(c appengine.Context, cc cache.Cache, now time.Time) *Schedule {
+	sched := &Schedule{}
+	switch err := cc.Get(c, cacheKey, sched); err {
+	case nil:
+		return sched.asOf(now)
+	case cache.ErrCacheMiss:
+		break
+	default:
+		c.Warningf("Failed to read cached schedule: %s", err)
+	}
+	sched = Build(c, now)
+	if err := cc.Set(c, cacheKey, sched, expiration); err != nil {
+		c.Warningf("Failed to cache schedule: %s", err)
+	}
+	return sched
+}
+
+// Invalidate removes any cached schedule, so that the next call to
+// Get rebuilds it. It should be called after any change to sessions,
+// classes, teachers, announcements or Yin Yogassage classes.
+func Invalidate(c appengine.Context, cc cache.Cache) {
+	if err := cc.Delete(c, cacheKey); err != nil {
+		c.Errorf("Failed to invalidate cached schedule: %s", err)
+	}
+}
+
+// asOf filters out announcements, sessions and Yin Yogassage classes
+// which have ended since the schedule was built.
+func (s *Schedule) asOf(now time.Time) *Schedule {
+	out := *s
+	out.Announcements = nil
+	for _, a := range s.Announcements {
+		if !a.Expiration.Before(now) {
+			out.Announcements = append(out.Announcements, a)
+		}
+	}
+	out.Sessions = nil
+	for _, session := range s.Sessions {
+		if !session.Session.End.Before(now) {
+			out.Sessions = append(out.Sessions, session)
+		}
+	}
+	out.YinYogassage = nil
+	today := dateOnly(now)
+	for _, yin := range s.YinYogassage {
+		if !yin.Date.Before(today) {
+			out.YinYogassage = append(out.YinYogassage, yin)
+		}
+	}
+	return &out
+}
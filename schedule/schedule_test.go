@@ -0,0 +1,79 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"appengine/aetest"
+
+	"github.com/decitrig/innerhearth/account"
+	"github.com/decitrig/innerhearth/cache"
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/staff"
+)
+
+var stafferSmith = &staff.Staff{ID: "1", Info: account.Info{FirstName: "staffer", LastName: "smith"}}
+
+func TestGetCachesSchedule(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	now := time.Unix(5000, 0)
+	teacher := classes.NewTeacher(&account.Account{
+		ID:   "0x1",
+		Info: account.Info{FirstName: "Teacher", LastName: "Person", Email: "t@example.com"},
+	})
+	if err := teacher.Put(c); err != nil {
+		t.Fatal(err)
+	}
+	session := classes.NewSession("session", time.Unix(1000, 0), time.Unix(10000, 0))
+	if err := session.Insert(c); err != nil {
+		t.Fatal(err)
+	}
+	class := &classes.Class{
+		Title:   "class",
+		Weekday: time.Monday,
+		Session: session.ID,
+		Teacher: teacher.Key(c),
+	}
+	if err := class.Insert(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := stafferSmith.AddAnnouncement(c, staff.NewAnnouncement("hello", time.Unix(6000, 0))); err != nil {
+		t.Fatal(err)
+	}
+
+	cc := cache.NewMemory()
+	sched := Get(c, cc, now)
+	if len(sched.Sessions) != 1 {
+		t.Fatalf("Wrong number of sessions: %d", len(sched.Sessions))
+	}
+	s := sched.Sessions[0]
+	if len(s.ClassesByDay[time.Monday]) != 1 {
+		t.Errorf("Wrong classes on Monday: %v", s.ClassesByDay)
+	}
+	if got := s.TeachersByClass[class.ID]; got == nil || got.Email != teacher.Email {
+		t.Errorf("Wrong teacher for class %d: %v", class.ID, got)
+	}
+	if len(sched.Announcements) != 1 {
+		t.Errorf("Wrong number of announcements: %d", len(sched.Announcements))
+	}
+
+	other := &classes.Class{Title: "other", Weekday: time.Tuesday, Session: session.ID}
+	if err := other.Insert(c); err != nil {
+		t.Fatal(err)
+	}
+	if got := Get(c, cc, now); len(got.Sessions[0].Classes) != 1 {
+		t.Errorf("Expected cached schedule; got %d classes", len(got.Sessions[0].Classes))
+	}
+	if got := Get(c, cc, time.Unix(7000, 0)); len(got.Announcements) != 0 {
+		t.Errorf("Expired announcement should be filtered from cached schedule")
+	}
+	Invalidate(c, cc)
+	if got := Get(c, cc, now); len(got.Sessions[0].Classes) != 2 {
+		t.Errorf("Expected rebuilt schedule; got %d classes", len(got.Sessions[0].Classes))
+	}
+}
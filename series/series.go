@@ -0,0 +1,346 @@
+// Package series manages short courses: a fixed list of dated
+// meetings for which students register all at once.
+//
+// Each series is backed by a single Class outside of any session, so
+// that one registration covers every meeting and the class's roster is
+// the series roster.
+package series
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/decitrig/innerhearth/account"
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/pricing"
+	"github.com/decitrig/innerhearth/students"
+)
+
+var (
+	ErrSeriesNotFound     = fmt.Errorf("series: series not found")
+	ErrMeetingNotFound    = fmt.Errorf("series: meeting not found")
+	ErrNoMeetings         = fmt.Errorf("series: a series must have at least one meeting")
+	ErrRegistrationClosed = fmt.Errorf("series: registration is closed")
+)
+
+// A Meeting is a single dated meeting of a series.
+type Meeting struct {
+	Start  time.Time
+	Length time.Duration
+}
+
+// End returns the time at which the meeting ends.
+func (m Meeting) End() time.Time {
+	return m.Start.Add(m.Length)
+}
+
+// A Series is a course of several meetings, for which students
+// register as a whole.
+type Series struct {
+	ID int64 `datastore:"-"`
+
+	Title       string `datastore:",noindex"`
+	Description []byte `datastore:",noindex"`
+	Teacher     *datastore.Key
+
+	Meetings []Meeting     `datastore:",noindex"`
+	Price    pricing.Cents `datastore:",noindex"`
+	Capacity int32         `datastore:",noindex"`
+
+	// The price of each remaining meeting for students who join after
+	// the series has begun, or zero if students may not join late.
+	LatePrice pricing.Cents `datastore:",noindex"`
+
+	// The URL of an image to show with the series, if any.
+	Image string `datastore:",noindex"`
+
+	// The class through which students register for the series.
+	ClassID int64 `datastore:",noindex"`
+
+	// The end of the series's last meeting.
+	End time.Time
+
+	Created   time.Time `datastore:",noindex"`
+	CreatedBy string    `datastore:",noindex"`
+}
+
+// DescriptionText returns the series's description.
+func (s *Series) DescriptionText() string {
+	return string(s.Description)
+}
+
+type byStart []Meeting
+
+func (l byStart) Len() int           { return len(l) }
+func (l byStart) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byStart) Less(i, j int) bool { return l[i].Start.Before(l[j].Start) }
+
+// sortMeetings puts the series's meetings in order and updates its end
+// time.
+func (s *Series) sortMeetings() {
+	sort.Sort(byStart(s.Meetings))
+	s.End = time.Time{}
+	for _, m := range s.Meetings {
+		if m.End().After(s.End) {
+			s.End = m.End()
+		}
+	}
+}
+
+// Occurrences returns the meetings of the series as occurrences of its
+// class.
+func (s *Series) Occurrences() []classes.Occurrence {
+	occurrences := make([]classes.Occurrence, len(s.Meetings))
+	for i, m := range s.Meetings {
+		occurrences[i] = classes.Occurrence{Start: m.Start, End: m.End()}
+	}
+	return occurrences
+}
+
+// Start returns the start of the series's first meeting.
+func (s *Series) Start() time.Time {
+	if len(s.Meetings) == 0 {
+		return time.Time{}
+	}
+	return s.Meetings[0].Start
+}
+
+// Remaining returns the meetings which start after now.
+func (s *Series) Remaining(now time.Time) []Meeting {
+	remaining := []Meeting{}
+	for _, m := range s.Meetings {
+		if m.Start.After(now) {
+			remaining = append(remaining, m)
+		}
+	}
+	return remaining
+}
+
+// Joining returns the first meeting which a student registering now
+// would attend. Returns ErrRegistrationClosed if the series has begun
+// and does not allow students to join late, or has no meetings left.
+func (s *Series) Joining(now time.Time) (time.Time, error) {
+	remaining := s.Remaining(now)
+	switch {
+	case len(remaining) == 0:
+		return time.Time{}, ErrRegistrationClosed
+	case len(remaining) < len(s.Meetings) && s.LatePrice == 0:
+		return time.Time{}, ErrRegistrationClosed
+	}
+	return remaining[0].Start, nil
+}
+
+// Open returns whether students may register for the series as of now.
+func (s *Series) Open(now time.Time) bool {
+	_, err := s.Joining(now)
+	return err == nil
+}
+
+// PriceFrom returns the price of the series for a student whose first
+// meeting starts at first. Students who join late pay the late price
+// for each meeting they attend, but never more than the full price.
+func (s *Series) PriceFrom(first time.Time) pricing.Cents {
+	if !first.After(s.Start()) {
+		return s.Price
+	}
+	n := 0
+	for _, m := range s.Meetings {
+		if !m.Start.Before(first) {
+			n++
+		}
+	}
+	if late := s.LatePrice * pricing.Cents(n); late < s.Price {
+		return late
+	}
+	return s.Price
+}
+
+// PriceAt returns the price of registering for the series as of now.
+func (s *Series) PriceAt(now time.Time) (pricing.Cents, error) {
+	first, err := s.Joining(now)
+	if err != nil {
+		return 0, err
+	}
+	return s.PriceFrom(first), nil
+}
+
+// TeacherEntity returns the series's teacher, or nil if it has none.
+func (s *Series) TeacherEntity(c appengine.Context) *classes.Teacher {
+	if s.Teacher == nil {
+		return nil
+	}
+	teacher, err := classes.TeacherWithID(c, s.Teacher.StringID())
+	if err != nil {
+		c.Errorf("Failed to find teacher for series %d: %s", s.ID, err)
+		return nil
+	}
+	return teacher
+}
+
+func seriesKey(c appengine.Context, id int64) *datastore.Key {
+	return datastore.NewKey(c, "Series", "", id, nil)
+}
+
+// WithID returns the series with the given ID, if one exists.
+func WithID(c appengine.Context, id int64) (*Series, error) {
+	s := &Series{}
+	switch err := datastore.Get(c, seriesKey(c, id), s); err {
+	case nil:
+		s.ID = id
+		return s, nil
+	case datastore.ErrNoSuchEntity:
+		return nil, ErrSeriesNotFound
+	default:
+		return nil, err
+	}
+}
+
+type byFirstMeeting []*Series
+
+func (l byFirstMeeting) Len() int           { return len(l) }
+func (l byFirstMeeting) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byFirstMeeting) Less(i, j int) bool { return l[i].Start().Before(l[j].Start()) }
+
+// Upcoming returns all series which have not yet ended, soonest first.
+func Upcoming(c appengine.Context, now time.Time) ([]*Series, error) {
+	q := datastore.NewQuery("Series").
+		Filter("End >=", now)
+	series := []*Series{}
+	keys, err := q.GetAll(c, &series)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		series[i].ID = key.IntID()
+	}
+	sort.Sort(byFirstMeeting(series))
+	return series, nil
+}
+
+// class returns the class backing the series.
+func (s *Series) class(loc *time.Location) *classes.Class {
+	first := s.Meetings[0]
+	return &classes.Class{
+		ID:              s.ClassID,
+		Title:           s.Title,
+		LongDescription: s.Description,
+		Teacher:         s.Teacher,
+		Weekday:         first.Start.In(loc).Weekday(),
+		StartTime:       first.Start,
+		Length:          first.Length,
+		Capacity:        s.Capacity,
+		Series:          s.ID,
+	}
+}
+
+// Insert stores a new series along with the class backing it, in a
+// single transaction.
+func (s *Series) Insert(c appengine.Context, loc *time.Location) error {
+	if len(s.Meetings) == 0 {
+		return ErrNoMeetings
+	}
+	s.sortMeetings()
+	return s.update(c, func(c appengine.Context) error {
+		key, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Series", nil), s)
+		if err != nil {
+			return err
+		}
+		s.ID = key.IntID()
+		return s.put(c, loc)
+	})
+}
+
+// Put stores the series and updates the class backing it to match,
+// creating the class if need be, in a single transaction.
+func (s *Series) Put(c appengine.Context, loc *time.Location) error {
+	if len(s.Meetings) == 0 {
+		return ErrNoMeetings
+	}
+	s.sortMeetings()
+	return s.update(c, func(c appengine.Context) error {
+		return s.put(c, loc)
+	})
+}
+
+// update runs f in a transaction spanning the series and the class
+// backing it. The series's IDs are restored before each attempt, so
+// that IDs allocated by a failed attempt are not kept.
+func (s *Series) update(c appengine.Context, f func(c appengine.Context) error) error {
+	id, classID := s.ID, s.ClassID
+	opts := &datastore.TransactionOptions{XG: true}
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		s.ID, s.ClassID = id, classID
+		return f(c)
+	}, opts)
+}
+
+func (s *Series) put(c appengine.Context, loc *time.Location) error {
+	class := s.class(loc)
+	if s.ClassID == 0 {
+		if err := class.Insert(c); err != nil {
+			return err
+		}
+		s.ClassID = class.ID
+	} else if err := class.Update(c); err != nil {
+		return err
+	}
+	if _, err := datastore.Put(c, seriesKey(c, s.ID), s); err != nil {
+		return err
+	}
+	return nil
+}
+
+// AddMeeting adds a new meeting to the series. The series must be Put
+// for the meeting to be stored.
+func (s *Series) AddMeeting(start time.Time, length time.Duration) {
+	s.Meetings = append(s.Meetings, Meeting{Start: start, Length: length})
+	s.sortMeetings()
+}
+
+// RemoveMeeting removes the meeting starting at the given time. The
+// series must be Put for the change to be stored.
+func (s *Series) RemoveMeeting(start time.Time) error {
+	meetings := []Meeting{}
+	for _, m := range s.Meetings {
+		if !m.Start.Equal(start) {
+			meetings = append(meetings, m)
+		}
+	}
+	switch {
+	case len(meetings) == len(s.Meetings):
+		return ErrMeetingNotFound
+	case len(meetings) == 0:
+		return ErrNoMeetings
+	}
+	s.Meetings = meetings
+	s.sortMeetings()
+	return nil
+}
+
+// Delete deletes the series and the class backing it. Its students are
+// not deleted; callers should cancel their registrations first.
+func (s *Series) Delete(c appengine.Context) error {
+	return s.update(c, func(c appengine.Context) error {
+		if err := (&classes.Class{ID: s.ClassID}).Delete(c); err != nil {
+			return err
+		}
+		return datastore.Delete(c, seriesKey(c, s.ID))
+	})
+}
+
+// NewStudent returns a registration for an account in the series,
+// starting with the first meeting which begins after now.
+func NewStudent(user *account.Account, class *classes.Class, s *Series, now time.Time) (*students.Student, error) {
+	first, err := s.Joining(now)
+	if err != nil {
+		return nil, err
+	}
+	student := students.New(user, class)
+	student.ClassType = classes.Series
+	student.Date = first
+	return student, nil
+}
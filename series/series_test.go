@@ -0,0 +1,104 @@
+package series
+
+import (
+	"testing"
+	"time"
+
+	"appengine/aetest"
+
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/pricing"
+)
+
+func fourWeeks(start time.Time) *Series {
+	s := &Series{Title: "4 Weeks to Handstand", Price: 10000, Capacity: 10}
+	for i := 0; i < 4; i++ {
+		s.AddMeeting(start.AddDate(0, 0, 7*i), 90*time.Minute)
+	}
+	return s
+}
+
+func TestPriceAt(t *testing.T) {
+	start := time.Date(2014, 3, 3, 18, 0, 0, 0, time.UTC)
+	s := fourWeeks(start)
+	if want := start.AddDate(0, 0, 21).Add(90 * time.Minute); !s.End.Equal(want) {
+		t.Errorf("Expected series to end at %s; got %s", want, s.End)
+	}
+	for _, test := range []struct {
+		name      string
+		latePrice pricing.Cents
+		now       time.Time
+		price     pricing.Cents
+		err       error
+	}{
+		{"before start", 0, start.Add(-time.Hour), 10000, nil},
+		{"started, no late joining", 0, start.Add(time.Hour), 0, ErrRegistrationClosed},
+		{"two meetings left", 3000, start.AddDate(0, 0, 8), 6000, nil},
+		{"capped at full price", 4000, start.Add(time.Hour), 10000, nil},
+		{"over", 3000, start.AddDate(0, 0, 22), 0, ErrRegistrationClosed},
+	} {
+		s.LatePrice = test.latePrice
+		price, err := s.PriceAt(test.now)
+		if err != test.err || price != test.price {
+			t.Errorf("%s: expected %s, %v; got %s, %v", test.name, test.price, test.err, price, err)
+		}
+	}
+}
+
+func TestRemoveMeeting(t *testing.T) {
+	start := time.Date(2014, 3, 3, 18, 0, 0, 0, time.UTC)
+	s := fourWeeks(start)
+	if err := s.RemoveMeeting(start.Add(time.Minute)); err != ErrMeetingNotFound {
+		t.Errorf("Expected ErrMeetingNotFound; got %v", err)
+	}
+	if err := s.RemoveMeeting(start.AddDate(0, 0, 21)); err != nil {
+		t.Fatal(err)
+	}
+	if want := start.AddDate(0, 0, 14).Add(90 * time.Minute); !s.End.Equal(want) {
+		t.Errorf("Expected series to end at %s; got %s", want, s.End)
+	}
+}
+
+func TestInsert(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	start := time.Date(2014, 3, 3, 18, 0, 0, 0, time.UTC)
+	if err := (&Series{Title: "Empty"}).Insert(c, time.UTC); err != ErrNoMeetings {
+		t.Errorf("Expected ErrNoMeetings; got %v", err)
+	}
+	s := fourWeeks(start)
+	if err := s.Insert(c, time.UTC); err != nil {
+		t.Fatalf("Failed to insert series: %s", err)
+	}
+	class, err := classes.ClassWithID(c, s.ClassID)
+	if err != nil {
+		t.Fatalf("Failed to find class for series: %s", err)
+	}
+	if class.Series != s.ID || class.Weekday != time.Monday || class.Capacity != 10 {
+		t.Errorf("Expected a Monday class for series %d; got %+v", s.ID, class)
+	}
+	got, err := WithID(c, s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Meetings) != 4 || got.ClassID != s.ClassID {
+		t.Errorf("Expected stored series to match %+v; got %+v", s, got)
+	}
+	upcoming, err := Upcoming(c, start.AddDate(0, 0, 22))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(upcoming) != 1 {
+		t.Errorf("Expected the series to be upcoming until its last meeting ends; got %+v", upcoming)
+	}
+	if err := s.Delete(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WithID(c, s.ID); err != ErrSeriesNotFound {
+		t.Errorf("Expected ErrSeriesNotFound; got %v", err)
+	}
+}
@@ -19,6 +19,9 @@ type Announcement struct {
 
 	Text       []byte
 	Expiration time.Time
+
+	// The URL of an image shown with the announcement, if any.
+	Image string `datastore:",noindex"`
 }
 
 // NewAnnouncement creates a new Announcement entity with the given
@@ -9,11 +9,49 @@ import (
 
 	"github.com/decitrig/innerhearth/account"
 	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/pricing"
 )
 
 var (
 	ErrStudentNotFound = fmt.Errorf("students: student not found")
 	ErrClassIsFull     = fmt.Errorf("students: class is full")
+
+	ErrAlreadyRegistered = fmt.Errorf("students: already registered")
+)
+
+// A PaymentMethod is the means by which a student paid.
+type PaymentMethod string
+
+const (
+	Cash  PaymentMethod = "cash"
+	Check PaymentMethod = "check"
+	Card  PaymentMethod = "card"
+	Pass  PaymentMethod = "pass"
+)
+
+// Registrations covered by an unlimited membership are recorded as
+// paid by Membership. Memberships themselves are sold separately, so
+// it is not among the PaymentMethods.
+const Membership PaymentMethod = "membership"
+
+// Payments made with credit from the account's ledger are recorded as
+// AccountCredit.
+const AccountCredit PaymentMethod = "account credit"
+
+// Make-up registrations are paid for by the session registration
+// whose missed class they replace.
+const MakeUp PaymentMethod = "make-up"
+
+// PaymentMethods lists the methods by which a payment can be made.
+var PaymentMethods = []PaymentMethod{Cash, Check, Card, Pass}
+
+// A PaymentStatus describes how much of a registration has been paid for.
+type PaymentStatus string
+
+const (
+	Unpaid        PaymentStatus = "unpaid"
+	PartiallyPaid PaymentStatus = "partially paid"
+	Paid          PaymentStatus = "paid"
 )
 
 // A Student is a single registration in a single class. A UserAccount
@@ -27,6 +65,109 @@ type Student struct {
 
 	Date   time.Time
 	DropIn bool
+
+	// When the registration was added and, for the record kept of a
+	// cancelled registration, when it was cancelled. Registrations
+	// made before these were recorded have zero times.
+	Registered time.Time `datastore:",noindex"`
+	Cancelled  time.Time `datastore:",noindex"`
+
+	// The discount category claimed by the student when registering.
+	Category pricing.Category `datastore:",noindex"`
+
+	// A student who pays online holds a pending reservation in the
+	// class until their payment completes. A reservation which has not
+	// been paid for by ReservedUntil no longer holds a spot.
+	Pending       bool      `datastore:",noindex"`
+	PaymentID     string    `datastore:",noindex"`
+	ReservedUntil time.Time `datastore:",noindex"`
+
+	// The price of the registration, as quoted when the student
+	// registered. Registrations made before prices were recorded are
+	// not Priced.
+	Price  pricing.Cents `datastore:",noindex"`
+	Priced bool          `datastore:",noindex"`
+
+	// The total paid so far, and by what means the latest payment was
+	// made and who recorded it.
+	AmountPaid        pricing.Cents `datastore:",noindex"`
+	PaymentMethod     PaymentMethod `datastore:",noindex"`
+	PaymentRecordedBy string        `datastore:",noindex"`
+	PaymentRecorded   time.Time     `datastore:",noindex"`
+
+	// The pass from which a credit was redeemed to pay for the
+	// registration, or zero.
+	PassID int64 `datastore:",noindex"`
+
+	// The make-up credit redeemed for the registration, if any.
+	MakeUpID string `datastore:",noindex"`
+
+	// The part of AmountPaid which was paid with account credit.
+	CreditApplied pricing.Cents `datastore:",noindex"`
+
+	// The promotional code applied to the registration, if any, and
+	// the amount it took off the price.
+	PromoCode     string        `datastore:",noindex"`
+	PromoDiscount pricing.Cents `datastore:",noindex"`
+}
+
+// SetPrice records the price of the registration.
+func (s *Student) SetPrice(price pricing.Cents) {
+	s.Price = price
+	s.Priced = true
+}
+
+// RecordPayment records a payment towards the registration.
+func (s *Student) RecordPayment(amount pricing.Cents, method PaymentMethod, recordedBy string, now time.Time) {
+	s.AmountPaid += amount
+	s.PaymentMethod = method
+	s.PaymentRecordedBy = recordedBy
+	s.PaymentRecorded = now
+}
+
+// Balance returns the amount still owed for the registration.
+func (s *Student) Balance() pricing.Cents {
+	if s.AmountPaid >= s.Price {
+		return 0
+	}
+	return s.Price - s.AmountPaid
+}
+
+// PaymentStatus returns how much of the registration has been paid
+// for. A registration whose price is unknown is paid only once some
+// payment has been recorded.
+func (s *Student) PaymentStatus() PaymentStatus {
+	switch {
+	case s.Priced && s.AmountPaid >= s.Price:
+		return Paid
+	case !s.Priced && s.PaymentMethod != "":
+		return Paid
+	case s.AmountPaid > 0:
+		return PartiallyPaid
+	default:
+		return Unpaid
+	}
+}
+
+// Reserve marks the registration as pending a payment, holding a spot
+// in the class until the given time.
+func (s *Student) Reserve(paymentID string, until time.Time) {
+	s.Pending = true
+	s.PaymentID = paymentID
+	s.ReservedUntil = until
+}
+
+// Lapsed returns true if the registration is a pending reservation
+// which was not paid for in time.
+func (s *Student) Lapsed(now time.Time) bool {
+	return s.Pending && s.ReservedUntil.Before(now)
+}
+
+// expired returns true if the registration no longer holds a spot in
+// its class: it is either a drop-in whose date has passed or a lapsed
+// reservation.
+func (s *Student) expired(now time.Time) bool {
+	return (s.DropIn && s.Date.Before(now)) || s.Lapsed(now)
 }
 
 // New creates a new session Student registration for a user in a class.
@@ -78,11 +219,12 @@ func WithEmail(c appengine.Context, email string) []*Student {
 	return students
 }
 
-// ExceptExpiredDropIns filters out Student entities whose drop-in dates are in the past
+// ExceptExpiredDropIns filters out Student entities whose drop-in
+// dates are in the past, along with lapsed reservations.
 func ExceptExpiredDropIns(l []*Student, now time.Time) []*Student {
 	var out []*Student
 	for _, s := range l {
-		if s.DropIn && s.Date.Before(now) {
+		if s.expired(now) {
 			continue
 		}
 		out = append(out, s)
@@ -90,21 +232,30 @@ func ExceptExpiredDropIns(l []*Student, now time.Time) []*Student {
 	return out
 }
 
-// In returns a list of all Students registered for a class. The list
-// will include only those drop-in Students whose date is not in the
-// past.
-func In(c appengine.Context, class *classes.Class, now time.Time) []*Student {
+// AllIn returns every Student registered for a class, including
+// drop-ins whose dates have passed and pending reservations.
+func AllIn(c appengine.Context, class *classes.Class) ([]*Student, error) {
 	q := datastore.NewQuery("Student").
 		Ancestor(class.Key(c))
 	students := []*Student{}
-	_, err := q.GetAll(c, &students)
+	if _, err := q.GetAll(c, &students); err != nil {
+		return nil, err
+	}
+	return students, nil
+}
+
+// In returns a list of all Students registered for a class. The list
+// will include only those drop-in Students whose date is not in the
+// past, and no lapsed reservations.
+func In(c appengine.Context, class *classes.Class, now time.Time) []*Student {
+	students, err := AllIn(c, class)
 	if err != nil {
 		c.Errorf("Failed to look up students for %d: %s", class.ID, err)
 		return nil
 	}
 	filtered := []*Student{}
 	for _, student := range students {
-		if student.DropIn && student.Date.Before(now) {
+		if student.expired(now) {
 			continue
 		}
 		filtered = append(filtered, student)
@@ -118,7 +269,27 @@ func WithIDInClass(c appengine.Context, id string, class *classes.Class, asOf ti
 	student := &Student{}
 	switch err := datastore.Get(c, key, student); err {
 	case nil:
-		if student.DropIn && student.Date.Before(asOf) {
+		if student.expired(asOf) {
+			return nil, ErrStudentNotFound
+		}
+		student.ID = key.StringID()
+		return student, nil
+	case datastore.ErrNoSuchEntity:
+		return nil, ErrStudentNotFound
+	default:
+		return nil, err
+	}
+}
+
+// ForPayment returns the registration of an account in a class which
+// is pending a payment. Returns ErrStudentNotFound if there is no
+// registration, or if it is not for that payment.
+func ForPayment(c appengine.Context, accountID string, classID int64, paymentID string) (*Student, error) {
+	key := datastore.NewKey(c, "Student", accountID, 0, classes.NewClassKey(c, classID))
+	student := &Student{}
+	switch err := datastore.Get(c, key, student); err {
+	case nil:
+		if student.PaymentID != paymentID {
 			return nil, ErrStudentNotFound
 		}
 		student.ID = key.StringID()
@@ -131,7 +302,8 @@ func WithIDInClass(c appengine.Context, id string, class *classes.Class, asOf ti
 }
 
 // Add attempts to write a new Student entity; it will not overwrite
-// any existing Students. Returns ErrClassFull if the class is full as
+// any existing Students, and returns ErrAlreadyRegistered if the
+// student is still registered. Returns ErrClassFull if the class is full as
 // of the given date. The number of students "currently registered"
 // for a class is the number of session-registered students plus any
 // future drop ins. This may be smaller than the number of students
@@ -140,7 +312,20 @@ func WithIDInClass(c appengine.Context, id string, class *classes.Class, asOf ti
 // drop in if we can prove that there is room for them to register for
 // the rest of the session.
 func (s *Student) Add(c appengine.Context, asOf time.Time) error {
+	return s.AddWith(c, asOf, nil)
+}
+
+// AddWith is like Add, but also runs f within the same transaction
+// once it is known that there is room in the class, before the
+// Student is written. If f returns an error, the Student is not
+// added. f may update the Student, and may use entities outside the
+// class's entity group.
+func (s *Student) AddWith(c appengine.Context, asOf time.Time, f func(c appengine.Context) error) error {
 	key := s.key(c)
+	var opts *datastore.TransactionOptions
+	if f != nil {
+		opts = &datastore.TransactionOptions{XG: true}
+	}
 	var txnErr error
 	for i := 0; i < 25; i++ {
 		txnErr = datastore.RunInTransaction(c, func(c appengine.Context) error {
@@ -149,13 +334,21 @@ func (s *Student) Add(c appengine.Context, asOf time.Time) error {
 			case datastore.ErrNoSuchEntity:
 				break
 			case nil:
-				if old.DropIn && old.Date.Before(asOf) {
-					// Old registration is an expired drop-in. Allow re-registering.
+				if old.expired(asOf) {
+					// Old registration is an expired drop-in or a lapsed
+					// reservation. Allow re-registering, keeping a record
+					// of a drop-in so that reports of the day it was for
+					// don't change.
+					if !old.Pending {
+						if err := old.recordReplaced(c); err != nil {
+							return err
+						}
+					}
 					break
 				}
 				// Old registration is still active; do nothing.
 				c.Warningf("Attempted duplicate registration of %q in %d", s.ID, s.ClassID)
-				return nil
+				return ErrAlreadyRegistered
 			default:
 				return fmt.Errorf("students: failed to look up existing student: %s", err)
 			}
@@ -167,14 +360,20 @@ func (s *Student) Add(c appengine.Context, asOf time.Time) error {
 			if int32(len(in)) >= class.Capacity {
 				return ErrClassIsFull
 			}
+			if f != nil {
+				if err := f(c); err != nil {
+					return err
+				}
+			}
 			if err := class.Update(c); err != nil {
 				return fmt.Errorf("students: failed to update class: %s", err)
 			}
+			s.Registered = asOf
 			if _, err := datastore.Put(c, key, s); err != nil {
 				return fmt.Errorf("students: failed to write student: %s", err)
 			}
 			return nil
-		}, nil)
+		}, opts)
 		if txnErr != datastore.ErrConcurrentTransaction {
 			break
 		}
@@ -189,6 +388,65 @@ func (s *Student) Add(c appengine.Context, asOf time.Time) error {
 	}
 }
 
+// recordReplaced keeps a copy of an expired registration which is
+// about to be overwritten by a new one.
+func (s *Student) recordReplaced(c appengine.Context) error {
+	iKey := datastore.NewIncompleteKey(c, "ReplacedStudent", classes.NewClassKey(c, s.ClassID))
+	if _, err := datastore.Put(c, iKey, s); err != nil {
+		return fmt.Errorf("students: failed to record replaced registration: %s", err)
+	}
+	return nil
+}
+
+// CancelWith deletes the Student, running f, if it is not nil, in the
+// same transaction. A record of the cancelled registration is kept so
+// that reports of past classes don't change; reservations which were
+// never paid for leave no record. If f returns an error, the Student
+// is not deleted. f may use entities outside the class's entity group.
+func (s *Student) CancelWith(c appengine.Context, now time.Time, f func(c appengine.Context) error) error {
+	opts := &datastore.TransactionOptions{XG: f != nil}
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if f != nil {
+			if err := f(c); err != nil {
+				return err
+			}
+		}
+		if !s.Pending {
+			cancelled := *s
+			cancelled.Cancelled = now
+			iKey := datastore.NewIncompleteKey(c, "CancelledStudent", classes.NewClassKey(c, s.ClassID))
+			if _, err := datastore.Put(c, iKey, &cancelled); err != nil {
+				return fmt.Errorf("students: failed to record cancellation: %s", err)
+			}
+		}
+		return s.Delete(c)
+	}, opts)
+}
+
+// CancelledIn returns the records of the cancelled registrations in a
+// class.
+func CancelledIn(c appengine.Context, class *classes.Class) ([]*Student, error) {
+	q := datastore.NewQuery("CancelledStudent").
+		Ancestor(class.Key(c))
+	cancelled := []*Student{}
+	if _, err := q.GetAll(c, &cancelled); err != nil {
+		return nil, err
+	}
+	return cancelled, nil
+}
+
+// ReplacedIn returns the records of expired drop-ins in a class which
+// were replaced when the same student registered again.
+func ReplacedIn(c appengine.Context, class *classes.Class) ([]*Student, error) {
+	q := datastore.NewQuery("ReplacedStudent").
+		Ancestor(class.Key(c))
+	replaced := []*Student{}
+	if _, err := q.GetAll(c, &replaced); err != nil {
+		return nil, err
+	}
+	return replaced, nil
+}
+
 func (s *Student) Delete(c appengine.Context) error {
 	if err := datastore.Delete(c, s.key(c)); err != nil {
 		return err
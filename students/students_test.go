@@ -54,6 +54,9 @@ func TestStudents(t *testing.T) {
 			}
 		}
 	}
+	if err := New(accounts[0], rosters[0].class).Add(c, time.Now()); err != ErrAlreadyRegistered {
+		t.Errorf("Expected ErrAlreadyRegistered; got %v", err)
+	}
 	student := New(accounts[2], rosters[0].class)
 	if err := student.Add(c, time.Now()); err != ErrClassIsFull {
 		t.Errorf("Should have gotten class full error")
@@ -138,3 +141,93 @@ func studentsEqual(a, b *Student) bool {
 	}
 	return true
 }
+
+func TestLapsedReservation(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cls := class(1, "class", 1)
+	putClass(c, cls)
+	now := time.Unix(10000, 0)
+	pending := New(makeAccount(1, "a"), cls)
+	pending.Reserve("payment", now.Add(time.Minute))
+	if err := pending.Add(c, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := New(makeAccount(2, "b"), cls).Add(c, now); err != ErrClassIsFull {
+		t.Errorf("Pending reservation should hold a spot; got %v", err)
+	}
+	later := now.Add(time.Hour)
+	if got := In(c, cls, later); len(got) != 0 {
+		t.Errorf("Lapsed reservation should not be in class: %v", got)
+	}
+	if err := New(makeAccount(2, "b"), cls).Add(c, later); err != nil {
+		t.Errorf("Lapsed reservation should release its spot; got %v", err)
+	}
+}
+
+func TestPaymentStatus(t *testing.T) {
+	now := time.Unix(10000, 0)
+	unpriced := &Student{}
+	if got := unpriced.PaymentStatus(); got != Unpaid {
+		t.Errorf("Unpriced registration with no payment should be unpaid; got %s", got)
+	}
+	unpriced.RecordPayment(1500, Cash, "staff@example.com", now)
+	if got := unpriced.PaymentStatus(); got != Paid {
+		t.Errorf("Unpriced registration with a payment should be paid; got %s", got)
+	}
+
+	s := &Student{}
+	s.SetPrice(14400)
+	if got, balance := s.PaymentStatus(), s.Balance(); got != Unpaid || balance != 14400 {
+		t.Errorf("Wrong status for new registration: %s, %s", got, balance)
+	}
+	s.RecordPayment(10000, Check, "staff@example.com", now)
+	if got, balance := s.PaymentStatus(), s.Balance(); got != PartiallyPaid || balance != 4400 {
+		t.Errorf("Wrong status after partial payment: %s, %s", got, balance)
+	}
+	s.RecordPayment(4400, Cash, "teacher@example.com", now)
+	if got, balance := s.PaymentStatus(), s.Balance(); got != Paid || balance != 0 {
+		t.Errorf("Wrong status after full payment: %s, %s", got, balance)
+	}
+	if s.PaymentMethod != Cash || s.PaymentRecordedBy != "teacher@example.com" {
+		t.Errorf("Wrong latest payment: %s by %s", s.PaymentMethod, s.PaymentRecordedBy)
+	}
+
+	free := &Student{}
+	free.SetPrice(0)
+	if got := free.PaymentStatus(); got != Paid {
+		t.Errorf("Free registration should be paid; got %s", got)
+	}
+}
+
+func TestReregisterAfterDropIn(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cls := class(1, "class", 5)
+	putClass(c, cls)
+	acct := makeAccount(1, "a")
+	first := time.Date(2014, time.April, 7, 0, 0, 0, 0, time.UTC)
+	if err := NewDropIn(acct, cls, first).Add(c, first.AddDate(0, 0, -1)); err != nil {
+		t.Fatal(err)
+	}
+	second := first.AddDate(0, 0, 7)
+	if err := NewDropIn(acct, cls, second).Add(c, first.AddDate(0, 0, 1)); err != nil {
+		t.Fatalf("Failed to register again after drop-in: %s", err)
+	}
+	if got, err := WithIDInClass(c, acct.ID, cls, first.AddDate(0, 0, 1)); err != nil || !got.Date.Equal(second) {
+		t.Errorf("Expected new drop-in on %s; got %v, %v", second, got, err)
+	}
+	replaced, err := ReplacedIn(c, cls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replaced) != 1 || !replaced[0].Date.Equal(first) || !replaced[0].DropIn {
+		t.Errorf("Expected a record of the drop-in on %s; got %v", first, replaced)
+	}
+}
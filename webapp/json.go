@@ -0,0 +1,87 @@
+package webapp
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// WriteJSON writes v to w as a JSON response, tagged with an ETag
+// computed from the encoded body. If modified is non-zero it is sent
+// as the Last-Modified time. Conditional requests whose validators
+// match are answered with 304 Not Modified.
+func WriteJSON(w http.ResponseWriter, r *http.Request, v interface{}, modified time.Time) *Error {
+	body, etag, err := encodeJSON(w, v, modified)
+	if err != nil {
+		return err
+	}
+	if notModified(r, etag, modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	w.Write(body)
+	return nil
+}
+
+// WriteJSONStatus writes v to w as a JSON response with the given
+// status code, such as 201 Created. Conditional requests are not
+// considered.
+func WriteJSONStatus(w http.ResponseWriter, status int, v interface{}) *Error {
+	body, _, err := encodeJSON(w, v, time.Time{})
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+	return nil
+}
+
+// encodeJSON encodes v and sets the response headers which describe
+// it, returning the body and its ETag.
+func encodeJSON(w http.ResponseWriter, v interface{}, modified time.Time) ([]byte, string, *Error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, "", InternalError(fmt.Errorf("failed to encode JSON: %s", err))
+	}
+	etag := fmt.Sprintf(`"%x"`, sha1.Sum(body))
+	h := w.Header()
+	h.Set("Content-Type", "application/json; charset=utf-8")
+	h.Set("ETag", etag)
+	if !modified.IsZero() {
+		h.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	return body, etag, nil
+}
+
+// notModified reports whether the request's conditional headers match
+// the current validators. If-None-Match takes precedence over
+// If-Modified-Since, as in RFC 7232.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			if tag = strings.TrimSpace(tag); tag == etag || tag == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	if modified.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(since)
+}
+
+// JSONError writes an error response with a JSON body describing the
+// error.
+func JSONError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
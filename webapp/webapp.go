@@ -23,6 +23,8 @@ import (
 
 	"appengine"
 	"github.com/gorilla/mux"
+
+	"github.com/decitrig/innerhearth/config"
 )
 
 type Error struct {
@@ -33,10 +35,14 @@ type Error struct {
 
 var (
 	Router            = mux.NewRouter()
-	notFoundPage      = template.Must(template.ParseFiles("templates/base.html", "templates/error/not-found.html"))
-	internalErrorPage = template.Must(template.ParseFiles("templates/base.html", "templates/error/internal.html"))
+	notFoundPage      = errorPage("templates/error/not-found.html")
+	internalErrorPage = errorPage("templates/error/internal.html")
 )
 
+func errorPage(file string) *template.Template {
+	return template.Must(template.New("base.html").Funcs(config.TemplateFuncs).ParseFiles("templates/base.html", file))
+}
+
 func (e *Error) Error() string {
 	return e.Err.Error()
 }
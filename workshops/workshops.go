@@ -0,0 +1,299 @@
+// Package workshops manages one-off workshops: events held at one or
+// more dated times, with their own price and capacity.
+//
+// Each time slot of a workshop is backed by a drop-in only Class
+// outside of any session, so that students register for a slot just as
+// they would drop in to a class, through the same capacity-checked
+// transaction.
+package workshops
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/decitrig/innerhearth/account"
+	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/pricing"
+	"github.com/decitrig/innerhearth/students"
+)
+
+var (
+	ErrWorkshopNotFound = fmt.Errorf("workshops: workshop not found")
+	ErrSlotNotFound     = fmt.Errorf("workshops: time slot not found")
+	ErrNoSlots          = fmt.Errorf("workshops: a workshop must have at least one time slot")
+	ErrTooManySlots     = fmt.Errorf("workshops: a workshop may have at most %d time slots", MaxSlots)
+)
+
+// MaxSlots is the largest number of time slots a workshop may have.
+// The workshop and the classes backing its slots are written in a
+// single cross-group transaction, which may span at most 25 entity
+// groups.
+const MaxSlots = 24
+
+// A Slot is a single dated meeting of a workshop.
+type Slot struct {
+	Start  time.Time
+	Length time.Duration
+
+	// The class through which students register for the slot.
+	ClassID int64
+}
+
+// End returns the time at which the slot ends.
+func (s Slot) End() time.Time {
+	return s.Start.Add(s.Length)
+}
+
+// A Workshop is a one-off event for which students register
+// separately from the session schedule.
+type Workshop struct {
+	ID int64 `datastore:"-"`
+
+	Title       string `datastore:",noindex"`
+	Description []byte `datastore:",noindex"`
+	Teacher     *datastore.Key
+
+	Slots    []Slot        `datastore:",noindex"`
+	Price    pricing.Cents `datastore:",noindex"`
+	Capacity int32         `datastore:",noindex"`
+
+	// The URL of an image to show with the workshop, if any.
+	Image string `datastore:",noindex"`
+
+	// The end of the workshop's last slot.
+	End time.Time
+
+	Created   time.Time `datastore:",noindex"`
+	CreatedBy string    `datastore:",noindex"`
+}
+
+// DescriptionText returns the workshop's description.
+func (w *Workshop) DescriptionText() string {
+	return string(w.Description)
+}
+
+type byStart []Slot
+
+func (l byStart) Len() int           { return len(l) }
+func (l byStart) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byStart) Less(i, j int) bool { return l[i].Start.Before(l[j].Start) }
+
+// sortSlots puts the workshop's slots in order and updates its end
+// time.
+func (w *Workshop) sortSlots() {
+	sort.Sort(byStart(w.Slots))
+	w.End = time.Time{}
+	for _, s := range w.Slots {
+		if s.End().After(w.End) {
+			w.End = s.End()
+		}
+	}
+}
+
+// Start returns the start of the workshop's first slot.
+func (w *Workshop) Start() time.Time {
+	if len(w.Slots) == 0 {
+		return time.Time{}
+	}
+	return w.Slots[0].Start
+}
+
+// Slot returns the slot backed by the given class.
+func (w *Workshop) Slot(classID int64) (Slot, error) {
+	for _, s := range w.Slots {
+		if s.ClassID == classID {
+			return s, nil
+		}
+	}
+	return Slot{}, ErrSlotNotFound
+}
+
+// TeacherEntity returns the workshop's teacher, or nil if it has none.
+func (w *Workshop) TeacherEntity(c appengine.Context) *classes.Teacher {
+	if w.Teacher == nil {
+		return nil
+	}
+	teacher, err := classes.TeacherWithID(c, w.Teacher.StringID())
+	if err != nil {
+		c.Errorf("Failed to find teacher for workshop %d: %s", w.ID, err)
+		return nil
+	}
+	return teacher
+}
+
+func workshopKey(c appengine.Context, id int64) *datastore.Key {
+	return datastore.NewKey(c, "Workshop", "", id, nil)
+}
+
+// WithID returns the workshop with the given ID, if one exists.
+func WithID(c appengine.Context, id int64) (*Workshop, error) {
+	w := &Workshop{}
+	switch err := datastore.Get(c, workshopKey(c, id), w); err {
+	case nil:
+		w.ID = id
+		return w, nil
+	case datastore.ErrNoSuchEntity:
+		return nil, ErrWorkshopNotFound
+	default:
+		return nil, err
+	}
+}
+
+type byFirstSlot []*Workshop
+
+func (l byFirstSlot) Len() int           { return len(l) }
+func (l byFirstSlot) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byFirstSlot) Less(i, j int) bool { return l[i].Start().Before(l[j].Start()) }
+
+// Upcoming returns all workshops which have not yet ended, soonest
+// first.
+func Upcoming(c appengine.Context, now time.Time) ([]*Workshop, error) {
+	q := datastore.NewQuery("Workshop").
+		Filter("End >=", now)
+	workshops := []*Workshop{}
+	keys, err := q.GetAll(c, &workshops)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		workshops[i].ID = key.IntID()
+	}
+	sort.Sort(byFirstSlot(workshops))
+	return workshops, nil
+}
+
+// classFor returns the class backing one of the workshop's slots.
+func (w *Workshop) classFor(s Slot, loc *time.Location) *classes.Class {
+	return &classes.Class{
+		ID:              s.ClassID,
+		Title:           w.Title,
+		LongDescription: w.Description,
+		Teacher:         w.Teacher,
+		Weekday:         s.Start.In(loc).Weekday(),
+		StartTime:       s.Start,
+		Length:          s.Length,
+		DropInOnly:      true,
+		Capacity:        w.Capacity,
+		Workshop:        w.ID,
+	}
+}
+
+// Insert stores a new workshop along with a class for each of its
+// slots, in a single transaction.
+func (w *Workshop) Insert(c appengine.Context, loc *time.Location) error {
+	if len(w.Slots) == 0 {
+		return ErrNoSlots
+	}
+	w.sortSlots()
+	return w.update(c, func(c appengine.Context) error {
+		key, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Workshop", nil), w)
+		if err != nil {
+			return err
+		}
+		w.ID = key.IntID()
+		return w.put(c, loc)
+	})
+}
+
+// Put stores the workshop and updates the classes backing its slots
+// to match it, creating classes for any new slots, in a single
+// transaction.
+func (w *Workshop) Put(c appengine.Context, loc *time.Location) error {
+	return w.update(c, func(c appengine.Context) error {
+		return w.put(c, loc)
+	})
+}
+
+// update runs f in a transaction spanning the workshop and the classes
+// backing its slots. The slots are restored before each attempt, so
+// that class IDs allocated by a failed attempt are not kept.
+func (w *Workshop) update(c appengine.Context, f func(c appengine.Context) error) error {
+	if len(w.Slots) > MaxSlots {
+		return ErrTooManySlots
+	}
+	slots := w.Slots
+	opts := &datastore.TransactionOptions{XG: true}
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		w.Slots = append([]Slot(nil), slots...)
+		return f(c)
+	}, opts)
+}
+
+func (w *Workshop) put(c appengine.Context, loc *time.Location) error {
+	w.sortSlots()
+	for i, s := range w.Slots {
+		class := w.classFor(s, loc)
+		if s.ClassID == 0 {
+			if err := class.Insert(c); err != nil {
+				return err
+			}
+			w.Slots[i].ClassID = class.ID
+			continue
+		}
+		if err := class.Update(c); err != nil {
+			return err
+		}
+	}
+	if _, err := datastore.Put(c, workshopKey(c, w.ID), w); err != nil {
+		return err
+	}
+	return nil
+}
+
+// AddSlot adds a new slot to the workshop. The workshop must be Put
+// for the slot to be stored.
+func (w *Workshop) AddSlot(start time.Time, length time.Duration) {
+	w.Slots = append(w.Slots, Slot{Start: start, Length: length})
+	w.sortSlots()
+}
+
+// RemoveSlot deletes the class backing one of the workshop's slots and
+// removes the slot from the workshop. Its students are not deleted;
+// callers should cancel their registrations first.
+func (w *Workshop) RemoveSlot(c appengine.Context, classID int64, loc *time.Location) error {
+	if len(w.Slots) == 1 {
+		return ErrNoSlots
+	}
+	slots := []Slot{}
+	for _, s := range w.Slots {
+		if s.ClassID != classID {
+			slots = append(slots, s)
+		}
+	}
+	if len(slots) == len(w.Slots) {
+		return ErrSlotNotFound
+	}
+	w.Slots = slots
+	return w.update(c, func(c appengine.Context) error {
+		if err := (&classes.Class{ID: classID}).Delete(c); err != nil {
+			return err
+		}
+		return w.put(c, loc)
+	})
+}
+
+// Delete deletes the workshop and the classes backing its slots. Its
+// students are not deleted; callers should cancel their registrations
+// first.
+func (w *Workshop) Delete(c appengine.Context) error {
+	return w.update(c, func(c appengine.Context) error {
+		for _, s := range w.Slots {
+			if err := (&classes.Class{ID: s.ClassID}).Delete(c); err != nil {
+				return err
+			}
+		}
+		return datastore.Delete(c, workshopKey(c, w.ID))
+	})
+}
+
+// NewStudent returns a registration for an account in one of the
+// workshop's slots.
+func NewStudent(user *account.Account, class *classes.Class, s Slot) *students.Student {
+	student := students.NewDropIn(user, class, s.Start)
+	student.ClassType = classes.Workshop
+	return student
+}
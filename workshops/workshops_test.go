@@ -0,0 +1,79 @@
+package workshops
+
+import (
+	"testing"
+	"time"
+
+	"appengine/aetest"
+
+	"github.com/decitrig/innerhearth/classes"
+)
+
+func TestSlots(t *testing.T) {
+	day := time.Date(2014, 3, 8, 10, 0, 0, 0, time.UTC)
+	w := &Workshop{}
+	w.AddSlot(day.AddDate(0, 0, 7), 2*time.Hour)
+	w.AddSlot(day, 3*time.Hour)
+	if !w.Start().Equal(day) {
+		t.Errorf("Expected workshop to start at %s; got %s", day, w.Start())
+	}
+	if want := day.AddDate(0, 0, 7).Add(2 * time.Hour); !w.End.Equal(want) {
+		t.Errorf("Expected workshop to end at %s; got %s", want, w.End)
+	}
+	if _, err := w.Slot(42); err != ErrSlotNotFound {
+		t.Errorf("Expected ErrSlotNotFound; got %v", err)
+	}
+	for i := len(w.Slots); i <= MaxSlots; i++ {
+		w.AddSlot(day.AddDate(0, 0, 7*i), time.Hour)
+	}
+	if err := w.Insert(nil, time.UTC); err != ErrTooManySlots {
+		t.Errorf("Expected ErrTooManySlots with %d slots; got %v", len(w.Slots), err)
+	}
+}
+
+func TestInsert(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	day := time.Date(2014, 3, 8, 10, 0, 0, 0, time.UTC)
+	w := &Workshop{Title: "Partner Yoga", Price: 3500, Capacity: 12}
+	if err := w.Insert(c, time.UTC); err != ErrNoSlots {
+		t.Errorf("Expected ErrNoSlots; got %v", err)
+	}
+	w.AddSlot(day, 2*time.Hour)
+	w.AddSlot(day.AddDate(0, 0, 7), 2*time.Hour)
+	if err := w.Insert(c, time.UTC); err != nil {
+		t.Fatalf("Failed to insert workshop: %s", err)
+	}
+	for _, s := range w.Slots {
+		class, err := classes.ClassWithID(c, s.ClassID)
+		if err != nil {
+			t.Fatalf("Failed to find class for slot %+v: %s", s, err)
+		}
+		if class.Workshop != w.ID || !class.DropInOnly || class.Capacity != 12 {
+			t.Errorf("Expected a drop-in class for workshop %d; got %+v", w.ID, class)
+		}
+	}
+
+	first := w.Slots[0].ClassID
+	if err := w.RemoveSlot(c, first, time.UTC); err != nil {
+		t.Fatalf("Failed to remove slot: %s", err)
+	}
+	if _, err := classes.ClassWithID(c, first); err != classes.ErrClassNotFound {
+		t.Errorf("Expected removed slot's class to be deleted; got %v", err)
+	}
+	if err := w.RemoveSlot(c, w.Slots[0].ClassID, time.UTC); err != ErrNoSlots {
+		t.Errorf("Expected ErrNoSlots removing the last slot; got %v", err)
+	}
+
+	upcoming, err := Upcoming(c, day.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(upcoming) != 1 || upcoming[0].ID != w.ID || len(upcoming[0].Slots) != 1 {
+		t.Errorf("Expected the workshop to be upcoming; got %+v", upcoming)
+	}
+}
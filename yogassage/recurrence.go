@@ -0,0 +1,289 @@
+package yogassage
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/decitrig/innerhearth/pricing"
+)
+
+var (
+	ErrRecurrenceNotFound = fmt.Errorf("yogassage: recurrence not found")
+	ErrInvalidRecurrence  = fmt.Errorf("yogassage: invalid recurrence")
+)
+
+// A Frequency is how often a recurring class meets.
+type Frequency string
+
+const (
+	Weekly  Frequency = "weekly"
+	Monthly Frequency = "monthly"
+)
+
+// Frequencies lists all frequencies of recurrence.
+var Frequencies = []Frequency{Weekly, Monthly}
+
+// Last is the Week of a monthly recurrence which falls in the last
+// week of each month.
+const Last = -1
+
+// A Recurrence is a regular schedule of Yin Yogassage classes, such as
+// "the second Friday of each month at 7pm through December". The
+// classes it generates refer back to it, so that changes can be made to
+// all of its remaining classes at once.
+type Recurrence struct {
+	ID int64 `datastore:"-"`
+
+	Frequency Frequency
+	Weekday   time.Weekday
+
+	// For monthly recurrences, the week of the month in which the class
+	// meets: 1 through 4, or Last.
+	Week int
+
+	// The first day on which the class may meet, at the class's start
+	// time, and the last day on which it may meet.
+	Start time.Time
+	Until time.Time
+
+	// The days on which the class does not meet, such as holidays.
+	Skip []time.Time `datastore:",noindex"`
+
+	// Details of each generated class.
+	Length     time.Duration `datastore:",noindex"`
+	Teacher    *datastore.Key
+	Price      pricing.Cents `datastore:",noindex"`
+	Capacity   int32         `datastore:",noindex"`
+	SignupLink string        `datastore:",noindex"`
+
+	Created   time.Time `datastore:",noindex"`
+	CreatedBy string    `datastore:",noindex"`
+}
+
+// Valid returns whether the recurrence describes a schedule.
+func (r *Recurrence) Valid() bool {
+	switch {
+	case r.Until.Before(r.Start):
+		return false
+	case r.Length <= 0:
+		return false
+	case r.Capacity == 0 && r.SignupLink == "":
+		return false
+	}
+	switch r.Frequency {
+	case Weekly:
+		return true
+	case Monthly:
+		return r.Week == Last || (r.Week >= 1 && r.Week <= 4)
+	}
+	return false
+}
+
+// Describe returns a short description of the schedule, such as
+// "second Friday monthly".
+func (r *Recurrence) Describe() string {
+	if r.Frequency == Weekly {
+		return fmt.Sprintf("every %s", r.Weekday)
+	}
+	ordinals := map[int]string{1: "first", 2: "second", 3: "third", 4: "fourth", Last: "last"}
+	return fmt.Sprintf("%s %s monthly", ordinals[r.Week], r.Weekday)
+}
+
+func sameDay(a, b time.Time, loc *time.Location) bool {
+	ay, am, ad := a.In(loc).Date()
+	by, bm, bd := b.In(loc).Date()
+	return ay == by && am == bm && ad == bd
+}
+
+// Skips returns whether the recurrence skips the given day.
+func (r *Recurrence) Skips(date time.Time, loc *time.Location) bool {
+	for _, skip := range r.Skip {
+		if sameDay(skip, date, loc) {
+			return true
+		}
+	}
+	return false
+}
+
+// nthWeekday returns the day of a month on which the given weekday of
+// the given week falls.
+func nthWeekday(year int, month time.Month, weekday time.Weekday, week int, loc *time.Location) int {
+	if week == Last {
+		last := time.Date(year, month+1, 0, 0, 0, 0, 0, loc)
+		return last.Day() - (int(last.Weekday())-int(weekday)+7)%7
+	}
+	first := time.Date(year, month, 1, 0, 0, 0, 0, loc)
+	return 1 + (int(weekday)-int(first.Weekday())+7)%7 + 7*(week-1)
+}
+
+// Dates returns the start time of every class in the recurrence,
+// including those on skipped days. The start time is the time of day
+// of the recurrence's Start in loc, so classes keep the same local time
+// across daylight saving time changes.
+func (r *Recurrence) Dates(loc *time.Location) []time.Time {
+	dates := []time.Time{}
+	if !r.Valid() {
+		return dates
+	}
+	start := r.Start.In(loc)
+	hour, min, _ := start.Clock()
+	y, m, d := r.Until.In(loc).Date()
+	until := time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+	at := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, loc)
+	}
+	switch r.Frequency {
+	case Weekly:
+		offset := (int(r.Weekday) - int(start.Weekday()) + 7) % 7
+		for date := at(start.Year(), start.Month(), start.Day()+offset); date.Before(until); date = date.AddDate(0, 0, 7) {
+			dates = append(dates, date)
+		}
+	case Monthly:
+		for month := at(start.Year(), start.Month(), 1); month.Before(until); month = month.AddDate(0, 1, 0) {
+			date := at(month.Year(), month.Month(), nthWeekday(month.Year(), month.Month(), r.Weekday, r.Week, loc))
+			if !date.Before(at(start.Year(), start.Month(), start.Day())) && date.Before(until) {
+				dates = append(dates, date)
+			}
+		}
+	}
+	return dates
+}
+
+// New returns a new class in the recurrence at the given time. The
+// recurrence must have been stored.
+func (r *Recurrence) New(date time.Time) *YinYogassage {
+	return &YinYogassage{
+		Date:       date,
+		SignupLink: r.SignupLink,
+		Length:     r.Length,
+		Teacher:    r.Teacher,
+		Price:      r.Price,
+		Capacity:   r.Capacity,
+		Recurrence: r.ID,
+	}
+}
+
+func recurrenceKey(c appengine.Context, id int64) *datastore.Key {
+	return datastore.NewKey(c, "YinYogassageRecurrence", "", id, nil)
+}
+
+// RecurrenceWithID returns the recurrence with the given ID, if one
+// exists.
+func RecurrenceWithID(c appengine.Context, id int64) (*Recurrence, error) {
+	r := &Recurrence{}
+	switch err := datastore.Get(c, recurrenceKey(c, id), r); err {
+	case nil:
+		r.ID = id
+		return r, nil
+	case datastore.ErrNoSuchEntity:
+		return nil, ErrRecurrenceNotFound
+	default:
+		return nil, err
+	}
+}
+
+// Put stores the recurrence.
+func (r *Recurrence) Put(c appengine.Context) error {
+	if _, err := datastore.Put(c, recurrenceKey(c, r.ID), r); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Insert stores a new recurrence and creates a class at each of the
+// given times. Times which are not generated by the recurrence, or
+// which fall on skipped days, are ignored; staff can leave out dates
+// which conflict with other events.
+//
+// A recurrence may have more classes than fit in one transaction, so
+// the recurrence is stored in the same transaction as its first class
+// and each later class in its own. If any class can't be stored, the
+// classes already stored and the recurrence are removed again.
+func (r *Recurrence) Insert(c appengine.Context, dates []time.Time, loc *time.Location) ([]*YinYogassage, error) {
+	if !r.Valid() {
+		return nil, ErrInvalidRecurrence
+	}
+	wanted := make(map[int64]bool)
+	for _, date := range dates {
+		wanted[date.Unix()] = true
+	}
+	insertRecurrence := func(c appengine.Context) error {
+		key, err := datastore.Put(c, datastore.NewIncompleteKey(c, "YinYogassageRecurrence", nil), r)
+		if err != nil {
+			return err
+		}
+		r.ID = key.IntID()
+		return nil
+	}
+	yins := []*YinYogassage{}
+	for _, date := range r.Dates(loc) {
+		if !wanted[date.Unix()] || r.Skips(date, loc) {
+			continue
+		}
+		yin := r.New(date)
+		var err error
+		if len(yins) == 0 {
+			err = yin.InsertWith(c, loc, func(c appengine.Context) error {
+				if err := insertRecurrence(c); err != nil {
+					return err
+				}
+				yin.Recurrence = r.ID
+				return nil
+			})
+		} else {
+			err = yin.Insert(c, loc)
+		}
+		if err != nil {
+			r.remove(c, yins)
+			return nil, err
+		}
+		yins = append(yins, yin)
+	}
+	if len(yins) == 0 {
+		if err := insertRecurrence(c); err != nil {
+			return nil, err
+		}
+	}
+	return yins, nil
+}
+
+// remove deletes a recurrence which could not be completely stored,
+// along with the classes which were. Errors are logged.
+func (r *Recurrence) remove(c appengine.Context, yins []*YinYogassage) {
+	if len(yins) == 0 {
+		return
+	}
+	for _, yin := range yins {
+		if err := yin.Delete(c); err != nil {
+			c.Errorf("Failed to remove yogassage %d of incomplete recurrence %d: %s", yin.ID, r.ID, err)
+		}
+	}
+	if err := datastore.Delete(c, recurrenceKey(c, r.ID)); err != nil {
+		c.Errorf("Failed to remove incomplete recurrence %d: %s", r.ID, err)
+	}
+}
+
+// InRecurrence returns the classes in a recurrence which start at or
+// after the given time, in order.
+func InRecurrence(c appengine.Context, id int64, from time.Time) ([]*YinYogassage, error) {
+	q := datastore.NewQuery("YinYogassage").
+		Filter("Recurrence =", id)
+	all := []*YinYogassage{}
+	keys, err := q.GetAll(c, &all)
+	if err != nil {
+		return nil, err
+	}
+	yins := []*YinYogassage{}
+	for i, key := range keys {
+		all[i].ID = key.IntID()
+		if !all[i].Date.Before(from) {
+			yins = append(yins, all[i])
+		}
+	}
+	sort.Sort(ByDate(yins))
+	return yins, nil
+}
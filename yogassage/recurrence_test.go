@@ -0,0 +1,161 @@
+package yogassage
+
+import (
+	"testing"
+	"time"
+
+	"appengine"
+	"appengine/aetest"
+)
+
+func TestDates(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		r    *Recurrence
+		want []time.Time
+	}{
+		{
+			"second Friday monthly",
+			&Recurrence{
+				Frequency: Monthly,
+				Weekday:   time.Friday,
+				Week:      2,
+				Start:     time.Date(2014, 1, 1, 19, 0, 0, 0, time.UTC),
+				Until:     time.Date(2014, 3, 31, 0, 0, 0, 0, time.UTC),
+			},
+			[]time.Time{
+				time.Date(2014, 1, 10, 19, 0, 0, 0, time.UTC),
+				time.Date(2014, 2, 14, 19, 0, 0, 0, time.UTC),
+				time.Date(2014, 3, 14, 19, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			"last Sunday monthly",
+			&Recurrence{
+				Frequency: Monthly,
+				Weekday:   time.Sunday,
+				Week:      Last,
+				Start:     time.Date(2014, 1, 27, 18, 30, 0, 0, time.UTC),
+				Until:     time.Date(2014, 3, 30, 0, 0, 0, 0, time.UTC),
+			},
+			[]time.Time{
+				time.Date(2014, 2, 23, 18, 30, 0, 0, time.UTC),
+				time.Date(2014, 3, 30, 18, 30, 0, 0, time.UTC),
+			},
+		},
+		{
+			"every Tuesday",
+			&Recurrence{
+				Frequency: Weekly,
+				Weekday:   time.Tuesday,
+				Start:     time.Date(2014, 4, 2, 7, 0, 0, 0, time.UTC),
+				Until:     time.Date(2014, 4, 22, 0, 0, 0, 0, time.UTC),
+			},
+			[]time.Time{
+				time.Date(2014, 4, 8, 7, 0, 0, 0, time.UTC),
+				time.Date(2014, 4, 15, 7, 0, 0, 0, time.UTC),
+				time.Date(2014, 4, 22, 7, 0, 0, 0, time.UTC),
+			},
+		},
+	} {
+		test.r.Length = time.Hour
+		test.r.Capacity = 10
+		got := test.r.Dates(time.UTC)
+		if len(got) != len(test.want) {
+			t.Errorf("%s: expected %v; got %v", test.name, test.want, got)
+			continue
+		}
+		for i, want := range test.want {
+			if !got[i].Equal(want) {
+				t.Errorf("%s: expected %s at %d; got %s", test.name, want, i, got[i])
+			}
+		}
+	}
+}
+
+func TestValid(t *testing.T) {
+	start := time.Date(2014, 1, 1, 19, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		name  string
+		r     *Recurrence
+		valid bool
+	}{
+		{"weekly", &Recurrence{Frequency: Weekly, Start: start, Until: start, Length: time.Hour, Capacity: 1}, true},
+		{"signup link", &Recurrence{Frequency: Weekly, Start: start, Until: start, Length: time.Hour, SignupLink: "a"}, true},
+		{"no capacity or link", &Recurrence{Frequency: Weekly, Start: start, Until: start, Length: time.Hour}, false},
+		{"ends first", &Recurrence{Frequency: Weekly, Start: start, Until: start.AddDate(0, 0, -1), Length: time.Hour, Capacity: 1}, false},
+		{"fifth week", &Recurrence{Frequency: Monthly, Week: 5, Start: start, Until: start, Length: time.Hour, Capacity: 1}, false},
+		{"unknown frequency", &Recurrence{Frequency: "daily", Start: start, Until: start, Length: time.Hour, Capacity: 1}, false},
+	} {
+		if got := test.r.Valid(); got != test.valid {
+			t.Errorf("%s: expected valid %t; got %t", test.name, test.valid, got)
+		}
+	}
+}
+
+func TestInsertRecurrence(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	r := &Recurrence{
+		Frequency:  Weekly,
+		Weekday:    time.Monday,
+		Start:      time.Date(2014, 3, 3, 19, 0, 0, 0, time.UTC),
+		Until:      time.Date(2014, 3, 31, 0, 0, 0, 0, time.UTC),
+		Skip:       []time.Time{time.Date(2014, 3, 17, 0, 0, 0, 0, time.UTC)},
+		Length:     time.Hour,
+		SignupLink: "a",
+	}
+	if !r.Skips(time.Date(2014, 3, 17, 19, 0, 0, 0, time.UTC), time.UTC) {
+		t.Errorf("Expected recurrence to skip 3/17")
+	}
+	dates := r.Dates(time.UTC)
+	if len(dates) != 5 {
+		t.Fatalf("Expected 5 dates; got %v", dates)
+	}
+	// Leave out the last date, as staff might for a conflict.
+	yins, err := r.Insert(c, dates[:4], time.UTC)
+	if err != nil {
+		t.Fatalf("Failed to insert recurrence: %s", err)
+	}
+	if len(yins) != 3 {
+		t.Errorf("Expected 3 classes, skipping 3/17 and 3/31; got %v", yins)
+	}
+	if _, err := RecurrenceWithID(c, r.ID); err != nil {
+		t.Errorf("Didn't find recurrence %d: %s", r.ID, err)
+	}
+	following, err := InRecurrence(c, r.ID, dates[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(following) != 2 || !following[0].Date.Equal(dates[1]) || following[0].Recurrence != r.ID {
+		t.Errorf("Expected the 3/10 and 3/24 classes; got %v", following)
+	}
+	if yins[0].Recurrence != r.ID {
+		t.Errorf("Expected first class to be in recurrence %d; got %d", r.ID, yins[0].Recurrence)
+	}
+
+	y := following[0]
+	y.Length = 90 * time.Minute
+	err = y.PutWith(c, time.UTC, func(c appengine.Context) error {
+		rec, err := RecurrenceWithID(c, y.Recurrence)
+		if err != nil {
+			return err
+		}
+		rec.Length = y.Length
+		return rec.Put(c)
+	})
+	if err != nil {
+		t.Fatalf("Failed to update class with its recurrence: %s", err)
+	}
+	if rec, err := RecurrenceWithID(c, r.ID); err != nil || rec.Length != 90*time.Minute {
+		t.Errorf("Expected recurrence to be updated; got %v, %v", rec, err)
+	}
+
+	if _, err := (&Recurrence{}).Insert(c, dates, time.UTC); err != ErrInvalidRecurrence {
+		t.Errorf("Expected ErrInvalidRecurrence; got %v", err)
+	}
+}
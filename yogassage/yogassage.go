@@ -1,4 +1,9 @@
 // Package yogassage handles creation & manipulation of YinYogassage classes.
+//
+// An offering which takes registrations is backed by a drop-in only
+// Class outside of any session, so that students register for it just
+// as they would drop in to a class. Offerings without a backing class
+// take signups through an external link instead.
 package yogassage
 
 import (
@@ -7,7 +12,10 @@ import (
 	"appengine"
 	"appengine/datastore"
 
+	"github.com/decitrig/innerhearth/account"
 	"github.com/decitrig/innerhearth/classes"
+	"github.com/decitrig/innerhearth/pricing"
+	"github.com/decitrig/innerhearth/students"
 )
 
 // A YinYogassage entity represents a scheduled offering of a
@@ -16,11 +24,42 @@ type YinYogassage struct {
 	ID         int64 `datastore: "-"`
 	Date       time.Time
 	SignupLink string
+
+	Length   time.Duration `datastore:",noindex"`
+	Teacher  *datastore.Key
+	Price    pricing.Cents `datastore:",noindex"`
+	Capacity int32         `datastore:",noindex"`
+
+	// The class through which students register for the offering, or
+	// zero if students sign up through SignupLink instead.
+	ClassID int64 `datastore:",noindex"`
+
+	// The recurrence which generated the class, or zero for a class
+	// which was added on its own.
+	Recurrence int64
 }
 
 // New creates a YinYogassage class.
 func New(date time.Time, signup string) *YinYogassage {
-	return &YinYogassage{0, date, signup}
+	return &YinYogassage{Date: date, SignupLink: signup}
+}
+
+// End returns the time at which the class ends.
+func (y *YinYogassage) End() time.Time {
+	return y.Date.Add(y.Length)
+}
+
+// TeacherEntity returns the class's teacher, or nil if it has none.
+func (y *YinYogassage) TeacherEntity(c appengine.Context) *classes.Teacher {
+	if y.Teacher == nil {
+		return nil
+	}
+	teacher, err := classes.TeacherWithID(c, y.Teacher.StringID())
+	if err != nil {
+		c.Errorf("Failed to find teacher for yogassage %d: %s", y.ID, err)
+		return nil
+	}
+	return teacher
 }
 
 func key(c appengine.Context, id int64) *datastore.Key {
@@ -42,24 +81,124 @@ func WithID(c appengine.Context, id int64) (*YinYogassage, error) {
 	}
 }
 
+// class returns the class backing the offering.
+func (y *YinYogassage) class(loc *time.Location) *classes.Class {
+	return &classes.Class{
+		ID:           y.ClassID,
+		Title:        "Yin Yogassage",
+		Teacher:      y.Teacher,
+		Weekday:      y.Date.In(loc).Weekday(),
+		StartTime:    y.Date,
+		Length:       y.Length,
+		DropInOnly:   true,
+		Capacity:     y.Capacity,
+		YinYogassage: y.ID,
+	}
+}
+
 // Insert writes a new YinYogassage entity to the datastore; it will
-// not overwrite any existing entities.
-func (y *YinYogassage) Insert(c appengine.Context) error {
-	iKey := datastore.NewIncompleteKey(c, "YinYogassage", nil)
-	key, err := datastore.Put(c, iKey, y)
-	if err != nil {
+// not overwrite any existing entities. If the class has a capacity, a
+// class is created through which students can register for it, in the
+// same transaction.
+func (y *YinYogassage) Insert(c appengine.Context, loc *time.Location) error {
+	return y.InsertWith(c, loc, func(c appengine.Context) error { return nil })
+}
+
+// InsertWith is like Insert, but also runs f in the transaction before
+// the offering is stored.
+func (y *YinYogassage) InsertWith(c appengine.Context, loc *time.Location, f func(c appengine.Context) error) error {
+	return y.update(c, func(c appengine.Context) error {
+		if err := f(c); err != nil {
+			return err
+		}
+		key, err := datastore.Put(c, datastore.NewIncompleteKey(c, "YinYogassage", nil), y)
+		if err != nil {
+			return err
+		}
+		y.ID = key.IntID()
+		if y.Capacity == 0 {
+			return nil
+		}
+		return y.put(c, loc)
+	})
+}
+
+// Put stores the offering and updates the class backing it to match,
+// in a single transaction. A class is created if the offering takes
+// registrations and has none yet, and the class is deleted if the
+// offering no longer takes registrations; callers should cancel its
+// registrations first.
+func (y *YinYogassage) Put(c appengine.Context, loc *time.Location) error {
+	return y.update(c, func(c appengine.Context) error {
+		return y.put(c, loc)
+	})
+}
+
+// PutWith is like Put, but also runs f in the transaction.
+func (y *YinYogassage) PutWith(c appengine.Context, loc *time.Location, f func(c appengine.Context) error) error {
+	return y.update(c, func(c appengine.Context) error {
+		if err := f(c); err != nil {
+			return err
+		}
+		return y.put(c, loc)
+	})
+}
+
+// update runs f in a transaction spanning the offering and the class
+// backing it. The offering's ID and class are restored before each
+// attempt, so that IDs allocated by a failed attempt are not kept.
+func (y *YinYogassage) update(c appengine.Context, f func(c appengine.Context) error) error {
+	id, classID := y.ID, y.ClassID
+	opts := &datastore.TransactionOptions{XG: true}
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		y.ID, y.ClassID = id, classID
+		return f(c)
+	}, opts)
+}
+
+func (y *YinYogassage) put(c appengine.Context, loc *time.Location) error {
+	switch class := y.class(loc); {
+	case y.Capacity > 0 && y.ClassID == 0:
+		if err := class.Insert(c); err != nil {
+			return err
+		}
+		y.ClassID = class.ID
+	case y.Capacity > 0:
+		if err := class.Update(c); err != nil {
+			return err
+		}
+	case y.ClassID != 0:
+		if err := class.Delete(c); err != nil {
+			return err
+		}
+		y.ClassID = 0
+	}
+	if _, err := datastore.Put(c, key(c, y.ID), y); err != nil {
 		return err
 	}
-	y.ID = key.IntID()
 	return nil
 }
 
-// Delete removes a YinYogassage entity from the datastore.
+// Delete removes a YinYogassage entity from the datastore, along with
+// the class backing it, in a single transaction. Its students are not
+// deleted; callers should cancel their registrations first.
 func (y *YinYogassage) Delete(c appengine.Context) error {
-	if err := datastore.Delete(c, key(c, y.ID)); err != nil {
-		return err
-	}
-	return nil
+	return y.update(c, func(c appengine.Context) error {
+		if y.ClassID != 0 {
+			if err := (&classes.Class{ID: y.ClassID}).Delete(c); err != nil {
+				return err
+			}
+		}
+		return datastore.Delete(c, key(c, y.ID))
+	})
+}
+
+// NewStudent returns a registration for an account in the class
+// backing the offering.
+func (y *YinYogassage) NewStudent(user *account.Account, class *classes.Class) *students.Student {
+	student := students.NewDropIn(user, class, y.Date)
+	student.ClassType = classes.YinYogassage
+	return student
 }
 
 // Classes returns a list of all YinYogassage classes which are after a specific time.
@@ -7,6 +7,7 @@ import (
 
 	"appengine/aetest"
 
+	"github.com/decitrig/innerhearth/account"
 	"github.com/decitrig/innerhearth/classes"
 )
 
@@ -22,7 +23,7 @@ func TestYinYogassage(t *testing.T) {
 		New(time.Unix(3000, 0), "c"),
 	}
 	for i, y := range yins {
-		if err := y.Insert(c); err != nil {
+		if err := y.Insert(c, time.UTC); err != nil {
 			t.Fatalf("Failed to insert yin %d: %s", i, err)
 		}
 		switch got, err := WithID(c, y.ID); {
@@ -48,6 +49,50 @@ func TestYinYogassage(t *testing.T) {
 	}
 }
 
+func TestBackingClass(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	y := New(time.Date(2014, 3, 14, 19, 0, 0, 0, time.UTC), "")
+	y.Length = 90 * time.Minute
+	y.Price = 3000
+	y.Capacity = 12
+	if err := y.Insert(c, time.UTC); err != nil {
+		t.Fatalf("Failed to insert yogassage: %s", err)
+	}
+	class, err := classes.ClassWithID(c, y.ClassID)
+	if err != nil {
+		t.Fatalf("Failed to find backing class: %s", err)
+	}
+	if class.YinYogassage != y.ID || !class.DropInOnly || class.Capacity != 12 || class.Weekday != time.Friday {
+		t.Errorf("Wrong backing class for %d: %+v", y.ID, class)
+	}
+	if s := y.NewStudent(&account.Account{ID: "0x1"}, class); s.ClassType != classes.YinYogassage || !s.DropIn || !s.Date.Equal(y.Date) {
+		t.Errorf("Wrong registration: %+v", s)
+	}
+
+	classID := y.ClassID
+	y.Capacity, y.SignupLink = 0, "http://example.com/signup"
+	if err := y.Put(c, time.UTC); err != nil {
+		t.Fatalf("Failed to remove capacity: %s", err)
+	}
+	if _, err := classes.ClassWithID(c, classID); err != classes.ErrClassNotFound || y.ClassID != 0 {
+		t.Errorf("Expected backing class to be deleted without a capacity; got %v, class %d", err, y.ClassID)
+	}
+	y.Capacity = 12
+	if err := y.Put(c, time.UTC); err != nil {
+		t.Fatalf("Failed to restore capacity: %s", err)
+	}
+	if err := y.Delete(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := classes.ClassWithID(c, y.ClassID); err != classes.ErrClassNotFound {
+		t.Errorf("Expected backing class to be deleted; got %v", err)
+	}
+}
+
 func yinsEqual(a, b *YinYogassage) bool {
 	switch {
 	case a == nil || b == nil: